@@ -0,0 +1,260 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::net::Ipv4Addr;
+
+#[derive(Deserialize, Clone, Copy, Debug, PartialEq)]
+#[serde(rename_all = "lowercase")]
+pub enum Action {
+    Allow,
+    Deny,
+}
+
+#[derive(Deserialize, Clone, Copy, Debug, PartialEq)]
+#[serde(rename_all = "lowercase")]
+pub enum Protocol {
+    Icmp,
+    Tcp,
+    Udp,
+}
+
+impl Protocol {
+    fn number(&self) -> u8 {
+        match *self {
+            Protocol::Icmp => 1,
+            Protocol::Tcp => 6,
+            Protocol::Udp => 17,
+        }
+    }
+}
+
+// A rule as written in the configuration file. Fields left out match anything.
+#[derive(Deserialize, Clone, Debug)]
+pub struct RuleConfig {
+    pub action: Action,
+    pub source: Option<String>,
+    pub destination: Option<String>,
+    pub protocol: Option<Protocol>,
+    // Destination port; only TCP and UDP packets can match a rule with one.
+    pub port: Option<u16>,
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+struct Cidr {
+    network: u32,
+    mask: u32,
+}
+
+impl Cidr {
+    fn parse(s: &str) -> Result<Cidr, String> {
+        let mut parts = s.splitn(2, '/');
+        let addr: Ipv4Addr = try!(parts.next()
+            .unwrap()
+            .parse()
+            .map_err(|_| format!("Invalid address in {}.", s)));
+        let len: u32 = match parts.next() {
+            Some(len) => try!(len.parse().map_err(|_| format!("Invalid prefix length in {}.", s))),
+            None => 32,
+        };
+        if len > 32 {
+            return Err(format!("Invalid prefix length in {}.", s));
+        }
+        let mask = if len == 0 { 0 } else { !0u32 << (32 - len) };
+        Ok(Cidr {
+            network: u32::from(addr) & mask,
+            mask: mask,
+        })
+    }
+
+    fn contains(&self, addr: u32) -> bool {
+        addr & self.mask == self.network
+    }
+}
+
+struct Rule {
+    action: Action,
+    source: Option<Cidr>,
+    destination: Option<Cidr>,
+    protocol: Option<u8>,
+    port: Option<u16>,
+}
+
+// The fields of an inner IPv4 packet that rules look at.
+struct Flow {
+    source: u32,
+    destination: u32,
+    protocol: u8,
+    port: Option<u16>,
+}
+
+impl Flow {
+    fn parse(packet: &[u8]) -> Option<Flow> {
+        if packet.len() < 20 || packet[0] >> 4 != 4 {
+            return None;
+        }
+        let be32 = |b: &[u8]| {
+            ((b[0] as u32) << 24) | ((b[1] as u32) << 16) | ((b[2] as u32) << 8) | b[3] as u32
+        };
+        let ihl = (packet[0] & 0xf) as usize * 4;
+        let protocol = packet[9];
+        // Only the first fragment carries the transport header.
+        let first_fragment = (packet[6] & 0x1f) == 0 && packet[7] == 0;
+        let port = if first_fragment && (protocol == 6 || protocol == 17) &&
+                      packet.len() >= ihl + 4 {
+            Some(((packet[ihl + 2] as u16) << 8) | packet[ihl + 3] as u16)
+        } else {
+            None
+        };
+        Some(Flow {
+            source: be32(&packet[12..16]),
+            destination: be32(&packet[16..20]),
+            protocol: protocol,
+            port: port,
+        })
+    }
+}
+
+impl Rule {
+    fn matches(&self, flow: &Flow) -> bool {
+        self.source.map_or(true, |c| c.contains(flow.source)) &&
+        self.destination.map_or(true, |c| c.contains(flow.destination)) &&
+        self.protocol.map_or(true, |p| p == flow.protocol) &&
+        self.port.map_or(true, |p| flow.port == Some(p))
+    }
+}
+
+// Decides which inner packets from clients are forwarded. Rules are checked in
+// order and the first match wins; packets matching no rule get the default.
+pub struct Acl {
+    rules: Vec<Rule>,
+    default: Action,
+}
+
+impl Acl {
+    pub fn new(rules: &[RuleConfig], default: Action) -> Result<Acl, String> {
+        let mut compiled = Vec::with_capacity(rules.len());
+        for rule in rules {
+            if rule.port.is_some() && rule.protocol == Some(Protocol::Icmp) {
+                return Err(String::from("ICMP rules cannot have a port."));
+            }
+            compiled.push(Rule {
+                action: rule.action,
+                source: match rule.source {
+                    Some(ref s) => Some(try!(Cidr::parse(s))),
+                    None => None,
+                },
+                destination: match rule.destination {
+                    Some(ref d) => Some(try!(Cidr::parse(d))),
+                    None => None,
+                },
+                protocol: rule.protocol.map(|p| p.number()),
+                port: rule.port,
+            });
+        }
+        Ok(Acl {
+            rules: compiled,
+            default: default,
+        })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.rules.is_empty() && self.default == Action::Allow
+    }
+
+    // Malformed packets are never allowed by a non-empty ACL.
+    pub fn allows(&self, packet: &[u8]) -> bool {
+        if self.is_empty() {
+            return true;
+        }
+        let flow = match Flow::parse(packet) {
+            Some(flow) => flow,
+            None => return false,
+        };
+        let action = self.rules
+            .iter()
+            .find(|r| r.matches(&flow))
+            .map_or(self.default, |r| r.action);
+        action == Action::Allow
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use acl::*;
+
+    fn packet(dst: [u8; 4], protocol: u8, port: u16) -> Vec<u8> {
+        let mut packet = vec![0x45, 0, 0, 24, 0, 0, 0x40, 0, 64, protocol, 0, 0, 10, 10, 10, 2];
+        packet.extend_from_slice(&dst);
+        packet.extend_from_slice(&[0x30, 0x39, (port >> 8) as u8, port as u8]);
+        packet
+    }
+
+    fn rule(action: Action,
+            destination: Option<&str>,
+            protocol: Option<Protocol>,
+            port: Option<u16>)
+            -> RuleConfig {
+        RuleConfig {
+            action: action,
+            source: Some(String::from("10.10.10.0/24")),
+            destination: destination.map(String::from),
+            protocol: protocol,
+            port: port,
+        }
+    }
+
+    #[test]
+    fn acl_test() {
+        let rules = [rule(Action::Deny, Some("192.168.0.0/16"), Some(Protocol::Tcp), Some(22)),
+                     rule(Action::Allow, Some("192.168.1.1"), None, None),
+                     rule(Action::Deny, Some("192.168.0.0/16"), None, None)];
+        let acl = Acl::new(&rules, Action::Allow).unwrap();
+
+        assert!(!acl.allows(&packet([192, 168, 1, 1], 6, 22)));
+        assert!(acl.allows(&packet([192, 168, 1, 1], 6, 80)));
+        assert!(acl.allows(&packet([192, 168, 1, 1], 17, 22)));
+        assert!(!acl.allows(&packet([192, 168, 7, 1], 17, 53)));
+        assert!(acl.allows(&packet([8, 8, 8, 8], 6, 22)));
+        assert!(!acl.allows(&[0x45, 0]));
+
+        let acl = Acl::new(&rules[1..2], Action::Deny).unwrap();
+        assert!(acl.allows(&packet([192, 168, 1, 1], 1, 0)));
+        assert!(!acl.allows(&packet([8, 8, 8, 8], 1, 0)));
+    }
+
+    #[test]
+    fn fragment_test() {
+        let rules = [rule(Action::Allow, None, Some(Protocol::Udp), Some(53))];
+        let acl = Acl::new(&rules, Action::Deny).unwrap();
+        let mut fragment = packet([8, 8, 8, 8], 17, 53);
+        assert!(acl.allows(&fragment));
+        fragment[7] = 1;
+        assert!(!acl.allows(&fragment));
+    }
+
+    #[test]
+    fn invalid_rule_test() {
+        assert!(Acl::new(&[rule(Action::Deny, Some("192.168.0.0/33"), None, None)],
+                         Action::Allow)
+            .is_err());
+        assert!(Acl::new(&[rule(Action::Deny, Some("192.168.0"), None, None)],
+                         Action::Allow)
+            .is_err());
+        assert!(Acl::new(&[rule(Action::Deny, None, Some(Protocol::Icmp), Some(1))],
+                         Action::Allow)
+            .is_err());
+        assert!(Acl::new(&[], Action::Allow).unwrap().is_empty());
+    }
+}
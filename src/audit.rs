@@ -0,0 +1,247 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::fs::OpenOptions;
+use std::io::{Read, Write};
+use std::net::{Ipv4Addr, SocketAddr};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+use ring::digest;
+use cipher::Cipher;
+
+// What `prev` of the first record in a log refers to.
+const GENESIS: &str = "0000000000000000";
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Event {
+    Connect,
+    // A session ended, e.g. because it "expired", was "replaced" by a new
+    // handshake for its address or the server shut down.
+    Disconnect { reason: &'static str },
+}
+
+// One session event, as kept for compliance.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Record {
+    pub event: Event,
+    pub identifier: Option<String>,
+    pub source: SocketAddr,
+    pub address: Ipv4Addr,
+    pub cipher: Cipher,
+    // Inner bytes received from and sent to the client.
+    pub rx_bytes: u64,
+    pub tx_bytes: u64,
+    pub duration: Duration,
+}
+
+impl Record {
+    fn fields(&self) -> String {
+        let event = match self.event {
+            Event::Connect => String::from("event=connect"),
+            Event::Disconnect { reason } => format!("event=disconnect reason={}", reason),
+        };
+        // Quoted, as identifiers are chosen by clients.
+        let identifier = self.identifier
+            .as_ref()
+            .map_or(String::from("-"), |i| format!("{:?}", i));
+        let time = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0);
+        format!("time={} {} identifier={} source={} address={} cipher={} rx_bytes={} \
+                 tx_bytes={} duration_ms={}",
+                time,
+                event,
+                identifier,
+                self.source,
+                self.address,
+                self.cipher.name(),
+                self.rx_bytes,
+                self.tx_bytes,
+                self.duration.as_secs() * 1000 + (self.duration.subsec_nanos() / 1_000_000) as u64)
+    }
+}
+
+fn hash(line: &str) -> String {
+    let hash = digest::digest(&digest::SHA256, line.as_bytes());
+    hash.as_ref()[..8].iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+// Checks that every line of an audit log follows the one before it, so lines
+// removed, reordered or edited after the fact show. Returns the sequence
+// number and hash of the last record.
+pub fn verify(log: &str) -> Result<(u64, String), String> {
+    let mut sequence = 0;
+    let mut previous = String::from(GENESIS);
+    for (n, line) in log.lines().enumerate() {
+        let expected = format!("seq={} prev={} ", sequence + 1, previous);
+        if !line.starts_with(&expected) {
+            return Err(format!("Audit record on line {} does not follow the one before it.",
+                               n + 1));
+        }
+        sequence += 1;
+        previous = hash(line);
+    }
+    Ok((sequence, previous))
+}
+
+// A dedicated log of session connects and disconnects, one line of key=value
+// fields per record, kept apart from the operational log. Each record carries
+// a sequence number and the hash of the record before it.
+pub struct AuditLog {
+    out: Box<Write + Send>,
+    sequence: u64,
+    previous: String,
+}
+
+impl AuditLog {
+    pub fn new(out: Box<Write + Send>) -> AuditLog {
+        AuditLog {
+            out: out,
+            sequence: 0,
+            previous: String::from(GENESIS),
+        }
+    }
+
+    // Appends to the log at `path`, continuing its sequence. A log that does
+    // not verify is refused rather than extended.
+    pub fn open(path: &str) -> Result<AuditLog, String> {
+        let mut file = try!(OpenOptions::new()
+            .read(true)
+            .append(true)
+            .create(true)
+            .open(path)
+            .map_err(|e| format!("{}: {}", path, e)));
+        let mut contents = String::new();
+        try!(file.read_to_string(&mut contents).map_err(|e| format!("{}: {}", path, e)));
+        let (sequence, previous) =
+            try!(verify(&contents).map_err(|e| format!("{}: {}", path, e)));
+        let mut log = AuditLog::new(Box::new(file));
+        log.sequence = sequence;
+        log.previous = previous;
+        Ok(log)
+    }
+
+    pub fn record(&mut self, record: &Record) {
+        let line = format!("seq={} prev={} {}",
+                           self.sequence + 1,
+                           self.previous,
+                           record.fields());
+        match writeln!(self.out, "{}", line).and_then(|_| self.out.flush()) {
+            Ok(_) => {
+                self.sequence += 1;
+                self.previous = hash(&line);
+            }
+            Err(e) => error!("Unable to write audit record: {}", e),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::io::{self, Write};
+    use std::sync::{Arc, Mutex};
+    use std::time::Duration;
+    use cipher;
+    use audit::*;
+
+    struct Buffer(Arc<Mutex<Vec<u8>>>);
+
+    impl Write for Buffer {
+        fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+            self.0.lock().unwrap().extend_from_slice(buf);
+            Ok(buf.len())
+        }
+
+        fn flush(&mut self) -> io::Result<()> {
+            Ok(())
+        }
+    }
+
+    fn record(event: Event) -> Record {
+        Record {
+            event: event,
+            identifier: Some(String::from("laptop one")),
+            source: "192.0.2.1:5000".parse().unwrap(),
+            address: "10.10.10.2".parse().unwrap(),
+            cipher: cipher::DEFAULT,
+            rx_bytes: 1200,
+            tx_bytes: 3400,
+            duration: Duration::from_millis(61500),
+        }
+    }
+
+    #[test]
+    fn record_test() {
+        let buffer = Arc::new(Mutex::new(Vec::new()));
+        let mut log = AuditLog::new(Box::new(Buffer(buffer.clone())));
+        log.record(&record(Event::Connect));
+        log.record(&record(Event::Disconnect { reason: "expired" }));
+
+        let contents = String::from_utf8(buffer.lock().unwrap().clone()).unwrap();
+        let lines: Vec<&str> = contents.lines().collect();
+        assert_eq!(lines.len(), 2);
+        assert!(lines[0].starts_with("seq=1 prev=0000000000000000 time="));
+        assert!(lines[0].contains(" event=connect identifier=\"laptop one\" \
+                                   source=192.0.2.1:5000 address=10.10.10.2 \
+                                   cipher=aes-256-gcm rx_bytes=1200 tx_bytes=3400 \
+                                   duration_ms=61500"));
+        assert!(lines[1].starts_with(&format!("seq=2 prev={} ", hash(lines[0]))));
+        assert!(lines[1].contains(" event=disconnect reason=expired "));
+        assert_eq!(verify(&contents).unwrap().0, 2);
+    }
+
+    #[test]
+    fn tamper_test() {
+        let buffer = Arc::new(Mutex::new(Vec::new()));
+        let mut log = AuditLog::new(Box::new(Buffer(buffer.clone())));
+        for _ in 0..3 {
+            log.record(&record(Event::Connect));
+        }
+        let contents = String::from_utf8(buffer.lock().unwrap().clone()).unwrap();
+        assert!(verify(&contents).is_ok());
+        assert!(verify("").is_ok());
+
+        // A record removed, or one edited, breaks the chain after it.
+        let lines: Vec<&str> = contents.lines().collect();
+        assert!(verify(&format!("{}\n{}\n", lines[0], lines[2])).is_err());
+        let edited = contents.replacen("rx_bytes=1200", "rx_bytes=12", 1);
+        assert_eq!(verify(&edited),
+                   Err(String::from("Audit record on line 2 does not follow the one before \
+                                     it.")));
+    }
+
+    #[test]
+    fn resume_test() {
+        use std::env;
+        use std::fs;
+        use rand;
+        use utils;
+
+        let path = env::temp_dir().join(format!("kytan-audit-{}.log", rand::random::<u32>()));
+        let path = path.to_str().unwrap();
+        AuditLog::open(path).unwrap().record(&record(Event::Connect));
+        // A restarted server carries on with the sequence.
+        AuditLog::open(path).unwrap().record(&record(Event::Disconnect { reason: "shutdown" }));
+        let contents = String::from_utf8(utils::read_file(path).unwrap()).unwrap();
+        assert_eq!(verify(&contents).unwrap().0, 2);
+
+        fs::File::create(path)
+            .unwrap()
+            .write_all(contents.replacen("seq=1", "seq=7", 1).as_bytes())
+            .unwrap();
+        assert!(AuditLog::open(path).is_err());
+        fs::remove_file(path).unwrap();
+    }
+}
@@ -0,0 +1,275 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::fmt::Write;
+use std::net::{SocketAddr, UdpSocket};
+use std::time::{Duration, Instant};
+use ring::aead;
+use config;
+use gso::SendBatch;
+use session::SessionTable;
+
+// Inner packet sizes to measure: small control packets, the minimum IPv4
+// MTU, and a full packet at the default tunnel MTU.
+pub const PACKET_SIZES: &[usize] = &[64, 576, 1400];
+
+pub fn ciphers() -> [(&'static str, &'static aead::Algorithm); 2] {
+    [("AES-256-GCM", &aead::AES_256_GCM), ("ChaCha20-Poly1305", &aead::CHACHA20_POLY1305)]
+}
+
+#[derive(Clone, Debug)]
+pub struct BenchResult {
+    pub cipher: &'static str,
+    pub packet_size: usize,
+    // Plaintext megabytes (10^6 bytes) per second.
+    pub seal_mbps: f64,
+    pub open_mbps: f64,
+}
+
+fn seconds(d: Duration) -> f64 {
+    d.as_secs() as f64 + d.subsec_nanos() as f64 / 1e9
+}
+
+// Runs `op` repeatedly for at least `duration` and returns the rate at which
+// it processed `bytes` per call, in MB/s.
+fn measure<F>(bytes: usize, duration: Duration, mut op: F) -> Result<f64, String>
+    where F: FnMut() -> Result<(), String>
+{
+    let start = Instant::now();
+    let mut iterations = 0u64;
+    while iterations == 0 || start.elapsed() < duration {
+        try!(op());
+        iterations += 1;
+    }
+    Ok((iterations * bytes as u64) as f64 / seconds(start.elapsed()).max(1e-9) / 1e6)
+}
+
+fn bench_cipher(name: &'static str,
+                algorithm: &'static aead::Algorithm,
+                packet_size: usize,
+                duration: Duration)
+                -> Result<BenchResult, String> {
+    let key = vec![0x42u8; algorithm.key_len()];
+    let sealing_key = try!(aead::SealingKey::new(algorithm, &key)
+        .map_err(|_| "aead::SealingKey::new"));
+    let opening_key = try!(aead::OpeningKey::new(algorithm, &key)
+        .map_err(|_| "aead::OpeningKey::new"));
+    let nonce = vec![0u8; algorithm.nonce_len()];
+    let tag_len = algorithm.tag_len();
+
+    let mut buf = vec![0u8; packet_size + tag_len];
+    let seal_mbps = try!(measure(packet_size, duration, || {
+        aead::seal_in_place(&sealing_key, &nonce, &[], &mut buf, tag_len)
+            .map(|_| ())
+            .map_err(|_| String::from("aead::seal_in_place"))
+    }));
+
+    let mut sealed = vec![0u8; packet_size + tag_len];
+    try!(aead::seal_in_place(&sealing_key, &nonce, &[], &mut sealed, tag_len)
+        .map_err(|_| "aead::seal_in_place"));
+    let open_mbps = try!(measure(packet_size, duration, || {
+        // Opening decrypts in place, so start from the sealed packet each time.
+        buf.copy_from_slice(&sealed);
+        aead::open_in_place(&opening_key, &nonce, &[], 0, &mut buf)
+            .map(|_| ())
+            .map_err(|_| String::from("aead::open_in_place"))
+    }));
+
+    Ok(BenchResult {
+        cipher: name,
+        packet_size: packet_size,
+        seal_mbps: seal_mbps,
+        open_mbps: open_mbps,
+    })
+}
+
+// Measures every cipher at every packet size, spending `duration` on each
+// direction of each.
+pub fn run(duration: Duration) -> Result<Vec<BenchResult>, String> {
+    let mut results = Vec::new();
+    for &(name, algorithm) in ciphers().iter() {
+        for &size in PACKET_SIZES {
+            results.push(try!(bench_cipher(name, algorithm, size, duration)));
+        }
+    }
+    Ok(results)
+}
+
+pub fn report(results: &[BenchResult]) -> String {
+    let mut out = format!("{:<20}{:>8}{:>16}{:>16}\n",
+                          "Cipher",
+                          "Bytes",
+                          "Encrypt MB/s",
+                          "Decrypt MB/s");
+    for result in results {
+        write!(out,
+               "{:<20}{:>8}{:>16.1}{:>16.1}\n",
+               result.cipher,
+               result.packet_size,
+               result.seal_mbps,
+               result.open_mbps)
+            .unwrap();
+    }
+    out
+}
+
+#[derive(Clone, Debug)]
+pub struct ConnectResult {
+    pub expected_sessions: usize,
+    pub sessions: usize,
+    // How often the session table had to grow, rehashing what it held.
+    pub regrowths: usize,
+    pub elapsed: Duration,
+}
+
+// Connects as many clients at once as the server has addresses for, as after
+// a restart, with the session table sized for `expected_sessions`.
+pub fn bench_connect(expected_sessions: usize) -> Result<ConnectResult, String> {
+    let config = config::ServerConfig {
+        expected_sessions: expected_sessions,
+        ..Default::default()
+    };
+    let mut sessions = try!(SessionTable::new(&config));
+    let mut capacity = sessions.capacity();
+    let mut regrowths = 0;
+    let start = Instant::now();
+    for port in 1024.. {
+        let addr = SocketAddr::new("192.0.2.1".parse().unwrap(), port);
+        if sessions.accept(None, addr).is_err() {
+            break;
+        }
+        if sessions.capacity() != capacity {
+            capacity = sessions.capacity();
+            regrowths += 1;
+        }
+    }
+    Ok(ConnectResult {
+        expected_sessions: expected_sessions,
+        sessions: sessions.len(),
+        regrowths: regrowths,
+        elapsed: start.elapsed(),
+    })
+}
+
+pub fn connect_report(results: &[ConnectResult]) -> String {
+    let mut out = format!("{:<12}{:>10}{:>12}{:>14}\n",
+                          "Expected",
+                          "Sessions",
+                          "Regrowths",
+                          "Elapsed us");
+    for result in results {
+        write!(out,
+               "{:<12}{:>10}{:>12}{:>14.1}\n",
+               result.expected_sessions,
+               result.sessions,
+               result.regrowths,
+               seconds(result.elapsed) * 1e6)
+            .unwrap();
+    }
+    out
+}
+
+#[derive(Clone, Debug)]
+pub struct SendResult {
+    pub gso: bool,
+    pub datagrams: usize,
+    pub syscalls: u64,
+    pub elapsed: Duration,
+}
+
+// Sends `datagrams` full-sized datagrams over loopback as the server sends
+// data to a client, with UDP GSO if `gso` and the kernel supports it.
+pub fn bench_send(gso: bool, datagrams: usize) -> Result<SendResult, String> {
+    let receiver = try!(UdpSocket::bind("127.0.0.1:0").map_err(|e| e.to_string()));
+    let destination = try!(receiver.local_addr().map_err(|e| e.to_string()));
+    let sender = try!(UdpSocket::bind("127.0.0.1:0").map_err(|e| e.to_string()));
+    let datagram = [0x42u8; 1400];
+    let mut batch = SendBatch::new(gso);
+    let start = Instant::now();
+    for _ in 0..datagrams {
+        try!(batch.push(&sender, destination, &datagram).result().map_err(|e| e.to_string()));
+    }
+    try!(batch.flush(&sender).result().map_err(|e| e.to_string()));
+    Ok(SendResult {
+        gso: batch.is_gso(),
+        datagrams: datagrams,
+        syscalls: batch.syscalls(),
+        elapsed: start.elapsed(),
+    })
+}
+
+pub fn send_report(results: &[SendResult]) -> String {
+    let mut out = format!("{:<8}{:>12}{:>12}{:>14}\n",
+                          "GSO",
+                          "Datagrams",
+                          "Syscalls",
+                          "Elapsed us");
+    for result in results {
+        write!(out,
+               "{:<8}{:>12}{:>12}{:>14.1}\n",
+               if result.gso { "on" } else { "off" },
+               result.datagrams,
+               result.syscalls,
+               seconds(result.elapsed) * 1e6)
+            .unwrap();
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+    use bench::*;
+
+    #[test]
+    fn bench_test() {
+        let results = run(Duration::from_millis(5)).unwrap();
+        assert_eq!(results.len(), ciphers().len() * PACKET_SIZES.len());
+        for result in &results {
+            assert!(result.seal_mbps > 0.0, "{:?}", result);
+            assert!(result.open_mbps > 0.0, "{:?}", result);
+        }
+        let report = report(&results);
+        assert!(report.contains("AES-256-GCM"));
+        assert!(report.contains("ChaCha20-Poly1305"));
+        assert_eq!(report.lines().count(), results.len() + 1);
+    }
+
+    #[test]
+    fn bench_connect_test() {
+        let growing = bench_connect(0).unwrap();
+        let sized = bench_connect(252).unwrap();
+        assert_eq!(growing.sessions, 252);
+        assert_eq!(sized.sessions, 252);
+        assert!(growing.regrowths > 0, "{:?}", growing);
+        assert_eq!(sized.regrowths, 0);
+        // A larger hint is fine, and not a cap.
+        assert_eq!(bench_connect(100000).unwrap().regrowths, 0);
+        assert_eq!(bench_connect(10).unwrap().sessions, 252);
+        assert_eq!(connect_report(&[growing, sized]).lines().count(), 3);
+    }
+
+    #[test]
+    fn bench_send_test() {
+        let plain = bench_send(false, 256).unwrap();
+        assert_eq!(plain.syscalls, 256);
+        let batched = bench_send(true, 256).unwrap();
+        if batched.gso {
+            // 46 datagrams of 1400 bytes fit in one send.
+            assert_eq!(batched.syscalls, 6);
+        }
+        assert_eq!(send_report(&[plain, batched]).lines().count(), 3);
+    }
+}
@@ -0,0 +1,322 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::collections::HashMap;
+use std::fmt;
+use std::net::Ipv4Addr;
+use utils::{self, RetryPolicy};
+use network::Id;
+
+// A subnet behind a client, e.g. a site's LAN, bridged into the tunnel.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Hash, Serialize, Deserialize)]
+pub struct Subnet {
+    pub network: Ipv4Addr,
+    pub prefix_len: u8,
+}
+
+impl Subnet {
+    // Parses e.g. "192.168.50.0/24". Host bits are cleared.
+    pub fn parse(s: &str) -> Result<Subnet, String> {
+        let mut parts = s.splitn(2, '/');
+        let network: Ipv4Addr = try!(parts.next()
+            .unwrap()
+            .parse()
+            .map_err(|_| format!("Invalid address in {}.", s)));
+        let prefix_len: u8 = match parts.next() {
+            Some(len) => try!(len.parse().map_err(|_| format!("Invalid prefix length in {}.", s))),
+            None => return Err(format!("{} needs a prefix length.", s)),
+        };
+        if prefix_len > 32 {
+            return Err(format!("Invalid prefix length in {}.", s));
+        }
+        let subnet = Subnet {
+            network: network,
+            prefix_len: prefix_len,
+        };
+        Ok(Subnet {
+            network: Ipv4Addr::from(u32::from(network) & subnet.mask()),
+            prefix_len: prefix_len,
+        })
+    }
+
+    pub fn parse_all(subnets: &[String]) -> Result<Vec<Subnet>, String> {
+        let mut parsed = Vec::with_capacity(subnets.len());
+        for subnet in subnets {
+            parsed.push(try!(Subnet::parse(subnet)));
+        }
+        Ok(parsed)
+    }
+
+    fn mask(&self) -> u32 {
+        if self.prefix_len == 0 {
+            0
+        } else {
+            !0u32 << (32 - self.prefix_len as u32)
+        }
+    }
+
+    pub fn contains(&self, addr: Ipv4Addr) -> bool {
+        u32::from(addr) & self.mask() == u32::from(self.network)
+    }
+}
+
+impl fmt::Display for Subnet {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "{}/{}", self.network, self.prefix_len)
+    }
+}
+
+// Which subnets the server routes to which session: clients advertise those
+// behind them in their handshake, and get the ones configured for their
+// identifier, so no client can draw another's traffic to itself.
+pub struct SubnetRoutes {
+    allowed: HashMap<String, Vec<Subnet>>,
+    routes: Vec<(Subnet, Id)>,
+}
+
+impl SubnetRoutes {
+    pub fn new(allowed: &HashMap<String, Vec<String>>) -> Result<SubnetRoutes, String> {
+        let mut parsed = HashMap::with_capacity(allowed.len());
+        for (identifier, subnets) in allowed {
+            parsed.insert(identifier.clone(), try!(Subnet::parse_all(subnets)));
+        }
+        Ok(SubnetRoutes {
+            allowed: parsed,
+            routes: Vec::new(),
+        })
+    }
+
+    // Every subnet some client may bridge, which the host should route into
+    // the tunnel.
+    pub fn allowed(&self) -> Vec<Subnet> {
+        let mut subnets: Vec<Subnet> = self.allowed.values().flat_map(|s| s.clone()).collect();
+        subnets.sort_by_key(|s| (u32::from(s.network), s.prefix_len));
+        subnets.dedup();
+        subnets
+    }
+
+    // Routes the `subnets` advertised by session `id`, of the client
+    // identified as `identifier`, to it, in place of any session bridging
+    // them before. Returns those it may not bridge.
+    pub fn advertise(&mut self,
+                     id: Id,
+                     identifier: Option<&str>,
+                     subnets: &[Subnet])
+                     -> Vec<Subnet> {
+        let allowed = identifier.and_then(|i| self.allowed.get(i)).cloned().unwrap_or_default();
+        let mut refused = Vec::new();
+        for subnet in subnets {
+            if !allowed.contains(subnet) {
+                refused.push(*subnet);
+                continue;
+            }
+            self.routes.retain(|&(s, _)| s != *subnet);
+            self.routes.push((*subnet, id));
+        }
+        refused
+    }
+
+    // Stops routing to session `id`, e.g. as it ended.
+    pub fn withdraw(&mut self, id: Id) {
+        self.routes.retain(|&(_, owner)| owner != id);
+    }
+
+    // The session bridging the most specific subnet containing
+    // `destination`, if any.
+    pub fn route(&self, destination: Ipv4Addr) -> Option<Id> {
+        self.routes
+            .iter()
+            .filter(|&&(s, _)| s.contains(destination))
+            .max_by_key(|&&(s, _)| s.prefix_len)
+            .map(|&(_, id)| id)
+    }
+
+    // Whether `destination` is in a subnet some client may bridge, whether
+    // or not one does now.
+    pub fn is_bridged(&self, destination: Ipv4Addr) -> bool {
+        self.allowed.values().any(|subnets| subnets.iter().any(|s| s.contains(destination)))
+    }
+}
+
+fn args(args: &[&str]) -> Vec<String> {
+    args.iter().map(|a| String::from(*a)).collect()
+}
+
+// Sets the kernel parameter `key`, e.g. "net/ipv4/ip_forward", to `value`,
+// and back to `previous` when undone. Slashes keep interface names with dots
+// in them, such as VLANs, intact.
+fn sysctl_step(key: &str, value: &str, previous: &str) -> (Vec<String>, Vec<String>) {
+    (args(&["sysctl", "-w", &format!("{}={}", key, value)]),
+     args(&["sysctl", "-w", &format!("{}={}", key, previous)]))
+}
+
+fn read_sysctl(key: &str) -> Result<String, String> {
+    let path = format!("/proc/sys/{}", key);
+    let value = try!(utils::read_file(&path));
+    Ok(String::from_utf8_lossy(&value).trim().to_string())
+}
+
+// The commands, in order, that make the client a router for the subnet
+// behind it: forwarding on, and proxy ARP on `lan`, so its hosts reach
+// tunnel addresses through us as if they were on the LAN. Each step comes
+// with the command undoing it; `previous` gives a parameter's current value.
+fn client_steps<F>(lan: Option<&str>,
+                   previous: F)
+                   -> Result<Vec<(Vec<String>, Vec<String>)>, String>
+    where F: Fn(&str) -> Result<String, String>
+{
+    let mut keys = vec![String::from("net/ipv4/ip_forward")];
+    if let Some(lan) = lan {
+        keys.push(format!("net/ipv4/conf/{}/proxy_arp", lan));
+    }
+    let mut steps = Vec::with_capacity(keys.len());
+    for key in keys {
+        let previous = try!(previous(&key));
+        steps.push(sysctl_step(&key, "1", &previous));
+    }
+    Ok(steps)
+}
+
+// The commands, in order, that route `subnets` into the server's `tun`,
+// each with the command undoing it.
+fn server_steps(subnets: &[Subnet], tun: &str) -> Vec<(Vec<String>, Vec<String>)> {
+    subnets.iter()
+        .map(|subnet| {
+            let route = |action| args(&["ip", "route", action, &subnet.to_string(), "dev", tun]);
+            (route("add"), route("del"))
+        })
+        .collect()
+}
+
+// Host changes made for bridging subnets, for as long as it lives. Linux
+// only.
+pub struct HostBridge {
+    policy: RetryPolicy,
+    undo: Vec<Vec<String>>,
+}
+
+impl HostBridge {
+    // Routes packets between the tunnel and the subnet behind the client on
+    // `lan`, if given.
+    pub fn client(lan: Option<&str>, policy: RetryPolicy) -> Result<HostBridge, String> {
+        if !cfg!(target_os = "linux") {
+            return Err(String::from("Bridging subnets is only supported on Linux."));
+        }
+        let steps = try!(client_steps(lan, read_sysctl));
+        HostBridge::apply(steps, policy)
+    }
+
+    // Routes the subnets clients may bridge into the server's `tun`.
+    pub fn server(subnets: &[Subnet],
+                  tun: &str,
+                  policy: RetryPolicy)
+                  -> Result<HostBridge, String> {
+        HostBridge::apply(server_steps(subnets, tun), policy)
+    }
+
+    fn apply(steps: Vec<(Vec<String>, Vec<String>)>,
+             policy: RetryPolicy)
+             -> Result<HostBridge, String> {
+        let mut bridge = HostBridge {
+            policy: policy,
+            undo: Vec::new(),
+        };
+        for (step, undo) in steps {
+            // Dropping the bridge undoes what was done so far.
+            try!(utils::run_step(&step, &bridge.policy));
+            bridge.undo.push(undo);
+        }
+        Ok(bridge)
+    }
+}
+
+impl Drop for HostBridge {
+    fn drop(&mut self) {
+        while let Some(step) = self.undo.pop() {
+            if let Err(e) = utils::run_step(&step, &self.policy) {
+                error!("Failed to undo bridging: {}", e);
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::HashMap;
+    use std::net::Ipv4Addr;
+    use bridge::*;
+
+    fn subnet(s: &str) -> Subnet {
+        Subnet::parse(s).unwrap()
+    }
+
+    #[test]
+    fn subnet_test() {
+        assert_eq!(subnet("192.168.50.7/24"), subnet("192.168.50.0/24"));
+        assert_eq!(subnet("192.168.50.0/24").to_string(), "192.168.50.0/24");
+        assert!(subnet("192.168.50.0/24").contains(Ipv4Addr::new(192, 168, 50, 200)));
+        assert!(!subnet("192.168.50.0/24").contains(Ipv4Addr::new(192, 168, 51, 1)));
+        assert!(subnet("0.0.0.0/0").contains(Ipv4Addr::new(203, 0, 113, 1)));
+        assert!(Subnet::parse("192.168.50.0").is_err());
+        assert!(Subnet::parse("192.168.50.0/33").is_err());
+    }
+
+    #[test]
+    fn routes_test() {
+        let mut allowed = HashMap::new();
+        allowed.insert(String::from("office"),
+                       vec![String::from("192.168.50.0/24"), String::from("192.168.50.128/25")]);
+        allowed.insert(String::from("branch"), vec![String::from("192.168.60.0/24")]);
+        let mut routes = SubnetRoutes::new(&allowed).unwrap();
+        assert_eq!(routes.allowed().len(), 3);
+
+        // Subnets not configured for the identifier are refused.
+        let refused = routes.advertise(2,
+                                       Some("office"),
+                                       &[subnet("192.168.50.0/24"), subnet("192.168.60.0/24")]);
+        assert_eq!(refused, vec![subnet("192.168.60.0/24")]);
+        assert_eq!(routes.advertise(3, None, &[subnet("192.168.50.0/24")]).len(), 1);
+        assert_eq!(routes.route(Ipv4Addr::new(192, 168, 50, 9)), Some(2));
+        assert_eq!(routes.route(Ipv4Addr::new(192, 168, 60, 9)), None);
+        assert!(routes.is_bridged(Ipv4Addr::new(192, 168, 60, 9)));
+        assert!(!routes.is_bridged(Ipv4Addr::new(10, 10, 10, 2)));
+
+        // The most specific subnet wins, and a new session takes over.
+        routes.advertise(4, Some("office"), &[subnet("192.168.50.128/25")]);
+        assert_eq!(routes.route(Ipv4Addr::new(192, 168, 50, 200)), Some(4));
+        assert_eq!(routes.route(Ipv4Addr::new(192, 168, 50, 9)), Some(2));
+        routes.advertise(5, Some("office"), &[subnet("192.168.50.0/24")]);
+        assert_eq!(routes.route(Ipv4Addr::new(192, 168, 50, 9)), Some(5));
+        routes.withdraw(5);
+        assert_eq!(routes.route(Ipv4Addr::new(192, 168, 50, 9)), None);
+    }
+
+    #[test]
+    fn steps_test() {
+        let steps = client_steps(Some("eth0.100"), |_| Ok(String::from("0"))).unwrap();
+        let steps: Vec<(String, String)> =
+            steps.iter().map(|&(ref s, ref u)| (s.join(" "), u.join(" "))).collect();
+        assert_eq!(steps,
+                   vec![(String::from("sysctl -w net/ipv4/ip_forward=1"),
+                         String::from("sysctl -w net/ipv4/ip_forward=0")),
+                        (String::from("sysctl -w net/ipv4/conf/eth0.100/proxy_arp=1"),
+                         String::from("sysctl -w net/ipv4/conf/eth0.100/proxy_arp=0"))]);
+        assert!(client_steps(None, |_| Err(String::from("no such key"))).is_err());
+
+        let steps = server_steps(&[subnet("192.168.50.0/24")], "tun0");
+        assert_eq!(steps[0].0.join(" "), "ip route add 192.168.50.0/24 dev tun0");
+        assert_eq!(steps[0].1.join(" "), "ip route del 192.168.50.0/24 dev tun0");
+    }
+}
@@ -0,0 +1,190 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The kernel verifies UDP checksums before a datagram reaches our socket, but
+// accepts datagrams without one and never tells us which those were. To look
+// at outer checksums we read a copy of every incoming UDP packet from a raw
+// socket, which sees them before the UDP layer does.
+
+use std::collections::hash_map::DefaultHasher;
+use std::collections::VecDeque;
+use std::fs::File;
+use std::hash::{Hash, Hasher};
+use std::io::{self, Read};
+use std::net::{IpAddr, Ipv4Addr, SocketAddr};
+use std::os::unix::io::FromRawFd;
+use libc;
+use packet::{self, UdpChecksum};
+
+// Fingerprints of checksum-less datagrams kept until they arrive on the UDP
+// socket.
+const MAX_SUSPECTS: usize = 1024;
+
+#[derive(Deserialize, Clone, Copy, Debug, PartialEq)]
+#[serde(rename_all = "lowercase")]
+pub enum ChecksumPolicy {
+    // Rely on the AEAD tag alone; corrupted datagrams fail to decrypt.
+    Ignore,
+    // Log datagrams with a missing or invalid UDP checksum.
+    Log,
+    // Log them, and also drop datagrams that carry no UDP checksum.
+    Require,
+}
+
+fn fingerprint(addr: &SocketAddr, payload: &[u8]) -> u64 {
+    let mut hasher = DefaultHasher::new();
+    addr.hash(&mut hasher);
+    payload.hash(&mut hasher);
+    hasher.finish()
+}
+
+pub struct ChecksumMonitor {
+    socket: Option<File>,
+    port: u16,
+    policy: ChecksumPolicy,
+    suspects: VecDeque<u64>,
+    anomalies: u64,
+}
+
+impl ChecksumMonitor {
+    // Watches UDP packets sent to `port`. Needs CAP_NET_RAW.
+    pub fn new(port: u16, policy: ChecksumPolicy) -> io::Result<ChecksumMonitor> {
+        let fd = unsafe {
+            libc::socket(libc::AF_INET,
+                         libc::SOCK_RAW | libc::SOCK_NONBLOCK,
+                         libc::IPPROTO_UDP)
+        };
+        if fd < 0 {
+            return Err(io::Error::last_os_error());
+        }
+        let mut monitor = ChecksumMonitor::detached(port, policy);
+        monitor.socket = Some(unsafe { File::from_raw_fd(fd) });
+        Ok(monitor)
+    }
+
+    fn detached(port: u16, policy: ChecksumPolicy) -> ChecksumMonitor {
+        ChecksumMonitor {
+            socket: None,
+            port: port,
+            policy: policy,
+            suspects: VecDeque::new(),
+            anomalies: 0,
+        }
+    }
+
+    pub fn anomalies(&self) -> u64 {
+        self.anomalies
+    }
+
+    // Reads every packet queued on the raw socket. Call before reading the UDP
+    // socket, so the copy of a datagram is inspected before the datagram.
+    pub fn drain(&mut self) {
+        let mut buf = [0u8; 65536];
+        loop {
+            let len = match self.socket.as_mut().map(|s| s.read(&mut buf)) {
+                Some(Ok(len)) => len,
+                Some(Err(ref e)) if e.kind() == io::ErrorKind::WouldBlock => return,
+                Some(Err(e)) => {
+                    warn!("Failed to read raw socket: {}", e);
+                    return;
+                }
+                None => return,
+            };
+            self.inspect(&buf[..len]);
+        }
+    }
+
+    // Checks one IPv4 packet, header included.
+    pub fn inspect(&mut self, ip_packet: &[u8]) {
+        let (src_port, dst_port, payload) = match packet::udp_parts(ip_packet) {
+            Ok(parts) => parts,
+            Err(_) => return,
+        };
+        if dst_port != self.port {
+            return;
+        }
+        let status = match packet::check_udp_checksum(ip_packet) {
+            Ok(status) => status,
+            Err(_) => return,
+        };
+        if status == UdpChecksum::Valid {
+            return;
+        }
+        let src_ip = Ipv4Addr::new(ip_packet[12], ip_packet[13], ip_packet[14], ip_packet[15]);
+        let src = SocketAddr::new(IpAddr::V4(src_ip), src_port);
+        self.anomalies += 1;
+        warn!("UDP checksum anomaly from {}: {:?} ({} bytes).",
+              src,
+              status,
+              payload.len());
+        // Invalid checksums are dropped by the kernel; missing ones are not.
+        if status == UdpChecksum::Missing && self.policy == ChecksumPolicy::Require {
+            if self.suspects.len() >= MAX_SUSPECTS {
+                self.suspects.pop_front();
+            }
+            self.suspects.push_back(fingerprint(&src, payload));
+        }
+    }
+
+    // Returns whether a datagram received on the UDP socket should be dropped.
+    pub fn reject(&mut self, src: &SocketAddr, payload: &[u8]) -> bool {
+        if self.suspects.is_empty() {
+            return false;
+        }
+        let fp = fingerprint(src, payload);
+        match self.suspects.iter().position(|&s| s == fp) {
+            Some(i) => {
+                self.suspects.remove(i);
+                true
+            }
+            None => false,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use checksum::*;
+
+    // 192.0.2.1:1234 -> 192.0.2.2:8964 carrying "hello" without a checksum.
+    fn unchecked_packet() -> Vec<u8> {
+        let mut packet = vec![0x45, 0, 0, 33, 0, 0, 0x40, 0, 64, 17, 0, 0, 192, 0, 2, 1, 192, 0,
+                              2, 2, 0x04, 0xd2, 0x23, 0x04, 0, 13, 0, 0];
+        packet.extend_from_slice(b"hello");
+        packet
+    }
+
+    #[test]
+    fn anomaly_test() {
+        let src: SocketAddr = "192.0.2.1:1234".parse().unwrap();
+        let packet = unchecked_packet();
+
+        let mut monitor = ChecksumMonitor::detached(8964, ChecksumPolicy::Log);
+        monitor.inspect(&packet);
+        assert_eq!(monitor.anomalies(), 1);
+        assert!(!monitor.reject(&src, b"hello"));
+
+        let mut monitor = ChecksumMonitor::detached(8964, ChecksumPolicy::Require);
+        monitor.inspect(&packet);
+        assert_eq!(monitor.anomalies(), 1);
+        assert!(!monitor.reject(&src, b"other"));
+        assert!(monitor.reject(&src, b"hello"));
+        assert!(!monitor.reject(&src, b"hello"));
+
+        // Other ports are not ours to judge.
+        let mut monitor = ChecksumMonitor::detached(53, ChecksumPolicy::Require);
+        monitor.inspect(&packet);
+        assert_eq!(monitor.anomalies(), 0);
+    }
+}
@@ -0,0 +1,193 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use ring::{aead, digest, hkdf, hmac, pbkdf2};
+
+#[derive(Serialize, Deserialize, Clone, Copy, Debug, PartialEq)]
+pub enum Cipher {
+    #[serde(rename = "aes-128-gcm")]
+    Aes128Gcm,
+    #[serde(rename = "aes-256-gcm")]
+    Aes256Gcm,
+    #[serde(rename = "chacha20-poly1305")]
+    Chacha20Poly1305,
+}
+
+// What clients offer unless configured otherwise.
+pub const DEFAULT: Cipher = Cipher::Aes256Gcm;
+
+const SECRET_LEN: usize = 32;
+const PBKDF2_ITERATIONS: u32 = 1024;
+// HKDF salt for the key schedule, fixed since secrets are salted already.
+const SCHEDULE_SALT: &[u8] = b"kytan key schedule";
+
+// Labels of the keys of the Requests and Responses of a handshake, and of a
+// session's data in each direction.
+pub const HANDSHAKE: &str = "handshake";
+pub const CLIENT_TO_SERVER: &str = "client to server";
+pub const SERVER_TO_CLIENT: &str = "server to client";
+
+impl Cipher {
+    pub fn name(&self) -> &'static str {
+        match *self {
+            Cipher::Aes128Gcm => "aes-128-gcm",
+            Cipher::Aes256Gcm => "aes-256-gcm",
+            Cipher::Chacha20Poly1305 => "chacha20-poly1305",
+        }
+    }
+
+    pub fn algorithm(&self) -> &'static aead::Algorithm {
+        match *self {
+            Cipher::Aes128Gcm => &aead::AES_128_GCM,
+            Cipher::Aes256Gcm => &aead::AES_256_GCM,
+            Cipher::Chacha20Poly1305 => &aead::CHACHA20_POLY1305,
+        }
+    }
+
+    // Key size in bits, which is what the floor compares.
+    pub fn strength(&self) -> u32 {
+        match *self {
+            Cipher::Aes128Gcm => 128,
+            Cipher::Aes256Gcm | Cipher::Chacha20Poly1305 => 256,
+        }
+    }
+}
+
+// Derives the keys of a session from a single secret with HKDF-SHA256, each
+// from a label naming what it is for, e.g. a direction or a rotation epoch,
+// and the cipher it is for. Keys for different labels or ciphers are
+// unrelated, so adding one never weakens another.
+pub struct KeySchedule {
+    prk: hmac::SigningKey,
+}
+
+impl KeySchedule {
+    pub fn new(secret: &[u8]) -> KeySchedule {
+        let salt = hmac::SigningKey::new(&digest::SHA256, SCHEDULE_SALT);
+        KeySchedule { prk: hkdf::extract(&salt, secret) }
+    }
+
+    // The secret stretched from a shared password with PBKDF2. Each use of
+    // the password, e.g. exported session state, has a salt of its own.
+    pub fn from_password(password: &str, salt: &[u8]) -> KeySchedule {
+        let mut secret = [0; SECRET_LEN];
+        pbkdf2::derive(&digest::SHA256,
+                       PBKDF2_ITERATIONS,
+                       salt,
+                       password.as_bytes(),
+                       &mut secret);
+        KeySchedule::new(&secret)
+    }
+
+    // Fills `out` with key material for `label`.
+    pub fn derive(&self, label: &str, out: &mut [u8]) {
+        hkdf::expand(&self.prk, format!("kytan {}", label).as_bytes(), out)
+    }
+
+    // The key for `label` under `cipher`, to seal and to open with.
+    pub fn keys(&self, cipher: Cipher, label: &str) -> (aead::SealingKey, aead::OpeningKey) {
+        let mut key = vec![0; cipher.algorithm().key_len()];
+        self.derive(&format!("{} {}", label, cipher.name()), &mut key);
+        (aead::SealingKey::new(cipher.algorithm(), &key).unwrap(),
+         aead::OpeningKey::new(cipher.algorithm(), &key).unwrap())
+    }
+
+    // The schedule of a session, from the `context` its handshake agreed on,
+    // e.g. the nonces of both sides. Sessions with different contexts have
+    // unrelated keys.
+    pub fn session(&self, context: &[u8]) -> KeySchedule {
+        let hex: Vec<String> = context.iter().map(|b| format!("{:02x}", b)).collect();
+        let mut secret = [0; SECRET_LEN];
+        self.derive(&format!("session {}", hex.concat()), &mut secret);
+        KeySchedule::new(&secret)
+    }
+}
+
+// Picks the strongest of the ciphers a client offered, refusing any weaker
+// than `floor` so a client cannot be talked down to one.
+pub fn choose(offered: &[Cipher], floor: Cipher) -> Result<Cipher, String> {
+    match offered.iter().filter(|c| c.strength() >= floor.strength()).max_by_key(|c| c.strength()) {
+        Some(&cipher) => Ok(cipher),
+        None => {
+            let names: Vec<&str> = offered.iter().map(|c| c.name()).collect();
+            Err(format!("Offered ciphers [{}] are all weaker than the minimum {}.",
+                        names.join(", "),
+                        floor.name()))
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use cipher::*;
+
+    #[test]
+    fn choose_test() {
+        assert_eq!(choose(&[Cipher::Aes128Gcm, Cipher::Aes256Gcm], Cipher::Aes128Gcm),
+                   Ok(Cipher::Aes256Gcm));
+        assert_eq!(choose(&[DEFAULT], Cipher::Chacha20Poly1305), Ok(DEFAULT));
+        assert_eq!(choose(&[Cipher::Aes128Gcm], Cipher::Aes256Gcm),
+                   Err(String::from("Offered ciphers [aes-128-gcm] are all weaker than the \
+                                     minimum aes-256-gcm.")));
+        assert!(choose(&[], Cipher::Aes128Gcm).is_err());
+    }
+
+    #[test]
+    fn key_schedule_test() {
+        let derive = |schedule: &KeySchedule, label| {
+            let mut key = [0u8; 32];
+            schedule.derive(label, &mut key);
+            key
+        };
+        let schedule = KeySchedule::from_password("password", &[0; 64]);
+        let up = derive(&schedule, "client to server");
+        let again = KeySchedule::from_password("password", &[0; 64]);
+        assert_eq!(up, derive(&again, "client to server"));
+        assert!(up != derive(&schedule, "server to client"));
+        let other_salt = KeySchedule::from_password("password", &[1; 64]);
+        assert!(up != derive(&other_salt, "client to server"));
+        let other_password = KeySchedule::from_password("passw0rd", &[0; 64]);
+        assert!(up != derive(&other_password, "client to server"));
+        // Each session has keys of its own.
+        let session = schedule.session(&[1; 32]);
+        assert!(up != derive(&session, "client to server"));
+        assert_eq!(derive(&session, "client to server"),
+                   derive(&again.session(&[1; 32]), "client to server"));
+        assert!(derive(&session, "client to server") !=
+                derive(&schedule.session(&[2; 32]), "client to server"));
+    }
+
+    #[test]
+    fn schedule_keys_test() {
+        let schedule = KeySchedule::new(&[7; 32]);
+        let seal = |key: &aead::SealingKey| {
+            let mut message = b"hello".to_vec();
+            message.resize(5 + aead::MAX_TAG_LEN, 0);
+            aead::seal_in_place(key, &[0; 12], &[], &mut message, aead::MAX_TAG_LEN).unwrap();
+            message
+        };
+        let open = |key: &aead::OpeningKey, mut message: Vec<u8>| {
+            aead::open_in_place(key, &[0; 12], &[], 0, &mut message).map(|m| m.to_vec())
+        };
+        let (sealing_key, _) = schedule.keys(DEFAULT, "data 0");
+        let (_, opening_key) = KeySchedule::new(&[7; 32]).keys(DEFAULT, "data 0");
+        assert_eq!(open(&opening_key, seal(&sealing_key)).unwrap(), b"hello");
+        // Another epoch, or another cipher, has another key.
+        let (_, next_epoch) = schedule.keys(DEFAULT, "data 1");
+        assert!(open(&next_epoch, seal(&sealing_key)).is_err());
+        let (chacha, _) = schedule.keys(Cipher::Chacha20Poly1305, "data 0");
+        assert!(open(&opening_key, seal(&chacha)).is_err());
+    }
+}
@@ -0,0 +1,141 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::time::{Duration, Instant};
+
+// How long packets may wait above the target before dropping starts, about a
+// round trip (RFC 8289).
+pub const INTERVAL_MS: u64 = 100;
+
+// Controlled delay (CoDel) for one queue: once packets have waited longer
+// than `target` for a whole interval, the ones at its head are dropped, more
+// often the longer it lasts, until the wait is back under the target. Short
+// bursts pass untouched.
+pub struct Codel {
+    target: Duration,
+    interval: Duration,
+    // When the wait went above the target, plus an interval, if it is.
+    first_above: Option<Instant>,
+    dropping: bool,
+    drop_next: Instant,
+    // Drops since dropping started, and at the time it last did.
+    count: u32,
+    last_count: u32,
+}
+
+impl Codel {
+    pub fn new(target: Duration, now: Instant) -> Codel {
+        Codel {
+            target: target,
+            interval: Duration::from_millis(INTERVAL_MS),
+            first_above: None,
+            dropping: false,
+            drop_next: now,
+            count: 0,
+            last_count: 0,
+        }
+    }
+
+    // The next drop comes sooner, by the square root of the drops so far.
+    fn control_law(&self, t: Instant) -> Instant {
+        let interval = self.interval.as_secs() as f64 * 1e9 + self.interval.subsec_nanos() as f64;
+        t + Duration::new(0, (interval / (self.count as f64).sqrt()) as u32)
+    }
+
+    // Whether the wait has been above the target for an interval. A packet
+    // with none behind it is never dropped, so a queue is not emptied just
+    // because the link is slow.
+    fn ok_to_drop(&mut self, sojourn: Duration, behind: usize, now: Instant) -> bool {
+        if sojourn < self.target || behind == 0 {
+            self.first_above = None;
+            return false;
+        }
+        match self.first_above {
+            None => {
+                self.first_above = Some(now + self.interval);
+                false
+            }
+            Some(first_above) => now >= first_above,
+        }
+    }
+
+    // Decides whether to drop the packet at the head of the queue, which
+    // waited `sojourn` and has `behind` packets behind it, instead of sending
+    // it.
+    pub fn should_drop(&mut self, sojourn: Duration, behind: usize, now: Instant) -> bool {
+        let ok_to_drop = self.ok_to_drop(sojourn, behind, now);
+        if self.dropping {
+            if !ok_to_drop {
+                self.dropping = false;
+                return false;
+            }
+            if now < self.drop_next {
+                return false;
+            }
+            self.count += 1;
+            let next = self.drop_next;
+            self.drop_next = self.control_law(next);
+            return true;
+        }
+        if !ok_to_drop {
+            return false;
+        }
+        self.dropping = true;
+        // Dropping again soon after it stopped picks up about where it left
+        // off, as the queue is likely still too long.
+        let delta = self.count - self.last_count;
+        self.count = if delta > 1 && now < self.drop_next + self.interval * 16 {
+            delta
+        } else {
+            1
+        };
+        self.drop_next = self.control_law(now);
+        self.last_count = self.count;
+        true
+    }
+
+    // Forgets the wait once the queue ran empty.
+    pub fn idle(&mut self) {
+        self.first_above = None;
+        self.dropping = false;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::{Duration, Instant};
+    use codel::*;
+
+    #[test]
+    fn codel_test() {
+        let target = Duration::from_millis(5);
+        let mut codel = Codel::new(target, Instant::now());
+        let start = Instant::now();
+        let at = |ms| start + Duration::from_millis(ms);
+        // A burst waiting long, but not for a whole interval, passes.
+        assert!(!codel.should_drop(Duration::from_millis(50), 10, at(0)));
+        assert!(!codel.should_drop(Duration::from_millis(50), 10, at(99)));
+        // Still above the target an interval later: drop, then again after
+        // an interval, and sooner after that.
+        assert!(codel.should_drop(Duration::from_millis(50), 10, at(100)));
+        assert!(!codel.should_drop(Duration::from_millis(50), 10, at(150)));
+        assert!(codel.should_drop(Duration::from_millis(50), 10, at(200)));
+        assert!(!codel.should_drop(Duration::from_millis(50), 10, at(270)));
+        assert!(codel.should_drop(Duration::from_millis(50), 10, at(271)));
+        // Back under the target, or the last packet: no drops.
+        assert!(!codel.should_drop(Duration::from_millis(1), 10, at(400)));
+        assert!(!codel.should_drop(Duration::from_millis(50), 0, at(400)));
+    }
+}
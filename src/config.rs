@@ -0,0 +1,911 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::cmp;
+use std::collections::{BTreeSet, HashMap};
+use std::fs::File;
+use std::io::Read;
+use std::net::{Ipv4Addr, Ipv6Addr, SocketAddr};
+use std::time::Duration;
+use toml;
+use device;
+use checksum::ChecksumPolicy;
+use fragment::FragmentPolicy;
+use cipher::{self, Cipher};
+use acl;
+use bridge;
+use dns;
+use control;
+use uplink;
+use utils::RetryPolicy;
+
+// Bytes per second a session may send to (upload) and receive from (download)
+// the server. Zero means unlimited.
+#[derive(Deserialize, Clone, Copy, Debug, Default, PartialEq)]
+#[serde(default)]
+pub struct RateLimit {
+    pub upload: u64,
+    pub download: u64,
+}
+
+// How the server treats a particular client: the weakest cipher accepted
+// from it, in place of `min_cipher`, and whether its data is compressed,
+// which low-powered clients can be spared.
+#[derive(Deserialize, Clone, Copy, Debug, PartialEq)]
+#[serde(default)]
+pub struct Profile {
+    pub min_cipher: Option<Cipher>,
+    pub compression: bool,
+}
+
+impl Default for Profile {
+    fn default() -> Profile {
+        Profile {
+            min_cipher: None,
+            compression: true,
+        }
+    }
+}
+
+#[derive(Deserialize, Debug)]
+#[serde(default)]
+pub struct ServerConfig {
+    // Client identifier -> inner IP address always assigned to that client.
+    pub reservations: HashMap<String, Ipv4Addr>,
+    // MTU of the server's TUN device, also given to clients without an entry
+    // in `mtus`.
+    pub mtu: u16,
+    // Client identifier -> MTU assigned to that client.
+    pub mtus: HashMap<String, u16>,
+    // Largest inner packet sent to clients, for paths narrower towards them
+    // than from them: larger ones are fragmented, or answered with ICMP
+    // fragmentation needed if DF is set. Zero sends any size, as does a
+    // client without an entry in `downstream_mtus` if this is zero.
+    pub downstream_mtu: u16,
+    pub downstream_mtus: HashMap<String, u16>,
+    // Sessions are imported from this file on start and exported to it on
+    // shutdown, so a standby server can take over without clients noticing.
+    pub state_file: Option<String>,
+    // Where a snapshot of the sessions quiesced for migration is written, in
+    // the format of `state_file`, for the server taking them over to import.
+    pub migration_file: Option<String>,
+    // Both files are encrypted and authenticated with a key derived from the
+    // shared secret, or from the key in this file if given, so the sessions
+    // survive rotating the secret and stay sealed from others holding it.
+    pub state_key_file: Option<String>,
+    // Imported sessions are only resumed while their token is younger than
+    // this, in seconds, and was resumed fewer times than this before; past
+    // either their clients have to handshake again. Zero means no limit.
+    pub resumption_max_age_secs: u64,
+    pub resumption_max_uses: u32,
+    // Share the uplink fairly among sessions instead of sending packets in
+    // arrival order. At most `fair_queue_limit` packets are queued per session.
+    pub fair_queuing: bool,
+    pub fair_queue_limit: usize,
+    // With fair queuing, drop packets that waited in a session's queue for
+    // long, keeping the wait near this many milliseconds (CoDel) instead of
+    // delivering them stale. Zero disables it.
+    pub queue_latency_target_ms: u64,
+    // Bytes queued across all sessions before packets are dropped from the
+    // largest backlogs.
+    pub queue_memory_limit: usize,
+    // Send data to a client in batches with UDP segmentation offload, one
+    // syscall for up to 64 packets of the same size. Linux only; falls back
+    // to one send per packet where the kernel lacks it.
+    pub udp_gso: bool,
+    // On shutdown, keep sending queued packets for at most this long before
+    // closing the socket.
+    pub drain_timeout_ms: u64,
+    // Act as a router hop: decrement the TTL of packets from clients, and
+    // answer those that expire with ICMP time exceeded. Off, the tunnel is
+    // transparent.
+    pub decrement_ttl: bool,
+    // Handshakes allowed per second (and in a burst) from one source address,
+    // and from all sources together.
+    pub handshake_rate: f64,
+    pub handshake_burst: f64,
+    pub global_handshake_rate: f64,
+    pub global_handshake_burst: f64,
+    // Requests older than this window, by their timestamp and allowing for
+    // clock skew, are dropped, and so are those seen again within it, from
+    // whatever address. At most `replay_cache_size` are remembered.
+    pub replay_window_ms: u64,
+    pub replay_cache_size: usize,
+    // What to do about the UDP checksum of incoming datagrams: "ignore" (rely
+    // on the AEAD tag), "log" anomalies, or "require" one to be present.
+    pub udp_checksum: ChecksumPolicy,
+    // What to do about datagrams that arrived in IP fragments: "ignore" them,
+    // "log" them, or "drop" them.
+    pub outer_fragments: FragmentPolicy,
+    // Prefix length of each client's link: 24 shares 10.10.10.0/24 among all
+    // clients, 30 or 31 gives every client a point-to-point link of its own.
+    pub link_prefix: u8,
+    // Recreate the TUN device if it is removed out from under us, e.g. with
+    // `ip link del`, trying this many times before giving up. Zero exits
+    // instead.
+    pub tun_recreate_attempts: u32,
+    // Clients only offering ciphers weaker than this are turned away.
+    pub min_cipher: Cipher,
+    // Client identifier -> profile negotiated in that client's handshake.
+    pub profiles: HashMap<String, Profile>,
+    // Client identifier -> pre-shared key that client authenticates with
+    // instead of the shared secret. Reloaded on SIGHUP, so a leaked key can
+    // be replaced without a restart.
+    pub psks: HashMap<String, String>,
+    // Also accept handshakes over TCP on this port, e.g. 443 where UDP is
+    // blocked. Data still goes over UDP to the main port.
+    pub tcp_handshake_port: Option<u16>,
+    // Answer unauthenticated diagnostic hellos, so clients whose handshakes
+    // fail can tell a key mismatch from a network problem.
+    pub diagnostic_hello: bool,
+    // Queue up to this many UDP handshakes over the global handshake rate
+    // and answer them as the rate allows, instead of dropping them. Zero
+    // drops them.
+    pub handshake_queue: usize,
+    // How many clients to make room for up front. Only a hint: more may
+    // connect, at the cost of growing the session table.
+    pub expected_sessions: usize,
+    // Rules deciding which inner packets from clients are forwarded, checked
+    // in order. Packets matching none get `acl_default`.
+    pub acl: Vec<acl::RuleConfig>,
+    pub acl_default: acl::Action,
+    // DNS queries from clients for these domains are answered by the server
+    // instead of being forwarded.
+    pub dns_rules: Vec<dns::RuleConfig>,
+    // Answer inner packets to destinations the server has no route to with
+    // an ICMP destination unreachable, instead of dropping them silently.
+    pub icmp_unreachable: bool,
+    // Send client traffic out of these uplinks, by flow or failing over, and
+    // drain an uplink once pinging `uplink_check_target` through it fails.
+    pub uplinks: Vec<uplink::UplinkConfig>,
+    pub uplink_policy: uplink::Policy,
+    pub uplink_check_target: Ipv4Addr,
+    pub uplink_check_interval_secs: u64,
+    // Rate limits for sessions, and for particular client identifiers.
+    pub rate_limit: RateLimit,
+    pub rate_limits: HashMap<String, RateLimit>,
+    // Log a traffic summary at info level this often. Zero disables it.
+    pub stats_interval_secs: u64,
+    // Mask IP addresses and interface names in log lines.
+    pub redact_logs: bool,
+    // Append a record of every session connect and disconnect to this file,
+    // apart from the operational log.
+    pub audit_log: Option<String>,
+    // Compress data with the preset dictionary in this file when the peer has
+    // the same one, agreed on in the handshake.
+    pub compression_dictionary: Option<String>,
+    // Mirror inner packets to an analyzer on this unix datagram socket,
+    // dropping copies once `tap_queue` are waiting for it.
+    pub tap_socket: Option<String>,
+    pub tap_queue: usize,
+    // Export a record of every inner flow to this IPFIX collector once it
+    // was idle for `flow_idle_timeout_secs`, and every
+    // `flow_active_timeout_secs` while it lasts. Beyond `max_flows` at once,
+    // all are exported early.
+    pub flow_collector: Option<SocketAddr>,
+    pub flow_idle_timeout_secs: u64,
+    pub flow_active_timeout_secs: u64,
+    pub max_flows: usize,
+    // IPFIX observation domain of the exported records. By default, the
+    // server's public IPv4 address.
+    pub flow_observation_domain: Option<u32>,
+    // Drop broadcast and multicast inner packets, except for these groups.
+    pub drop_non_unicast: bool,
+    pub multicast_groups: Vec<Ipv4Addr>,
+    // Drop inner packets longer than this many bytes in either direction,
+    // which only a misconfigured MTU or an attack produces. Zero allows any.
+    pub max_inner_packet: usize,
+    // Move a session to the source address of its keepalives, so replies
+    // follow a client whose NAT mapped it to a new port.
+    pub follow_rebinds: bool,
+    // Client identifier -> subnets behind that client, e.g. "192.168.50.0/24",
+    // it may bridge into the tunnel. They are routed into the TUN device, and
+    // on to the session of the client advertising them.
+    pub bridged_subnets: HashMap<String, Vec<String>>,
+}
+
+impl Default for ServerConfig {
+    fn default() -> ServerConfig {
+        ServerConfig {
+            reservations: HashMap::new(),
+            mtu: device::DEFAULT_MTU,
+            mtus: HashMap::new(),
+            downstream_mtu: 0,
+            downstream_mtus: HashMap::new(),
+            state_file: None,
+            migration_file: None,
+            state_key_file: None,
+            resumption_max_age_secs: 0,
+            resumption_max_uses: 0,
+            fair_queuing: false,
+            fair_queue_limit: 64,
+            queue_latency_target_ms: 0,
+            queue_memory_limit: 16 * 1024 * 1024,
+            udp_gso: false,
+            drain_timeout_ms: 1000,
+            decrement_ttl: false,
+            handshake_rate: 1.0,
+            handshake_burst: 5.0,
+            global_handshake_rate: 100.0,
+            global_handshake_burst: 200.0,
+            replay_window_ms: 5000,
+            replay_cache_size: 4096,
+            udp_checksum: ChecksumPolicy::Ignore,
+            outer_fragments: FragmentPolicy::Ignore,
+            link_prefix: 24,
+            tun_recreate_attempts: 3,
+            min_cipher: cipher::DEFAULT,
+            profiles: HashMap::new(),
+            psks: HashMap::new(),
+            tcp_handshake_port: None,
+            diagnostic_hello: false,
+            handshake_queue: 0,
+            expected_sessions: 0,
+            acl: Vec::new(),
+            acl_default: acl::Action::Allow,
+            dns_rules: Vec::new(),
+            icmp_unreachable: false,
+            uplinks: Vec::new(),
+            uplink_policy: uplink::Policy::FlowHash,
+            uplink_check_target: Ipv4Addr::new(8, 8, 8, 8),
+            uplink_check_interval_secs: 10,
+            rate_limit: RateLimit::default(),
+            rate_limits: HashMap::new(),
+            stats_interval_secs: 0,
+            redact_logs: false,
+            audit_log: None,
+            compression_dictionary: None,
+            tap_socket: None,
+            tap_queue: 1024,
+            flow_collector: None,
+            flow_idle_timeout_secs: 15,
+            flow_active_timeout_secs: 60,
+            max_flows: 65536,
+            flow_observation_domain: None,
+            drop_non_unicast: false,
+            multicast_groups: Vec::new(),
+            max_inner_packet: 0,
+            follow_rebinds: false,
+            bridged_subnets: HashMap::new(),
+        }
+    }
+}
+
+#[derive(Deserialize, Debug)]
+#[serde(default)]
+pub struct ClientConfig {
+    // Sent in the handshake so the server can apply per-client policy.
+    pub identifier: Option<String>,
+    // Authenticate with this pre-shared key of our own, the one the server
+    // has for our identifier, instead of the shared secret.
+    pub psk: Option<String>,
+    // Ciphers offered in the handshake, for the server to pick the strongest
+    // it accepts.
+    pub ciphers: Vec<Cipher>,
+    // Retry and timeout settings for the route commands run during bring-up.
+    pub route_attempts: u32,
+    pub route_backoff_ms: u64,
+    pub route_timeout_ms: u64,
+    // Recreate the TUN device if it is removed out from under us, e.g. with
+    // `ip link del`, trying this many times before giving up. Zero exits
+    // instead.
+    pub tun_recreate_attempts: u32,
+    // Handshake over TCP to this port of the server, instead of over UDP.
+    pub handshake_port: Option<u16>,
+    // Log every handshake step at info level the first time we connect.
+    pub log_handshake: bool,
+    // Give up on an unanswered UDP handshake after a few tries and send a
+    // diagnostic hello, to report whether the server is reachable at all.
+    pub diagnose_handshake: bool,
+    // Set DF on outer packets and lower the MTU when the path turns out to be
+    // narrower, instead of letting routers fragment them.
+    pub path_mtu_discovery: bool,
+    // The server's downstream_mtu for us, if it is below the assigned MTU,
+    // which still limits what we send. The TUN device takes the lower of the
+    // two, so neither direction has to fragment. Zero uses the assigned MTU.
+    pub downstream_mtu: u16,
+    // User and group allowed to use the TUN device without privileges, for
+    // handing it over to an unprivileged process.
+    pub tun_owner: Option<u32>,
+    pub tun_group: Option<u32>,
+    // Log a traffic summary at info level this often. Zero disables it.
+    pub stats_interval_secs: u64,
+    // Mask IP addresses and interface names in log lines.
+    pub redact_logs: bool,
+    // Compress data with the preset dictionary in this file when the peer has
+    // the same one, agreed on in the handshake.
+    pub compression_dictionary: Option<String>,
+    // Mirror inner packets to an analyzer on this unix datagram socket,
+    // dropping copies once `tap_queue` are waiting for it.
+    pub tap_socket: Option<String>,
+    pub tap_queue: usize,
+    // Drop broadcast and multicast inner packets, except for these groups.
+    pub drop_non_unicast: bool,
+    pub multicast_groups: Vec<Ipv4Addr>,
+    // Drop inner packets longer than this many bytes in either direction,
+    // which only a misconfigured MTU or an attack produces. Zero allows any.
+    pub max_inner_packet: usize,
+    // Resolve the server's hostname again this often, and reconnect when it
+    // moved, e.g. behind dynamic DNS. Zero resolves only once.
+    pub resolve_interval_secs: u64,
+    // Connect to the server's IPv6 addresses before its IPv4 ones. With a
+    // NAT64 prefix (a /96, e.g. 64:ff9b::), IPv4 addresses are synthesized
+    // into it, so an IPv6-only network reaches an IPv4 server.
+    pub prefer_ipv6: bool,
+    pub nat64_prefix: Option<Ipv6Addr>,
+    // Check which local address leads to the server this often, and reconnect
+    // through a fresh socket when it changed, e.g. after a handoff between
+    // Wi-Fi and cellular. Zero disables it.
+    pub path_check_interval_secs: u64,
+    // Wait a random delay of up to this long before reconnecting, so a crowd
+    // of clients reconnecting at once reaches the server spread out.
+    pub reconnect_jitter_ms: u64,
+    // Tag data packets with a random connection ID, so the server can tell
+    // they belong to this session whichever path they take. Changes the wire
+    // format of data packets; servers without support drop them.
+    pub connection_id: bool,
+    // Without `-d`, send traffic to these destination ports through the
+    // tunnel whatever its destination, and nothing else. Linux only.
+    pub tunnel_ports: Vec<u16>,
+    // Hold packets from the server that arrive out of order for up to
+    // `reorder_timeout_ms`, and up to this many sequence numbers behind a
+    // gap, to release them in order. Zero disables it.
+    pub reorder_window: usize,
+    pub reorder_timeout_ms: u64,
+    // Connect even when the tunnel's subnet overlaps a route the host already
+    // has, e.g. a LAN on 10.10.10.0/24, instead of refusing to.
+    pub allow_route_conflicts: bool,
+    // Instead of bringing up a TUN device, serve a SOCKS5 proxy on this
+    // address whose connections leave through the tunnel. It asks for no
+    // credentials, so it must be a loopback address.
+    pub socks_proxy: Option<SocketAddr>,
+    // Where the proxy looks up hostnames, through the tunnel.
+    pub socks_resolver: Ipv4Addr,
+    // Send an empty data packet after this long without sending anything,
+    // to keep NAT mappings on the way open. Zero disables it.
+    pub keepalive_interval_secs: u64,
+    // Subnets behind this client to bridge into the tunnel, advertised in
+    // the handshake. The client forwards between them and the tunnel, with
+    // proxy ARP on `bridge_interface`, the one facing them, if given.
+    pub bridged_subnets: Vec<String>,
+    pub bridge_interface: Option<String>,
+}
+
+impl Default for ClientConfig {
+    fn default() -> ClientConfig {
+        ClientConfig {
+            identifier: None,
+            psk: None,
+            ciphers: vec![cipher::DEFAULT],
+            route_attempts: 3,
+            route_backoff_ms: 100,
+            route_timeout_ms: 5000,
+            tun_recreate_attempts: 3,
+            handshake_port: None,
+            log_handshake: true,
+            diagnose_handshake: false,
+            path_mtu_discovery: false,
+            downstream_mtu: 0,
+            tun_owner: None,
+            tun_group: None,
+            stats_interval_secs: 0,
+            redact_logs: false,
+            compression_dictionary: None,
+            tap_socket: None,
+            tap_queue: 1024,
+            drop_non_unicast: false,
+            multicast_groups: Vec::new(),
+            max_inner_packet: 0,
+            resolve_interval_secs: 0,
+            prefer_ipv6: false,
+            nat64_prefix: None,
+            path_check_interval_secs: 0,
+            reconnect_jitter_ms: 0,
+            connection_id: false,
+            tunnel_ports: Vec::new(),
+            reorder_window: 0,
+            reorder_timeout_ms: 50,
+            allow_route_conflicts: false,
+            socks_proxy: None,
+            socks_resolver: Ipv4Addr::new(8, 8, 8, 8),
+            keepalive_interval_secs: 0,
+            bridged_subnets: Vec::new(),
+            bridge_interface: None,
+        }
+    }
+}
+
+impl ClientConfig {
+    pub fn route_policy(&self) -> RetryPolicy {
+        RetryPolicy {
+            attempts: cmp::max(self.route_attempts, 1),
+            backoff: Duration::from_millis(self.route_backoff_ms),
+            timeout: Duration::from_millis(self.route_timeout_ms),
+        }
+    }
+}
+
+// The endpoint serving metrics and control commands. It is only ever bound
+// to a unix socket, so filesystem permissions decide who may use it.
+#[derive(Deserialize, Debug)]
+#[serde(default)]
+pub struct ControlConfig {
+    pub socket: Option<String>,
+    // Octal permissions of the socket, e.g. "0660" to let a group in. Never
+    // world-writable.
+    pub socket_mode: String,
+    // The share of latency observations, from 0 to 1, kept as exemplars in
+    // the OpenMetrics exposition. Zero keeps none.
+    pub exemplar_rate: f64,
+}
+
+impl Default for ControlConfig {
+    fn default() -> ControlConfig {
+        ControlConfig {
+            socket: None,
+            socket_mode: String::from("0600"),
+            exemplar_rate: 0.0,
+        }
+    }
+}
+
+#[derive(Deserialize, Debug, Default)]
+#[serde(default)]
+pub struct Config {
+    pub server: ServerConfig,
+    pub client: ClientConfig,
+    pub control: ControlConfig,
+}
+
+// The settings under [server] a reload applies. The others need a restart.
+const RELOADABLE: &'static [&'static str] = &["acl",
+                                              "acl_default",
+                                              "dns_rules",
+                                              "max_inner_packet",
+                                              "decrement_ttl",
+                                              "psks"];
+
+fn read(path: &str) -> Result<String, String> {
+    let mut file = try!(File::open(path).map_err(|e| format!("{}: {}", path, e)));
+    let mut contents = String::new();
+    try!(file.read_to_string(&mut contents).map_err(|e| format!("{}: {}", path, e)));
+    Ok(contents)
+}
+
+// The settings under [server] in the file at `path`, as written, to tell
+// which a reload changed.
+pub fn load_server_settings(path: &str) -> Result<toml::Value, String> {
+    let contents = try!(read(path));
+    let config: toml::Value = try!(toml::from_str(&contents).map_err(|e| e.to_string()));
+    Ok(config.get("server").cloned().unwrap_or_else(|| toml::Value::Table(Default::default())))
+}
+
+// The settings under [server] that differ between `old` and `new` although
+// a reload does not apply them.
+pub fn unreloaded(old: &toml::Value, new: &toml::Value) -> Vec<String> {
+    let keys = |settings: &toml::Value| -> BTreeSet<String> {
+        settings.as_table().map_or(BTreeSet::new(), |t| t.keys().cloned().collect())
+    };
+    keys(old)
+        .union(&keys(new))
+        .filter(|key| !RELOADABLE.contains(&key.as_str()) && old.get(*key) != new.get(*key))
+        .cloned()
+        .collect()
+}
+
+impl Config {
+    pub fn load(path: &str) -> Result<Config, String> {
+        Config::parse(&try!(read(path)))
+    }
+
+    pub fn parse(contents: &str) -> Result<Config, String> {
+        let config: Config = try!(toml::from_str(contents).map_err(|e| e.to_string()));
+        try!(config.validate());
+        Ok(config)
+    }
+
+    fn validate(&self) -> Result<(), String> {
+        let mtus = self.server.mtus.iter().map(|(i, mtu)| (i.as_str(), mtu));
+        for (name, &mtu) in Some(("server", &self.server.mtu)).into_iter().chain(mtus) {
+            try!(device::check_mtu(mtu).map_err(|e| format!("{}: {}", name, e)));
+        }
+        let downstream = self.server.downstream_mtus.iter().map(|(i, mtu)| (i.as_str(), mtu));
+        let defaults = vec![("server", &self.server.downstream_mtu),
+                            ("client", &self.client.downstream_mtu)];
+        for (name, &mtu) in defaults.into_iter().filter(|&(_, &m)| m != 0).chain(downstream) {
+            try!(device::check_mtu(mtu)
+                .map_err(|e| format!("{}: downstream_mtu: {}", name, e)));
+        }
+        let rates = [self.server.handshake_rate,
+                     self.server.handshake_burst,
+                     self.server.global_handshake_rate,
+                     self.server.global_handshake_burst];
+        if rates.iter().any(|&r| !(r > 0.0)) {
+            return Err(String::from("Handshake rates and bursts must be positive."));
+        }
+        if self.server.psks.keys().any(|i| i.is_empty() || i.len() > 255) {
+            return Err(String::from("Identifiers with pre-shared keys must be 1 to 255 bytes \
+                                     long."));
+        }
+        if self.server.psks.values().chain(&self.client.psk).any(|psk| psk.is_empty()) {
+            return Err(String::from("Pre-shared keys cannot be empty."));
+        }
+        if self.client.ciphers.is_empty() {
+            return Err(String::from("ciphers needs at least one cipher to offer."));
+        }
+        try!(acl::Acl::new(&self.server.acl, self.server.acl_default));
+        try!(dns::DnsFilter::new(&self.server.dns_rules));
+        try!(bridge::SubnetRoutes::new(&self.server.bridged_subnets));
+        try!(bridge::Subnet::parse_all(&self.client.bridged_subnets));
+        if !self.client.bridged_subnets.is_empty() && self.client.handshake_port.is_some() {
+            return Err(String::from("Handshakes over TCP cannot advertise bridged_subnets."));
+        }
+        if self.server.flow_idle_timeout_secs == 0 || self.server.flow_active_timeout_secs == 0 ||
+           self.server.max_flows == 0 {
+            return Err(String::from("Flow timeouts and max_flows must be positive."));
+        }
+        if self.server.queue_latency_target_ms > 0 && !self.server.fair_queuing {
+            return Err(String::from("queue_latency_target_ms needs fair_queuing."));
+        }
+        if !self.server.uplinks.is_empty() && self.server.uplink_check_interval_secs == 0 {
+            return Err(String::from("uplink_check_interval_secs must be positive with uplinks."));
+        }
+        try!(device::check_owner(self.client.tun_owner, self.client.tun_group));
+        if self.client.nat64_prefix.map_or(false, |p| p.segments()[6..] != [0, 0]) {
+            return Err(String::from("nat64_prefix must be a /96, ending in 32 zero bits."));
+        }
+        if self.client.tunnel_ports.contains(&0) {
+            return Err(String::from("Port 0 cannot be routed through the tunnel."));
+        }
+        if self.client.socks_proxy.map_or(false, |a| !a.ip().is_loopback()) {
+            return Err(String::from("socks_proxy must be a loopback address, as the proxy asks \
+                                     for no credentials."));
+        }
+        try!(control::parse_mode(&self.control.socket_mode));
+        if !(self.control.exemplar_rate >= 0.0 && self.control.exemplar_rate <= 1.0) {
+            return Err(String::from("exemplar_rate must be between 0 and 1."));
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use config::*;
+
+    #[test]
+    fn parse_empty_test() {
+        let config = Config::parse("").unwrap();
+        assert!(config.server.reservations.is_empty());
+        assert_eq!(config.client.identifier, None);
+    }
+
+    #[test]
+    fn parse_reservations_test() {
+        let config = Config::parse(r#"
+            [server.reservations]
+            laptop = "10.10.10.20"
+            phone = "10.10.10.21"
+
+            [client]
+            identifier = "laptop"
+        "#)
+            .unwrap();
+        assert_eq!(config.server.reservations.get("laptop"),
+                   Some(&Ipv4Addr::new(10, 10, 10, 20)));
+        assert_eq!(config.server.reservations.get("phone"),
+                   Some(&Ipv4Addr::new(10, 10, 10, 21)));
+        assert_eq!(config.client.identifier, Some(String::from("laptop")));
+    }
+
+    #[test]
+    fn route_policy_test() {
+        let default = Config::parse("").unwrap().client.route_policy();
+        assert_eq!(default.attempts, RetryPolicy::default().attempts);
+        assert_eq!(default.backoff, RetryPolicy::default().backoff);
+        assert_eq!(default.timeout, RetryPolicy::default().timeout);
+
+        let config = Config::parse("[client]\nroute_attempts = 0\nroute_timeout_ms = 250").unwrap();
+        let policy = config.client.route_policy();
+        assert_eq!(policy.attempts, 1);
+        assert_eq!(policy.timeout, Duration::from_millis(250));
+    }
+
+    #[test]
+    fn parse_mtus_test() {
+        let config = Config::parse("[server]\nmtu = 1400\n[server.mtus]\nlaptop = 1280").unwrap();
+        assert_eq!(config.server.mtu, 1400);
+        assert_eq!(config.server.mtus.get("laptop"), Some(&1280));
+        assert_eq!(Config::parse("").unwrap().server.mtu, device::DEFAULT_MTU);
+    }
+
+    #[test]
+    fn parse_tun_recreate_attempts_test() {
+        let config = Config::parse("[server]\ntun_recreate_attempts = 0\n\
+                                    [client]\ntun_recreate_attempts = 10")
+            .unwrap();
+        assert_eq!(config.server.tun_recreate_attempts, 0);
+        assert_eq!(config.client.tun_recreate_attempts, 10);
+        assert_eq!(Config::parse("").unwrap().server.tun_recreate_attempts, 3);
+    }
+
+    #[test]
+    fn parse_flow_collector_test() {
+        let config = Config::parse("[server]\nflow_collector = \"192.0.2.5:4739\"\n\
+                                    flow_idle_timeout_secs = 30")
+            .unwrap();
+        assert_eq!(config.server.flow_collector, Some("192.0.2.5:4739".parse().unwrap()));
+        assert_eq!(config.server.flow_idle_timeout_secs, 30);
+        assert_eq!(config.server.flow_active_timeout_secs, 60);
+        assert_eq!(Config::parse("").unwrap().server.flow_collector, None);
+        assert_eq!(Config::parse("").unwrap().server.flow_observation_domain, None);
+        let config = Config::parse("[server]\nflow_observation_domain = 7").unwrap();
+        assert_eq!(config.server.flow_observation_domain, Some(7));
+        assert!(Config::parse("[server]\nflow_collector = \"collector\"").is_err());
+        assert!(Config::parse("[server]\nmax_flows = 0").is_err());
+    }
+
+    #[test]
+    fn parse_downstream_mtu_test() {
+        let config = Config::parse(r#"
+            [server]
+            downstream_mtu = 1280
+            [server.downstream_mtus]
+            phone = 1200
+            [client]
+            downstream_mtu = 1200
+        "#)
+            .unwrap();
+        assert_eq!(config.server.downstream_mtu, 1280);
+        assert_eq!(config.server.downstream_mtus.get("phone"), Some(&1200));
+        assert_eq!(config.client.downstream_mtu, 1200);
+        assert_eq!(Config::parse("").unwrap().server.downstream_mtu, 0);
+        assert!(Config::parse("[server]\ndownstream_mtu = 100").is_err());
+        assert!(Config::parse("[server.downstream_mtus]\nphone = 0").is_err());
+        assert!(Config::parse("[client]\ndownstream_mtu = 9000").is_err());
+    }
+
+    #[test]
+    fn parse_min_cipher_test() {
+        assert_eq!(Config::parse("").unwrap().server.min_cipher, Cipher::Aes256Gcm);
+        let config = Config::parse("[server]\nmin_cipher = \"chacha20-poly1305\"").unwrap();
+        assert_eq!(config.server.min_cipher, Cipher::Chacha20Poly1305);
+        assert!(Config::parse("[server]\nmin_cipher = \"des\"").is_err());
+
+        assert_eq!(Config::parse("").unwrap().client.ciphers, vec![Cipher::Aes256Gcm]);
+        let config = Config::parse("[client]\nciphers = [\"chacha20-poly1305\", \
+                                    \"aes-128-gcm\"]")
+            .unwrap();
+        assert_eq!(config.client.ciphers,
+                   vec![Cipher::Chacha20Poly1305, Cipher::Aes128Gcm]);
+        assert!(Config::parse("[client]\nciphers = []").is_err());
+    }
+
+    #[test]
+    fn parse_udp_checksum_test() {
+        assert_eq!(Config::parse("").unwrap().server.udp_checksum,
+                   ChecksumPolicy::Ignore);
+        let config = Config::parse("[server]\nudp_checksum = \"require\"").unwrap();
+        assert_eq!(config.server.udp_checksum, ChecksumPolicy::Require);
+        assert!(Config::parse("[server]\nudp_checksum = \"sometimes\"").is_err());
+    }
+
+    #[test]
+    fn parse_outer_fragments_test() {
+        assert_eq!(Config::parse("").unwrap().server.outer_fragments,
+                   FragmentPolicy::Ignore);
+        let config = Config::parse("[server]\nouter_fragments = \"drop\"").unwrap();
+        assert_eq!(config.server.outer_fragments, FragmentPolicy::Drop);
+        assert!(Config::parse("[server]\nouter_fragments = \"reassemble\"").is_err());
+    }
+
+    #[test]
+    fn parse_rate_limits_test() {
+        let config = Config::parse(r#"
+            [server.rate_limit]
+            download = 1000000
+
+            [server.rate_limits.laptop]
+            upload = 50000
+            download = 200000
+        "#)
+            .unwrap();
+        assert_eq!(config.server.rate_limit,
+                   RateLimit {
+                       upload: 0,
+                       download: 1000000,
+                   });
+        assert_eq!(config.server.rate_limits.get("laptop"),
+                   Some(&RateLimit {
+                       upload: 50000,
+                       download: 200000,
+                   }));
+    }
+
+    #[test]
+    fn parse_profiles_test() {
+        let config = Config::parse(r#"
+            [server.profiles.sensor]
+            min_cipher = "chacha20-poly1305"
+            compression = false
+
+            [server.profiles.laptop]
+        "#)
+            .unwrap();
+        assert_eq!(config.server.profiles.get("sensor"),
+                   Some(&Profile {
+                       min_cipher: Some(Cipher::Chacha20Poly1305),
+                       compression: false,
+                   }));
+        assert_eq!(config.server.profiles.get("laptop"), Some(&Profile::default()));
+        assert!(Config::parse("[server.profiles.sensor]\ncompression = \"no\"").is_err());
+    }
+
+    #[test]
+    fn parse_acl_test() {
+        let config = Config::parse(r#"
+            [server]
+            acl_default = "deny"
+
+            [[server.acl]]
+            action = "allow"
+            destination = "192.168.1.0/24"
+            protocol = "tcp"
+            port = 443
+        "#)
+            .unwrap();
+        assert_eq!(config.server.acl.len(), 1);
+        assert_eq!(config.server.acl_default, acl::Action::Deny);
+        assert!(Config::parse("[[server.acl]]\naction = \"deny\"\nsource = \"10.0.0.0/40\"")
+            .is_err());
+    }
+
+    #[test]
+    fn parse_uplinks_test() {
+        let config = Config::parse(r#"
+            [server]
+            uplink_policy = "failover"
+
+            [[server.uplinks]]
+            interface = "eth0"
+            gateway = "192.0.2.1"
+
+            [[server.uplinks]]
+            interface = "wwan0"
+            gateway = "198.51.100.1"
+        "#)
+            .unwrap();
+        assert_eq!(config.server.uplinks.len(), 2);
+        assert_eq!(config.server.uplinks[1].interface, "wwan0");
+        assert_eq!(config.server.uplink_policy, uplink::Policy::Failover);
+        assert_eq!(Config::parse("").unwrap().server.uplink_policy,
+                   uplink::Policy::FlowHash);
+        assert!(Config::parse("[server]\nuplink_policy = \"random\"").is_err());
+    }
+
+    #[test]
+    fn parse_tunnel_ports_test() {
+        let config = Config::parse("[client]\ntunnel_ports = [443, 22]").unwrap();
+        assert_eq!(config.client.tunnel_ports, vec![443, 22]);
+        assert!(Config::parse("[client]\ntunnel_ports = [0]").is_err());
+        assert!(Config::parse("[client]\ntunnel_ports = [70000]").is_err());
+    }
+
+    #[test]
+    fn parse_socks_proxy_test() {
+        assert_eq!(Config::parse("").unwrap().client.socks_proxy, None);
+        let config = Config::parse("[client]\nsocks_proxy = \"127.0.0.1:1080\"").unwrap();
+        assert_eq!(config.client.socks_proxy, Some("127.0.0.1:1080".parse().unwrap()));
+        assert!(Config::parse("[client]\nsocks_proxy = \"localhost\"").is_err());
+        assert!(Config::parse("[client]\nsocks_proxy = \"0.0.0.0:1080\"").is_err());
+        assert_eq!(config.client.socks_resolver, Ipv4Addr::new(8, 8, 8, 8));
+    }
+
+    #[test]
+    fn parse_keepalive_test() {
+        let config = Config::parse("").unwrap();
+        assert_eq!(config.client.keepalive_interval_secs, 0);
+        assert!(!config.server.follow_rebinds);
+        let config = Config::parse("[server]\nfollow_rebinds = true\n\
+                                    [client]\nkeepalive_interval_secs = 25")
+            .unwrap();
+        assert_eq!(config.client.keepalive_interval_secs, 25);
+        assert!(config.server.follow_rebinds);
+    }
+
+    #[test]
+    fn parse_queue_latency_target_test() {
+        assert_eq!(Config::parse("").unwrap().server.queue_latency_target_ms, 0);
+        let config = Config::parse("[server]\nfair_queuing = true\nqueue_latency_target_ms = 5")
+            .unwrap();
+        assert_eq!(config.server.queue_latency_target_ms, 5);
+        assert!(Config::parse("[server]\nqueue_latency_target_ms = 5").is_err());
+    }
+
+    #[test]
+    fn parse_state_key_file_test() {
+        assert_eq!(Config::parse("").unwrap().server.state_key_file, None);
+        let config = Config::parse("[server]\nstate_key_file = \"/etc/kytan/state.key\"").unwrap();
+        assert_eq!(config.server.state_key_file, Some(String::from("/etc/kytan/state.key")));
+    }
+
+    #[test]
+    fn parse_bridged_subnets_test() {
+        let config = Config::parse(r#"
+            [server.bridged_subnets]
+            office = ["192.168.50.0/24"]
+
+            [client]
+            bridged_subnets = ["192.168.50.0/24"]
+            bridge_interface = "eth1"
+        "#)
+            .unwrap();
+        assert_eq!(config.server.bridged_subnets.get("office"),
+                   Some(&vec![String::from("192.168.50.0/24")]));
+        assert_eq!(config.client.bridged_subnets, vec![String::from("192.168.50.0/24")]);
+        assert_eq!(config.client.bridge_interface, Some(String::from("eth1")));
+        assert!(Config::parse("[client]\nbridged_subnets = [\"192.168.50.0\"]").is_err());
+        assert!(Config::parse("[server.bridged_subnets]\noffice = [\"lan\"]").is_err());
+        assert!(Config::parse("[client]\nhandshake_port = 443\n\
+                               bridged_subnets = [\"192.168.50.0/24\"]")
+            .is_err());
+    }
+
+    #[test]
+    fn parse_dns_rules_test() {
+        let config = Config::parse(r#"
+            [[server.dns_rules]]
+            domain = "ads.example.com"
+            action = "block"
+
+            [[server.dns_rules]]
+            domain = "portal.example"
+            action = "sinkhole"
+            address = "10.10.10.1"
+        "#)
+            .unwrap();
+        assert_eq!(config.server.dns_rules.len(), 2);
+        assert_eq!(config.server.dns_rules[1].action, dns::Action::Sinkhole);
+        assert!(Config::parse("[[server.dns_rules]]\ndomain = \"a.example\"\naction = \"sinkhole\"")
+            .is_err());
+    }
+
+    #[test]
+    fn unreloaded_test() {
+        let settings = |contents: &str| {
+            let config: toml::Value = toml::from_str(contents).unwrap();
+            config.get("server").cloned().unwrap()
+        };
+        let old = settings("[server]\nmtu = 1400\nacl_default = \"deny\"\nudp_gso = true");
+        let new = settings("[server]\nmtu = 1280\nacl_default = \"allow\"\n\
+                            tcp_handshake_port = 443\n\
+                            [server.psks]\nlaptop = \"key\"");
+        assert_eq!(unreloaded(&old, &new), vec!["mtu", "tcp_handshake_port", "udp_gso"]);
+        assert!(unreloaded(&old, &old).is_empty());
+    }
+
+    #[test]
+    fn parse_invalid_test() {
+        assert!(Config::parse("[server.reservations]\nlaptop = \"not an ip\"").is_err());
+        assert!(Config::parse("[server]\nmtu = 100").is_err());
+        assert!(Config::parse("[server.mtus]\nlaptop = 9000").is_err());
+        assert!(Config::parse("[server]\nhandshake_rate = 0.0").is_err());
+        assert!(Config::parse("[client]\ntun_owner = 4294967295").is_err());
+        assert!(Config::parse("[client]\ntun_group = -1").is_err());
+        assert!(Config::parse("[control]\nexemplar_rate = 1.5").is_err());
+        assert!(Config::parse("[client]\nnat64_prefix = \"64:ff9b::1\"").is_err());
+        assert!(Config::parse("[client]\nnat64_prefix = \"64:ff9b::\"").is_ok());
+    }
+}
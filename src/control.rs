@@ -0,0 +1,232 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::fs::{self, Permissions};
+use std::io::{BufRead, BufReader, Write};
+use std::net::SocketAddr;
+use std::os::unix::fs::{FileTypeExt, PermissionsExt};
+use std::os::unix::net::{UnixListener, UnixStream};
+use std::sync::Arc;
+use std::thread;
+use std::time::Duration;
+use metrics::PrometheusSink;
+use network;
+
+const WORLD_WRITABLE: u32 = 0o002;
+
+// Parses the octal permissions of the control socket, refusing any that would
+// let every local user in.
+pub fn parse_mode(mode: &str) -> Result<u32, String> {
+    let bits = try!(u32::from_str_radix(mode, 8)
+        .map_err(|_| format!("Invalid socket mode {}; expected octal, e.g. 0600.", mode)));
+    if bits > 0o777 {
+        return Err(format!("Invalid socket mode {}.", mode));
+    }
+    if bits & WORLD_WRITABLE != 0 {
+        return Err(format!("Refusing a world-writable control socket (mode {}).", mode));
+    }
+    Ok(bits)
+}
+
+// Serves metrics and control commands on a unix socket, so only users the
+// filesystem lets in can reach them. It is never bound to TCP.
+pub struct ControlEndpoint {
+    listener: UnixListener,
+    path: String,
+}
+
+impl ControlEndpoint {
+    pub fn bind(path: &str, mode: &str) -> Result<ControlEndpoint, String> {
+        if path.parse::<SocketAddr>().is_ok() {
+            return Err(format!("Control endpoint {} is a TCP address; only unix sockets are \
+                                supported.",
+                               path));
+        }
+        let mode = try!(parse_mode(mode));
+        // A socket left behind by an earlier run is replaced; anything else
+        // at the path is not ours to remove.
+        if let Ok(metadata) = fs::symlink_metadata(path) {
+            if !metadata.file_type().is_socket() {
+                return Err(format!("{} exists and is not a socket.", path));
+            }
+            try!(fs::remove_file(path).map_err(|e| format!("{}: {}", path, e)));
+        }
+        let listener = try!(UnixListener::bind(path).map_err(|e| format!("{}: {}", path, e)));
+        try!(fs::set_permissions(path, Permissions::from_mode(mode))
+            .map_err(|e| format!("{}: {}", path, e)));
+        // Checked on the socket itself, in case the mode did not take.
+        let actual = try!(fs::metadata(path).map_err(|e| format!("{}: {}", path, e)))
+            .permissions()
+            .mode();
+        if actual & WORLD_WRITABLE != 0 {
+            let _ = fs::remove_file(path);
+            return Err(format!("Refusing to serve on {}: it is world-writable.", path));
+        }
+        Ok(ControlEndpoint {
+            listener: listener,
+            path: String::from(path),
+        })
+    }
+
+    pub fn path(&self) -> &str {
+        &self.path
+    }
+
+    // Answers one command per connection, from another thread.
+    pub fn serve(self, metrics: Arc<PrometheusSink>) -> thread::JoinHandle<()> {
+        info!("Control endpoint listening on {}.", self.path);
+        thread::spawn(move || {
+            for stream in self.listener.incoming() {
+                match stream {
+                    Ok(stream) => {
+                        if let Err(e) = handle(stream, &metrics) {
+                            debug!("Control connection failed: {}", e);
+                        }
+                    }
+                    Err(e) => warn!("Control endpoint {}: {}", self.path, e),
+                }
+            }
+        })
+    }
+}
+
+fn handle(stream: UnixStream, metrics: &PrometheusSink) -> Result<(), String> {
+    try!(stream.set_read_timeout(Some(Duration::from_secs(5))).map_err(|e| e.to_string()));
+    let mut command = String::new();
+    try!(BufReader::new(&stream).read_line(&mut command).map_err(|e| e.to_string()));
+    let mut stream = stream;
+    stream.write_all(respond(&command, metrics).as_bytes()).map_err(|e| e.to_string())
+}
+
+// The reply to a command: "metrics" renders all metrics, "openmetrics" does so
+// in the OpenMetrics format with exemplars, "mtu" shows the client's tunnel
+// MTU and "mtu <bytes>" changes it. On a server, "quiesce <id>", "resume
+// <id>" and "hand-off <id>" migrate a session.
+pub fn respond(command: &str, metrics: &PrometheusSink) -> String {
+    let words: Vec<&str> = command.split_whitespace().collect();
+    match (words.get(0).cloned(), words.get(1)) {
+        (Some("metrics"), None) => metrics.render(),
+        (Some("openmetrics"), None) => metrics.render_openmetrics(),
+        (Some("mtu"), None) => {
+            match network::mtu() {
+                Some(mtu) => format!("{}\n", mtu),
+                None => String::from("Not connected.\n"),
+            }
+        }
+        (Some("mtu"), Some(mtu)) if words.len() == 2 => {
+            match mtu.parse().map_err(|_| format!("Invalid MTU {}.", mtu))
+                .and_then(network::set_mtu) {
+                Ok(_) => String::from("OK\n"),
+                Err(e) => format!("{}\n", e),
+            }
+        }
+        (Some(op), Some(id)) if words.len() == 2 && session_op(op).is_some() => {
+            match id.parse().map_err(|_| format!("Invalid session id {}.", id))
+                .and_then(|id| network::request_session_op(session_op(op).unwrap(), id)) {
+                Ok(_) => String::from("OK\n"),
+                Err(e) => format!("{}\n", e),
+            }
+        }
+        _ => format!("Unknown command: {}\n", command.trim()),
+    }
+}
+
+fn session_op(command: &str) -> Option<network::SessionOp> {
+    match command {
+        "quiesce" => Some(network::SessionOp::Quiesce),
+        "resume" => Some(network::SessionOp::Resume),
+        "hand-off" => Some(network::SessionOp::HandOff),
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::env;
+    use std::fs;
+    use std::io::{Read, Write};
+    use std::os::unix::fs::PermissionsExt;
+    use std::os::unix::net::UnixStream;
+    use std::sync::Arc;
+    use rand;
+    use metrics::{MetricsSink, PrometheusSink};
+    use network;
+    use control::*;
+
+    fn socket_path() -> String {
+        let path = env::temp_dir().join(format!("kytan-control-{}.sock", rand::random::<u32>()));
+        String::from(path.to_str().unwrap())
+    }
+
+    #[test]
+    fn control_test() {
+        let path = socket_path();
+        let endpoint = ControlEndpoint::bind(&path, "0600").unwrap();
+        assert_eq!(fs::metadata(&path).unwrap().permissions().mode() & 0o777, 0o600);
+
+        let metrics = Arc::new(PrometheusSink::new());
+        metrics.counter("kytan_rx_packets_total", 3);
+        endpoint.serve(metrics.clone());
+
+        let mut stream = UnixStream::connect(&path).unwrap();
+        stream.write_all(b"metrics\n").unwrap();
+        let mut reply = String::new();
+        stream.read_to_string(&mut reply).unwrap();
+        assert_eq!(reply, metrics.render());
+
+        let mut stream = UnixStream::connect(&path).unwrap();
+        stream.write_all(b"reboot\n").unwrap();
+        let mut reply = String::new();
+        stream.read_to_string(&mut reply).unwrap();
+        assert_eq!(reply, "Unknown command: reboot\n");
+
+        // A second endpoint replaces the stale socket.
+        ControlEndpoint::bind(&path, "0660").unwrap();
+        fs::remove_file(&path).unwrap();
+    }
+
+    #[test]
+    fn refuse_test() {
+        // Never bound to TCP, whatever the address.
+        assert!(ControlEndpoint::bind("127.0.0.1:9100", "0600").is_err());
+        assert!(ControlEndpoint::bind("[::1]:9100", "0600").is_err());
+
+        let path = socket_path();
+        assert!(ControlEndpoint::bind(&path, "0666").is_err());
+        assert!(ControlEndpoint::bind(&path, "0602").is_err());
+        assert!(fs::metadata(&path).is_err());
+
+        fs::File::create(&path).unwrap();
+        assert!(ControlEndpoint::bind(&path, "0600").is_err());
+        fs::remove_file(&path).unwrap();
+
+        assert_eq!(parse_mode("660"), Ok(0o660));
+        assert!(parse_mode("rw-------").is_err());
+        assert!(parse_mode("1777").is_err());
+    }
+
+    #[test]
+    fn respond_test() {
+        let metrics = PrometheusSink::new();
+        assert_eq!(respond("openmetrics\n", &metrics), "# EOF\n");
+        assert_eq!(respond("mtu\n", &metrics), "Not connected.\n");
+        assert_eq!(respond("mtu 10\n", &metrics),
+                   format!("{}\n", network::set_mtu(10).unwrap_err()));
+        assert_eq!(respond("mtu big\n", &metrics), "Invalid MTU big.\n");
+        assert_eq!(respond("quiesce two\n", &metrics), "Invalid session id two.\n");
+        assert_eq!(respond("resume\n", &metrics), "Unknown command: resume\n");
+        assert_eq!(respond("\n", &metrics), "Unknown command: \n");
+    }
+}
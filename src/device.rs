@@ -17,7 +17,25 @@ use libc::*;
 use std::os::unix::io::{RawFd, AsRawFd};
 use std::io::{Write, Read};
 
-const MTU: &'static str = "1380";
+pub const DEFAULT_MTU: u16 = 1380;
+pub const MIN_MTU: u16 = 576;
+pub const MAX_MTU: u16 = 1500;
+
+// (uid_t)-1 and (gid_t)-1 mean "no owner" to the kernel, so they cannot be
+// configured.
+pub fn check_owner(uid: Option<u32>, gid: Option<u32>) -> Result<(), String> {
+    if uid == Some(u32::max_value()) || gid == Some(u32::max_value()) {
+        return Err(format!("Invalid TUN owner {:?} or group {:?}.", uid, gid));
+    }
+    Ok(())
+}
+
+pub fn check_mtu(mtu: u16) -> Result<(), String> {
+    if mtu < MIN_MTU || mtu > MAX_MTU {
+        return Err(format!("MTU {} is outside {}-{}.", mtu, MIN_MTU, MAX_MTU));
+    }
+    Ok(())
+}
 
 #[cfg(target_os = "linux")]
 use std::path;
@@ -29,6 +47,12 @@ const IFF_TUN: c_short = 0x0001;
 const IFF_NO_PI: c_short = 0x1000;
 #[cfg(target_os = "linux")]
 const TUNSETIFF: c_ulong = 0x400454ca; // TODO: use _IOW('T', 202, int)
+#[cfg(target_os = "linux")]
+const SIOCGIFMTU: c_ulong = 0x8921;
+#[cfg(target_os = "linux")]
+const TUNSETOWNER: c_ulong = 0x400454cc; // TODO: use _IOW('T', 204, int)
+#[cfg(target_os = "linux")]
+const TUNSETGROUP: c_ulong = 0x400454ce; // TODO: use _IOW('T', 206, int)
 
 #[cfg(target_os = "macos")]
 use std::mem;
@@ -48,6 +72,8 @@ const UTUN_OPT_IFNAME: c_int = 2;
 const CTLIOCGINFO: c_ulong = 0xc0644e03; // TODO: use _IOWR('N', 3, struct ctl_info)
 #[cfg(target_os = "macos")]
 const UTUN_CONTROL_NAME: &'static str = "com.apple.net.utun_control";
+#[cfg(target_os = "macos")]
+const SIOCGIFMTU: c_ulong = 0xc0206933; // TODO: use _IOWR('i', 51, struct ifreq)
 
 #[cfg(target_os = "linux")]
 #[repr(C)]
@@ -56,6 +82,14 @@ pub struct ioctl_flags_data {
     pub ifr_flags: c_short,
 }
 
+// struct ifreq as used by SIOCGIFMTU, padded to the largest union member.
+#[repr(C)]
+pub struct ioctl_mtu_data {
+    pub ifr_name: [u8; 16],
+    pub ifr_mtu: c_int,
+    pub ifr_pad: [u8; 20],
+}
+
 #[cfg(target_os = "macos")]
 #[repr(C)]
 pub struct ctl_info {
@@ -74,6 +108,27 @@ pub struct sockaddr_ctl {
     pub sc_reserved: [u32; 5],
 }
 
+// What reads and writes fail with once the device was removed out from under
+// us, e.g. with `ip link del`: Linux detaches the file from it.
+#[cfg(target_os = "linux")]
+const VANISHED: [c_int; 2] = [EBADFD, ENODEV];
+#[cfg(target_os = "macos")]
+const VANISHED: [c_int; 2] = [ENXIO, ENODEV];
+
+// Whether a failed read or write means the device is gone for good, and has
+// to be recreated to carry packets again.
+pub fn is_vanished(e: &io::Error) -> bool {
+    e.raw_os_error().map_or(false, |errno| VANISHED.contains(&errno))
+}
+
+// Reads and writes whole IP packets. Implemented by the TUN device, and by
+// tunnel::Tunnel for programs that want to send packets through the VPN
+// without one.
+pub trait PacketIO {
+    fn read_packet(&mut self, buf: &mut [u8]) -> io::Result<usize>;
+    fn write_packet(&mut self, packet: &[u8]) -> io::Result<()>;
+}
+
 pub struct Tun {
     handle: fs::File,
     if_name: String,
@@ -197,47 +252,135 @@ impl Tun {
         &self.if_name
     }
 
-    pub fn up(&self, self_id: u8) {
-        let mut status = if cfg!(target_os = "linux") {
-            process::Command::new("ifconfig")
-                .arg(self.if_name.clone())
-                .arg(format!("10.10.10.{}/24", self_id))
-                .status()
-                .unwrap()
+    // Creates a device of the same name again, e.g. after this one vanished,
+    // so firewall rules and scripts referring to it keep working. It still
+    // has to be brought up.
+    pub fn recreate(&self) -> Result<Tun, io::Error> {
+        let digits = self.if_name.trim_left_matches(|c: char| !c.is_digit(10));
+        let name = try!(digits.parse()
+            .map_err(|_| io::Error::new(io::ErrorKind::InvalidInput, self.if_name.clone())));
+        Tun::create(name)
+    }
+
+    pub fn up(&self, self_id: u8, mtu: u16) {
+        self.up_link(self_id, 24, 1, mtu)
+    }
+
+    // Brings the device up as 10.10.10.<self_id>/<prefix_len>, with
+    // 10.10.10.<peer_id> at the other end of the link.
+    pub fn up_link(&self, self_id: u8, prefix_len: u8, peer_id: u8, mtu: u16) {
+        self.configure(self_id, prefix_len, peer_id, mtu).unwrap()
+    }
+
+    // Like `up_link`, but returns an error instead of panicking, e.g. when
+    // bringing up a recreated device.
+    pub fn configure(&self,
+                     self_id: u8,
+                     prefix_len: u8,
+                     peer_id: u8,
+                     mtu: u16)
+                     -> Result<(), String> {
+        let address = if cfg!(target_os = "linux") {
+            vec![format!("10.10.10.{}/{}", self_id, prefix_len)]
         } else if cfg!(target_os = "macos") {
-            process::Command::new("ifconfig")
-                .arg(self.if_name.clone())
-                .arg(format!("10.10.10.{}", self_id))
-                .arg("10.10.10.1")
-                .status()
-                .unwrap()
+            vec![format!("10.10.10.{}", self_id), format!("10.10.10.{}", peer_id)]
         } else {
             unimplemented!()
         };
+        try!(self.ifconfig(&address));
+        self.ifconfig(&[String::from("mtu"), mtu.to_string(), String::from("up")])
+    }
 
-        assert!(status.success());
+    fn ifconfig(&self, args: &[String]) -> Result<(), String> {
+        let status = try!(process::Command::new("ifconfig")
+            .arg(self.if_name.clone())
+            .args(args)
+            .status()
+            .map_err(|e| e.to_string()));
+        if status.success() {
+            Ok(())
+        } else {
+            Err(format!("Unable to configure {}: ifconfig {}.", self.if_name, args.join(" ")))
+        }
+    }
 
-        status = if cfg!(target_os = "linux") {
-            process::Command::new("ifconfig")
-                .arg(self.if_name.clone())
-                .arg("mtu")
-                .arg(MTU)
-                .arg("up")
-                .status()
-                .unwrap()
-        } else if cfg!(target_os = "macos") {
-            process::Command::new("ifconfig")
-                .arg(self.if_name.clone())
-                .arg("mtu")
-                .arg(MTU)
-                .arg("up")
-                .status()
-                .unwrap()
+    // Adds 10.10.10.<id> as another address of the device, e.g. the server's
+    // end of a point-to-point link. Only available in Linux.
+    pub fn add_address(&self, id: u8) -> Result<(), String> {
+        let status = try!(process::Command::new("ifconfig")
+            .arg(format!("{}:{}", self.if_name, id))
+            .arg(format!("10.10.10.{}/32", id))
+            .status()
+            .map_err(|e| e.to_string()));
+        if status.success() {
+            Ok(())
         } else {
-            unimplemented!()
+            Err(format!("Unable to add 10.10.10.{} to {}.", id, self.if_name))
+        }
+    }
+
+    // The MTU currently configured on the interface.
+    pub fn mtu(&self) -> io::Result<u16> {
+        let mut req = ioctl_mtu_data {
+            ifr_name: [0u8; 16],
+            ifr_mtu: 0,
+            ifr_pad: [0u8; 20],
         };
+        req.ifr_name[..self.if_name.len()].clone_from_slice(self.if_name.as_bytes());
+
+        let fd = unsafe { socket(AF_INET, SOCK_DGRAM, 0) };
+        if fd < 0 {
+            return Err(io::Error::last_os_error());
+        }
+        let res = unsafe { ioctl(fd, SIOCGIFMTU, &mut req) };
+        let err = io::Error::last_os_error();
+        unsafe { close(fd) };
+        if res < 0 {
+            return Err(err);
+        }
+        Ok(req.ifr_mtu as u16)
+    }
+
+    // Lets the given user and/or group use the device without privileges, so
+    // it can be handed to an unprivileged process.
+    #[cfg(target_os = "linux")]
+    pub fn set_owner(&self, uid: Option<u32>, gid: Option<u32>) -> Result<(), String> {
+        try!(check_owner(uid, gid));
+        for &(request, id) in &[(TUNSETOWNER, uid), (TUNSETGROUP, gid)] {
+            if let Some(id) = id {
+                let res = unsafe { ioctl(self.handle.as_raw_fd(), request, id as c_ulong) };
+                if res < 0 {
+                    return Err(format!("Failed to set owner of {}: {}",
+                                       self.if_name,
+                                       io::Error::last_os_error()));
+                }
+            }
+        }
+        Ok(())
+    }
+
+    #[cfg(target_os = "macos")]
+    pub fn set_owner(&self, uid: Option<u32>, gid: Option<u32>) -> Result<(), String> {
+        try!(check_owner(uid, gid));
+        if uid.is_some() || gid.is_some() {
+            return Err(String::from("TUN device ownership is only supported on Linux."));
+        }
+        Ok(())
+    }
 
-        assert!(status.success());
+    // Changes the MTU of a device that is already up.
+    pub fn set_mtu(&self, mtu: u16) -> Result<(), String> {
+        try!(check_mtu(mtu));
+        let status = try!(process::Command::new("ifconfig")
+            .arg(self.if_name.clone())
+            .arg("mtu")
+            .arg(mtu.to_string())
+            .status()
+            .map_err(|e| e.to_string()));
+        if !status.success() {
+            return Err(format!("Failed to set MTU of {} to {}.", self.if_name, mtu));
+        }
+        Ok(())
     }
 }
 
@@ -287,6 +430,16 @@ impl Write for Tun {
     }
 }
 
+impl PacketIO for Tun {
+    fn read_packet(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        self.read(buf)
+    }
+
+    fn write_packet(&mut self, packet: &[u8]) -> io::Result<()> {
+        self.write_all(packet)
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use std::process;
@@ -306,6 +459,65 @@ mod tests {
             .expect("failed to create tun device");
         assert!(output.status.success());
 
-        tun.up(1);
+        tun.up(1, DEFAULT_MTU);
+    }
+
+    #[test]
+    #[cfg(target_os = "linux")]
+    fn tun_mtu_test() {
+        use std::fs::File;
+        use std::io::Read;
+        assert!(utils::is_root());
+
+        for &(id, mtu) in &[(11, 1280), (12, 1400)] {
+            let tun = Tun::create(id).unwrap();
+            tun.up(1, mtu);
+            let mut sysfs_mtu = String::new();
+            File::open(format!("/sys/class/net/{}/mtu", tun.name()))
+                .unwrap()
+                .read_to_string(&mut sysfs_mtu)
+                .unwrap();
+            assert_eq!(sysfs_mtu.trim(), mtu.to_string());
+        }
+    }
+
+    #[test]
+    #[cfg(target_os = "linux")]
+    fn set_owner_test() {
+        use std::fs::File;
+        use std::io::Read;
+        assert!(utils::is_root());
+
+        let read = |name: &str, attr: &str| {
+            let mut value = String::new();
+            File::open(format!("/sys/class/net/{}/{}", name, attr))
+                .unwrap()
+                .read_to_string(&mut value)
+                .unwrap();
+            value.trim().to_string()
+        };
+        let tun = Tun::create(14).unwrap();
+        tun.set_owner(Some(1000), Some(2000)).unwrap();
+        assert_eq!(read(tun.name(), "owner"), "1000");
+        assert_eq!(read(tun.name(), "group"), "2000");
+
+        let tun = Tun::create(15).unwrap();
+        tun.set_owner(None, Some(3000)).unwrap();
+        assert_eq!(read(tun.name(), "owner"), "-1");
+        assert_eq!(read(tun.name(), "group"), "3000");
+        assert!(tun.set_owner(Some(u32::max_value()), None).is_err());
+    }
+
+    #[test]
+    fn set_mtu_test() {
+        assert!(utils::is_root());
+
+        let tun = Tun::create(13).unwrap();
+        tun.up(1, DEFAULT_MTU);
+        assert_eq!(tun.mtu().unwrap(), DEFAULT_MTU);
+        tun.set_mtu(1280).unwrap();
+        assert_eq!(tun.mtu().unwrap(), 1280);
+        assert!(tun.set_mtu(MAX_MTU + 1).is_err());
+        assert_eq!(tun.mtu().unwrap(), 1280);
     }
 }
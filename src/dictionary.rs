@@ -0,0 +1,243 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::collections::HashMap;
+use ring::digest;
+use utils;
+
+// Copies reach back at most 65535 bytes, so the dictionary plus a packet must
+// fit in that.
+pub const MAX_DICTIONARY_LEN: usize = 32 * 1024;
+const MIN_MATCH: usize = 4;
+const MAX_MATCH: usize = 0x7f + MIN_MATCH;
+const MAX_LITERAL: usize = 0x80;
+const MAX_DISTANCE: usize = 0xffff;
+// The first byte of everything compressed, so a later format can be told
+// from this one.
+pub const FORMAT_VERSION: u8 = 1;
+
+fn key(bytes: &[u8]) -> u32 {
+    (bytes[0] as u32) << 24 | (bytes[1] as u32) << 16 | (bytes[2] as u32) << 8 | bytes[3] as u32
+}
+
+// A preset dictionary shared by client and server. Snappy cannot be primed
+// with one, so packets compressed with it use a small LZ77 format of their
+// own, where copies may refer back into the dictionary. After the version
+// byte, FORMAT_VERSION, come
+//
+//   0xxxxxxx                 a literal run of x + 1 bytes, which follow
+//   1xxxxxxx dddddddd*2      a copy of x + 4 bytes starting d bytes back
+//
+// This pays off for small packets with predictable content (e.g. protocol
+// headers), which generic compression cannot shrink on their own.
+pub struct Dictionary {
+    bytes: Vec<u8>,
+    id: u64,
+    // Last position of every 4-byte sequence in the dictionary.
+    index: HashMap<u32, usize>,
+}
+
+impl Dictionary {
+    pub fn new(bytes: Vec<u8>) -> Result<Dictionary, String> {
+        if bytes.is_empty() || bytes.len() > MAX_DICTIONARY_LEN {
+            return Err(format!("Dictionary of {} bytes is not within 1-{} bytes.",
+                               bytes.len(),
+                               MAX_DICTIONARY_LEN));
+        }
+        let hash = digest::digest(&digest::SHA256, &bytes);
+        let id = hash.as_ref()[..8].iter().fold(0u64, |id, &b| id << 8 | b as u64);
+        let mut index = HashMap::new();
+        for i in 0..bytes.len().saturating_sub(MIN_MATCH - 1) {
+            index.insert(key(&bytes[i..]), i);
+        }
+        Ok(Dictionary {
+            bytes: bytes,
+            id: id,
+            index: index,
+        })
+    }
+
+    pub fn open(path: &str) -> Result<Dictionary, String> {
+        Dictionary::new(try!(utils::read_file(path)))
+            .map_err(|e| format!("{}: {}", path, e))
+    }
+
+    // Derived from the contents, so peers can tell whether they share one.
+    pub fn id(&self) -> u64 {
+        self.id
+    }
+
+    fn byte_at(&self, out: &[u8], position: usize) -> u8 {
+        if position < self.bytes.len() {
+            self.bytes[position]
+        } else {
+            out[position - self.bytes.len()]
+        }
+    }
+
+    pub fn compress(&self, packet: &[u8]) -> Vec<u8> {
+        let base = self.bytes.len();
+        let mut out = Vec::with_capacity(1 + packet.len() + packet.len() / MAX_LITERAL + 1);
+        out.push(FORMAT_VERSION);
+        // Positions of 4-byte sequences seen in this packet so far, which are
+        // preferred over the dictionary's as they are closer.
+        let mut recent: HashMap<u32, usize> = HashMap::new();
+        let mut literal_start = 0;
+        let mut i = 0;
+        while i + MIN_MATCH <= packet.len() {
+            let k = key(&packet[i..]);
+            let current = base + i;
+            let found = recent.get(&k).or_else(|| self.index.get(&k)).cloned();
+            recent.insert(k, current);
+            let start = match found {
+                Some(start) if current - start <= MAX_DISTANCE => start,
+                _ => {
+                    i += 1;
+                    continue;
+                }
+            };
+            let mut len = 0;
+            while len < MAX_MATCH && i + len < packet.len() &&
+                  self.byte_at(packet, start + len) == packet[i + len] {
+                len += 1;
+            }
+            if len < MIN_MATCH {
+                i += 1;
+                continue;
+            }
+            push_literals(&mut out, &packet[literal_start..i]);
+            let distance = current - start;
+            out.push(0x80 | (len - MIN_MATCH) as u8);
+            out.push((distance >> 8) as u8);
+            out.push(distance as u8);
+            i += len;
+            literal_start = i;
+        }
+        push_literals(&mut out, &packet[literal_start..]);
+        out
+    }
+
+    pub fn decompress(&self, data: &[u8]) -> Result<Vec<u8>, String> {
+        let base = self.bytes.len();
+        match data.first() {
+            Some(&FORMAT_VERSION) => {}
+            Some(&version) => return Err(format!("Unknown dictionary format version {}", version)),
+            None => return Err(String::from("Missing dictionary format version")),
+        }
+        let mut out = Vec::with_capacity(data.len() * 2);
+        let mut i = 1;
+        while i < data.len() {
+            let tag = data[i] as usize;
+            if tag < 0x80 {
+                let end = i + 1 + tag + 1;
+                if end > data.len() {
+                    return Err(String::from("Truncated literal"));
+                }
+                out.extend_from_slice(&data[i + 1..end]);
+                i = end;
+            } else {
+                if i + 3 > data.len() {
+                    return Err(String::from("Truncated copy"));
+                }
+                let len = (tag & 0x7f) + MIN_MATCH;
+                let distance = (data[i + 1] as usize) << 8 | data[i + 2] as usize;
+                let current = base + out.len();
+                if distance == 0 || distance > current {
+                    return Err(format!("Copy from {} bytes back is out of range", distance));
+                }
+                // Byte by byte, as a copy may overlap what it produces.
+                for position in current - distance..current - distance + len {
+                    let b = self.byte_at(&out, position);
+                    out.push(b);
+                }
+                i += 3;
+            }
+        }
+        Ok(out)
+    }
+}
+
+fn push_literals(out: &mut Vec<u8>, literals: &[u8]) {
+    for chunk in literals.chunks(MAX_LITERAL) {
+        out.push((chunk.len() - 1) as u8);
+        out.extend_from_slice(chunk);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use snap;
+    use dictionary::*;
+
+    fn request(path: &str) -> Vec<u8> {
+        let mut packet = vec![0x45, 0, 0, 0, 0, 0, 0x40, 0, 0x40, 6];
+        packet.extend_from_slice(&[0, 0, 10, 10, 10, 2, 1, 2, 3, 4]);
+        packet.extend_from_slice(format!("GET {} HTTP/1.1\r\nHost: api.example.com\r\n\
+                                          Accept: application/json\r\n\
+                                          Connection: keep-alive\r\n\r\n",
+                                         path)
+            .as_bytes());
+        packet
+    }
+
+    #[test]
+    fn round_trip_test() {
+        let dictionary = Dictionary::new(request("/v1/status")).unwrap();
+        let mut packets = vec![Vec::new(), vec![0x45], request("/v1/users/42"), vec![7u8; 1400]];
+        packets.push((0..1400).map(|i| (i * 7919 % 251) as u8).collect());
+        for packet in &packets {
+            let compressed = dictionary.compress(packet);
+            assert_eq!(dictionary.decompress(&compressed).unwrap(), *packet);
+        }
+        assert!(dictionary.decompress(&[FORMAT_VERSION, 0x05, 1, 2]).is_err());
+        assert!(dictionary.decompress(&[FORMAT_VERSION, 0x80, 0xff, 0xff]).is_err());
+        assert!(dictionary.decompress(&[FORMAT_VERSION, 0x80, 0]).is_err());
+    }
+
+    #[test]
+    fn version_test() {
+        let dictionary = Dictionary::new(request("/v1/status")).unwrap();
+        let compressed = dictionary.compress(b"hello");
+        assert_eq!(compressed[0], FORMAT_VERSION);
+        assert_eq!(dictionary.decompress(&compressed).unwrap(), b"hello");
+        let mut later = compressed.clone();
+        later[0] = FORMAT_VERSION + 1;
+        assert_eq!(dictionary.decompress(&later),
+                   Err(format!("Unknown dictionary format version {}", FORMAT_VERSION + 1)));
+        assert!(dictionary.decompress(&[]).is_err());
+        assert_eq!(dictionary.compress(&[]), vec![FORMAT_VERSION]);
+    }
+
+    #[test]
+    fn ratio_test() {
+        let dictionary = Dictionary::new(request("/v1/status")).unwrap();
+        let packet = request("/v1/users/42");
+        let with_dictionary = dictionary.compress(&packet).len();
+        let without = snap::Encoder::new().compress_vec(&packet).unwrap().len();
+        assert!(with_dictionary * 3 < without,
+                "{} bytes with the dictionary, {} without",
+                with_dictionary,
+                without);
+    }
+
+    #[test]
+    fn id_test() {
+        let a = Dictionary::new(b"Host: ".to_vec()).unwrap();
+        assert_eq!(a.id(), Dictionary::new(b"Host: ".to_vec()).unwrap().id());
+        assert!(a.id() != Dictionary::new(b"Host:".to_vec()).unwrap().id());
+        assert!(Dictionary::new(Vec::new()).is_err());
+        assert!(Dictionary::new(vec![0; MAX_DICTIONARY_LEN + 1]).is_err());
+    }
+}
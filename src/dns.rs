@@ -0,0 +1,401 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::net::Ipv4Addr;
+use packet;
+
+const DNS_PORT: u16 = 53;
+const HEADER_LEN: usize = 12;
+const TYPE_A: u16 = 1;
+const TYPE_ANY: u16 = 255;
+const CLASS_IN: u16 = 1;
+const RCODE_NXDOMAIN: u8 = 3;
+// How long resolvers may cache our answers, in seconds.
+const ANSWER_TTL: u32 = 60;
+
+#[derive(Deserialize, Clone, Copy, Debug, PartialEq)]
+#[serde(rename_all = "lowercase")]
+pub enum Action {
+    // Answer that the name does not exist.
+    Block,
+    // Answer with `address` instead, e.g. a captive portal.
+    Sinkhole,
+}
+
+// A rule as written in the configuration file. It catches `domain` and every
+// name below it.
+#[derive(Deserialize, Clone, Debug)]
+pub struct RuleConfig {
+    pub domain: String,
+    pub action: Action,
+    pub address: Option<Ipv4Addr>,
+}
+
+struct Rule {
+    domain: String,
+    // None blocks the name.
+    address: Option<Ipv4Addr>,
+}
+
+impl Rule {
+    fn matches(&self, name: &str) -> bool {
+        name == self.domain ||
+        (name.ends_with(&self.domain) && name[..name.len() - self.domain.len()].ends_with('.'))
+    }
+}
+
+struct Query<'a> {
+    id: [u8; 2],
+    recursion_desired: bool,
+    // Lowercase, without the trailing dot.
+    name: String,
+    qtype: u16,
+    // The question as sent, to be echoed in the answer.
+    question: &'a [u8],
+}
+
+fn be16(buf: &[u8]) -> u16 {
+    ((buf[0] as u16) << 8) | buf[1] as u16
+}
+
+// Parses a standard query with a single question. Anything else, including
+// names using compression, which queries have no need for, is left alone.
+fn parse_query(payload: &[u8]) -> Option<Query> {
+    if payload.len() < HEADER_LEN {
+        return None;
+    }
+    let is_query = payload[2] & 0x80 == 0;
+    let opcode = (payload[2] >> 3) & 0xf;
+    if !is_query || opcode != 0 || be16(&payload[4..6]) != 1 {
+        return None;
+    }
+    let mut labels = Vec::new();
+    let mut i = HEADER_LEN;
+    loop {
+        let len = match payload.get(i) {
+            Some(&len) => len as usize,
+            None => return None,
+        };
+        i += 1;
+        if len == 0 {
+            break;
+        }
+        if len > 63 || i + len > payload.len() {
+            return None;
+        }
+        labels.push(String::from_utf8_lossy(&payload[i..i + len]).to_lowercase());
+        i += len;
+    }
+    if i + 4 > payload.len() || be16(&payload[i + 2..i + 4]) != CLASS_IN {
+        return None;
+    }
+    Some(Query {
+        id: [payload[0], payload[1]],
+        recursion_desired: payload[2] & 0x01 != 0,
+        name: labels.join("."),
+        qtype: be16(&payload[i..i + 2]),
+        question: &payload[HEADER_LEN..i + 4],
+    })
+}
+
+fn answer(query: &Query, address: Option<Ipv4Addr>) -> Vec<u8> {
+    let rd = if query.recursion_desired { 0x01 } else { 0 };
+    // Sinkholed names exist, but only have an A record.
+    let (rcode, answers) = match address {
+        None => (RCODE_NXDOMAIN, 0),
+        Some(_) if query.qtype == TYPE_A || query.qtype == TYPE_ANY => (0, 1),
+        Some(_) => (0, 0),
+    };
+    let mut reply = vec![query.id[0], query.id[1], 0x80 | rd, 0x80 | rcode, 0, 1, 0, answers, 0,
+                         0, 0, 0];
+    reply.extend_from_slice(query.question);
+    if let (Some(address), 1) = (address, answers) {
+        // The name is a pointer to the question's.
+        reply.extend_from_slice(&[0xc0, HEADER_LEN as u8, 0, TYPE_A as u8, 0, CLASS_IN as u8]);
+        reply.extend_from_slice(&[(ANSWER_TTL >> 24) as u8,
+                                  (ANSWER_TTL >> 16) as u8,
+                                  (ANSWER_TTL >> 8) as u8,
+                                  ANSWER_TTL as u8,
+                                  0,
+                                  4]);
+        reply.extend_from_slice(&address.octets());
+    }
+    reply
+}
+
+// A recursive query for the A records of `name`, or None if it is not a
+// valid name.
+pub fn encode_query(id: u16, name: &str) -> Option<Vec<u8>> {
+    let name = name.trim_right_matches('.');
+    if name.is_empty() || name.len() > 253 {
+        return None;
+    }
+    let mut query = vec![(id >> 8) as u8, id as u8, 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0];
+    for label in name.split('.') {
+        if label.is_empty() || label.len() > 63 {
+            return None;
+        }
+        query.push(label.len() as u8);
+        query.extend_from_slice(label.as_bytes());
+    }
+    query.extend_from_slice(&[0, 0, TYPE_A as u8, 0, CLASS_IN as u8]);
+    Some(query)
+}
+
+// Where the name starting at `i` ends, following it up to a pointer if it is
+// compressed.
+fn skip_name(payload: &[u8], mut i: usize) -> Option<usize> {
+    loop {
+        let len = match payload.get(i) {
+            Some(&len) => len as usize,
+            None => return None,
+        };
+        if len & 0xc0 == 0xc0 {
+            return if i + 2 <= payload.len() { Some(i + 2) } else { None };
+        }
+        if len > 63 {
+            return None;
+        }
+        i += 1 + len;
+        if len == 0 {
+            return Some(i);
+        }
+    }
+}
+
+// Reads a response into its ID and the addresses of its A records, none if
+// the name does not exist. Names are not checked against the question.
+pub fn parse_answer(payload: &[u8]) -> Option<(u16, Vec<Ipv4Addr>)> {
+    if payload.len() < HEADER_LEN || payload[2] & 0x80 == 0 {
+        return None;
+    }
+    let id = be16(&payload[0..2]);
+    let mut addresses = Vec::new();
+    if payload[3] & 0xf != 0 {
+        return Some((id, addresses));
+    }
+    let mut i = HEADER_LEN;
+    for _ in 0..be16(&payload[4..6]) {
+        i = match skip_name(payload, i) {
+            Some(end) => end + 4,
+            None => return None,
+        };
+    }
+    for _ in 0..be16(&payload[6..8]) {
+        i = match skip_name(payload, i) {
+            Some(end) => end,
+            None => return None,
+        };
+        if i + 10 > payload.len() {
+            return None;
+        }
+        let rtype = be16(&payload[i..i + 2]);
+        let class = be16(&payload[i + 2..i + 4]);
+        let len = be16(&payload[i + 8..i + 10]) as usize;
+        i += 10;
+        if i + len > payload.len() {
+            return None;
+        }
+        if rtype == TYPE_A && class == CLASS_IN && len == 4 {
+            addresses.push(Ipv4Addr::new(payload[i], payload[i + 1], payload[i + 2],
+                                         payload[i + 3]));
+        }
+        i += len;
+    }
+    Some((id, addresses))
+}
+
+// Answers DNS queries from clients on the server for names caught by a rule:
+// blocked names do not exist, sinkholed ones resolve to an address of our
+// choosing. All other queries pass through untouched.
+pub struct DnsFilter {
+    rules: Vec<Rule>,
+}
+
+impl DnsFilter {
+    pub fn new(rules: &[RuleConfig]) -> Result<DnsFilter, String> {
+        let mut compiled = Vec::with_capacity(rules.len());
+        for rule in rules {
+            let domain = rule.domain.trim_right_matches('.').to_lowercase();
+            if domain.is_empty() {
+                return Err(String::from("DNS rules need a domain."));
+            }
+            let address = match (rule.action, rule.address) {
+                (Action::Block, None) => None,
+                (Action::Sinkhole, Some(address)) => Some(address),
+                (Action::Block, Some(_)) => {
+                    return Err(format!("Blocking DNS rule for {} cannot have an address.",
+                                       rule.domain))
+                }
+                (Action::Sinkhole, None) => {
+                    return Err(format!("Sinkhole DNS rule for {} needs an address.", rule.domain))
+                }
+            };
+            compiled.push(Rule {
+                domain: domain,
+                address: address,
+            });
+        }
+        Ok(DnsFilter { rules: compiled })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.rules.is_empty()
+    }
+
+    // The answer to send back in place of forwarding `packet`, an inner IPv4
+    // packet, if it is a DNS query a rule catches. The first matching rule
+    // wins.
+    pub fn intercept(&self, packet: &[u8]) -> Option<Vec<u8>> {
+        if self.is_empty() {
+            return None;
+        }
+        // Fragments other than the first have no UDP header to look at.
+        if packet.len() < 20 || packet[6] & 0x3f != 0 || packet[7] != 0 {
+            return None;
+        }
+        let (_, dst_port, payload) = match packet::udp_parts(packet) {
+            Ok(parts) => parts,
+            Err(_) => return None,
+        };
+        if dst_port != DNS_PORT {
+            return None;
+        }
+        let query = match parse_query(payload) {
+            Some(query) => query,
+            None => return None,
+        };
+        let rule = match self.rules.iter().find(|r| r.matches(&query.name)) {
+            Some(rule) => rule,
+            None => return None,
+        };
+        debug!("DNS query for {} caught by the rule for {}.", query.name, rule.domain);
+        packet::udp_reply(packet, &answer(&query, rule.address)).ok()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::net::Ipv4Addr;
+    use packet;
+    use dns::*;
+
+    // A query from 10.10.10.2:5353 to 8.8.8.8:53, with an EDNS record.
+    fn query(name: &str, qtype: u16) -> Vec<u8> {
+        let mut dns = vec![0xbe, 0xef, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 1];
+        for label in name.split('.') {
+            dns.push(label.len() as u8);
+            dns.extend_from_slice(label.as_bytes());
+        }
+        dns.extend_from_slice(&[0, (qtype >> 8) as u8, qtype as u8, 0, 1]);
+        dns.extend_from_slice(&[0, 0, 41, 0x10, 0, 0, 0, 0, 0, 0, 0]);
+        let udp_len = 8 + dns.len();
+        let total_len = 20 + udp_len;
+        let mut packet = vec![0x45, 0, (total_len >> 8) as u8, total_len as u8, 0, 0, 0x40, 0, 64,
+                              17, 0, 0, 10, 10, 10, 2, 8, 8, 8, 8, 0x14, 0xe9, 0, 53,
+                              (udp_len >> 8) as u8, udp_len as u8, 0, 0];
+        packet.extend_from_slice(&dns);
+        packet
+    }
+
+    fn filter() -> DnsFilter {
+        DnsFilter::new(&[RuleConfig {
+                             domain: String::from("Ads.Example.com."),
+                             action: Action::Block,
+                             address: None,
+                         },
+                         RuleConfig {
+                             domain: String::from("portal.example"),
+                             action: Action::Sinkhole,
+                             address: Some(Ipv4Addr::new(10, 10, 10, 1)),
+                         }])
+            .unwrap()
+    }
+
+    #[test]
+    fn sinkhole_test() {
+        let login = query("login.portal.example", 1);
+        let reply = filter().intercept(&login).unwrap();
+        assert_eq!(packet::check_udp_checksum(&reply), Ok(packet::UdpChecksum::Valid));
+        assert_eq!(&reply[12..16], &[8, 8, 8, 8]);
+        assert_eq!(&reply[16..20], &[10, 10, 10, 2]);
+        let (src_port, dst_port, dns) = packet::udp_parts(&reply).unwrap();
+        assert_eq!((src_port, dst_port), (53, 5353));
+        // Same ID, a response with recursion, no error and one answer.
+        assert_eq!(&dns[..12], &[0xbe, 0xef, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0]);
+        let question_end = 12 + 22 + 4;
+        assert_eq!(&dns[12..question_end], &login[40..40 + 26]);
+        assert_eq!(&dns[question_end..],
+                   &[0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 10, 10, 10, 1]);
+
+        // Sinkholed names have no other records.
+        let reply = filter().intercept(&query("portal.example", 28)).unwrap();
+        let (_, _, dns) = packet::udp_parts(&reply).unwrap();
+        assert_eq!(&dns[2..8], &[0x81, 0x80, 0, 1, 0, 0]);
+    }
+
+    #[test]
+    fn block_test() {
+        let reply = filter().intercept(&query("tracker.ads.example.com", 1)).unwrap();
+        let (_, _, dns) = packet::udp_parts(&reply).unwrap();
+        assert_eq!(&dns[2..8], &[0x81, 0x83, 0, 1, 0, 0]);
+
+        // Other names, and lookalikes, go to the resolver.
+        assert!(filter().intercept(&query("example.com", 1)).is_none());
+        assert!(filter().intercept(&query("badads.example.com", 1)).is_none());
+        let mut response = query("ads.example.com", 1);
+        response[30] |= 0x80;
+        assert!(filter().intercept(&response).is_none());
+        let mut other_port = query("ads.example.com", 1);
+        other_port[23] = 54;
+        assert!(filter().intercept(&other_port).is_none());
+        assert!(filter().intercept(&query("ads.example.com", 1)[..35]).is_none());
+        assert!(DnsFilter::new(&[]).unwrap().intercept(&query("ads.example.com", 1)).is_none());
+    }
+
+    #[test]
+    fn rule_test() {
+        let rule = |action, address| {
+            DnsFilter::new(&[RuleConfig {
+                                 domain: String::from("example.com"),
+                                 action: action,
+                                 address: address,
+                             }])
+        };
+        assert!(rule(Action::Sinkhole, None).is_err());
+        assert!(rule(Action::Block, Some(Ipv4Addr::new(10, 10, 10, 1))).is_err());
+        assert!(rule(Action::Block, None).is_ok());
+    }
+
+    #[test]
+    fn query_answer_test() {
+        let sent = encode_query(0x1234, "Example.com.").unwrap();
+        assert_eq!(&sent[12..], &b"\x07Example\x03com\x00\x00\x01\x00\x01"[..]);
+        let question = parse_query(&sent).unwrap();
+        assert_eq!(question.name, "example.com");
+        let address = Ipv4Addr::new(192, 0, 2, 7);
+        assert_eq!(parse_answer(&answer(&question, Some(address))),
+                   Some((0x1234, vec![address])));
+        assert_eq!(parse_answer(&answer(&question, None)), Some((0x1234, Vec::new())));
+        // Not a response, or cut short.
+        assert_eq!(parse_answer(&sent), None);
+        let reply = answer(&question, Some(address));
+        assert_eq!(parse_answer(&reply[..reply.len() - 2]), None);
+
+        assert!(encode_query(1, "").is_none());
+        assert!(encode_query(1, "a..b").is_none());
+        assert!(encode_query(1, &"a".repeat(64)).is_none());
+    }
+}
@@ -0,0 +1,245 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// The kernel reassembles fragmented IP datagrams before they reach our UDP
+// socket. With IP_RECVFRAGSIZE set it tells us which ones were, by attaching
+// the size of the largest fragment to each reassembled datagram. Fragments
+// are easy to lose, reorder or spoof, so a steady stream of them usually
+// means the tunnel MTU is too large for the path.
+
+use std::collections::HashSet;
+use std::io;
+use std::mem;
+use std::net::{Ipv4Addr, Ipv6Addr, SocketAddr, SocketAddrV4, SocketAddrV6};
+use std::os::unix::io::AsRawFd;
+use libc;
+use metrics::MetricsSink;
+
+// From linux/in.h and linux/in6.h.
+const IP_RECVFRAGSIZE: libc::c_int = 25;
+const IPV6_RECVFRAGSIZE: libc::c_int = 77;
+// Sources already warned about, so a client with a bad MTU does not flood
+// the log.
+const MAX_WARNED: usize = 1024;
+
+#[derive(Deserialize, Clone, Copy, Debug, PartialEq)]
+#[serde(rename_all = "lowercase")]
+pub enum FragmentPolicy {
+    // Accept reassembled datagrams like any other.
+    Ignore,
+    // Accept them, but log and count them.
+    Log,
+    // Log and count them, and drop them.
+    Drop,
+}
+
+fn socket_address(storage: &libc::sockaddr_storage) -> io::Result<SocketAddr> {
+    match storage.ss_family as libc::c_int {
+        libc::AF_INET => {
+            let sin = unsafe { &*(storage as *const _ as *const libc::sockaddr_in) };
+            let ip = Ipv4Addr::from(u32::from_be(sin.sin_addr.s_addr));
+            Ok(SocketAddr::V4(SocketAddrV4::new(ip, u16::from_be(sin.sin_port))))
+        }
+        libc::AF_INET6 => {
+            let sin6 = unsafe { &*(storage as *const _ as *const libc::sockaddr_in6) };
+            Ok(SocketAddr::V6(SocketAddrV6::new(Ipv6Addr::from(sin6.sin6_addr.s6_addr),
+                                                u16::from_be(sin6.sin6_port),
+                                                sin6.sin6_flowinfo,
+                                                sin6.sin6_scope_id)))
+        }
+        family => {
+            Err(io::Error::new(io::ErrorKind::InvalidData,
+                               format!("Unknown address family {}.", family)))
+        }
+    }
+}
+
+// The size of the largest fragment a received datagram was reassembled from,
+// or None if it arrived whole.
+fn fragment_size(msg: &libc::msghdr) -> Option<usize> {
+    unsafe {
+        let mut cmsg = libc::CMSG_FIRSTHDR(msg);
+        while !cmsg.is_null() {
+            let option = ((*cmsg).cmsg_level, (*cmsg).cmsg_type);
+            if option == (libc::IPPROTO_IP, IP_RECVFRAGSIZE) ||
+               option == (libc::IPPROTO_IPV6, IPV6_RECVFRAGSIZE) {
+                return Some(*(libc::CMSG_DATA(cmsg) as *const libc::c_int) as usize);
+            }
+            cmsg = libc::CMSG_NXTHDR(msg, cmsg);
+        }
+    }
+    None
+}
+
+// Like UdpSocket::recv_from, but also returns the size of the largest
+// fragment if the datagram was reassembled from fragments.
+pub fn recv_from<S: AsRawFd>(socket: &S,
+                             buf: &mut [u8])
+                             -> io::Result<(usize, SocketAddr, Option<usize>)> {
+    let mut address: libc::sockaddr_storage = unsafe { mem::zeroed() };
+    let mut iov = libc::iovec {
+        iov_base: buf.as_mut_ptr() as *mut libc::c_void,
+        iov_len: buf.len(),
+    };
+    // Room for a few cmsghdrs, suitably aligned.
+    let mut control = [0u64; 16];
+    let mut msg: libc::msghdr = unsafe { mem::zeroed() };
+    msg.msg_name = &mut address as *mut _ as *mut libc::c_void;
+    msg.msg_namelen = mem::size_of_val(&address) as libc::socklen_t;
+    msg.msg_iov = &mut iov;
+    msg.msg_iovlen = 1;
+    msg.msg_control = control.as_mut_ptr() as *mut libc::c_void;
+    msg.msg_controllen = mem::size_of_val(&control) as _;
+    let len = unsafe { libc::recvmsg(socket.as_raw_fd(), &mut msg, 0) };
+    if len < 0 {
+        return Err(io::Error::last_os_error());
+    }
+    let source = try!(socket_address(&address));
+    Ok((len as usize, source, fragment_size(&msg)))
+}
+
+// Notices datagrams that reached the server in fragments.
+pub struct FragmentMonitor {
+    policy: FragmentPolicy,
+    warned: HashSet<SocketAddr>,
+}
+
+impl FragmentMonitor {
+    // Asks the kernel to mark reassembled datagrams on `socket`, which is then
+    // to be read with `recv_from`.
+    pub fn new<S: AsRawFd>(socket: &S, policy: FragmentPolicy) -> io::Result<FragmentMonitor> {
+        let enable: libc::c_int = 1;
+        for &(level, name) in &[(libc::IPPROTO_IP, IP_RECVFRAGSIZE),
+                                (libc::IPPROTO_IPV6, IPV6_RECVFRAGSIZE)] {
+            let res = unsafe {
+                libc::setsockopt(socket.as_raw_fd(),
+                                 level,
+                                 name,
+                                 &enable as *const _ as *const libc::c_void,
+                                 mem::size_of_val(&enable) as libc::socklen_t)
+            };
+            // IPv6 options only apply to IPv6 sockets.
+            if res < 0 && level == libc::IPPROTO_IP {
+                return Err(io::Error::last_os_error());
+            }
+        }
+        Ok(FragmentMonitor::detached(policy))
+    }
+
+    fn detached(policy: FragmentPolicy) -> FragmentMonitor {
+        FragmentMonitor {
+            policy: policy,
+            warned: HashSet::new(),
+        }
+    }
+
+    // Returns whether a datagram of `len` bytes from `src`, with the fragment
+    // size `recv_from` returned for it, should be dropped. Reassembled ones
+    // are counted in `sink`.
+    pub fn reject(&mut self,
+                  src: &SocketAddr,
+                  len: usize,
+                  fragment: Option<usize>,
+                  sink: &MetricsSink)
+                  -> bool {
+        let fragment = match fragment {
+            Some(fragment) => fragment,
+            None => return false,
+        };
+        sink.counter("kytan_reassembled_datagrams_total", 1);
+        if self.warned.len() >= MAX_WARNED {
+            self.warned.clear();
+        }
+        if self.warned.insert(*src) {
+            warn!("Datagram of {} bytes from {} arrived in fragments of up to {} bytes. Lower \
+                   the client's MTU or enable path_mtu_discovery.",
+                  len,
+                  src,
+                  fragment);
+        } else {
+            debug!("Reassembled datagram of {} bytes from {}.", len, src);
+        }
+        self.policy == FragmentPolicy::Drop
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::mem;
+    use std::net::SocketAddr;
+    use libc;
+    use metrics::PrometheusSink;
+    use fragment::*;
+
+    #[test]
+    fn fragment_size_test() {
+        let mut control = [0u64; 16];
+        let mut msg: libc::msghdr = unsafe { mem::zeroed() };
+        msg.msg_control = control.as_mut_ptr() as *mut libc::c_void;
+        msg.msg_controllen = mem::size_of_val(&control) as _;
+        assert_eq!(fragment_size(&msg), None);
+
+        // What the kernel attaches to a datagram reassembled from fragments
+        // of up to 1480 bytes, after an unrelated option.
+        unsafe {
+            let space = libc::CMSG_SPACE(mem::size_of::<libc::c_int>() as u32) as usize;
+            msg.msg_controllen = (2 * space) as _;
+            let first = libc::CMSG_FIRSTHDR(&msg);
+            (*first).cmsg_level = libc::IPPROTO_IP;
+            (*first).cmsg_type = libc::IP_TTL;
+            (*first).cmsg_len = libc::CMSG_LEN(mem::size_of::<libc::c_int>() as u32) as _;
+            *(libc::CMSG_DATA(first) as *mut libc::c_int) = 64;
+            let second = libc::CMSG_NXTHDR(&msg, first);
+            (*second).cmsg_level = libc::IPPROTO_IP;
+            (*second).cmsg_type = IP_RECVFRAGSIZE;
+            (*second).cmsg_len = libc::CMSG_LEN(mem::size_of::<libc::c_int>() as u32) as _;
+            *(libc::CMSG_DATA(second) as *mut libc::c_int) = 1480;
+        }
+        assert_eq!(fragment_size(&msg), Some(1480));
+    }
+
+    #[test]
+    fn reject_test() {
+        let src: SocketAddr = "192.0.2.1:1234".parse().unwrap();
+
+        let sink = PrometheusSink::new();
+        let mut monitor = FragmentMonitor::detached(FragmentPolicy::Log);
+        assert!(!monitor.reject(&src, 1400, None, &sink));
+        assert!(!monitor.reject(&src, 2000, Some(1480), &sink));
+        assert!(!monitor.reject(&src, 2000, Some(1480), &sink));
+        assert!(sink.render().contains("kytan_reassembled_datagrams_total 2"), "{}", sink.render());
+
+        let sink = PrometheusSink::new();
+        let mut monitor = FragmentMonitor::detached(FragmentPolicy::Drop);
+        assert!(!monitor.reject(&src, 1400, None, &sink));
+        assert!(monitor.reject(&src, 2000, Some(1480), &sink));
+        assert!(sink.render().contains("kytan_reassembled_datagrams_total 1"), "{}", sink.render());
+    }
+
+    #[test]
+    fn recv_test() {
+        use std::net::UdpSocket;
+
+        let server = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let client = UdpSocket::bind("127.0.0.1:0").unwrap();
+        FragmentMonitor::new(&server, FragmentPolicy::Log).unwrap();
+        client.send_to(b"hello", server.local_addr().unwrap()).unwrap();
+        let mut buf = [0u8; 16];
+        let (len, src, fragment) = recv_from(&server, &mut buf).unwrap();
+        assert_eq!(&buf[..len], b"hello");
+        assert_eq!(src, client.local_addr().unwrap());
+        assert_eq!(fragment, None);
+    }
+}
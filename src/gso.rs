@@ -0,0 +1,381 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::io;
+use std::net::{self, SocketAddr};
+use std::os::unix::io::AsRawFd;
+use libc;
+use mio;
+
+// From linux/udp.h.
+#[cfg(target_os = "linux")]
+const SOL_UDP: libc::c_int = 17;
+#[cfg(target_os = "linux")]
+const UDP_SEGMENT: libc::c_int = 103;
+// The kernel splits at most this many datagrams off one send.
+const MAX_SEGMENTS: usize = 64;
+// The largest UDP payload over IPv4.
+const MAX_BATCH_BYTES: usize = 65507;
+
+// The sockets batches go out on.
+pub trait DatagramSocket: AsRawFd {
+    fn send_datagram(&self, buf: &[u8], destination: &SocketAddr) -> io::Result<usize>;
+}
+
+impl DatagramSocket for net::UdpSocket {
+    fn send_datagram(&self, buf: &[u8], destination: &SocketAddr) -> io::Result<usize> {
+        self.send_to(buf, destination)
+    }
+}
+
+impl DatagramSocket for mio::net::UdpSocket {
+    fn send_datagram(&self, buf: &[u8], destination: &SocketAddr) -> io::Result<usize> {
+        self.send_to(buf, destination)
+    }
+}
+
+#[cfg(target_os = "linux")]
+fn raw_address(address: &SocketAddr) -> (libc::sockaddr_storage, libc::socklen_t) {
+    use std::mem;
+
+    let mut storage: libc::sockaddr_storage = unsafe { mem::zeroed() };
+    let len = match *address {
+        SocketAddr::V4(ref a) => {
+            let sin = unsafe { &mut *(&mut storage as *mut _ as *mut libc::sockaddr_in) };
+            sin.sin_family = libc::AF_INET as libc::sa_family_t;
+            sin.sin_port = a.port().to_be();
+            sin.sin_addr = libc::in_addr { s_addr: u32::from(*a.ip()).to_be() };
+            mem::size_of::<libc::sockaddr_in>()
+        }
+        SocketAddr::V6(ref a) => {
+            let sin6 = unsafe { &mut *(&mut storage as *mut _ as *mut libc::sockaddr_in6) };
+            sin6.sin6_family = libc::AF_INET6 as libc::sa_family_t;
+            sin6.sin6_port = a.port().to_be();
+            sin6.sin6_flowinfo = a.flowinfo();
+            sin6.sin6_addr = libc::in6_addr { s6_addr: a.ip().octets() };
+            sin6.sin6_scope_id = a.scope_id();
+            mem::size_of::<libc::sockaddr_in6>()
+        }
+    };
+    (storage, len as libc::socklen_t)
+}
+
+// Sends `buf` in one sendmsg, for the kernel to split into datagrams of
+// `segment` bytes, the last of which may be shorter.
+#[cfg(target_os = "linux")]
+fn send_segmented<S: AsRawFd>(socket: &S,
+                              buf: &[u8],
+                              segment: usize,
+                              destination: &SocketAddr)
+                              -> io::Result<()> {
+    use std::mem;
+
+    let (mut address, address_len) = raw_address(destination);
+    let mut iov = libc::iovec {
+        iov_base: buf.as_ptr() as *mut libc::c_void,
+        iov_len: buf.len(),
+    };
+    // Room for one cmsghdr and its u16, suitably aligned.
+    let mut control = [0u64; 4];
+    let mut msg: libc::msghdr = unsafe { mem::zeroed() };
+    msg.msg_name = &mut address as *mut _ as *mut libc::c_void;
+    msg.msg_namelen = address_len;
+    msg.msg_iov = &mut iov;
+    msg.msg_iovlen = 1;
+    msg.msg_control = control.as_mut_ptr() as *mut libc::c_void;
+    let res = unsafe {
+        msg.msg_controllen = libc::CMSG_SPACE(mem::size_of::<u16>() as u32) as _;
+        let cmsg = libc::CMSG_FIRSTHDR(&msg);
+        (*cmsg).cmsg_level = SOL_UDP;
+        (*cmsg).cmsg_type = UDP_SEGMENT;
+        (*cmsg).cmsg_len = libc::CMSG_LEN(mem::size_of::<u16>() as u32) as _;
+        *(libc::CMSG_DATA(cmsg) as *mut u16) = segment as u16;
+        libc::sendmsg(socket.as_raw_fd(), &msg, 0)
+    };
+    if res < 0 {
+        return Err(io::Error::last_os_error());
+    }
+    Ok(())
+}
+
+#[cfg(not(target_os = "linux"))]
+fn send_segmented<S: AsRawFd>(_: &S, _: &[u8], _: usize, _: &SocketAddr) -> io::Result<()> {
+    Err(io::Error::from_raw_os_error(libc::EOPNOTSUPP))
+}
+
+// What sending with UDP_SEGMENT fails with where the kernel, or the device
+// on the way out, does not support it.
+fn is_unsupported(e: &io::Error) -> bool {
+    match e.raw_os_error() {
+        Some(code) => {
+            code == libc::EIO || code == libc::EINVAL || code == libc::ENOPROTOOPT ||
+            code == libc::EOPNOTSUPP
+        }
+        None => false,
+    }
+}
+
+// What a push or flush handed to the kernel: the lengths of the datagrams it
+// accepted, and how many it refused, e.g. with EAGAIN or ENOBUFS, which are
+// lost, along with why.
+#[derive(Debug, Default)]
+pub struct Delivery {
+    pub sent: Vec<usize>,
+    pub lost: usize,
+    pub error: Option<io::Error>,
+}
+
+impl Delivery {
+    // Of sending `buf`, made up of datagrams of `segment` bytes.
+    fn of(result: io::Result<()>, buf: &[u8], segment: usize) -> Delivery {
+        match result {
+            Ok(()) => {
+                Delivery {
+                    sent: buf.chunks(segment).map(|datagram| datagram.len()).collect(),
+                    lost: 0,
+                    error: None,
+                }
+            }
+            Err(e) => {
+                Delivery {
+                    sent: Vec::new(),
+                    lost: buf.chunks(segment).count(),
+                    error: Some(e),
+                }
+            }
+        }
+    }
+
+    pub fn add(&mut self, other: Delivery) {
+        self.sent.extend(other.sent);
+        self.lost += other.lost;
+        if self.error.is_none() {
+            self.error = other.error;
+        }
+    }
+
+    pub fn result(self) -> io::Result<()> {
+        match self.error {
+            Some(e) => Err(e),
+            None => Ok(()),
+        }
+    }
+}
+
+// Collects consecutive datagrams to one destination and sends them with UDP
+// segmentation offload: a single sendmsg, which the kernel splits into the
+// original datagrams. They all have to be the same size, except the last,
+// so a datagram of another size or for another destination sends what was
+// collected first. Without GSO, every datagram is sent right away.
+pub struct SendBatch {
+    gso: bool,
+    buf: Vec<u8>,
+    destination: Option<SocketAddr>,
+    segment: usize,
+    segments: usize,
+    // Sends made, to tell how much batching saves.
+    syscalls: u64,
+}
+
+impl SendBatch {
+    // GSO is only available in Linux, and is given up the first time the
+    // kernel refuses it.
+    pub fn new(gso: bool) -> SendBatch {
+        SendBatch {
+            gso: gso && cfg!(target_os = "linux"),
+            buf: Vec::new(),
+            destination: None,
+            segment: 0,
+            segments: 0,
+            syscalls: 0,
+        }
+    }
+
+    pub fn is_gso(&self) -> bool {
+        self.gso
+    }
+
+    // Datagrams waiting for `flush`.
+    pub fn len(&self) -> usize {
+        self.segments
+    }
+
+    pub fn syscalls(&self) -> u64 {
+        self.syscalls
+    }
+
+    pub fn push<S: DatagramSocket>(&mut self,
+                                   socket: &S,
+                                   destination: SocketAddr,
+                                   datagram: &[u8])
+                                   -> Delivery {
+        if !self.gso {
+            self.syscalls += 1;
+            let result = socket.send_datagram(datagram, &destination).map(|_| ());
+            return Delivery::of(result, datagram, datagram.len());
+        }
+        let fits = self.destination == Some(destination) && datagram.len() <= self.segment &&
+                   self.buf.len() == self.segment * self.segments &&
+                   self.segments < MAX_SEGMENTS &&
+                   self.buf.len() + datagram.len() <= MAX_BATCH_BYTES;
+        // The datagrams collected before are lost if sending them fails,
+        // but this one is still collected.
+        let mut delivery = Delivery::default();
+        if !fits {
+            delivery = self.flush(socket);
+            self.destination = Some(destination);
+            self.segment = datagram.len();
+        }
+        self.buf.extend_from_slice(datagram);
+        self.segments += 1;
+        delivery
+    }
+
+    // Sends the datagrams collected so far.
+    pub fn flush<S: DatagramSocket>(&mut self, socket: &S) -> Delivery {
+        let destination = match self.destination.take() {
+            Some(destination) => destination,
+            None => return Delivery::default(),
+        };
+        let segments = self.segments;
+        self.segments = 0;
+        self.syscalls += 1;
+        let delivery = if segments == 1 {
+            let result = socket.send_datagram(&self.buf, &destination).map(|_| ());
+            Delivery::of(result, &self.buf, self.segment)
+        } else {
+            match send_segmented(socket, &self.buf, self.segment, &destination) {
+                Err(ref e) if is_unsupported(e) => {
+                    warn!("UDP GSO unavailable ({}). Sending datagrams one by one.", e);
+                    self.gso = false;
+                    self.syscalls -= 1;
+                    let mut delivery = Delivery::default();
+                    for datagram in self.buf.chunks(self.segment) {
+                        self.syscalls += 1;
+                        let result = socket.send_datagram(datagram, &destination).map(|_| ());
+                        delivery.add(Delivery::of(result, datagram, datagram.len()));
+                    }
+                    delivery
+                }
+                result => Delivery::of(result, &self.buf, self.segment),
+            }
+        };
+        self.buf.clear();
+        delivery
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::net::{SocketAddr, UdpSocket};
+    use std::time::Duration;
+    use gso::*;
+
+    fn receiver() -> UdpSocket {
+        let socket = UdpSocket::bind("127.0.0.1:0").unwrap();
+        socket.set_read_timeout(Some(Duration::from_secs(1))).unwrap();
+        socket
+    }
+
+    fn received(socket: &UdpSocket, count: usize) -> Vec<Vec<u8>> {
+        let mut buf = [0; 2048];
+        (0..count)
+            .map(|_| {
+                let len = socket.recv(&mut buf).unwrap();
+                buf[..len].to_vec()
+            })
+            .collect()
+    }
+
+    #[test]
+    fn gso_test() {
+        let sender = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let receiver = receiver();
+        let destination = receiver.local_addr().unwrap();
+        let datagrams: Vec<Vec<u8>> =
+            (0..5).map(|i| vec![i as u8; if i < 4 { 1200 } else { 300 }]).collect();
+        let mut batch = SendBatch::new(true);
+        for datagram in &datagrams {
+            batch.push(&sender, destination, datagram).result().unwrap();
+        }
+        assert_eq!(batch.len(), 5);
+        batch.flush(&sender).result().unwrap();
+        assert_eq!(batch.len(), 0);
+        // Kernels before 4.18 have no GSO, and fall back to one send each.
+        if batch.is_gso() {
+            assert_eq!(batch.syscalls(), 1);
+        }
+        // The peer sees the datagrams as they were pushed.
+        assert_eq!(received(&receiver, 5), datagrams);
+        batch.flush(&sender).result().unwrap();
+        assert!(batch.syscalls() <= 5);
+    }
+
+    #[test]
+    fn split_test() {
+        let sender = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let (first, second) = (receiver(), receiver());
+        let mut batch = SendBatch::new(true);
+        let mut push = |to: &UdpSocket, datagram: &[u8]| {
+            batch.push(&sender, to.local_addr().unwrap(), datagram).result().unwrap();
+        };
+        push(&first, &[1; 100]);
+        push(&second, &[2; 100]);
+        // Shorter, so it ends the batch.
+        push(&second, &[3; 50]);
+        push(&second, &[4; 100]);
+        push(&second, &[5; 200]);
+        batch.flush(&sender).result().unwrap();
+        if batch.is_gso() {
+            assert_eq!(batch.syscalls(), 4);
+        }
+        assert_eq!(received(&first, 1), vec![vec![1; 100]]);
+        assert_eq!(received(&second, 4),
+                   vec![vec![2; 100], vec![3; 50], vec![4; 100], vec![5; 200]]);
+    }
+
+    #[test]
+    fn no_gso_test() {
+        let sender = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let receiver = receiver();
+        let mut batch = SendBatch::new(false);
+        for _ in 0..3 {
+            batch.push(&sender, receiver.local_addr().unwrap(), &[7; 100]).result().unwrap();
+        }
+        // Sent right away.
+        assert_eq!(batch.len(), 0);
+        assert_eq!(batch.syscalls(), 3);
+        assert_eq!(received(&receiver, 3), vec![vec![7; 100]; 3]);
+    }
+
+    #[test]
+    fn lost_test() {
+        let sender = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let receiver = receiver();
+        // An IPv4 socket refuses to send to an IPv6 address.
+        let refused: SocketAddr = "[::1]:9".parse().unwrap();
+        for &gso in &[false, true] {
+            let mut batch = SendBatch::new(gso);
+            let mut delivery = batch.push(&sender, refused, &[1; 100]);
+            delivery.add(batch.push(&sender, refused, &[2; 100]));
+            delivery.add(batch.push(&sender, receiver.local_addr().unwrap(), &[3; 50]));
+            delivery.add(batch.flush(&sender));
+            assert_eq!(delivery.sent, vec![50]);
+            assert_eq!(delivery.lost, 2);
+            assert!(delivery.error.is_some());
+            assert_eq!(received(&receiver, 1), vec![vec![3; 50]]);
+        }
+    }
+}
@@ -0,0 +1,411 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::collections::HashMap;
+use std::io;
+use std::mem;
+use std::net::{Ipv4Addr, SocketAddr, UdpSocket};
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+const VERSION: u16 = 10;
+const TEMPLATE_SET_ID: u16 = 2;
+const TEMPLATE_ID: u16 = 256;
+// The information elements of a flow record and their lengths (RFC 7012).
+const FIELDS: [(u16, u16); 9] = [(8, 4), // sourceIPv4Address
+                                 (12, 4), // destinationIPv4Address
+                                 (7, 2), // sourceTransportPort
+                                 (11, 2), // destinationTransportPort
+                                 (4, 1), // protocolIdentifier
+                                 (2, 8), // packetDeltaCount
+                                 (1, 8), // octetDeltaCount
+                                 (152, 8), // flowStartMilliseconds
+                                 (153, 8)]; // flowEndMilliseconds
+const RECORD_LEN: usize = 45;
+// Records per message, so each fits in a datagram that is not fragmented.
+const MAX_RECORDS: usize = 30;
+// The template is resent this often, so a collector that restarted learns it
+// again (RFC 7011, section 8.4).
+const TEMPLATE_INTERVAL_SECS: u64 = 60;
+// Flows are scanned for timeouts at most this often.
+const SCAN_INTERVAL_MS: u64 = 1000;
+
+// What tells flows apart: the inner 5-tuple. Ports are zero for protocols
+// other than TCP and UDP, and for fragments but the first.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Hash)]
+pub struct FlowKey {
+    pub source: Ipv4Addr,
+    pub destination: Ipv4Addr,
+    pub protocol: u8,
+    pub source_port: u16,
+    pub destination_port: u16,
+}
+
+impl FlowKey {
+    // The flow of an inner IPv4 packet, if it is one.
+    pub fn of(packet: &[u8]) -> Option<FlowKey> {
+        if packet.len() < 20 || packet[0] >> 4 != 4 {
+            return None;
+        }
+        let ihl = (packet[0] & 0xf) as usize * 4;
+        let first = packet[6] & 0x1f == 0 && packet[7] == 0;
+        let ports = match packet[9] {
+            6 | 17 if first && packet.len() >= ihl + 4 => {
+                let port = |i: usize| ((packet[i] as u16) << 8) | packet[i + 1] as u16;
+                (port(ihl), port(ihl + 2))
+            }
+            _ => (0, 0),
+        };
+        Some(FlowKey {
+            source: Ipv4Addr::new(packet[12], packet[13], packet[14], packet[15]),
+            destination: Ipv4Addr::new(packet[16], packet[17], packet[18], packet[19]),
+            protocol: packet[9],
+            source_port: ports.0,
+            destination_port: ports.1,
+        })
+    }
+}
+
+// A flow as exported: its packets and bytes, and when its first and last
+// packets were seen, in milliseconds since the epoch.
+#[derive(Clone, Debug, PartialEq)]
+pub struct FlowRecord {
+    pub key: FlowKey,
+    pub packets: u64,
+    pub bytes: u64,
+    pub start: u64,
+    pub end: u64,
+}
+
+fn epoch_millis(time: SystemTime) -> u64 {
+    time.duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs() * 1000 + d.subsec_nanos() as u64 / 1_000_000)
+        .unwrap_or(0)
+}
+
+struct Flow {
+    record: FlowRecord,
+    first: Instant,
+    last: Instant,
+}
+
+// Accounts inner packets to their flows. A flow ends once it was idle for
+// `idle_timeout`, or has lasted `active_timeout`, so a long one is reported
+// as it goes. At most `max_flows` are kept: a new flow beyond that ends all
+// of them early, which splits them in records but loses nothing.
+pub struct FlowTable {
+    flows: HashMap<FlowKey, Flow>,
+    max_flows: usize,
+    active_timeout: Duration,
+    idle_timeout: Duration,
+    // Flows ended early, waiting for `expire`.
+    ended: Vec<FlowRecord>,
+    last_scan: Instant,
+}
+
+impl FlowTable {
+    pub fn new(max_flows: usize,
+               active_timeout: Duration,
+               idle_timeout: Duration,
+               now: Instant)
+               -> FlowTable {
+        FlowTable {
+            flows: HashMap::new(),
+            max_flows: max_flows,
+            active_timeout: active_timeout,
+            idle_timeout: idle_timeout,
+            ended: Vec::new(),
+            last_scan: now,
+        }
+    }
+
+    pub fn len(&self) -> usize {
+        self.flows.len()
+    }
+
+    // Counts `packet` in its flow, seen at `now`, or `time` by the clock.
+    pub fn account(&mut self, packet: &[u8], now: Instant, time: SystemTime) {
+        let key = match FlowKey::of(packet) {
+            Some(key) => key,
+            None => return,
+        };
+        let millis = epoch_millis(time);
+        if !self.flows.contains_key(&key) && self.flows.len() >= self.max_flows {
+            let ended = mem::replace(&mut self.flows, HashMap::new());
+            self.ended.extend(ended.into_iter().map(|(_, flow)| flow.record));
+        }
+        let flow = self.flows.entry(key).or_insert_with(|| {
+            Flow {
+                record: FlowRecord {
+                    key: key,
+                    packets: 0,
+                    bytes: 0,
+                    start: millis,
+                    end: millis,
+                },
+                first: now,
+                last: now,
+            }
+        });
+        flow.record.packets += 1;
+        flow.record.bytes += packet.len() as u64;
+        flow.record.end = millis;
+        flow.last = now;
+    }
+
+    // Returns the flows that ended by `now`. Timeouts are checked about once
+    // a second, however often this is called.
+    pub fn expire(&mut self, now: Instant) -> Vec<FlowRecord> {
+        let mut ended = mem::replace(&mut self.ended, Vec::new());
+        if now < self.last_scan + Duration::from_millis(SCAN_INTERVAL_MS) {
+            return ended;
+        }
+        self.last_scan = now;
+        let (active, idle) = (self.active_timeout, self.idle_timeout);
+        let keys: Vec<FlowKey> = self.flows
+            .iter()
+            .filter(|&(_, f)| now >= f.last + idle || now >= f.first + active)
+            .map(|(&k, _)| k)
+            .collect();
+        for key in keys {
+            ended.push(self.flows.remove(&key).unwrap().record);
+        }
+        ended
+    }
+
+    // Ends every flow, e.g. on shutdown.
+    pub fn flush(&mut self) -> Vec<FlowRecord> {
+        let mut ended = mem::replace(&mut self.ended, Vec::new());
+        let flows = mem::replace(&mut self.flows, HashMap::new());
+        ended.extend(flows.into_iter().map(|(_, flow)| flow.record));
+        ended
+    }
+}
+
+fn put16(buf: &mut Vec<u8>, v: u16) {
+    buf.push((v >> 8) as u8);
+    buf.push(v as u8);
+}
+
+fn put32(buf: &mut Vec<u8>, v: u32) {
+    put16(buf, (v >> 16) as u16);
+    put16(buf, v as u16);
+}
+
+fn put64(buf: &mut Vec<u8>, v: u64) {
+    put32(buf, (v >> 32) as u32);
+    put32(buf, v as u32);
+}
+
+// Builds an IPFIX message carrying `records`, with the template ahead of them
+// if `template`. `sequence` counts the records sent before.
+pub fn message(records: &[FlowRecord],
+               template: bool,
+               sequence: u32,
+               domain: u32,
+               export_time: u32)
+               -> Vec<u8> {
+    let mut buf = Vec::with_capacity(16 + 4 + 4 * FIELDS.len() + 4 + records.len() * RECORD_LEN);
+    put16(&mut buf, VERSION);
+    // The length is filled in last.
+    put16(&mut buf, 0);
+    put32(&mut buf, export_time);
+    put32(&mut buf, sequence);
+    put32(&mut buf, domain);
+    if template {
+        put16(&mut buf, TEMPLATE_SET_ID);
+        put16(&mut buf, (4 + 4 + 4 * FIELDS.len()) as u16);
+        put16(&mut buf, TEMPLATE_ID);
+        put16(&mut buf, FIELDS.len() as u16);
+        for &(id, len) in FIELDS.iter() {
+            put16(&mut buf, id);
+            put16(&mut buf, len);
+        }
+    }
+    if !records.is_empty() {
+        put16(&mut buf, TEMPLATE_ID);
+        put16(&mut buf, (4 + records.len() * RECORD_LEN) as u16);
+        for record in records {
+            buf.extend_from_slice(&record.key.source.octets());
+            buf.extend_from_slice(&record.key.destination.octets());
+            put16(&mut buf, record.key.source_port);
+            put16(&mut buf, record.key.destination_port);
+            buf.push(record.key.protocol);
+            put64(&mut buf, record.packets);
+            put64(&mut buf, record.bytes);
+            put64(&mut buf, record.start);
+            put64(&mut buf, record.end);
+        }
+    }
+    let len = buf.len();
+    buf[2] = (len >> 8) as u8;
+    buf[3] = len as u8;
+    buf
+}
+
+// Sends flow records to an IPFIX collector over UDP.
+pub struct Exporter {
+    socket: UdpSocket,
+    domain: u32,
+    sequence: u32,
+    template_sent: Option<Instant>,
+}
+
+impl Exporter {
+    pub fn new(collector: &SocketAddr, domain: u32) -> io::Result<Exporter> {
+        let socket = try!(UdpSocket::bind(match *collector {
+            SocketAddr::V4(_) => "0.0.0.0:0",
+            SocketAddr::V6(_) => "[::]:0",
+        }));
+        try!(socket.connect(collector));
+        Ok(Exporter {
+            socket: socket,
+            domain: domain,
+            sequence: 0,
+            template_sent: None,
+        })
+    }
+
+    // Sends `records` at `now`, or `time` by the clock. The template goes
+    // ahead of them in the first message, and again once it is due.
+    pub fn export(&mut self,
+                  records: &[FlowRecord],
+                  now: Instant,
+                  time: SystemTime)
+                  -> io::Result<()> {
+        let export_time = (epoch_millis(time) / 1000) as u32;
+        for chunk in records.chunks(MAX_RECORDS) {
+            let template = self.template_sent
+                .map_or(true, |t| now >= t + Duration::from_secs(TEMPLATE_INTERVAL_SECS));
+            let msg = message(chunk, template, self.sequence, self.domain, export_time);
+            try!(self.socket.send(&msg));
+            if template {
+                self.template_sent = Some(now);
+            }
+            self.sequence = self.sequence.wrapping_add(chunk.len() as u32);
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::net::{Ipv4Addr, UdpSocket};
+    use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+    use ipfix::*;
+
+    fn udp(source_port: u8, len: usize) -> Vec<u8> {
+        let mut packet = vec![0x45, 0, 0, 0, 0, 0, 0x40, 0, 64, 17, 0, 0, 10, 10, 10, 2, 192, 0,
+                              2, 9, 0x30, source_port, 0, 53];
+        packet.resize(len, 0);
+        packet
+    }
+
+    #[test]
+    fn flow_key_test() {
+        let key = FlowKey::of(&udp(0x39, 28)).unwrap();
+        assert_eq!(key.source, Ipv4Addr::new(10, 10, 10, 2));
+        assert_eq!(key.destination, Ipv4Addr::new(192, 0, 2, 9));
+        assert_eq!((key.protocol, key.source_port, key.destination_port), (17, 12345, 53));
+        // A later fragment carries no ports.
+        let mut fragment = udp(0x39, 28);
+        fragment[7] = 3;
+        assert_eq!(FlowKey::of(&fragment).unwrap().source_port, 0);
+        assert!(FlowKey::of(&[0x60; 40]).is_none());
+    }
+
+    #[test]
+    fn flow_table_test() {
+        let now = Instant::now();
+        let time = UNIX_EPOCH + Duration::from_secs(1_500_000_000);
+        let at = |s| (now + Duration::from_secs(s), time + Duration::from_secs(s));
+        let mut table = FlowTable::new(2, Duration::from_secs(60), Duration::from_secs(15), now);
+
+        let (n, t) = at(0);
+        table.account(&udp(1, 100), n, t);
+        table.account(&udp(2, 40), n, t);
+        let (n, t) = at(10);
+        table.account(&udp(1, 200), n, t);
+        assert_eq!(table.len(), 2);
+
+        // Flow 2 is idle long enough; flow 1 is not.
+        let ended = table.expire(at(20).0);
+        assert_eq!(ended.len(), 1);
+        assert_eq!(ended[0].key.source_port, 0x3002);
+        for &s in &[30, 50] {
+            let (n, t) = at(s);
+            table.account(&udp(1, 100), n, t);
+        }
+        // Still active at 60 seconds, but it has lasted that long.
+        assert!(table.expire(at(59).0).is_empty());
+        let ended = table.expire(at(60).0);
+        assert_eq!(ended,
+                   vec![FlowRecord {
+                            key: FlowKey::of(&udp(1, 28)).unwrap(),
+                            packets: 4,
+                            bytes: 500,
+                            start: 1_500_000_000_000,
+                            end: 1_500_000_050_000,
+                        }]);
+
+        // A third flow in a full table ends the others.
+        let (n, t) = at(70);
+        for port in 1..4 {
+            table.account(&udp(port, 28), n, t);
+        }
+        assert_eq!(table.len(), 1);
+        assert_eq!(table.expire(n).len(), 2);
+        assert_eq!(table.flush().len(), 1);
+        assert_eq!(table.len(), 0);
+    }
+
+    #[test]
+    fn export_test() {
+        let collector = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let mut exporter = Exporter::new(&collector.local_addr().unwrap(), 7).unwrap();
+        let now = Instant::now();
+        let time = UNIX_EPOCH + Duration::from_secs(1_500_000_000);
+        let mut table = FlowTable::new(16, Duration::from_secs(60), Duration::from_secs(15), now);
+        table.account(&udp(0x39, 120), now, time);
+        table.account(&udp(0x39, 80), now, time + Duration::from_millis(250));
+        let records = table.flush();
+        exporter.export(&records, now, time).unwrap();
+        exporter.export(&records, now, SystemTime::now()).unwrap();
+
+        let mut buf = [0u8; 1500];
+        let len = collector.recv(&mut buf).unwrap();
+        let msg = &buf[..len];
+        let be = |i: usize, n: usize| msg[i..i + n].iter().fold(0u64, |v, &b| v << 8 | b as u64);
+        // Header: version, length, export time, sequence, observation domain.
+        assert_eq!((be(0, 2), be(2, 2) as usize), (10, len));
+        assert_eq!((be(4, 4), be(8, 4), be(12, 4)), (1_500_000_000, 0, 7));
+        // The template set, then the data set it describes.
+        assert_eq!((be(16, 2), be(18, 2), be(20, 2), be(22, 2)), (2, 44, 256, 9));
+        assert_eq!((be(24, 2), be(26, 2)), (8, 4));
+        assert_eq!((be(56, 2), be(58, 2)), (153, 8));
+        assert_eq!((be(60, 2), be(62, 2)), (256, 49));
+        let record = &msg[64..];
+        assert_eq!(&record[..8], &[10, 10, 10, 2, 192, 0, 2, 9]);
+        assert_eq!((be(72, 2), be(74, 2), be(76, 1)), (12345, 53, 17));
+        assert_eq!((be(77, 8), be(85, 8)), (2, 200));
+        assert_eq!((be(93, 8), be(101, 8)), (1_500_000_000_000, 1_500_000_000_250));
+        assert_eq!(len, 109);
+
+        // The second carries no template, and counts the record sent before.
+        let len = collector.recv(&mut buf).unwrap();
+        assert_eq!(len, 16 + 49);
+        assert_eq!(&buf[8..12], &[0, 0, 0, 1]);
+        assert_eq!(&buf[16..18], &[1, 0]);
+    }
+}
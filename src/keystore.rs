@@ -0,0 +1,178 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use ring::aead;
+use cipher::{self, Cipher, KeySchedule};
+
+// Holds the keys of a session, or of a pre-shared key, and does the sealing
+// and opening with them. Everything that encrypts goes through a store, so
+// one kept in an HSM, a TPM or the kernel keyring never has to hand its keys
+// to the process.
+pub trait KeyStore: Send {
+    // Seals `data` in place, appending the tag.
+    fn seal(&self, nonce: &[u8], data: &mut Vec<u8>) -> Result<(), String>;
+
+    // Opens `data` in place. Returns the plaintext, at its start.
+    fn open<'a>(&self, nonce: &[u8], data: &'a mut [u8]) -> Result<&'a mut [u8], String>;
+
+    // Derives the keys of a session from ours, under `cipher` and for the
+    // `context` its handshake agreed on. The store returned seals with the
+    // key labeled `sealing` and opens with the one labeled `opening`, so each
+    // direction has its own, and keeps them as this one keeps ours.
+    fn derive(&self,
+              cipher: Cipher,
+              context: &[u8],
+              sealing: &str,
+              opening: &str)
+              -> Result<Box<KeyStore>, String>;
+}
+
+// Keeps the keys in the process's memory. The default.
+pub struct MemoryKeyStore {
+    schedule: KeySchedule,
+    sealing: aead::SealingKey,
+    opening: aead::OpeningKey,
+}
+
+impl MemoryKeyStore {
+    // Seals and opens with the key labeled `label` in `schedule`, under the
+    // default cipher.
+    pub fn new(schedule: KeySchedule, label: &str) -> MemoryKeyStore {
+        let (sealing, opening) = schedule.keys(cipher::DEFAULT, label);
+        MemoryKeyStore {
+            schedule: schedule,
+            sealing: sealing,
+            opening: opening,
+        }
+    }
+}
+
+impl KeyStore for MemoryKeyStore {
+    fn seal(&self, nonce: &[u8], data: &mut Vec<u8>) -> Result<(), String> {
+        let tag_len = self.sealing.algorithm().tag_len();
+        let len = data.len();
+        data.resize(len + tag_len, 0);
+        let len = try!(aead::seal_in_place(&self.sealing, nonce, &[], data, tag_len)
+            .map_err(|_| "aead::seal_in_place"));
+        data.truncate(len);
+        Ok(())
+    }
+
+    fn open<'a>(&self, nonce: &[u8], data: &'a mut [u8]) -> Result<&'a mut [u8], String> {
+        aead::open_in_place(&self.opening, nonce, &[], 0, data)
+            .map_err(|_| String::from("aead::open_in_place"))
+    }
+
+    fn derive(&self,
+              cipher: Cipher,
+              context: &[u8],
+              sealing: &str,
+              opening: &str)
+              -> Result<Box<KeyStore>, String> {
+        let schedule = self.schedule.session(context);
+        let (sealing, _) = schedule.keys(cipher, sealing);
+        let (_, opening) = schedule.keys(cipher, opening);
+        Ok(Box::new(MemoryKeyStore {
+            schedule: schedule,
+            sealing: sealing,
+            opening: opening,
+        }))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Arc;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use ring::aead;
+    use network;
+    use keystore::*;
+
+    // Stands in for a hardware store: the keys stay behind it, and every
+    // operation is counted, as a device would see it.
+    struct MockKeyStore {
+        keys: MemoryKeyStore,
+        operations: Arc<AtomicUsize>,
+    }
+
+    impl KeyStore for MockKeyStore {
+        fn seal(&self, nonce: &[u8], data: &mut Vec<u8>) -> Result<(), String> {
+            self.operations.fetch_add(1, Ordering::SeqCst);
+            self.keys.seal(nonce, data)
+        }
+
+        fn open<'a>(&self, nonce: &[u8], data: &'a mut [u8]) -> Result<&'a mut [u8], String> {
+            self.operations.fetch_add(1, Ordering::SeqCst);
+            self.keys.open(nonce, data)
+        }
+
+        fn derive(&self,
+                  cipher: Cipher,
+                  context: &[u8],
+                  sealing: &str,
+                  opening: &str)
+                  -> Result<Box<KeyStore>, String> {
+            self.operations.fetch_add(1, Ordering::SeqCst);
+            self.keys.derive(cipher, context, sealing, opening)
+        }
+    }
+
+    fn keys(key: &[u8]) -> MemoryKeyStore {
+        MemoryKeyStore::new(KeySchedule::new(key), "test")
+    }
+
+    #[test]
+    fn mock_store_test() {
+        let operations = Arc::new(AtomicUsize::new(0));
+        let mock = MockKeyStore {
+            keys: keys(&[7; 32]),
+            operations: operations.clone(),
+        };
+        let nonce = [1; 12];
+
+        let mut sealed = b"hello".to_vec();
+        mock.seal(&nonce, &mut sealed).unwrap();
+        assert_eq!(sealed.len(), 5 + aead::AES_256_GCM.tag_len());
+        // What the mock seals opens with the same keys held in memory.
+        assert_eq!(keys(&[7; 32]).open(&nonce, &mut sealed.clone()).unwrap(), b"hello");
+        assert!(keys(&[8; 32]).open(&nonce, &mut sealed.clone()).is_err());
+        assert!(mock.open(&[2; 12], &mut sealed.clone()).is_err());
+        assert_eq!(mock.open(&nonce, &mut sealed).unwrap(), b"hello");
+
+        // Messages are sealed and opened through the store.
+        let msg = network::Message::Request {
+            identifier: None,
+            nonce: [3; 16],
+            timestamp: 0,
+            ciphers: vec![cipher::DEFAULT],
+            dictionary: None,
+            subnets: Vec::new(),
+        };
+        let mut datagram = network::seal_handshake(None, &mock, &msg).unwrap();
+        assert_eq!(network::open_datagram(&mock, &mut datagram).unwrap(), msg);
+        assert_eq!(operations.load(Ordering::SeqCst), 5);
+
+        // Session keys are derived through the store, one per direction.
+        let client = mock.derive(cipher::DEFAULT, b"context", "a to b", "b to a").unwrap();
+        let server = keys(&[7; 32])
+            .derive(cipher::DEFAULT, b"context", "b to a", "a to b")
+            .unwrap();
+        assert_eq!(operations.load(Ordering::SeqCst), 6);
+        let mut sealed = b"hello".to_vec();
+        client.seal(&nonce, &mut sealed).unwrap();
+        assert!(client.open(&nonce, &mut sealed.clone()).is_err());
+        assert_eq!(server.open(&nonce, &mut sealed).unwrap(), b"hello");
+    }
+}
@@ -0,0 +1,65 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+extern crate mio;
+extern crate libc;
+
+#[macro_use]
+extern crate serde_derive;
+extern crate bincode;
+
+extern crate dns_lookup;
+extern crate snap;
+extern crate rand;
+extern crate toml;
+
+#[macro_use]
+extern crate log;
+extern crate ring;
+
+pub mod device;
+pub mod utils;
+pub mod network;
+pub mod packet;
+pub mod config;
+pub mod pool;
+pub mod session;
+pub mod scheduler;
+pub mod ratelimit;
+pub mod replay;
+pub mod acl;
+pub mod stats;
+pub mod metrics;
+pub mod checksum;
+pub mod cipher;
+pub mod tunnel;
+pub mod bench;
+pub mod redact;
+pub mod tap;
+pub mod dictionary;
+pub mod control;
+pub mod audit;
+pub mod dns;
+pub mod reachability;
+pub mod uplink;
+pub mod reorder;
+pub mod gso;
+pub mod fragment;
+pub mod stack;
+pub mod socks;
+pub mod keystore;
+pub mod bridge;
+pub mod codel;
+pub mod ipfix;
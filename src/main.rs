@@ -13,33 +13,27 @@
 // limitations under the License.
 
 extern crate getopts;
-extern crate mio;
 extern crate libc;
-
-#[macro_use]
-extern crate serde_derive;
-extern crate bincode;
-
 extern crate env_logger;
-extern crate dns_lookup;
-extern crate snap;
-extern crate rand;
-extern crate transient_hashmap;
 
 #[macro_use]
 extern crate log;
-extern crate ring;
+extern crate kytan;
 
+use std::sync::Arc;
 use std::sync::atomic::Ordering;
-use ring::rand::{SystemRandom, SecureRandom};
-
-mod device;
-mod utils;
-mod network;
-mod packet;
+use std::time::Duration;
+use kytan::{bench, config, network, redact, utils};
+use kytan::control::ControlEndpoint;
+use kytan::metrics::{MetricsSink, NoopSink, PrometheusSink};
 
 fn print_usage(program: &str, opts: getopts::Options) {
-    let brief = format!("Usage: {} [options]", program);
+    let brief = format!("Usage: {} [options]\n       {} bench-crypto\n       {} \
+                         bench-sessions\n       {} bench-send",
+                        program,
+                        program,
+                        program,
+                        program);
     print!("{}", opts.usage(&brief));
 }
 
@@ -47,11 +41,79 @@ extern "C" fn handle_signal(_: libc::c_int) {
     network::INTERRUPTED.store(true, Ordering::Relaxed);
 }
 
+extern "C" fn handle_reload(_: libc::c_int) {
+    network::RELOAD_REQUESTED.store(true, Ordering::Relaxed);
+}
+
+fn bench_crypto() {
+    println!("Measuring cipher throughput. This takes a few seconds.");
+    match bench::run(Duration::from_millis(500)) {
+        Ok(results) => print!("{}", bench::report(&results)),
+        Err(e) => {
+            error!("{}", e);
+            std::process::exit(1);
+        }
+    }
+}
+
+fn bench_sessions() {
+    let results = [bench::bench_connect(0), bench::bench_connect(usize::max_value())];
+    match results.iter().cloned().collect::<Result<Vec<_>, _>>() {
+        Ok(results) => print!("{}", bench::connect_report(&results)),
+        Err(e) => {
+            error!("{}", e);
+            std::process::exit(1);
+        }
+    }
+}
+
+fn bench_send() {
+    let results = [bench::bench_send(false, 100000), bench::bench_send(true, 100000)];
+    match results.iter().cloned().collect::<Result<Vec<_>, _>>() {
+        Ok(results) => print!("{}", bench::send_report(&results)),
+        Err(e) => {
+            error!("{}", e);
+            std::process::exit(1);
+        }
+    }
+}
+
 fn main() {
-    env_logger::init().unwrap();
+    // The default format, with log lines masked if redaction is enabled.
+    let mut logger = env_logger::LogBuilder::new();
+    logger.format(|record| {
+        format!("{}:{}: {}",
+                record.level(),
+                record.location().module_path(),
+                redact::apply(&record.args().to_string()))
+    });
+    if let Ok(spec) = std::env::var("RUST_LOG") {
+        logger.parse(&spec);
+    }
+    logger.init().unwrap();
+
+    // Needs no privileges, so it is handled before anything else.
+    match std::env::args().nth(1).as_ref().map(|arg| arg.as_str()) {
+        Some("bench-crypto") => {
+            bench_crypto();
+            return;
+        }
+        Some("bench-sessions") => {
+            bench_sessions();
+            return;
+        }
+        Some("bench-send") => {
+            bench_send();
+            return;
+        }
+        _ => {}
+    }
 
-    if !utils::is_root() {
-        panic!("Please run as root");
+    // Installed before anything is set up, so a signal during bring-up still
+    // lets the tunnel roll back the changes made so far.
+    unsafe {
+        libc::signal(libc::SIGINT, handle_signal as libc::sighandler_t);
+        libc::signal(libc::SIGTERM, handle_signal as libc::sighandler_t);
     }
 
     let mut opts = getopts::Options::new();
@@ -59,6 +121,8 @@ fn main() {
     opts.optopt("p", "port", "UDP port to listen/connect", "PORT");
     opts.optopt("h", "host", "remote host to connect (client mode)", "HOST");
     opts.optopt("s", "secret", "shared secret", "PASSWORD");
+    opts.optopt("c", "config", "configuration file", "FILE");
+    opts.optopt("i", "identifier", "client identifier (client mode)", "ID");
 
     let args: Vec<String> = std::env::args().collect();
     let program = args[0].clone();
@@ -72,19 +136,68 @@ fn main() {
     };
 
     let mode = matches.opt_str("m").unwrap();
+    // Only the server reloads its configuration.
+    let hangup = match mode.as_ref() {
+        "s" => handle_reload as libc::sighandler_t,
+        _ => libc::SIG_IGN,
+    };
+    unsafe {
+        libc::signal(libc::SIGHUP, hangup);
+    }
     let port: u16 = matches.opt_str("p").unwrap_or(String::from("8964")).parse().unwrap();
     let secret = matches.opt_str("s").unwrap();
-
-    unsafe {
-        libc::signal(libc::SIGINT, handle_signal as libc::sighandler_t);
-        libc::signal(libc::SIGTERM, handle_signal as libc::sighandler_t);
+    let mut config = match matches.opt_str("c") {
+        Some(path) => config::Config::load(&path).unwrap(),
+        None => config::Config::default(),
+    };
+    if let Some(identifier) = matches.opt_str("i") {
+        config.client.identifier = Some(identifier);
+    }
+    // A SOCKS proxy needs no TUN device and no routes.
+    if mode != "c" || config.client.socks_proxy.is_none() {
+        if let Err(e) = utils::check_privileges() {
+            error!("{}", e);
+            std::process::exit(1);
+        }
     }
 
+    let sink: Box<MetricsSink> = match config.control.socket {
+        Some(ref path) => {
+            let endpoint = match ControlEndpoint::bind(path, &config.control.socket_mode) {
+                Ok(endpoint) => endpoint,
+                Err(e) => {
+                    error!("{}", e);
+                    std::process::exit(1);
+                }
+            };
+            let mut metrics = PrometheusSink::new();
+            metrics.set_exemplar_rate(config.control.exemplar_rate);
+            let metrics = Arc::new(metrics);
+            endpoint.serve(metrics.clone());
+            Box::new(metrics)
+        }
+        None => Box::new(NoopSink),
+    };
+
     match mode.as_ref() {
-        "s" => network::serve(port, &secret),
+        "s" => {
+            let path = matches.opt_str("c");
+            if let Err(e) = network::serve_with_metrics(port,
+                                                        &secret,
+                                                        &config.server,
+                                                        path.as_ref().map(|p| p.as_str()),
+                                                        sink) {
+                error!("{}", e);
+                std::process::exit(1);
+            }
+        }
         "c" => {
             let host = matches.opt_str("h").unwrap();
-            network::connect(&host, port, true, &secret)
+            if let Err(e) =
+                   network::connect_with_metrics(&host, port, true, &secret, &config.client, sink) {
+                error!("{}", e);
+                std::process::exit(1);
+            }
         }
         _ => unreachable!(),
     };
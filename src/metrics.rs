@@ -0,0 +1,285 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::collections::BTreeMap;
+use std::fmt::Write;
+use std::sync::{Arc, Mutex};
+use rand;
+
+// Where the client and server report their metrics. Embedders implement it to
+// feed their own metrics backend.
+pub trait MetricsSink: Send + Sync {
+    // Adds `value` to a monotonically increasing counter.
+    fn counter(&self, name: &str, value: u64);
+    // Sets a value that can go up and down.
+    fn gauge(&self, name: &str, value: f64);
+    // Records one observation, e.g. a packet size.
+    fn histogram(&self, name: &str, value: f64);
+    // Records an observation like `histogram`, with labels linking it to
+    // e.g. a trace, which sinks may keep as an exemplar.
+    fn histogram_with_exemplar(&self, name: &str, value: f64, labels: &[(&str, &str)]) {
+        let _ = labels;
+        self.histogram(name, value)
+    }
+}
+
+impl<T: MetricsSink + ?Sized> MetricsSink for Arc<T> {
+    fn counter(&self, name: &str, value: u64) {
+        (**self).counter(name, value)
+    }
+
+    fn gauge(&self, name: &str, value: f64) {
+        (**self).gauge(name, value)
+    }
+
+    fn histogram(&self, name: &str, value: f64) {
+        (**self).histogram(name, value)
+    }
+
+    fn histogram_with_exemplar(&self, name: &str, value: f64, labels: &[(&str, &str)]) {
+        (**self).histogram_with_exemplar(name, value, labels)
+    }
+}
+
+pub struct NoopSink;
+
+impl MetricsSink for NoopSink {
+    fn counter(&self, _: &str, _: u64) {}
+    fn gauge(&self, _: &str, _: f64) {}
+    fn histogram(&self, _: &str, _: f64) {}
+}
+
+// Upper bounds of the histogram buckets, suited to packet sizes in bytes.
+const DEFAULT_BUCKETS: &[f64] = &[64.0, 128.0, 256.0, 512.0, 1024.0, 1500.0];
+// Durations, named `_seconds` by convention, get these instead.
+const LATENCY_BUCKETS: &[f64] = &[0.001, 0.01, 0.1, 1.0, 10.0];
+
+struct Histogram {
+    counts: Vec<u64>,
+    sum: f64,
+    count: u64,
+    // The last sampled observation in each bucket, +Inf included, with its
+    // labels as rendered.
+    exemplars: Vec<Option<(String, f64)>>,
+}
+
+// The name of the metric family a sample belongs to, which for counters
+// OpenMetrics wants without the `_total` suffix.
+fn family(name: &str) -> &str {
+    if name.ends_with("_total") {
+        &name[..name.len() - "_total".len()]
+    } else {
+        name
+    }
+}
+
+#[derive(Default)]
+struct Registry {
+    counters: BTreeMap<String, u64>,
+    gauges: BTreeMap<String, f64>,
+    histograms: BTreeMap<String, Histogram>,
+}
+
+// Keeps metrics in memory and renders them in the Prometheus text format.
+// Share it through an Arc to serve `render` from another thread.
+pub struct PrometheusSink {
+    buckets: Vec<f64>,
+    registry: Mutex<Registry>,
+    // The share of observations with labels kept as exemplars.
+    exemplar_rate: f64,
+}
+
+impl PrometheusSink {
+    pub fn new() -> PrometheusSink {
+        PrometheusSink::with_buckets(DEFAULT_BUCKETS.to_vec())
+    }
+
+    pub fn with_buckets(buckets: Vec<f64>) -> PrometheusSink {
+        PrometheusSink {
+            buckets: buckets,
+            registry: Mutex::new(Registry::default()),
+            exemplar_rate: 0.0,
+        }
+    }
+
+    // Keeps this share, from 0 to 1, of the observations made with labels as
+    // exemplars, shown by `render_openmetrics`.
+    pub fn set_exemplar_rate(&mut self, rate: f64) {
+        self.exemplar_rate = rate;
+    }
+
+    fn buckets(&self, name: &str) -> &[f64] {
+        if name.ends_with("_seconds") {
+            LATENCY_BUCKETS
+        } else {
+            &self.buckets
+        }
+    }
+
+    // In the Prometheus text format.
+    pub fn render(&self) -> String {
+        self.render_as(false)
+    }
+
+    // In the OpenMetrics text format, with exemplars.
+    pub fn render_openmetrics(&self) -> String {
+        let mut out = self.render_as(true);
+        out.push_str("# EOF\n");
+        out
+    }
+
+    fn render_as(&self, openmetrics: bool) -> String {
+        let registry = self.registry.lock().unwrap();
+        let mut out = String::new();
+        for (name, value) in &registry.counters {
+            let family = if openmetrics { family(name) } else { name };
+            write!(out, "# TYPE {} counter\n{} {}\n", family, name, value).unwrap();
+        }
+        for (name, value) in &registry.gauges {
+            write!(out, "# TYPE {} gauge\n{} {}\n", name, name, value).unwrap();
+        }
+        for (name, histogram) in &registry.histograms {
+            write!(out, "# TYPE {} histogram\n", name).unwrap();
+            let bounds = self.buckets(name)
+                .iter()
+                .map(|b| b.to_string())
+                .chain(Some(String::from("+Inf")));
+            let mut cumulative = 0;
+            for (i, bound) in bounds.enumerate() {
+                cumulative += histogram.counts[i];
+                write!(out, "{}_bucket{{le=\"{}\"}} {}", name, bound, cumulative).unwrap();
+                if let (true, &Some((ref labels, value))) = (openmetrics, &histogram.exemplars[i]) {
+                    write!(out, " # {{{}}} {}", labels, value).unwrap();
+                }
+                out.push('\n');
+            }
+            write!(out,
+                   "{}_sum {}\n{}_count {}\n",
+                   name,
+                   histogram.sum,
+                   name,
+                   histogram.count)
+                .unwrap();
+        }
+        out
+    }
+
+    fn observe(&self, name: &str, value: f64, exemplar: Option<String>) {
+        let buckets = self.buckets(name);
+        let mut registry = self.registry.lock().unwrap();
+        let histogram = registry.histograms.entry(String::from(name)).or_insert_with(|| {
+            Histogram {
+                counts: vec![0; buckets.len() + 1],
+                sum: 0.0,
+                count: 0,
+                exemplars: vec![None; buckets.len() + 1],
+            }
+        });
+        let i = buckets.iter().position(|&bound| value <= bound).unwrap_or(buckets.len());
+        histogram.counts[i] += 1;
+        histogram.sum += value;
+        histogram.count += 1;
+        if let Some(labels) = exemplar {
+            histogram.exemplars[i] = Some((labels, value));
+        }
+    }
+}
+
+impl MetricsSink for PrometheusSink {
+    fn counter(&self, name: &str, value: u64) {
+        let mut registry = self.registry.lock().unwrap();
+        *registry.counters.entry(String::from(name)).or_insert(0) += value;
+    }
+
+    fn gauge(&self, name: &str, value: f64) {
+        let mut registry = self.registry.lock().unwrap();
+        registry.gauges.insert(String::from(name), value);
+    }
+
+    fn histogram(&self, name: &str, value: f64) {
+        self.observe(name, value, None)
+    }
+
+    fn histogram_with_exemplar(&self, name: &str, value: f64, labels: &[(&str, &str)]) {
+        let sampled = self.exemplar_rate > 0.0 && rand::random::<f64>() < self.exemplar_rate;
+        let exemplar = if sampled {
+            let labels: Vec<String> =
+                labels.iter().map(|&(k, v)| format!("{}={:?}", k, v)).collect();
+            Some(labels.join(","))
+        } else {
+            None
+        };
+        self.observe(name, value, exemplar)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use metrics::*;
+
+    #[test]
+    fn prometheus_test() {
+        let sink = PrometheusSink::with_buckets(vec![100.0, 1000.0]);
+        sink.counter("kytan_rx_packets_total", 1);
+        sink.counter("kytan_rx_packets_total", 2);
+        sink.gauge("kytan_sessions", 4.0);
+        sink.gauge("kytan_sessions", 3.0);
+        for &size in &[50.0, 500.0, 5000.0] {
+            sink.histogram("kytan_rx_packet_bytes", size);
+        }
+        assert_eq!(sink.render(),
+                   "# TYPE kytan_rx_packets_total counter\n\
+                    kytan_rx_packets_total 3\n\
+                    # TYPE kytan_sessions gauge\n\
+                    kytan_sessions 3\n\
+                    # TYPE kytan_rx_packet_bytes histogram\n\
+                    kytan_rx_packet_bytes_bucket{le=\"100\"} 1\n\
+                    kytan_rx_packet_bytes_bucket{le=\"1000\"} 2\n\
+                    kytan_rx_packet_bytes_bucket{le=\"+Inf\"} 3\n\
+                    kytan_rx_packet_bytes_sum 5550\n\
+                    kytan_rx_packet_bytes_count 3\n");
+    }
+
+    #[test]
+    fn exemplar_test() {
+        let mut sink = PrometheusSink::new();
+        sink.set_exemplar_rate(1.0);
+        sink.counter("kytan_handshakes_total", 2);
+        sink.histogram_with_exemplar("kytan_handshake_seconds", 0.004, &[("trace_id", "7f3a")]);
+        sink.histogram_with_exemplar("kytan_handshake_seconds", 0.002, &[("trace_id", "1b2c")]);
+        sink.histogram_with_exemplar("kytan_handshake_seconds", 20.0, &[("trace_id", "a9e0")]);
+        sink.histogram("kytan_handshake_seconds", 0.05);
+        assert_eq!(sink.render_openmetrics(),
+                   "# TYPE kytan_handshakes counter\n\
+                    kytan_handshakes_total 2\n\
+                    # TYPE kytan_handshake_seconds histogram\n\
+                    kytan_handshake_seconds_bucket{le=\"0.001\"} 0\n\
+                    kytan_handshake_seconds_bucket{le=\"0.01\"} 2 # {trace_id=\"1b2c\"} 0.002\n\
+                    kytan_handshake_seconds_bucket{le=\"0.1\"} 3\n\
+                    kytan_handshake_seconds_bucket{le=\"1\"} 3\n\
+                    kytan_handshake_seconds_bucket{le=\"10\"} 3\n\
+                    kytan_handshake_seconds_bucket{le=\"+Inf\"} 4 # {trace_id=\"a9e0\"} 20\n\
+                    kytan_handshake_seconds_sum 20.056\n\
+                    kytan_handshake_seconds_count 4\n\
+                    # EOF\n");
+        // The Prometheus text format has no room for them.
+        assert!(!sink.render().contains("trace_id"));
+
+        // Unsampled, nothing is kept.
+        let sink = PrometheusSink::new();
+        sink.histogram_with_exemplar("kytan_handshake_seconds", 0.004, &[("trace_id", "7f3a")]);
+        assert!(!sink.render_openmetrics().contains("trace_id"));
+    }
+}
@@ -12,53 +12,432 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-use std::net::{SocketAddr, IpAddr, UdpSocket};
-use std::os::unix::io::AsRawFd;
-use std::sync::atomic::{AtomicBool, Ordering, ATOMIC_BOOL_INIT};
-use std::io::{Write, Read};
+use std::cmp;
+use std::collections::HashMap;
+use std::net::{SocketAddr, IpAddr, Ipv4Addr, Ipv6Addr, UdpSocket};
+use std::os::unix::io::{AsRawFd, RawFd};
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering, ATOMIC_BOOL_INIT, ATOMIC_USIZE_INIT};
+use std::io::{self, Read, Write};
+use std::net::{TcpListener, TcpStream};
+use std::str;
+use std::thread;
+use std::time::{Duration, Instant, SystemTime};
 use mio;
+use libc;
 use dns_lookup;
 use bincode::{serialize, deserialize, Infinite};
 use device;
+use device::PacketIO;
+use tunnel::{self, Tunnel};
+use socks;
 use utils;
+use pool;
+use redact;
+use tap::{self, Tap};
+use dictionary::Dictionary;
+use config;
+use session::{self, SessionTable, MAX_SKEW_SECS};
+use scheduler::FairQueue;
+use ratelimit::{AdmissionQueue, Direction, HandshakeLimiter};
+use replay::ReplayCache;
+use acl::Acl;
+use bridge::{HostBridge, Subnet};
+use dns::DnsFilter;
+use reachability::{Reachability, SystemLookup};
+use uplink::{PingCheck, UplinkBalancer};
+use stats::{Stats, StatsLogger};
+use metrics::{MetricsSink, NoopSink};
+use packet::{self, UnicastFilter};
+use checksum::{ChecksumMonitor, ChecksumPolicy};
+use ipfix::{Exporter, FlowRecord, FlowTable};
+use fragment::{self, FragmentMonitor, FragmentPolicy};
+use gso::{Delivery, SendBatch};
+use cipher::{self, Cipher, KeySchedule};
+use keystore::{KeyStore, MemoryKeyStore};
 use snap;
-use rand::{thread_rng, Rng};
-use transient_hashmap::TransientHashMap;
-use ring::{aead, pbkdf2, digest};
+use rand::{self, Rng};
+use ring::rand::{SecureRandom, SystemRandom};
 
 pub static INTERRUPTED: AtomicBool = ATOMIC_BOOL_INIT;
+// Set to have the server reload its configuration file, e.g. on SIGHUP.
+pub static RELOAD_REQUESTED: AtomicBool = ATOMIC_BOOL_INIT;
+static HANDSHAKE_LOGGED: AtomicBool = ATOMIC_BOOL_INIT;
 static CONNECTED: AtomicBool = ATOMIC_BOOL_INIT;
 static LISTENING: AtomicBool = ATOMIC_BOOL_INIT;
-const KEY_LEN: usize = 32;
-const TAG_LEN: usize = 16;
-const NONCE: &[u8; 12] = &[0; 12];
+// MTU of the connected client's TUN device, and a change waiting to be
+// applied by the client loop. Zero means none.
+static CURRENT_MTU: AtomicUsize = ATOMIC_USIZE_INIT;
+static REQUESTED_MTU: AtomicUsize = ATOMIC_USIZE_INIT;
+// A request about one session waiting to be applied by the server loop, as
+// the operation's code and the id. Zero means none.
+static REQUESTED_SESSION_OP: AtomicUsize = ATOMIC_USIZE_INIT;
+// What a datagram carries, in its first byte.
+const HANDSHAKE: u8 = 1;
+const DATA: u8 = 2;
+// Handshakes are sealed under a random nonce sent along, and data under the
+// number its direction gives each packet, so no nonce is used twice with one
+// key.
+const NONCE_LEN: usize = 12;
+const NUMBER_LEN: usize = 8;
 
-type Id = u8;
-type Token = u64;
+pub type Id = u8;
+pub type Token = u64;
+pub type ConnectionId = u64;
+// Picked by each side of a handshake, so the keys of the session are its
+// own.
+pub type HandshakeNonce = [u8; 16];
+
+// How the data in a data message is encoded.
+#[derive(Serialize, Deserialize, Clone, Copy, PartialEq, Debug)]
+pub enum Encoding {
+    Snappy,
+    // Compressed with the preset dictionary agreed on in the handshake.
+    Dictionary,
+    // As is, for clients whose profile exempts them from compression.
+    Plain,
+}
 
 #[derive(Serialize, Deserialize, PartialEq, Debug)]
-enum Message {
-    Request,
-    Response { id: Id, token: Token },
-    Data { id: Id, token: Token, data: Vec<u8> },
+pub enum Message {
+    // Offers the `ciphers` the client can use for its session, and the preset
+    // compression dictionary `dictionary`, if any, and advertises the subnets
+    // behind the client to bridge into the tunnel. Requests and Responses
+    // carry the sender's clock, in seconds since the epoch, so skew shows.
+    Request {
+        identifier: Option<String>,
+        nonce: HandshakeNonce,
+        timestamp: u64,
+        ciphers: Vec<Cipher>,
+        dictionary: Option<u64>,
+        subnets: Vec<Subnet>,
+    },
+    // `nonces` are the client's from the Request and the server's, which
+    // the keys of the session are derived from, for the `cipher` picked from
+    // the offered ones. The client's link to us is of `link_prefix`, e.g. a
+    // /31 of its own. `compression` is false if
+    // the client's profile exempts its data from compression, and
+    // `dictionary` whether the one offered was accepted. A Request made over
+    // TCP is told the UDP `data_port` data goes to.
+    Response {
+        id: Id,
+        token: Token,
+        nonces: (HandshakeNonce, HandshakeNonce),
+        cipher: Cipher,
+        timestamp: u64,
+        link_prefix: u8,
+        mtu: u16,
+        compression: bool,
+        dictionary: bool,
+        data_port: Option<u16>,
+    },
+    // `connection` tags data with the ID of the connection it belongs to, so
+    // it can be attributed to its session whichever path or socket it
+    // arrived over. `sequence` numbers it in the order it was sent, so the
+    // receiver can put it back in that order.
+    Data {
+        id: Id,
+        token: Token,
+        connection: Option<ConnectionId>,
+        sequence: Option<u64>,
+        encoding: Encoding,
+        data: Vec<u8>,
+    },
+}
+
+// What the server assigned to this client in its Response.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Assignment {
+    pub id: Id,
+    pub token: Token,
+    pub mtu: u16,
+    // False if the client's profile exempts its data from compression.
+    pub compression: bool,
+    pub nonces: (HandshakeNonce, HandshakeNonce),
+    pub cipher: Cipher,
+    // Prefix length of our link to the server.
+    pub link_prefix: u8,
+}
+
+const MAX_HANDSHAKE_LEN: usize = 8192;
+
+// Sent in plaintext, after handshakes went unanswered, to ask whether a
+// server is there at all. Neither carries anything secret, and the reply is
+// no longer than the hello, so servers answering cannot be used to amplify.
+const DIAGNOSTIC_HELLO: &[u8] = b"kytan diagnostic hello";
+const DIAGNOSTIC_REPLY: &[u8] = b"kytan diagnostic reply";
+// Requests sent before falling back to a diagnostic hello.
+const DIAGNOSTIC_ATTEMPTS: usize = 3;
+
+// Bytes each session may send per round when fair queuing is enabled.
+const FAIR_QUEUE_QUANTUM: usize = 1500;
+
+// Packets read from TUN in one go to be sent in batches with UDP GSO.
+const TUN_BATCH: usize = 64;
+
+// Wait before retrying to recreate a vanished TUN device, doubled each time.
+const TUN_RECREATE_BACKOFF_MS: u64 = 1000;
+
+// Whether reading `fd` would not block.
+fn is_readable(fd: RawFd) -> bool {
+    let mut pollfd = libc::pollfd {
+        fd: fd,
+        events: libc::POLLIN,
+        revents: 0,
+    };
+    unsafe { libc::poll(&mut pollfd, 1, 0) > 0 }
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum HandshakeStep {
+    Resolve,
+    Dial,
+    RequestSent,
+    ResponseReceived,
+    AddressAssigned,
+    RoutesApplied,
+}
+
+const HANDSHAKE_STEPS: usize = 6;
+
+// Records the steps of bringing a session up. The first time in a process they
+// are logged at info level, so users can see where a failing connection
+// breaks; afterwards (e.g. on reconnects) only at debug level. Secrets and
+// session tokens are never included.
+pub struct HandshakeLog {
+    verbose: bool,
+    steps: Vec<HandshakeStep>,
+}
+
+impl HandshakeLog {
+    pub fn new(verbose: bool) -> HandshakeLog {
+        HandshakeLog {
+            verbose: verbose,
+            steps: Vec::new(),
+        }
+    }
+
+    // Verbose only for the first session of the process, if `enabled`.
+    pub fn first(enabled: bool) -> HandshakeLog {
+        let first = !HANDSHAKE_LOGGED.swap(true, Ordering::Relaxed);
+        HandshakeLog::new(enabled && first)
+    }
+
+    pub fn step(&mut self, step: HandshakeStep, detail: &str) {
+        self.steps.push(step);
+        if self.verbose {
+            info!("Handshake step {}/{} ({:?}): {}",
+                  self.steps.len(),
+                  HANDSHAKE_STEPS,
+                  step,
+                  detail);
+        } else {
+            debug!("Handshake step {:?}: {}", step, detail);
+        }
+    }
+
+    pub fn steps(&self) -> &[HandshakeStep] {
+        &self.steps
+    }
 }
 
 const TUN: mio::Token = mio::Token(0);
 const SOCK: mio::Token = mio::Token(1);
+const TCP_LISTEN: mio::Token = mio::Token(2);
+// Clients of the SOCKS proxy take the tokens from here up.
+const FIRST_SOCKS_TOKEN: usize = 3;
+// On the server, TCP handshakes being read do.
+const FIRST_TCP_TOKEN: usize = 3;
 
-fn resolve(host: &str) -> Result<IpAddr, String> {
+// How long the server waits for a client to send its Request over TCP.
+const TCP_HANDSHAKE_TIMEOUT_MS: u64 = 1000;
+// How many TCP handshakes the server reads at once. Connections beyond are
+// closed right away.
+const MAX_TCP_HANDSHAKES: usize = 256;
+// How often waiting for the answer to a handshake checks for interruption.
+const INTERRUPT_CHECK_MS: u64 = 100;
+
+pub fn resolve(host: &str) -> Result<IpAddr, String> {
     let mut ip_list = try!(dns_lookup::lookup_host(host).map_err(|_| "dns_lookup::lookup_host"));
     let ip = ip_list.next().unwrap().unwrap();
     Ok(ip)
 }
 
-fn create_tun_attempt() -> device::Tun {
-    fn attempt(id: u8) -> device::Tun {
+pub fn resolve_all(host: &str) -> Result<Vec<IpAddr>, String> {
+    let ip_list = try!(dns_lookup::lookup_host(host).map_err(|_| "dns_lookup::lookup_host"));
+    Ok(ip_list.filter_map(|ip| ip.ok()).collect())
+}
+
+// Embeds an IPv4 address in a NAT64 /96 prefix (RFC 6052).
+pub fn synthesize(prefix: Ipv6Addr, ip: Ipv4Addr) -> Ipv6Addr {
+    let s = prefix.segments();
+    let o = ip.octets();
+    Ipv6Addr::new(s[0],
+                  s[1],
+                  s[2],
+                  s[3],
+                  s[4],
+                  s[5],
+                  (o[0] as u16) << 8 | o[1] as u16,
+                  (o[2] as u16) << 8 | o[3] as u16)
+}
+
+// Orders the addresses the server resolved to in the order to try them:
+// IPv4 addresses are synthesized into `nat64_prefix` if given, and IPv6
+// addresses go first if preferred. Otherwise the resolver's order stands.
+pub fn order_addresses(addresses: Vec<IpAddr>,
+                       prefer_ipv6: bool,
+                       nat64_prefix: Option<Ipv6Addr>)
+                       -> Vec<IpAddr> {
+    let mut addresses: Vec<IpAddr> = addresses.into_iter()
+        .map(|ip| match (ip, nat64_prefix) {
+            (IpAddr::V4(v4), Some(prefix)) => IpAddr::V6(synthesize(prefix, v4)),
+            (ip, _) => ip,
+        })
+        .collect();
+    if prefer_ipv6 {
+        // Stable, so each family keeps the resolver's order.
+        addresses.sort_by_key(|ip| ip.is_ipv4());
+    }
+    addresses.dedup();
+    addresses
+}
+
+// Looks up the addresses of the server at `host` as the client should try
+// them.
+pub fn resolve_server(host: &str, config: &config::ClientConfig) -> Result<Vec<IpAddr>, String> {
+    let addresses = try!(resolve_all(host));
+    Ok(order_addresses(addresses, config.prefer_ipv6, config.nat64_prefix))
+}
+
+// Resolves the server's hostname again every `interval`, so the client can
+// follow it to a new address.
+pub struct HostWatcher {
+    host: String,
+    interval: Duration,
+    last: Instant,
+}
+
+impl HostWatcher {
+    pub fn new(host: &str, interval: Duration, now: Instant) -> HostWatcher {
+        HostWatcher {
+            host: String::from(host),
+            interval: interval,
+            last: now,
+        }
+    }
+
+    // Returns the address to move to if a resolution is due and `current` is
+    // no longer among the results. Failed lookups keep the current address.
+    pub fn check<F>(&mut self, current: IpAddr, now: Instant, resolve: F) -> Option<IpAddr>
+        where F: Fn(&str) -> Result<Vec<IpAddr>, String>
+    {
+        if now < self.last + self.interval {
+            return None;
+        }
+        self.last = now;
+        match resolve(&self.host) {
+            Ok(ref ips) if ips.is_empty() || ips.contains(&current) => None,
+            Ok(ips) => Some(ips[0]),
+            Err(e) => {
+                warn!("Unable to resolve {}: {}", self.host, e);
+                None
+            }
+        }
+    }
+}
+
+// The local address the kernel would send from to reach `remote` right now.
+// Connecting a UDP socket only picks a route; nothing is sent.
+pub fn preferred_source(remote: &SocketAddr) -> io::Result<IpAddr> {
+    let local: SocketAddr = match *remote {
+        SocketAddr::V4(_) => "0.0.0.0:0".parse().unwrap(),
+        SocketAddr::V6(_) => "[::]:0".parse().unwrap(),
+    };
+    let socket = try!(UdpSocket::bind(&local));
+    try!(socket.connect(remote));
+    Ok(try!(socket.local_addr()).ip())
+}
+
+// Checks every `interval` which local address leads to the server, so the
+// client notices when it moves to another network (e.g. from Wi-Fi to
+// cellular) even though the socket reports no error.
+pub struct PathWatcher {
+    source: IpAddr,
+    interval: Duration,
+    last: Instant,
+}
+
+impl PathWatcher {
+    pub fn new(source: IpAddr, interval: Duration, now: Instant) -> PathWatcher {
+        PathWatcher {
+            source: source,
+            interval: interval,
+            last: now,
+        }
+    }
+
+    // Returns the new local address if a check is due and it changed. Failed
+    // checks, e.g. while no network is up, keep the current one.
+    pub fn check<F>(&mut self, remote: &SocketAddr, now: Instant, probe: F) -> Option<IpAddr>
+        where F: Fn(&SocketAddr) -> io::Result<IpAddr>
+    {
+        if now < self.last + self.interval {
+            return None;
+        }
+        self.last = now;
+        match probe(remote) {
+            Ok(source) if source != self.source => {
+                self.source = source;
+                Some(source)
+            }
+            Ok(_) => None,
+            Err(e) => {
+                debug!("No route to {}: {}", remote, e);
+                None
+            }
+        }
+    }
+}
+
+// A random delay of less than `window` before reconnecting, so clients that
+// all notice a change at once spread their handshakes over the window instead
+// of arriving at the server together.
+pub fn reconnect_delay<R: Rng>(window: Duration, rng: &mut R) -> Duration {
+    let window_ms = window.as_secs() * 1000 + (window.subsec_nanos() / 1_000_000) as u64;
+    match window_ms {
+        0 => Duration::from_secs(0),
+        ms => Duration::from_millis(rng.gen_range(0, ms)),
+    }
+}
+
+// Sleeps for `delay`, waking early on interruption. Returns false if
+// interrupted.
+fn pause(delay: Duration) -> bool {
+    let deadline = Instant::now() + delay;
+    loop {
+        if INTERRUPTED.load(Ordering::Relaxed) {
+            return false;
+        }
+        let now = Instant::now();
+        if now >= deadline {
+            return true;
+        }
+        thread::sleep(cmp::min(deadline - now, Duration::from_millis(100)));
+    }
+}
+
+fn create_tun_attempt() -> Result<device::Tun, String> {
+    fn attempt(id: u8) -> Result<device::Tun, String> {
         match id {
-            255 => panic!("Unable to create TUN device."),
+            255 => Err(String::from("Unable to create TUN device.")),
             _ => {
                 match device::Tun::create(id) {
-                    Ok(tun) => tun,
+                    Ok(tun) => Ok(tun),
+                    Err(ref e) if e.kind() == io::ErrorKind::PermissionDenied => {
+                        Err(format!("Unable to create TUN device: {}. {}",
+                                    e,
+                                    utils::check_privileges().err().unwrap_or_default()))
+                    }
                     Err(_) => attempt(id + 1),
                 }
             }
@@ -67,319 +446,2615 @@ fn create_tun_attempt() -> device::Tun {
     attempt(0)
 }
 
-fn derive_keys(password: &str) -> (aead::SealingKey, aead::OpeningKey) {
-    let mut key = [0; KEY_LEN];
-    let salt = vec![0; 64];
-    pbkdf2::derive(&digest::SHA256, 1024, &salt, password.as_bytes(), &mut key);
-    let sealing_key = aead::SealingKey::new(&aead::AES_256_GCM, &key).unwrap();
-    let opening_key = aead::OpeningKey::new(&aead::AES_256_GCM, &key).unwrap();
-    (sealing_key, opening_key)
+// Reads a packet from the TUN device. Returns None if the device vanished,
+// e.g. was deleted with `ip link del`, and has to be recreated.
+fn read_tun<T: PacketIO>(tun: &mut T, buf: &mut [u8]) -> Option<usize> {
+    match tun.read_packet(buf) {
+        Ok(len) => Some(len),
+        Err(ref e) if device::is_vanished(e) => None,
+        Err(e) => panic!("{}", e),
+    }
 }
 
-fn initiate(socket: &UdpSocket, addr: &SocketAddr, secret: &str) -> Result<(Id, Token), String> {
-    let (sealing_key, opening_key) = derive_keys(secret);
-    let req_msg = Message::Request;
-    let encoded_req_msg: Vec<u8> = try!(serialize(&req_msg, Infinite).map_err(|e| e.to_string()));
-    let mut encrypted_req_msg = encoded_req_msg.clone();
-    encrypted_req_msg.resize(encoded_req_msg.len() + TAG_LEN, 0);
-    let mut remaining_len =
-        aead::seal_in_place(&sealing_key, NONCE, &[], &mut encrypted_req_msg, TAG_LEN).unwrap();
-
-    while remaining_len > 0 {
-        let sent_bytes = try!(socket.send_to(&encrypted_req_msg, addr)
-            .map_err(|e| e.to_string()));
-        remaining_len -= sent_bytes;
+// Recreates a TUN device that vanished, with `configure` bringing it up
+// again, trying up to `attempts` times with backoff. Zero gives up at once.
+fn recreate_tun<F>(tun: &device::Tun, attempts: u32, configure: F) -> Result<device::Tun, String>
+    where F: Fn(&device::Tun) -> Result<(), String>
+{
+    if attempts == 0 {
+        return Err(format!("TUN device {} vanished.", tun.name()));
     }
-    info!("Request sent to {}.", addr);
+    warn!("TUN device {} vanished. Recreating it.", tun.name());
+    let policy = utils::RetryPolicy {
+        attempts: attempts,
+        backoff: Duration::from_millis(TUN_RECREATE_BACKOFF_MS),
+        ..Default::default()
+    };
+    let recreated = try!(policy.run(&format!("Recreating TUN device {}", tun.name()), |_| {
+        let recreated = try!(tun.recreate().map_err(|e| e.to_string()));
+        try!(configure(&recreated));
+        Ok(recreated)
+    }));
+    info!("TUN device {} recreated.", recreated.name());
+    Ok(recreated)
+}
 
-    let mut buf = [0u8; 1600];
-    let (len, recv_addr) = try!(socket.recv_from(&mut buf).map_err(|e| e.to_string()));
-    assert_eq!(&recv_addr, addr);
-    info!("Response received from {}.", addr);
-    let decrypted_buf = aead::open_in_place(&opening_key, NONCE, &[], 0, &mut buf[0..len]).unwrap();
-    let dlen = decrypted_buf.len();
-    let resp_msg: Message = try!(deserialize(&decrypted_buf[0..dlen]).map_err(|e| e.to_string()));
-    match resp_msg {
-        Message::Response { id, token } => Ok((id, token)),
-        _ => Err(format!("Invalid message {:?} from {}", resp_msg, addr)),
+// Drops a broadcast or multicast inner packet if configured to. Returns whether
+// it was dropped.
+fn drop_non_unicast(filter: &Option<UnicastFilter>, packet: &[u8], stats: &Stats) -> bool {
+    match *filter {
+        Some(ref filter) if !filter.allows(packet) => {
+            stats.dropped();
+            stats.sink().counter("kytan_non_unicast_drops_total", 1);
+            true
+        }
+        _ => false,
     }
 }
 
-pub fn connect(host: &str, port: u16, default: bool, secret: &str) {
-    info!("Working in client mode.");
-    let remote_ip = resolve(host).unwrap();
-    let remote_addr = SocketAddr::new(remote_ip, port);
-    info!("Remote server: {}", remote_addr);
-
-    let local_addr: SocketAddr = "0.0.0.0:0".parse::<SocketAddr>().unwrap();
-    let socket = UdpSocket::bind(&local_addr).unwrap();
-
-    let (sealing_key, opening_key) = derive_keys(secret);
+// Drops an inner packet longer than `max` bytes, which a correct MTU never
+// lets through. Zero allows any size. Returns whether it was dropped.
+fn drop_oversized(max: usize, packet: &[u8], stats: &Stats) -> bool {
+    if max == 0 || packet.len() <= max {
+        return false;
+    }
+    stats.dropped();
+    stats.sink().counter("kytan_oversized_drops_total", 1);
+    true
+}
 
-    let (id, token) = initiate(&socket, &remote_addr, &secret).unwrap();
-    info!("Session established with token {}. Assigned IP address: 10.10.10.{}.",
-          token,
-          id);
+// Whether data claiming to be from session `id` is from a client without a
+// session, e.g. one that has not finished its handshake, or with another's
+// token. Such data is dropped before anything is done with it: no session is
+// kept alive by it, and it is only logged at debug level, so a flood of it
+// costs little.
+fn unsolicited(sessions: &SessionTable, id: Id, token: Token, stats: &Stats) -> bool {
+    match sessions.peek(id) {
+        Some(session) if session.token == token => return false,
+        Some(_) => debug!("Dropping data with mismatched token from id {}.", id),
+        None => debug!("Dropping data for unknown id {}.", id),
+    }
+    stats.dropped();
+    stats.sink().counter("kytan_unsolicited_drops_total", 1);
+    true
+}
 
-    info!("Bringing up TUN device.");
-    let mut tun = create_tun_attempt();
-    let tun_rawfd = tun.as_raw_fd();
-    tun.up(id);
-    let tunfd = mio::unix::EventedFd(&tun_rawfd);
-    info!("TUN device {} initialized. Internal IP: 10.10.10.{}/24.",
-          tun.name(),
-          id);
+// Writes a decrypted inner packet to the TUN device. Malformed packets and
+// failed writes are dropped and counted, so one bad packet does not bring the
+// tunnel down.
+fn write_inner<T: PacketIO>(tun: &mut T, packet: &[u8], stats: &Stats) -> bool {
+    if !packet::is_valid_ip(packet) {
+        warn!("Dropping malformed inner packet of {} bytes.", packet.len());
+        stats.dropped();
+        stats.sink().counter("kytan_malformed_drops_total", 1);
+        return false;
+    }
+    if let Err(e) = tun.write_packet(packet) {
+        warn!("Failed to write inner packet of {} bytes: {}", packet.len(), e);
+        stats.dropped();
+        return false;
+    }
+    true
+}
 
-    let poll = mio::Poll::new().unwrap();
-    info!("Setting up TUN device for polling.");
-    poll.register(&tunfd, TUN, mio::Ready::readable(), mio::PollOpt::level()).unwrap();
+// Where a client's inner packets go to and come from.
+enum Local {
+    Tun(device::Tun),
+    Socks(socks::Proxy),
+}
 
-    info!("Setting up socket for polling.");
-    let sockfd = mio::net::UdpSocket::from_socket(socket).unwrap();
-    poll.register(&sockfd, SOCK, mio::Ready::readable(), mio::PollOpt::level()).unwrap();
+impl Local {
+    fn set_mtu(&mut self, mtu: u16) -> Result<(), String> {
+        match *self {
+            Local::Tun(ref tun) => tun.set_mtu(mtu),
+            Local::Socks(ref mut proxy) => Ok(proxy.set_mtu(mtu)),
+        }
+    }
 
-    let mut events = mio::Events::with_capacity(1024);
-    let mut buf = [0u8; 1600];
+    fn up_link(&mut self, id: Id, prefix_len: u8, peer: Id, mtu: u16) {
+        match *self {
+            Local::Tun(ref tun) => tun.up_link(id, prefix_len, peer, mtu),
+            Local::Socks(ref mut proxy) => proxy.set_address(Ipv4Addr::new(10, 10, 10, id)),
+        }
+    }
+}
 
-    // RAII so ignore unused variable warning
-    let _gw = if default {
-        Some(utils::DefaultGateway::create("10.10.10.1", &format!("{}", remote_addr.ip())))
-    } else {
-        None
-    };
+impl PacketIO for Local {
+    fn read_packet(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        match *self {
+            Local::Tun(ref mut tun) => tun.read_packet(buf),
+            Local::Socks(ref mut proxy) => proxy.read_packet(buf),
+        }
+    }
 
-    let mut encoder = snap::Encoder::new();
-    let mut decoder = snap::Decoder::new();
+    fn write_packet(&mut self, packet: &[u8]) -> io::Result<()> {
+        match *self {
+            Local::Tun(ref mut tun) => tun.write_packet(packet),
+            Local::Socks(ref mut proxy) => proxy.write_packet(packet),
+        }
+    }
+}
 
-    CONNECTED.store(true, Ordering::Relaxed);
-    info!("Ready for transmission.");
+// Sends a packet read from the TUN device or the SOCKS proxy to the server,
+// unless it is oversized or not unicast. Returns what `forward` does.
+fn forward_local(tunnel: &mut Tunnel,
+                 packet: &[u8],
+                 max_inner_packet: usize,
+                 filter: &Option<UnicastFilter>,
+                 tap: &Option<Tap>)
+                 -> bool {
+    if drop_oversized(max_inner_packet, packet, tunnel.stats()) {
+        debug!("Dropping oversized packet of {} bytes.", packet.len());
+        return false;
+    }
+    if drop_non_unicast(filter, packet, tunnel.stats()) {
+        return false;
+    }
+    forward(tunnel, packet, tap)
+}
 
-    loop {
-        if INTERRUPTED.load(Ordering::Relaxed) {
-            break;
+// Sends an inner packet to the server. Returns whether the MTU was lowered
+// on the way, which the local side has to follow.
+fn forward(tunnel: &mut Tunnel, packet: &[u8], tap: &Option<Tap>) -> bool {
+    match tunnel.send(packet) {
+        Ok(_) => mirror(tap, packet),
+        // Read before an MTU decrease took effect.
+        Err(ref e) if e.kind() == io::ErrorKind::InvalidInput => {
+            debug!("Dropping packet: {}", e);
+            tunnel.stats().dropped();
         }
-        poll.poll(&mut events, None).unwrap();
-        for event in events.iter() {
-            match event.token() {
-                SOCK => {
-                    let (len, addr) = sockfd.recv_from(&mut buf).unwrap();
-                    let decrypted_buf =
-                        aead::open_in_place(&opening_key, NONCE, &[], 0, &mut buf[0..len]).unwrap();
-                    let dlen = decrypted_buf.len();
-                    let msg: Message = deserialize(&decrypted_buf[0..dlen]).unwrap();
-                    match msg {
-                        Message::Request |
-                        Message::Response { id: _, token: _ } => {
-                            warn!("Invalid message {:?} from {}", msg, addr);
-                        }
-                        Message::Data { id: _, token: server_token, data } => {
-                            if token == server_token {
-                                let decompressed_data = decoder.decompress_vec(&data).unwrap();
-                                let data_len = decompressed_data.len();
-                                let mut sent_len = 0;
-                                while sent_len < data_len {
-                                    sent_len += tun.write(&decompressed_data[sent_len..data_len])
-                                        .unwrap();
-                                }
-                            } else {
-                                warn!("Token mismatched. Received: {}. Expected: {}",
-                                      server_token,
-                                      token);
-                            }
-                        }
-                    }
-                }
-                TUN => {
-                    let len: usize = tun.read(&mut buf).unwrap();
-                    let data = &buf[0..len];
-                    let msg = Message::Data {
-                        id: id,
-                        token: token,
-                        data: encoder.compress_vec(data).unwrap(),
-                    };
-                    let encoded_msg = serialize(&msg, Infinite).unwrap();
-                    let mut encrypted_msg = encoded_msg.clone();
-                    encrypted_msg.resize(encoded_msg.len() + TAG_LEN, 0);
-                    let data_len =
-                        aead::seal_in_place(&sealing_key, NONCE, &[], &mut encrypted_msg, TAG_LEN)
-                            .unwrap();
-                    let mut sent_len = 0;
-                    while sent_len < data_len {
-                        sent_len += sockfd.send_to(&encrypted_msg[sent_len..data_len], &remote_addr)
-                            .unwrap();
-                    }
+        // The path to the server is narrower than our MTU.
+        Err(ref e) if e.raw_os_error() == Some(libc::EMSGSIZE) => {
+            tunnel.stats().dropped();
+            match tunnel.update_path_mtu() {
+                Ok(Some(mtu)) => {
+                    info!("Path MTU decreased. Lowering MTU to {}.", mtu);
+                    CURRENT_MTU.store(tunnel.tun_mtu() as usize, Ordering::Relaxed);
+                    return true;
                 }
-                _ => unreachable!(),
+                Ok(None) => {}
+                Err(e) => warn!("Unable to get path MTU: {}", e),
             }
         }
+        // Still in flight while the server restarts or we reconnect; the
+        // packet is lost like on any link.
+        Err(ref e) if is_transient(e) => {
+            debug!("Dropping packet while the server is unreachable: {}", e);
+            tunnel.stats().dropped();
+        }
+        Err(e) => panic!("{}", e),
     }
+    false
 }
 
-pub fn serve(port: u16, secret: &str) {
-    if cfg!(not(target_os = "linux")) {
-        panic!("Server mode is only available in Linux!");
+// Writes an inner packet from the server to the TUN device, unless it is
+// oversized or filtered, and mirrors it.
+fn deliver<T: PacketIO>(tun: &mut T,
+                        packet: &[u8],
+                        max_inner_packet: usize,
+                        filter: &Option<UnicastFilter>,
+                        tap: &Option<Tap>,
+                        stats: &Stats) {
+    if drop_oversized(max_inner_packet, packet, stats) {
+        debug!("Dropping oversized packet of {} bytes from the server.", packet.len());
+    } else if !drop_non_unicast(filter, packet, stats) && write_inner(tun, packet, stats) {
+        mirror(tap, packet);
     }
+}
 
-    info!("Working in server mode.");
+// Sends what is left in `queue` at shutdown, giving up after `timeout` so a
+// session that cannot be sent to does not hold up the exit. Returns how many
+// packets were left unsent.
+fn drain<F>(queue: &mut FairQueue<Id>, timeout: Duration, mut send: F) -> usize
+    where F: FnMut(Id, &[u8]) -> io::Result<()>
+{
+    let deadline = Instant::now() + timeout;
+    while Instant::now() < deadline {
+        let (id, packet) = match queue.pop() {
+            Some(next) => next,
+            None => break,
+        };
+        match send(id, &packet) {
+            Ok(_) => {}
+            Err(ref e) if e.kind() == io::ErrorKind::WouldBlock => {
+                // To the back, so the other sessions still get their turn.
+                queue.push(id, packet);
+                thread::sleep(Duration::from_millis(1));
+            }
+            Err(e) => warn!("Failed to send to id {} during drain: {}", id, e),
+        }
+    }
+    queue.len()
+}
 
-    let public_ip = utils::get_public_ip().unwrap();
-    info!("Public IP: {}", public_ip);
+// Decrements the TTL of a packet from a client if configured to. Returns the
+// ICMP time exceeded message to send back instead if the TTL expired.
+fn apply_ttl(enabled: bool, packet: &mut [u8]) -> Result<(), Vec<u8>> {
+    if !enabled || packet::decrement_ttl(packet) {
+        return Ok(());
+    }
+    Err(packet::time_exceeded(packet, Ipv4Addr::new(10, 10, 10, 1)))
+}
 
-    info!("Enabling kernel's IPv4 forwarding.");
-    utils::enable_ipv4_forwarding().unwrap();
+// Fits a packet to a client into its downstream MTU, if it has one. Returns
+// the fragments to send instead if it had to be split, none if it goes as it
+// is, or the ICMP fragmentation needed message for `source`, the server's end
+// of the client's link, to send back if DF is set. Only IPv4 packets are
+// split; anything else goes as it is.
+fn fit_downstream(packet: &[u8],
+                  mtu: Option<u16>,
+                  source: Ipv4Addr)
+                  -> Result<Vec<Vec<u8>>, Vec<u8>> {
+    let mtu = match mtu {
+        Some(mtu) if packet.len() > mtu as usize => mtu,
+        _ => return Ok(Vec::new()),
+    };
+    if packet.len() < 20 || packet[0] >> 4 != 4 {
+        return Ok(Vec::new());
+    }
+    match packet::fragment(packet, mtu as usize) {
+        Some(fragments) => Ok(fragments),
+        None if packet[6] & 0x40 != 0 => Err(packet::fragmentation_needed(packet, source, mtu)),
+        None => Ok(Vec::new()),
+    }
+}
 
-    info!("Bringing up TUN device.");
-    let mut tun = create_tun_attempt();
-    tun.up(1);
+// Whether a failed send or receive on the tunnel only means the server is
+// unreachable for now, e.g. an ICMP port unreachable while it restarts or
+// while we reconnect, rather than that the tunnel is broken.
+pub fn is_transient(e: &io::Error) -> bool {
+    match e.kind() {
+        io::ErrorKind::ConnectionRefused |
+        io::ErrorKind::ConnectionReset |
+        io::ErrorKind::NotConnected |
+        io::ErrorKind::WouldBlock |
+        io::ErrorKind::Interrupted => true,
+        _ => {
+            e.raw_os_error() == Some(libc::ENETUNREACH) ||
+            e.raw_os_error() == Some(libc::EHOSTUNREACH)
+        }
+    }
+}
 
-    let tun_rawfd = tun.as_raw_fd();
-    let tunfd = mio::unix::EventedFd(&tun_rawfd);
-    info!("TUN device {} initialized. Internal IP: 10.10.10.1/24.",
-          tun.name());
+// Counts the datagrams a send batch got to the kernel as sent, and those it
+// refused, e.g. with ENOBUFS while the uplink is congested, as drops.
+fn count_delivery(delivery: Delivery, stats: &Stats) {
+    for len in delivery.sent {
+        stats.sent(len);
+    }
+    for _ in 0..delivery.lost {
+        stats.dropped();
+    }
+    if let Some(e) = delivery.error {
+        warn!("Dropped {} datagram(s) the kernel refused: {}", delivery.lost, e);
+    }
+}
 
-    let addr = format!("0.0.0.0:{}", port).parse().unwrap();
-    let sockfd = mio::net::UdpSocket::bind(&addr).unwrap();
-    info!("Listening on: 0.0.0.0:{}.", port);
+fn mirror(tap: &Option<Tap>, packet: &[u8]) {
+    if let Some(ref tap) = *tap {
+        tap.mirror(packet);
+    }
+}
 
-    let poll = mio::Poll::new().unwrap();
-    poll.register(&sockfd, SOCK, mio::Ready::readable(), mio::PollOpt::level()).unwrap();
-    poll.register(&tunfd, TUN, mio::Ready::readable(), mio::PollOpt::level()).unwrap();
+// Counts an inner packet in its flow, if flows are exported.
+fn account(flows: &mut Option<(FlowTable, Exporter)>, packet: &[u8]) {
+    if let Some((ref mut table, _)) = *flows {
+        table.account(packet, Instant::now(), SystemTime::now());
+    }
+}
 
-    let mut events = mio::Events::with_capacity(1024);
+fn export_flows(exporter: &mut Exporter, records: &[FlowRecord], stats: &Stats) {
+    if records.is_empty() {
+        return;
+    }
+    match exporter.export(records, Instant::now(), SystemTime::now()) {
+        Ok(()) => stats.sink().counter("kytan_flows_exported_total", records.len() as u64),
+        Err(e) => warn!("Failed to export {} flow(s): {}", records.len(), e),
+    }
+}
+
+fn unicast_filter(enabled: bool, groups: &[Ipv4Addr], prefix_len: u8) -> Option<UnicastFilter> {
+    if enabled {
+        Some(UnicastFilter::new(groups, prefix_len))
+    } else {
+        None
+    }
+}
 
-    let mut rng = thread_rng();
-    let mut available_ids: Vec<Id> = (2..254).collect();
-    let mut client_info: TransientHashMap<Id, (Token, SocketAddr)> = TransientHashMap::new(60);
+// The keys handshakes with `password` are sealed with, and the keys of
+// their sessions derived from.
+pub fn derive_keys(password: &str) -> MemoryKeyStore {
+    MemoryKeyStore::new(KeySchedule::from_password(password, &[0; 64]), cipher::HANDSHAKE)
+}
 
-    let mut buf = [0u8; 1600];
-    let mut encoder = snap::Encoder::new();
-    let mut decoder = snap::Decoder::new();
+// A fresh nonce for one side of a handshake.
+pub fn handshake_nonce() -> Result<HandshakeNonce, String> {
+    let mut nonce = [0; 16];
+    try!(SystemRandom::new().fill(&mut nonce).map_err(|_| "SystemRandom::fill"));
+    Ok(nonce)
+}
 
-    let (sealing_key, opening_key) = derive_keys(secret);
+// The keys under `cipher` of the session `nonces` agreed on, from the keys its
+// handshake was sealed with, as the client uses them if `client` is set and
+// as the server does otherwise.
+pub fn session_keys(keys: &KeyStore,
+                    cipher: Cipher,
+                    nonces: &(HandshakeNonce, HandshakeNonce),
+                    client: bool)
+                    -> Result<Box<KeyStore>, String> {
+    let mut context = nonces.0.to_vec();
+    context.extend_from_slice(&nonces.1);
+    let (sealing, opening) = if client {
+        (cipher::CLIENT_TO_SERVER, cipher::SERVER_TO_CLIENT)
+    } else {
+        (cipher::SERVER_TO_CLIENT, cipher::CLIENT_TO_SERVER)
+    };
+    keys.derive(cipher, &context, sealing, opening)
+}
 
-    LISTENING.store(true, Ordering::Relaxed);
-    info!("Ready for transmission.");
+fn seal_message(keys: &KeyStore, nonce: &[u8], msg: &Message) -> Result<Vec<u8>, String> {
+    let mut encrypted_msg = try!(serialize(msg, Infinite).map_err(|e| e.to_string()));
+    try!(keys.seal(nonce, &mut encrypted_msg));
+    Ok(encrypted_msg)
+}
 
-    loop {
-        if INTERRUPTED.load(Ordering::Relaxed) {
-            break;
-        }
+pub fn open_message(keys: &KeyStore, nonce: &[u8], buf: &mut [u8]) -> Result<Message, String> {
+    let decrypted_buf = try!(keys.open(nonce, buf));
+    deserialize(decrypted_buf).map_err(|e| e.to_string())
+}
 
-        // Clear expired client info
-        available_ids.append(&mut client_info.prune());
-        poll.poll(&mut events, None).unwrap();
-        for event in events.iter() {
-            match event.token() {
-                SOCK => {
-                    let (len, addr) = sockfd.recv_from(&mut buf).unwrap();
-                    let decrypted_buf =
-                        aead::open_in_place(&opening_key, NONCE, &[], 0, &mut buf[0..len]).unwrap();
-                    let dlen = decrypted_buf.len();
-                    let msg: Message = deserialize(&decrypted_buf[0..dlen]).unwrap();
-                    match msg {
-                        Message::Request => {
-                            let client_id: Id = available_ids.pop().unwrap();
-                            let client_token: Token = rng.gen::<Token>();
+// What is sent ahead of a sealed message, in the clear, so the receiver knows
+// which key and nonce to open it with: for a handshake, the identity of a
+// client with a pre-shared key of its own, and for data, the id of the
+// session and the number of the packet.
+#[derive(Debug, PartialEq)]
+pub enum Header {
+    Handshake(Option<String>),
+    Data(Id, u64),
+}
 
-                            client_info.insert(client_id, (client_token, addr));
+// The nonce data numbered `number` is sealed under.
+pub fn data_nonce(number: u64) -> [u8; NONCE_LEN] {
+    let mut nonce = [0; NONCE_LEN];
+    for i in 0..NUMBER_LEN {
+        nonce[NONCE_LEN - 1 - i] = (number >> (8 * i)) as u8;
+    }
+    nonce
+}
 
-                            info!("Got request from {}. Assigning IP address: 10.10.10.{}.",
-                                  addr,
-                                  client_id);
+// Seals a Request or Response under a random nonce, prefixed with a length
+// byte and `identity` (nothing if it is None) and the nonce.
+pub fn seal_handshake(identity: Option<&str>,
+                      keys: &KeyStore,
+                      msg: &Message)
+                      -> Result<Vec<u8>, String> {
+    let identity = identity.unwrap_or("");
+    if identity.len() > u8::max_value() as usize {
+        return Err(format!("Identifier {} is too long to go with a pre-shared key.", identity));
+    }
+    let mut nonce = [0; NONCE_LEN];
+    try!(SystemRandom::new().fill(&mut nonce).map_err(|_| "SystemRandom::fill"));
+    let mut datagram = vec![HANDSHAKE, identity.len() as u8];
+    datagram.extend_from_slice(identity.as_bytes());
+    datagram.extend_from_slice(&nonce);
+    datagram.extend_from_slice(&try!(seal_message(keys, &nonce, msg)));
+    Ok(datagram)
+}
 
-                            let reply = Message::Response {
-                                id: client_id,
-                                token: client_token,
-                            };
-                            let encoded_reply = serialize(&reply, Infinite).unwrap();
-                            let mut encrypted_reply = encoded_reply.clone();
-                            encrypted_reply.resize(encoded_reply.len() + TAG_LEN, 0);
-                            let data_len = aead::seal_in_place(&sealing_key,
-                                                               NONCE,
-                                                               &[],
-                                                               &mut encrypted_reply,
-                                                               TAG_LEN)
-                                .unwrap();
-                            let mut sent_len = 0;
-                            while sent_len < data_len {
-                                sent_len +=
-                                    sockfd.send_to(&encrypted_reply[sent_len..data_len], &addr)
-                                        .unwrap();
-                            }
-                        }
-                        Message::Response { id: _, token: _ } => {
-                            warn!("Invalid message {:?} from {}", msg, addr)
-                        }
-                        Message::Data { id, token, data } => {
-                            match client_info.get(&id) {
-                                None => warn!("Unknown data with token {} from id {}.", token, id),
-                                Some(&(t, _)) => {
-                                    if t != token {
-                                        warn!("Unknown data with mismatched token {} from id {}. \
-                                               Expected: {}",
-                                              token,
-                                              id,
-                                              t);
-                                    } else {
-                                        let decompressed_data = decoder.decompress_vec(&data)
-                                            .unwrap();
-                                        let data_len = decompressed_data.len();
-                                        let mut sent_len = 0;
-                                        while sent_len < data_len {
-                                            sent_len +=
-                                                tun.write(&decompressed_data[sent_len..data_len])
-                                                    .unwrap();
-                                        }
-                                    }
-                                }
-                            }
-                        }
-                    }
-                }
-                TUN => {
-                    let len: usize = tun.read(&mut buf).unwrap();
-                    let data = &buf[0..len];
-                    let client_id: u8 = data[19];
-
-                    match client_info.get(&client_id) {
-                        None => warn!("Unknown IP packet from TUN for client {}.", client_id),
-                        Some(&(token, addr)) => {
-                            let msg = Message::Data {
-                                id: client_id,
-                                token: token,
-                                data: encoder.compress_vec(data).unwrap(),
-                            };
-                            let encoded_msg = serialize(&msg, Infinite).unwrap();
-                            let mut encrypted_msg = encoded_msg.clone();
-                            encrypted_msg.resize(encoded_msg.len() + TAG_LEN, 0);
-                            let data_len = aead::seal_in_place(&sealing_key,
-                                                               NONCE,
-                                                               &[],
-                                                               &mut encrypted_msg,
-                                                               TAG_LEN)
-                                .unwrap();
-                            let mut sent_len = 0;
-                            while sent_len < data_len {
-                                sent_len +=
-                                    sockfd.send_to(&encrypted_msg[sent_len..data_len], &addr)
-                                        .unwrap();
-                            }
-                        }
-                    }
-                }
-                _ => unreachable!(),
+// Seals a data message with the keys of its session as packet `number` of its
+// direction, prefixed with the id of the session and the number.
+pub fn seal_data(keys: &KeyStore, number: u64, msg: &Message) -> Result<Vec<u8>, String> {
+    let id = match *msg {
+        Message::Data { id, .. } => id,
+        _ => return Err(format!("Message {:?} is not data.", msg)),
+    };
+    let nonce = data_nonce(number);
+    let mut datagram = vec![DATA, id];
+    datagram.extend_from_slice(&nonce[NONCE_LEN - NUMBER_LEN..]);
+    datagram.extend_from_slice(&try!(seal_message(keys, &nonce, msg)));
+    Ok(datagram)
+}
+
+// The header of a datagram, the nonce its message was sealed under, and
+// where the sealed message starts.
+pub fn split_datagram(datagram: &[u8]) -> Result<(Header, [u8; NONCE_LEN], usize), String> {
+    let mut nonce = [0; NONCE_LEN];
+    match datagram.first() {
+        Some(&HANDSHAKE) => {
+            let end = 2 + *try!(datagram.get(1).ok_or("Truncated header")) as usize;
+            if end + NONCE_LEN > datagram.len() {
+                return Err(String::from("Truncated header"));
             }
+            let identity = try!(str::from_utf8(&datagram[2..end]).map_err(|e| e.to_string()));
+            let identity = if identity.is_empty() {
+                None
+            } else {
+                Some(String::from(identity))
+            };
+            nonce.copy_from_slice(&datagram[end..end + NONCE_LEN]);
+            Ok((Header::Handshake(identity), nonce, end + NONCE_LEN))
         }
+        Some(&DATA) if datagram.len() >= 2 + NUMBER_LEN => {
+            nonce[NONCE_LEN - NUMBER_LEN..].copy_from_slice(&datagram[2..2 + NUMBER_LEN]);
+            let number = nonce.iter().fold(0, |n, &b| (n << 8) | b as u64);
+            Ok((Header::Data(datagram[1], number), nonce, 2 + NUMBER_LEN))
+        }
+        _ => Err(String::from("Unknown header")),
     }
 }
 
-#[cfg(test)]
-mod tests {
-    use std::net::Ipv4Addr;
-    use network::*;
+// Opens a datagram with `keys`, whatever its header says.
+pub fn open_datagram(keys: &KeyStore, datagram: &mut [u8]) -> Result<Message, String> {
+    let (_, nonce, start) = try!(split_datagram(datagram));
+    open_message(keys, &nonce, &mut datagram[start..])
+}
 
-    #[cfg(target_os = "linux")]
-    use std::thread;
+// Receives a handshake message. These are not bound by the tunnel MTU and may
+// grow as more is negotiated, so the buffer is much larger than a data packet;
+// anything beyond it is rejected rather than silently truncated.
+// Waits for the answer to a handshake from `addr`, ignoring datagrams from
+// anywhere else, for as long as the socket's read timeout if it has one.
+// Gives up once `interrupted` is set, e.g. by SIGINT, so a Request that is
+// never answered does not keep us from exiting.
+fn recv_handshake(socket: &UdpSocket,
+                  addr: &SocketAddr,
+                  interrupted: &AtomicBool)
+                  -> Result<Vec<u8>, String> {
+    let timeout = try!(socket.read_timeout().map_err(|e| e.to_string()));
+    let result = wait_for_handshake(socket, addr, timeout, interrupted);
+    try!(socket.set_read_timeout(timeout).map_err(|e| e.to_string()));
+    result
+}
+
+fn wait_for_handshake(socket: &UdpSocket,
+                      addr: &SocketAddr,
+                      timeout: Option<Duration>,
+                      interrupted: &AtomicBool)
+                      -> Result<Vec<u8>, String> {
+    let deadline = timeout.map(|timeout| Instant::now() + timeout);
+    let mut buf = vec![0u8; MAX_HANDSHAKE_LEN + 1];
+    loop {
+        if interrupted.load(Ordering::Relaxed) {
+            return Err(format!("Interrupted while waiting for a response from {}.", addr));
+        }
+        let mut wait = Duration::from_millis(INTERRUPT_CHECK_MS);
+        if let Some(deadline) = deadline {
+            let now = Instant::now();
+            if now >= deadline {
+                return Err(format!("No response from {} within {:?}.", addr, timeout.unwrap()));
+            }
+            wait = cmp::min(wait, deadline - now);
+        }
+        try!(socket.set_read_timeout(Some(wait)).map_err(|e| e.to_string()));
+        match socket.recv_from(&mut buf) {
+            Ok((len, _)) if len > MAX_HANDSHAKE_LEN => {
+                return Err(format!("Response from {} exceeds {} bytes.", addr, MAX_HANDSHAKE_LEN));
+            }
+            Ok((len, recv_addr)) if recv_addr == *addr => {
+                buf.truncate(len);
+                return Ok(buf);
+            }
+            Ok((_, recv_addr)) => debug!("Ignoring a datagram from {}.", recv_addr),
+            Err(ref e) if e.kind() == io::ErrorKind::WouldBlock ||
+                          e.kind() == io::ErrorKind::TimedOut ||
+                          e.kind() == io::ErrorKind::Interrupted => {}
+            Err(e) => return Err(e.to_string()),
+        }
+    }
+}
+
+// How many seconds the clock of `peer` is ahead of ours, from `theirs`, its
+// time as it told us, and `ours`. Nothing fails on skew, but skew beyond
+// MAX_SKEW_SECS is logged, as it usually means NTP is not working.
+pub fn clock_skew(peer: &SocketAddr, theirs: u64, ours: u64) -> i64 {
+    let skew = theirs as i64 - ours as i64;
+    if skew.abs() as u64 > MAX_SKEW_SECS {
+        warn!("The clock of {} is {} seconds {} ours. Is NTP working on both?",
+              peer,
+              skew.abs(),
+              if skew > 0 { "ahead of" } else { "behind" });
+    }
+    skew
+}
+
+pub fn initiate(socket: &UdpSocket,
+                addr: &SocketAddr,
+                secret: &str,
+                identifier: Option<&str>,
+                log: &mut HandshakeLog)
+                -> Result<Assignment, String> {
+    initiate_with_dictionary(socket,
+                             addr,
+                             &derive_keys(secret),
+                             identifier,
+                             None,
+                             &[cipher::DEFAULT],
+                             None,
+                             &[],
+                             log)
+        .map(|(a, _)| a)
+}
+
+// Like `initiate`, also offering the compression dictionary `dictionary`, and
+// authenticating with the pre-shared key `psk` of `identifier` instead of the
+// shared keys `shared` if given. The server picks one of `ciphers` for the session.
+// `subnets` behind us are advertised for the server to route to us. Returns
+// whether the server accepted the dictionary.
+pub fn initiate_with_dictionary(socket: &UdpSocket,
+                                addr: &SocketAddr,
+                                shared: &KeyStore,
+                                identifier: Option<&str>,
+                                psk: Option<&str>,
+                                ciphers: &[Cipher],
+                                dictionary: Option<u64>,
+                                subnets: &[Subnet],
+                                log: &mut HandshakeLog)
+                                -> Result<(Assignment, bool), String> {
+    let own = psk.map(derive_keys);
+    let keys = own.as_ref().map_or(shared, |keys| keys as &KeyStore);
+    let identity = psk.and(identifier);
+    let nonce = try!(handshake_nonce());
+    let req_msg = Message::Request {
+        identifier: identifier.map(String::from),
+        nonce: nonce,
+        timestamp: session::unix_time(),
+        ciphers: ciphers.to_vec(),
+        dictionary: dictionary,
+        subnets: subnets.to_vec(),
+    };
+    let encrypted_req_msg = try!(seal_handshake(identity, keys, &req_msg));
+    let mut remaining_len = encrypted_req_msg.len();
+
+    while remaining_len > 0 {
+        let sent_bytes = try!(socket.send_to(&encrypted_req_msg, addr)
+            .map_err(|e| e.to_string()));
+        remaining_len -= sent_bytes;
+    }
+    log.step(HandshakeStep::RequestSent, &format!("Request sent to {}.", addr));
+
+    let mut buf = try!(recv_handshake(socket, addr, &INTERRUPTED));
+    log.step(HandshakeStep::ResponseReceived,
+             &format!("Response received from {}.", addr));
+    match try!(open_datagram(keys, &mut buf)) {
+        Message::Response { id,
+                            token,
+                            nonces,
+                            cipher,
+                            timestamp,
+                            link_prefix,
+                            mtu,
+                            compression,
+                            dictionary,
+                            .. } => {
+            if nonces.0 != nonce {
+                return Err(format!("Response from {} is not to our Request.", addr));
+            }
+            clock_skew(addr, timestamp, session::unix_time());
+            if !ciphers.contains(&cipher) {
+                return Err(format!("{} picked {}, which we did not offer.", addr, cipher.name()));
+            }
+            Ok((Assignment {
+                    id: id,
+                    token: token,
+                    mtu: mtu,
+                    compression: compression,
+                    nonces: nonces,
+                    cipher: cipher,
+                    link_prefix: link_prefix,
+                },
+                dictionary))
+        }
+        msg => Err(format!("Invalid message {:?} from {}", msg, addr)),
+    }
+}
+
+// Like `initiate_with_dictionary`, but waits at most `timeout` for each of a
+// few Requests. If none is answered, a diagnostic hello tells whether the
+// server is reachable, i.e. whether the keys or the network are to blame,
+// and the error says which.
+pub fn initiate_with_diagnosis(socket: &UdpSocket,
+                               addr: &SocketAddr,
+                               shared: &KeyStore,
+                               identifier: Option<&str>,
+                               psk: Option<&str>,
+                               ciphers: &[Cipher],
+                               dictionary: Option<u64>,
+                               subnets: &[Subnet],
+                               timeout: Duration,
+                               log: &mut HandshakeLog)
+                               -> Result<(Assignment, bool), String> {
+    let previous = try!(socket.read_timeout().map_err(|e| e.to_string()));
+    try!(socket.set_read_timeout(Some(timeout)).map_err(|e| e.to_string()));
+    let mut result = Err(String::new());
+    for _ in 0..DIAGNOSTIC_ATTEMPTS {
+        result = initiate_with_dictionary(socket,
+                                          addr,
+                                          shared,
+                                          identifier,
+                                          psk,
+                                          ciphers,
+                                          dictionary,
+                                          subnets,
+                                          log);
+        if result.is_ok() {
+            break;
+        }
+    }
+    let result = result.map_err(|e| match diagnose(socket, addr, timeout) {
+        Ok(true) => {
+            format!("Handshake failed: {}. The server answered an unauthenticated diagnostic \
+                     hello, so it is reachable: check that the secret{} matches the server's.",
+                    e,
+                    if psk.is_some() { " or pre-shared key" } else { "" })
+        }
+        Ok(false) => {
+            format!("Handshake failed: {}. The server did not answer a diagnostic hello \
+                     either: it is unreachable, down, or has diagnostic_hello disabled.",
+                    e)
+        }
+        Err(diagnosis) => format!("Handshake failed: {}. Diagnosis failed: {}", e, diagnosis),
+    });
+    try!(socket.set_read_timeout(previous).map_err(|e| e.to_string()));
+    result
+}
+
+// Sends a diagnostic hello to `addr` and waits up to `timeout` for the
+// reply. Returns whether it came. The reply is not authenticated, so
+// it only hints at what is wrong.
+pub fn diagnose(socket: &UdpSocket, addr: &SocketAddr, timeout: Duration) -> Result<bool, String> {
+    try!(socket.set_read_timeout(Some(timeout)).map_err(|e| e.to_string()));
+    try!(socket.send_to(DIAGNOSTIC_HELLO, addr).map_err(|e| e.to_string()));
+    let deadline = Instant::now() + timeout;
+    let mut buf = [0u8; 64];
+    while Instant::now() < deadline {
+        match socket.recv_from(&mut buf) {
+            Ok((len, from)) if from == *addr && &buf[..len] == DIAGNOSTIC_REPLY => return Ok(true),
+            // E.g. a late Response.
+            Ok(_) => {}
+            Err(ref e) if e.kind() == io::ErrorKind::WouldBlock ||
+                          e.kind() == io::ErrorKind::TimedOut ||
+                          is_transient(e) => return Ok(false),
+            Err(e) => return Err(e.to_string()),
+        }
+    }
+    Ok(false)
+}
+
+// The reply to `datagram` if it is a diagnostic hello.
+fn diagnostic_reply(datagram: &[u8]) -> Option<&'static [u8]> {
+    if datagram == DIAGNOSTIC_HELLO {
+        Some(DIAGNOSTIC_REPLY)
+    } else {
+        None
+    }
+}
+
+// Handshakes over TCP are framed as a 2-byte big-endian length and the sealed
+// message.
+pub fn write_frame<W: Write>(stream: &mut W, frame: &[u8]) -> io::Result<()> {
+    if frame.len() > MAX_HANDSHAKE_LEN {
+        return Err(io::Error::new(io::ErrorKind::InvalidInput, "Frame too large"));
+    }
+    try!(stream.write_all(&[(frame.len() >> 8) as u8, frame.len() as u8]));
+    stream.write_all(frame)
+}
+
+pub fn read_frame<R: Read>(stream: &mut R) -> Result<Vec<u8>, String> {
+    let mut len = [0u8; 2];
+    try!(stream.read_exact(&mut len).map_err(|e| e.to_string()));
+    let len = ((len[0] as usize) << 8) | len[1] as usize;
+    if len > MAX_HANDSHAKE_LEN {
+        return Err(format!("Frame of {} bytes exceeds {} bytes.", len, MAX_HANDSHAKE_LEN));
+    }
+    let mut frame = vec![0u8; len];
+    try!(stream.read_exact(&mut frame).map_err(|e| e.to_string()));
+    Ok(frame)
+}
+
+// Like `read_frame`, for a nonblocking stream: reads what has arrived into
+// `buf`, which keeps it between calls. Returns the frame once it is whole.
+pub fn read_partial_frame<R: Read>(stream: &mut R,
+                                   buf: &mut Vec<u8>)
+                                   -> Result<Option<Vec<u8>>, String> {
+    loop {
+        let wanted = if buf.len() < 2 {
+            2
+        } else {
+            let len = ((buf[0] as usize) << 8) | buf[1] as usize;
+            if len > MAX_HANDSHAKE_LEN {
+                return Err(format!("Frame of {} bytes exceeds {} bytes.", len, MAX_HANDSHAKE_LEN));
+            }
+            2 + len
+        };
+        if buf.len() == wanted {
+            return Ok(Some(buf.split_off(2)));
+        }
+        let start = buf.len();
+        buf.resize(wanted, 0);
+        match stream.read(&mut buf[start..]) {
+            Ok(0) => return Err(String::from("Connection closed mid-frame.")),
+            Ok(len) => buf.truncate(start + len),
+            Err(e) => {
+                buf.truncate(start);
+                match e.kind() {
+                    io::ErrorKind::WouldBlock => return Ok(None),
+                    io::ErrorKind::Interrupted => {}
+                    _ => return Err(e.to_string()),
+                }
+            }
+        }
+    }
+}
+
+// Performs the handshake over a TCP connection to the server, like
+// `initiate_with_dictionary`. Returns the assignment, whether the server
+// accepted the dictionary, and the UDP port to send data to.
+pub fn initiate_tcp(stream: &mut TcpStream,
+                    shared: &KeyStore,
+                    identifier: Option<&str>,
+                    psk: Option<&str>,
+                    ciphers: &[Cipher],
+                    dictionary: Option<u64>,
+                    subnets: &[Subnet],
+                    log: &mut HandshakeLog)
+                    -> Result<(Assignment, bool, u16), String> {
+    let own = psk.map(derive_keys);
+    let keys = own.as_ref().map_or(shared, |keys| keys as &KeyStore);
+    let addr = try!(stream.peer_addr().map_err(|e| e.to_string()));
+    let nonce = try!(handshake_nonce());
+    let req_msg = Message::Request {
+        identifier: identifier.map(String::from),
+        nonce: nonce,
+        timestamp: session::unix_time(),
+        ciphers: ciphers.to_vec(),
+        dictionary: dictionary,
+        subnets: subnets.to_vec(),
+    };
+    try!(write_frame(stream,
+                     &try!(seal_handshake(psk.and(identifier), keys, &req_msg)))
+        .map_err(|e| e.to_string()));
+    log.step(HandshakeStep::RequestSent,
+             &format!("Request sent to {} over TCP.", addr));
+
+    let mut frame = try!(read_frame(stream));
+    log.step(HandshakeStep::ResponseReceived,
+             &format!("Response received from {} over TCP.", addr));
+    match try!(open_datagram(keys, &mut frame)) {
+        Message::Response { id,
+                            token,
+                            nonces,
+                            cipher,
+                            timestamp,
+                            link_prefix,
+                            mtu,
+                            compression,
+                            dictionary,
+                            data_port: Some(port) } if nonces.0 == nonce &&
+                                                       ciphers.contains(&cipher) => {
+            clock_skew(&addr, timestamp, session::unix_time());
+            Ok((Assignment {
+                    id: id,
+                    token: token,
+                    mtu: mtu,
+                    compression: compression,
+                    nonces: nonces,
+                    cipher: cipher,
+                    link_prefix: link_prefix,
+                },
+                dictionary,
+                port))
+        }
+        msg => Err(format!("Invalid message {:?} from {}", msg, addr)),
+    }
+}
+
+// Sends a packet the server itself answers a client with, e.g. an ICMP error.
+// `keys` are those the session's keys derive from.
+fn answer(socket: &mio::net::UdpSocket,
+          sessions: &mut SessionTable,
+          keys: &KeyStore,
+          id: Id,
+          msg: &Message,
+          addr: &SocketAddr,
+          stats: &Stats) {
+    let encrypted_msg = sessions.seal(id, keys, msg).unwrap();
+    match socket.send_to(&encrypted_msg, addr) {
+        Ok(len) => stats.sent(len),
+        Err(e) => warn!("Failed to send to {}: {}", addr, e),
+    }
+}
+
+// A Request that got past the rate limits, possibly after waiting in the
+// admission queue.
+struct Handshake {
+    identifier: Option<String>,
+    // The identity whose pre-shared key opened it, if not the shared secret's.
+    keyed: Option<String>,
+    addr: SocketAddr,
+    nonce: HandshakeNonce,
+    // The client's clock when it sent the Request.
+    timestamp: u64,
+    ciphers: Vec<Cipher>,
+    offered: Option<u64>,
+    // Subnets advertised for bridging.
+    subnets: Vec<Subnet>,
+    received: Instant,
+    // The connection a Request over TCP came on, to answer it over.
+    stream: Option<TcpStream>,
+}
+
+// A Request over TCP still arriving.
+struct PendingTcp {
+    stream: TcpStream,
+    addr: SocketAddr,
+    buf: Vec<u8>,
+    accepted: Instant,
+}
+
+// The TCP handshakes whose Request is being read, by poll token. Their
+// streams are nonblocking and polled with the rest, so a client that sends
+// its Request slowly, or never, holds up no one else.
+struct TcpHandshakes {
+    pending: HashMap<usize, PendingTcp>,
+    next: usize,
+}
+
+impl TcpHandshakes {
+    fn new() -> TcpHandshakes {
+        TcpHandshakes {
+            pending: HashMap::new(),
+            next: FIRST_TCP_TOKEN,
+        }
+    }
+
+    // Starts reading the Request `addr` sends over `stream`.
+    fn add(&mut self,
+           poll: &mio::Poll,
+           stream: TcpStream,
+           addr: SocketAddr,
+           now: Instant)
+           -> Result<(), String> {
+        if self.pending.len() >= MAX_TCP_HANDSHAKES {
+            return Err(format!("Already reading {} TCP handshakes.", MAX_TCP_HANDSHAKES));
+        }
+        try!(stream.set_nonblocking(true).map_err(|e| e.to_string()));
+        while self.pending.contains_key(&self.next) {
+            self.next = self.next.checked_add(1).unwrap_or(FIRST_TCP_TOKEN);
+        }
+        try!(poll.register(&mio::unix::EventedFd(&stream.as_raw_fd()),
+                           mio::Token(self.next),
+                           mio::Ready::readable(),
+                           mio::PollOpt::level())
+            .map_err(|e| e.to_string()));
+        self.pending.insert(self.next,
+                            PendingTcp {
+                                stream: stream,
+                                addr: addr,
+                                buf: Vec::new(),
+                                accepted: now,
+                            });
+        Ok(())
+    }
+
+    // Reads what arrived on the stream polled as `token`. Once the Request
+    // is whole, returns the stream, its peer and the Request, and stops
+    // polling the stream, as after an error.
+    fn read(&mut self,
+            poll: &mio::Poll,
+            token: usize)
+            -> Result<Option<(TcpStream, SocketAddr, Vec<u8>)>, (SocketAddr, String)> {
+        let read = match self.pending.get_mut(&token) {
+            Some(pending) => read_partial_frame(&mut pending.stream, &mut pending.buf),
+            // Given up on earlier in the same poll.
+            None => return Ok(None),
+        };
+        match read {
+            Ok(None) => Ok(None),
+            Ok(Some(frame)) => {
+                let pending = self.remove(poll, token);
+                Ok(Some((pending.stream, pending.addr, frame)))
+            }
+            Err(e) => Err((self.remove(poll, token).addr, e)),
+        }
+    }
+
+    // Gives up on the handshakes accepted `timeout` or longer before `now`.
+    // Returns their peers.
+    fn expire(&mut self, poll: &mio::Poll, now: Instant, timeout: Duration) -> Vec<SocketAddr> {
+        let expired: Vec<usize> = self.pending
+            .iter()
+            .filter(|&(_, pending)| now.duration_since(pending.accepted) >= timeout)
+            .map(|(&token, _)| token)
+            .collect();
+        expired.into_iter().map(|token| self.remove(poll, token).addr).collect()
+    }
+
+    fn remove(&mut self, poll: &mio::Poll, token: usize) -> PendingTcp {
+        let pending = self.pending.remove(&token).unwrap();
+        if let Err(e) = poll.deregister(&mio::unix::EventedFd(&pending.stream.as_raw_fd())) {
+            warn!("Failed to stop polling the TCP handshake from {}: {}", pending.addr, e);
+        }
+        pending
+    }
+}
+
+// Checks a Request as it arrives, before it may wait in the admission queue,
+// so copies of one cannot fill the queue. Returns false if it is stale or a
+// replay.
+fn check_replay(replays: &mut ReplayCache, handshake: &Handshake) -> bool {
+    let addr = handshake.addr;
+    // The cache forgets a Request once it is stale, so a stale one is refused
+    // rather than answered again.
+    if !replays.is_fresh(handshake.timestamp, session::unix_time()) {
+        warn!("Rejecting handshake from {}: its clock or the Request is too far off.",
+              addr);
+        return false;
+    }
+    // The client's nonce makes each of its Requests differ, even retries.
+    let context = handshake.keyed.as_ref().map_or(&[][..], |k| k.as_bytes());
+    let mut contents = handshake.identifier.as_ref().map_or(Vec::new(), |i| i.as_bytes().to_vec());
+    contents.extend_from_slice(&handshake.nonce);
+    if !replays.check(context, &contents, Instant::now()) {
+        debug!("Replayed handshake from {} ignored.", addr);
+        return false;
+    }
+    true
+}
+
+// Passes a Request that just arrived on to be answered, or to wait in the
+// admission queue `backlog` if there is one, as far as the rate limits allow
+// and unless it is a replay.
+fn pass_on(handshake: Handshake,
+           limiter: &mut HandshakeLimiter,
+           backlog: &mut Option<AdmissionQueue<Handshake>>,
+           replays: &mut ReplayCache,
+           handshakes: &mut Vec<Handshake>) {
+    let (addr, now) = (handshake.addr, Instant::now());
+    match *backlog {
+        Some(ref mut backlog) => {
+            if !limiter.allow_source(addr.ip(), now) {
+                debug!("Handshake from {} rate limited.", addr);
+            } else if check_replay(replays, &handshake) && !backlog.push(handshake, now) {
+                debug!("Handshake queue is full. Dropping request from {}.", addr);
+            }
+        }
+        None => {
+            if !limiter.allow(addr.ip(), now) {
+                debug!("Handshake from {} rate limited.", addr);
+            } else if check_replay(replays, &handshake) {
+                handshakes.push(handshake);
+            }
+        }
+    }
+}
+
+// Decides whether to admit a Request that is within the rate limits and
+// returns the Response for it, or None if it was dropped. The session gets
+// the strongest of the offered ciphers, none of which may be weaker than the
+// client's profile's floor, if it has one, or `min_cipher`.
+fn admit(sessions: &mut SessionTable,
+         handshake: &Handshake,
+         min_cipher: Cipher)
+         -> Option<Message> {
+    let (identifier, addr) = (handshake.identifier.as_ref(), handshake.addr);
+    let floor = sessions.profile(identifier.map(|i| i.as_str()))
+        .min_cipher
+        .unwrap_or(min_cipher);
+    let chosen = match cipher::choose(&handshake.ciphers, floor) {
+        Ok(chosen) => chosen,
+        Err(e) => {
+            warn!("Rejecting handshake from {}: {}", addr, e);
+            return None;
+        }
+    };
+    let mut reply = match sessions.accept(identifier.map(|i| i.as_str()), addr) {
+        Ok(reply) => reply,
+        Err(e) => {
+            warn!("{}", e);
+            return None;
+        }
+    };
+    if let Message::Response { id, ref mut cipher, .. } = reply {
+        sessions.use_cipher(id, chosen);
+        *cipher = chosen;
+        info!("Got request from {}. Assigning IP address: 10.10.10.{}.",
+              addr,
+              id);
+    }
+    Some(reply)
+}
+
+// Accepts the compression dictionary a client offered with its Request if it
+// is ours and its data is compressed at all, telling it so in `reply`.
+fn grant_dictionary(sessions: &mut SessionTable,
+                    mut reply: Message,
+                    offered: u64,
+                    ours: &Option<Dictionary>)
+                    -> Message {
+    if ours.as_ref().map(|d| d.id()) != Some(offered) {
+        debug!("Compression dictionary {:016x} offered for {:?} is not ours.",
+               offered,
+               reply);
+        return reply;
+    }
+    if let Message::Response { id, compression: true, ref mut dictionary, .. } = reply {
+        sessions.use_dictionary(id);
+        *dictionary = true;
+    }
+    reply
+}
+
+// Picks the server's nonce for the session `reply` assigned, to go with the
+// client's `nonce`, telling the client in `reply`. Returns None if that
+// failed.
+fn grant_keys(sessions: &mut SessionTable,
+              mut reply: Message,
+              nonce: HandshakeNonce)
+              -> Option<Message> {
+    if let Message::Response { id, ref mut nonces, .. } = reply {
+        match sessions.pick_nonces(id, nonce) {
+            Ok(picked) => *nonces = picked,
+            Err(e) => {
+                warn!("Unable to key the session of id {}: {}", id, e);
+                return None;
+            }
+        }
+    }
+    Some(reply)
+}
+
+// Routes the subnets a client advertised with its Request to the session
+// `reply` assigned it, as far as its identifier may bridge them.
+fn grant_subnets(sessions: &mut SessionTable, reply: &Message, subnets: &[Subnet]) {
+    let id = match *reply {
+        Message::Response { id, .. } => id,
+        _ => return,
+    };
+    let refused = sessions.advertise(id, subnets);
+    for subnet in subnets.iter().filter(|s| !refused.contains(s)) {
+        info!("Routing {} to id {}.", subnet, id);
+    }
+    for subnet in refused {
+        warn!("Id {} may not bridge {}. Ignoring it.", id, subnet);
+    }
+}
+
+// Admits a Request passed on from the rate limits or the admission queue,
+// granting it the dictionary and subnets it asked for as far as they may be.
+// Returns the Response for it, or None if it was dropped.
+fn respond(sessions: &mut SessionTable,
+           handshake: &Handshake,
+           min_cipher: Cipher,
+           dictionary: &Option<Dictionary>)
+           -> Option<Message> {
+    clock_skew(&handshake.addr, handshake.timestamp, session::unix_time());
+    let reply = match admit(sessions, handshake, min_cipher)
+        .and_then(|reply| grant_keys(sessions, reply, handshake.nonce)) {
+        Some(reply) => reply,
+        None => return None,
+    };
+    let reply = match handshake.offered {
+        Some(offered) => grant_dictionary(sessions, reply, offered, dictionary),
+        None => reply,
+    };
+    if !handshake.subnets.is_empty() {
+        grant_subnets(sessions, &reply, &handshake.subnets);
+    }
+    Some(reply)
+}
+
+// The encoding of data to session `id`.
+fn encoding_for(sessions: &SessionTable, id: Id, dictionary: &Option<Dictionary>) -> Encoding {
+    if !sessions.uses_compression(id) {
+        Encoding::Plain
+    } else if dictionary.is_some() && sessions.uses_dictionary(id) {
+        Encoding::Dictionary
+    } else {
+        Encoding::Snappy
+    }
+}
+
+// Encodes an inner packet as `encoding`.
+pub fn encode(encoding: Encoding,
+              packet: &[u8],
+              encoder: &mut snap::Encoder,
+              dictionary: &Option<Dictionary>)
+              -> Result<Vec<u8>, String> {
+    match (encoding, dictionary) {
+        (Encoding::Snappy, _) => encoder.compress_vec(packet).map_err(|e| e.to_string()),
+        (Encoding::Dictionary, &Some(ref dictionary)) => Ok(dictionary.compress(packet)),
+        (Encoding::Dictionary, &None) => {
+            Err(String::from("No compression dictionary is configured"))
+        }
+        (Encoding::Plain, _) => Ok(packet.to_vec()),
+    }
+}
+
+// Decodes the data of a data message back into the inner packet.
+pub fn decode(encoding: Encoding,
+              data: Vec<u8>,
+              decoder: &mut snap::Decoder,
+              dictionary: &Option<Dictionary>)
+              -> Result<Vec<u8>, String> {
+    match (encoding, dictionary) {
+        (Encoding::Snappy, _) => decoder.decompress_vec(&data).map_err(|e| e.to_string()),
+        (Encoding::Dictionary, &Some(ref dictionary)) => dictionary.decompress(&data),
+        (Encoding::Dictionary, &None) => {
+            Err(String::from("No compression dictionary is configured"))
+        }
+        (Encoding::Plain, _) => Ok(data),
+    }
+}
+
+// The MTU of the running client's tunnel, if connected.
+pub fn mtu() -> Option<u16> {
+    match CURRENT_MTU.load(Ordering::Relaxed) {
+        0 => None,
+        mtu => Some(mtu as u16),
+    }
+}
+
+// Asks the running client to change its tunnel MTU without reconnecting. The
+// change is applied to the TUN device within a second. Only the client loop
+// applies it, so this fails when no client is connected.
+pub fn set_mtu(mtu: u16) -> Result<(), String> {
+    try!(device::check_mtu(mtu));
+    if !CONNECTED.load(Ordering::Relaxed) {
+        return Err(String::from("Not connected."));
+    }
+    REQUESTED_MTU.store(mtu as usize, Ordering::Relaxed);
+    Ok(())
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum SessionOp {
+    // Freeze the session, flush what is queued for it and write a snapshot
+    // of it to the `migration_file`.
+    Quiesce,
+    // Let it carry on here.
+    Resume,
+    // Give it up to the server that imported the snapshot.
+    HandOff,
+}
+
+impl SessionOp {
+    fn code(&self) -> usize {
+        match *self {
+            SessionOp::Quiesce => 1,
+            SessionOp::Resume => 2,
+            SessionOp::HandOff => 3,
+        }
+    }
+
+    fn from_code(code: usize) -> Option<SessionOp> {
+        match code {
+            1 => Some(SessionOp::Quiesce),
+            2 => Some(SessionOp::Resume),
+            3 => Some(SessionOp::HandOff),
+            _ => None,
+        }
+    }
+}
+
+// Asks the running server to apply `op` to session `id`, within a second.
+// Only one request can be pending at a time.
+pub fn request_session_op(op: SessionOp, id: Id) -> Result<(), String> {
+    if !LISTENING.load(Ordering::Relaxed) {
+        return Err(String::from("Not serving."));
+    }
+    let request = op.code() << 8 | id as usize;
+    match REQUESTED_SESSION_OP.compare_exchange(0, request, Ordering::SeqCst, Ordering::SeqCst) {
+        Ok(_) => Ok(()),
+        Err(_) => Err(String::from("Another session request is pending.")),
+    }
+}
+
+// The parts of the server configuration applied again on reload. All other
+// settings only take effect on restart.
+struct Policy {
+    acl: Acl,
+    dns: DnsFilter,
+    max_inner_packet: usize,
+    decrement_ttl: bool,
+    // Keys of the clients with pre-shared keys of their own, by identifier.
+    psks: HashMap<String, Box<KeyStore>>,
+    // The pre-shared keys as configured, to tell which a reload replaced.
+    psk_config: HashMap<String, String>,
+}
+
+impl Policy {
+    fn new(config: &config::ServerConfig) -> Result<Policy, String> {
+        Ok(Policy {
+            acl: try!(Acl::new(&config.acl, config.acl_default)),
+            dns: try!(DnsFilter::new(&config.dns_rules)),
+            max_inner_packet: config.max_inner_packet,
+            decrement_ttl: config.decrement_ttl,
+            psks: config.psks
+                .iter()
+                .map(|(identifier, psk)| {
+                    (identifier.clone(), Box::new(derive_keys(psk)) as Box<KeyStore>)
+                })
+                .collect(),
+            psk_config: config.psks.clone(),
+        })
+    }
+
+    // Opens a datagram from a client in place: a handshake with the
+    // pre-shared key of the identity it names, if any, or else with the
+    // shared key, and data with the keys of the session it is for. Returns
+    // the identity whose key opened it.
+    fn open(&self,
+            sessions: &mut SessionTable,
+            shared: &KeyStore,
+            datagram: &mut [u8])
+            -> Result<(Message, Option<String>), String> {
+        let (header, nonce, start) = try!(split_datagram(datagram));
+        match header {
+            Header::Handshake(identity) => {
+                if let Some(ref identity) = identity {
+                    if !self.psks.contains_key(identity) {
+                        return Err(format!("No pre-shared key for {}.", identity));
+                    }
+                }
+                let keys = self.keys(identity.as_ref(), shared);
+                match try!(open_message(keys, &nonce, &mut datagram[start..])) {
+                    msg @ Message::Request { .. } => Ok((msg, identity)),
+                    msg => Err(format!("Message {:?} sent as a handshake.", msg)),
+                }
+            }
+            Header::Data(id, number) => {
+                let identifier = match sessions.peek(id) {
+                    Some(session) => session.identifier.clone(),
+                    None => return Err(format!("Data for unknown id {}.", id)),
+                };
+                let own = identifier.and_then(|i| {
+                    if self.psks.contains_key(&i) { Some(i) } else { None }
+                });
+                let keys = self.keys(own.as_ref(), shared);
+                let msg = try!(sessions.open(id, keys, number, &mut datagram[start..]));
+                match msg {
+                    Message::Data { id: inner, .. } if inner == id => Ok((msg, own)),
+                    msg => Err(format!("Message {:?} sent as data for id {}.", msg, id)),
+                }
+            }
+        }
+    }
+
+    // Checks that a message from the client identified as `identifier` was
+    // opened with its own pre-shared key if it has one, and with the shared
+    // key otherwise. `keyed` is the identity whose key opened it.
+    fn check_key(&self, identifier: Option<&String>, keyed: Option<&String>) -> Result<(), String> {
+        let own = identifier.and_then(|i| if self.psks.contains_key(i) { Some(i) } else { None });
+        match (own, keyed) {
+            (own, keyed) if own == keyed => Ok(()),
+            (Some(own), _) => Err(format!("{} has a pre-shared key of its own.", own)),
+            (None, Some(keyed)) => Err(format!("Sealed with the pre-shared key of {}.", keyed)),
+            (None, None) => unreachable!(),
+        }
+    }
+
+    // The keys to seal messages to the client identified as `identifier`
+    // with.
+    fn keys<'a>(&'a self, identifier: Option<&String>, shared: &'a KeyStore) -> &'a KeyStore {
+        identifier.and_then(|i| self.psks.get(i)).map_or(shared, |keys| &**keys)
+    }
+
+    // Replaces the policy with the one from the configuration file at `path`.
+    // The whole file is validated and the new policy built before anything is
+    // replaced, so a bad file leaves the old policy in effect as a whole.
+    // Returns the identifiers whose pre-shared key was replaced or removed.
+    fn reload(&mut self, path: &str) -> Result<Vec<String>, String> {
+        let config = try!(config::Config::load(path));
+        let policy = try!(Policy::new(&config.server));
+        let rekeyed = self.psk_config
+            .iter()
+            .filter(|&(identifier, psk)| policy.psk_config.get(identifier) != Some(psk))
+            .map(|(identifier, _)| identifier.clone())
+            .collect();
+        *self = policy;
+        Ok(rekeyed)
+    }
+}
+
+// Follows a keepalive numbered `number` from `addr` for session `id`, or one
+// sent to bind the UDP address after a TCP handshake. Having been opened it
+// is authenticated, so its source is where the client is now, unless newer
+// data came already: it may have been held back and replayed. Tagged data
+// keeps every path instead. Returns whether the session moved.
+fn follow_keepalive(sessions: &mut SessionTable,
+                    id: Id,
+                    addr: SocketAddr,
+                    number: u64,
+                    connection: Option<ConnectionId>)
+                    -> bool {
+    connection.is_none() && sessions.rebind(id, addr, number)
+}
+
+fn take_session_op() -> Option<(SessionOp, Id)> {
+    match REQUESTED_SESSION_OP.swap(0, Ordering::SeqCst) {
+        0 => None,
+        request => SessionOp::from_code(request >> 8).map(|op| (op, request as Id)),
+    }
+}
+
+pub fn connect(host: &str,
+               port: u16,
+               default: bool,
+               secret: &str,
+               config: &config::ClientConfig)
+               -> Result<(), String> {
+    connect_with_metrics(host, port, default, secret, config, Box::new(NoopSink))
+}
+
+// Keeps the traffic to the server at `ip` out of the tunnel: routes it
+// around the default route into the tunnel, and excludes it from the ports
+// routed through the tunnel.
+fn pin_remote(gw: Option<&mut utils::DefaultGateway>,
+              ports: Option<&mut utils::PortRouting>,
+              ip: IpAddr) {
+    let remote = format!("{}", ip);
+    if let Some(gw) = gw {
+        if let Err(e) = gw.set_remote(&remote) {
+            warn!("{}", e);
+        }
+    }
+    if let Some(ports) = ports {
+        if let Err(e) = ports.set_remote(&remote) {
+            warn!("{}", e);
+        }
+    }
+}
+
+pub fn connect_with_metrics(host: &str,
+                            port: u16,
+                            default: bool,
+                            secret: &str,
+                            config: &config::ClientConfig,
+                            sink: Box<MetricsSink>)
+                            -> Result<(), String> {
+    connect_with_keystore(host, port, default, Box::new(derive_keys(secret)), config, sink)
+}
+
+// Like `connect_with_metrics`, handshaking with the shared keys `keys`
+// instead of those derived from a secret, e.g. keys kept in an HSM.
+pub fn connect_with_keystore(host: &str,
+                             port: u16,
+                             default: bool,
+                             keys: Box<KeyStore>,
+                             config: &config::ClientConfig,
+                             sink: Box<MetricsSink>)
+                             -> Result<(), String> {
+    redact::set_enabled(config.redact_logs);
+    info!("Working in client mode.");
+    let mut log = HandshakeLog::first(config.log_handshake);
+    let mut tunnel = match Tunnel::open_with_keystore(host, port, &*keys, config, &mut log) {
+        Ok(tunnel) => tunnel,
+        Err(_) if INTERRUPTED.load(Ordering::Relaxed) => {
+            info!("Interrupted during the handshake.");
+            return Ok(());
+        }
+        Err(e) => return Err(e),
+    };
+    tunnel.set_metrics(sink);
+    let mut id = tunnel.id();
+    let mut prefix = tunnel.link_prefix();
+    let mut peer = try!(pool::peer(id, prefix));
+    let remote_addr = tunnel.remote_addr();
+    if INTERRUPTED.load(Ordering::Relaxed) {
+        return Ok(());
+    }
+    let poll = mio::Poll::new().unwrap();
+    // A SOCKS proxy stands in for the TUN device, leaving routes alone.
+    let mut local = if let Some(listen) = config.socks_proxy {
+        let address = Ipv4Addr::new(10, 10, 10, id);
+        let mut proxy = try!(socks::Proxy::new(address,
+                                               tunnel.tun_mtu(),
+                                               &listen,
+                                               config.socks_resolver)
+            .map_err(|e| format!("Unable to listen on {}: {}", listen, e)));
+        try!(proxy.register(&poll, FIRST_SOCKS_TOKEN).map_err(|e| e.to_string()));
+        log.step(HandshakeStep::AddressAssigned,
+                 &format!("SOCKS5 proxy listening on {}. Internal IP: {}.", listen, address));
+        Local::Socks(proxy)
+    } else {
+        try!(utils::check_route_conflict(&utils::SystemRouting {
+                                             policy: config.route_policy(),
+                                         },
+                                         Ipv4Addr::new(10, 10, 10, id),
+                                         prefix,
+                                         config.allow_route_conflicts));
+
+        info!("Bringing up TUN device.");
+        let tun = try!(create_tun_attempt());
+        try!(tun.set_owner(config.tun_owner, config.tun_group));
+        tun.up_link(id, prefix, peer, tunnel.tun_mtu());
+        log.step(HandshakeStep::AddressAssigned,
+                 &format!("TUN device {} initialized. Internal IP: 10.10.10.{}/{}. MTU: {}.",
+                          tun.name(),
+                          id,
+                          prefix,
+                          tunnel.tun_mtu()));
+
+        info!("Setting up TUN device for polling.");
+        poll.register(&mio::unix::EventedFd(&tun.as_raw_fd()),
+                      TUN,
+                      mio::Ready::readable(),
+                      mio::PollOpt::level())
+            .unwrap();
+        Local::Tun(tun)
+    };
+
+    info!("Setting up socket for polling.");
+    let sock_rawfd = tunnel.as_raw_fd();
+    let sockfd = mio::unix::EventedFd(&sock_rawfd);
+    poll.register(&sockfd, SOCK, mio::Ready::readable(), mio::PollOpt::level()).unwrap();
+
+    let mut events = mio::Events::with_capacity(1024);
+    let mut buf = [0u8; 1600];
+
+    // RAII so ignore unused variable warning
+    let mut gw = if default && config.socks_proxy.is_none() {
+        let routing = Box::new(utils::SystemRouting { policy: config.route_policy() });
+        match utils::DefaultGateway::create_interruptible(routing,
+                                                          &format!("10.10.10.{}", peer),
+                                                          &format!("{}", remote_addr.ip()),
+                                                          || INTERRUPTED.load(Ordering::Relaxed)) {
+            Ok(gw) => Some(gw),
+            Err(_) if INTERRUPTED.load(Ordering::Relaxed) => {
+                info!("Interrupted during bring-up. Routes restored.");
+                return Ok(());
+            }
+            Err(e) => return Err(format!("Unable to route traffic through the tunnel: {}", e)),
+        }
+    } else {
+        None
+    };
+    // Redundant when all traffic goes through the tunnel anyway.
+    let mut ports = match local {
+        Local::Tun(ref tun) if !default && !config.tunnel_ports.is_empty() => {
+            Some(try!(utils::PortRouting::create(&config.tunnel_ports,
+                                                 tun.name(),
+                                                 &format!("{}", remote_addr.ip()),
+                                                 config.route_policy())
+                .map_err(|e| format!("Unable to route ports through the tunnel: {}", e))))
+        }
+        _ => None,
+    };
+    let _bridge = match local {
+        Local::Tun(_) if !config.bridged_subnets.is_empty() => {
+            let lan = config.bridge_interface.as_ref().map(|i| i.as_str());
+            Some(try!(HostBridge::client(lan, config.route_policy())
+                .map_err(|e| format!("Unable to bridge the subnets behind us: {}", e))))
+        }
+        _ => None,
+    };
+    log.step(HandshakeStep::RoutesApplied,
+             if default {
+                 "Default route now points into the tunnel."
+             } else if ports.is_some() {
+                 "Traffic to the configured ports now goes into the tunnel."
+             } else {
+                 "Routes left unchanged."
+             });
+
+    let mut stats_logger = match config.stats_interval_secs {
+        0 => None,
+        secs => Some(StatsLogger::new(Duration::from_secs(secs), Instant::now())),
+    };
+    let mut filter = unicast_filter(config.drop_non_unicast, &config.multicast_groups, prefix);
+    let tap = try!(tap::open(&config.tap_socket, config.tap_queue));
+    let mut watcher = match config.resolve_interval_secs {
+        0 => None,
+        secs => Some(HostWatcher::new(host, Duration::from_secs(secs), Instant::now())),
+    };
+    let mut path_watcher = match config.path_check_interval_secs {
+        0 => None,
+        secs => {
+            let source = try!(preferred_source(&tunnel.remote_addr()).map_err(|e| e.to_string()));
+            Some(PathWatcher::new(source, Duration::from_secs(secs), Instant::now()))
+        }
+    };
+
+    let keepalive = match config.keepalive_interval_secs {
+        0 => None,
+        secs => Some(Duration::from_secs(secs)),
+    };
+
+    CURRENT_MTU.store(tunnel.tun_mtu() as usize, Ordering::Relaxed);
+    CONNECTED.store(true, Ordering::Relaxed);
+    info!("Ready for transmission.");
+
+    loop {
+        if INTERRUPTED.load(Ordering::Relaxed) {
+            break;
+        }
+        match REQUESTED_MTU.swap(0, Ordering::Relaxed) {
+            0 => {}
+            mtu => {
+                let mtu = mtu as u16;
+                match tunnel.set_mtu(mtu).and_then(|_| local.set_mtu(tunnel.tun_mtu())) {
+                    Ok(_) => {
+                        info!("MTU changed to {}.", mtu);
+                        CURRENT_MTU.store(tunnel.tun_mtu() as usize, Ordering::Relaxed);
+                    }
+                    Err(e) => warn!("{}", e),
+                }
+            }
+        }
+        // Wake up periodically to pick up MTU changes, and when a gap in the
+        // packets from the server times out.
+        let mut timeout = stats_logger.as_ref()
+            .map_or(Duration::from_secs(1),
+                    |l| cmp::min(l.timeout(Instant::now()), Duration::from_secs(1)));
+        if let Some(reorder) = tunnel.reorder_timeout(Instant::now()) {
+            timeout = cmp::min(timeout, reorder);
+        }
+        if let Local::Socks(_) = local {
+            timeout = cmp::min(timeout, Duration::from_millis(socks::TICK_MS));
+        }
+        poll.poll(&mut events, Some(timeout)).unwrap();
+        for event in events.iter() {
+            match event.token() {
+                SOCK => {
+                    match tunnel.recv(&mut buf) {
+                        Ok(Some(len)) => {
+                            deliver(&mut local,
+                                    &buf[0..len],
+                                    config.max_inner_packet,
+                                    &filter,
+                                    &tap,
+                                    tunnel.stats())
+                        }
+                        Ok(None) => {}
+                        Err(ref e) if e.kind() == io::ErrorKind::InvalidData => {
+                            warn!("Dropping datagram: {}", e);
+                            tunnel.stats().dropped();
+                        }
+                        Err(ref e) if is_transient(e) => debug!("Server unreachable: {}", e),
+                        Err(e) => panic!("{}", e),
+                    }
+                }
+                TUN => {
+                    let len: usize = match read_tun(&mut local, &mut buf) {
+                        Some(len) => len,
+                        None => {
+                            let tun = match local {
+                                Local::Tun(ref old) => {
+                                    poll.deregister(&mio::unix::EventedFd(&old.as_raw_fd()))
+                                        .unwrap();
+                                    try!(recreate_tun(old, config.tun_recreate_attempts, |tun| {
+                                        try!(tun.set_owner(config.tun_owner, config.tun_group));
+                                        tun.configure(id,
+                                                      prefix,
+                                                      peer,
+                                                      tunnel.tun_mtu())
+                                    }))
+                                }
+                                Local::Socks(_) => unreachable!(),
+                            };
+                            poll.register(&mio::unix::EventedFd(&tun.as_raw_fd()),
+                                          TUN,
+                                          mio::Ready::readable(),
+                                          mio::PollOpt::level())
+                                .unwrap();
+                            // The routes into the tunnel went with the device.
+                            if let Some(ref gw) = gw {
+                                if let Err(e) = gw.reapply() {
+                                    warn!("Unable to route traffic through the tunnel again: {}",
+                                          e);
+                                }
+                            }
+                            if ports.is_some() {
+                                ports = None;
+                                match utils::PortRouting::create(&config.tunnel_ports,
+                                                                 tun.name(),
+                                                                 &format!("{}",
+                                                                          tunnel.remote_addr()
+                                                                              .ip()),
+                                                                 config.route_policy()) {
+                                    Ok(routing) => ports = Some(routing),
+                                    Err(e) => {
+                                        warn!("Unable to route ports through the tunnel again: \
+                                               {}",
+                                              e)
+                                    }
+                                }
+                            }
+                            local = Local::Tun(tun);
+                            continue;
+                        }
+                    };
+                    if forward_local(&mut tunnel,
+                                     &buf[0..len],
+                                     config.max_inner_packet,
+                                     &filter,
+                                     &tap) {
+                        if let Err(e) = local.set_mtu(tunnel.tun_mtu()) {
+                            warn!("{}", e);
+                        }
+                    }
+                }
+                token => {
+                    if let Local::Socks(ref mut proxy) = local {
+                        proxy.ready(&poll, token, event.readiness());
+                    }
+                }
+            }
+        }
+        if let Local::Socks(ref mut proxy) = local {
+            proxy.service(&poll, Instant::now());
+            while let Ok(len) = proxy.read_packet(&mut buf) {
+                if forward_local(&mut tunnel,
+                                 &buf[0..len],
+                                 config.max_inner_packet,
+                                 &filter,
+                                 &tap) {
+                    proxy.set_mtu(tunnel.tun_mtu());
+                }
+            }
+        }
+        // Released from the reorder buffer along with an earlier packet, or
+        // because the gap in front of them timed out.
+        loop {
+            match tunnel.next_ready(&mut buf) {
+                Ok(Some(len)) => {
+                    deliver(&mut local,
+                            &buf[0..len],
+                            config.max_inner_packet,
+                            &filter,
+                            &tap,
+                            tunnel.stats())
+                }
+                Ok(None) => break,
+                Err(e) => {
+                    warn!("Dropping packet: {}", e);
+                    tunnel.stats().dropped();
+                }
+            }
+        }
+
+        if let Some(ref mut logger) = stats_logger {
+            logger.tick(tunnel.stats(), 1, Instant::now());
+        }
+        if let Some(interval) = keepalive {
+            match tunnel.keepalive(interval, Instant::now()) {
+                Ok(_) => {}
+                Err(ref e) if is_transient(e) => debug!("Server unreachable: {}", e),
+                Err(e) => warn!("Failed to send keepalive: {}", e),
+            }
+        }
+
+        let remote_ip = tunnel.remote_addr().ip();
+        let mut target = watcher.as_mut()
+            .and_then(|w| w.check(remote_ip, Instant::now(), |h| resolve_server(h, config)));
+        if let Some(ip) = target {
+            info!("{} now resolves to {}. Reconnecting.", host, ip);
+        } else if let Some(source) = path_watcher.as_mut()
+            .and_then(|w| w.check(&tunnel.remote_addr(), Instant::now(), preferred_source)) {
+            info!("Local address changed to {}. Reconnecting on the new path.", source);
+            // The network we moved to reaches the server via a gateway of
+            // its own.
+            if let Some(ref mut gw) = gw {
+                match gw.repin() {
+                    Ok(Some(gateway)) => info!("Reaching the server via {} now.", gateway),
+                    Ok(None) => {}
+                    Err(e) => warn!("Unable to route to the server on the new path: {}", e),
+                }
+            }
+            target = Some(remote_ip);
+        }
+        if let Some(ip) = target {
+            let window = Duration::from_millis(config.reconnect_jitter_ms);
+            let delay = reconnect_delay(window, &mut rand::thread_rng());
+            if delay > Duration::from_secs(0) {
+                debug!("Waiting {:?} before reconnecting.", delay);
+                if !pause(delay) {
+                    break;
+                }
+            }
+            poll.deregister(&mio::unix::EventedFd(&tunnel.as_raw_fd())).unwrap();
+            // The handshake with a new address has to go around the tunnel,
+            // not into it. Moving to a new local path keeps the address.
+            let moved = ip != remote_ip;
+            if moved {
+                pin_remote(gw.as_mut(), ports.as_mut(), ip);
+            }
+            match tunnel.reconnect_with_keystore(ip, &*keys, config, &mut log) {
+                Ok(_) => {
+                    if tunnel.id() != id || tunnel.link_prefix() != prefix {
+                        id = tunnel.id();
+                        prefix = tunnel.link_prefix();
+                        filter = unicast_filter(config.drop_non_unicast,
+                                                &config.multicast_groups,
+                                                prefix);
+                        match pool::peer(id, prefix) {
+                            Ok(p) => {
+                                if p != peer && gw.is_some() {
+                                    warn!("The default route still points at 10.10.10.{}.", peer);
+                                }
+                                peer = p;
+                            }
+                            Err(e) => warn!("{}", e),
+                        }
+                        local.up_link(id, prefix, peer, tunnel.tun_mtu());
+                        info!("Internal IP changed to 10.10.10.{}/{}.", id, prefix);
+                    }
+                }
+                Err(e) => {
+                    warn!("Unable to reconnect to {}: {}", ip, e);
+                    // Still connected to the old one.
+                    if moved {
+                        pin_remote(gw.as_mut(), ports.as_mut(), remote_ip);
+                    }
+                }
+            }
+            poll.register(&mio::unix::EventedFd(&tunnel.as_raw_fd()),
+                          SOCK,
+                          mio::Ready::readable(),
+                          mio::PollOpt::level())
+                .unwrap();
+        }
+    }
+    if let Local::Socks(ref mut proxy) = local {
+        proxy.close();
+        while let Ok(len) = proxy.read_packet(&mut buf) {
+            forward_local(&mut tunnel, &buf[0..len], config.max_inner_packet, &filter, &tap);
+        }
+    }
+    Ok(())
+}
+
+pub fn serve(port: u16, secret: &str, config: &config::ServerConfig) -> Result<(), String> {
+    serve_with_metrics(port, secret, config, None, Box::new(NoopSink))
+}
+
+// `config_path` is the file `config` came from, if any, to reload it from.
+pub fn serve_with_metrics(port: u16,
+                          secret: &str,
+                          config: &config::ServerConfig,
+                          config_path: Option<&str>,
+                          sink: Box<MetricsSink>)
+                          -> Result<(), String> {
+    serve_with_keystore(port,
+                        Box::new(derive_keys(secret)),
+                        secret,
+                        config,
+                        config_path,
+                        sink)
+}
+
+// Like `serve_with_metrics`, handshaking with the shared keys `keys` instead
+// of those derived from a secret. Exported session state is sealed with
+// `state_key` unless the configuration names a state key file.
+pub fn serve_with_keystore(port: u16,
+                           keys: Box<KeyStore>,
+                           state_key: &str,
+                           config: &config::ServerConfig,
+                           config_path: Option<&str>,
+                           sink: Box<MetricsSink>)
+                           -> Result<(), String> {
+    if cfg!(not(target_os = "linux")) {
+        return Err(String::from("Server mode is only available in Linux!"));
+    }
+
+    redact::set_enabled(config.redact_logs);
+    info!("Working in server mode.");
+
+    let public_ip = utils::get_public_ip().unwrap();
+    info!("Public IP: {}", public_ip);
+
+    info!("Enabling kernel's IPv4 forwarding.");
+    utils::enable_ipv4_forwarding().unwrap();
+
+    info!("Bringing up TUN device.");
+    let mut tun = try!(create_tun_attempt());
+    tun.up(pool::SERVER_ID, config.mtu);
+    if config.link_prefix != 24 {
+        // Each client's peer is an address of its own on the server.
+        for id in pool::server_ids(config.link_prefix) {
+            tun.add_address(id).unwrap();
+        }
+    }
+    // RAII so ignore unused variable warning
+    let _balancer = if config.uplinks.is_empty() {
+        None
+    } else {
+        let checker = PingCheck {
+            target: config.uplink_check_target,
+            timeout: Duration::from_secs(1),
+        };
+        Some(UplinkBalancer::start(tun.name(),
+                                   &config.uplinks,
+                                   config.uplink_policy,
+                                   Box::new(checker),
+                                   Duration::from_secs(config.uplink_check_interval_secs))
+            .unwrap())
+    };
+
+    let mut tun_rawfd = tun.as_raw_fd();
+    let tunfd = mio::unix::EventedFd(&tun_rawfd);
+    info!("TUN device {} initialized. Internal IP: 10.10.10.1/24.",
+          tun.name());
+
+    // IPv4 only: clients reach us over IPv6 through a translator, if at all.
+    let addr = format!("0.0.0.0:{}", port).parse().unwrap();
+    let sockfd = mio::net::UdpSocket::bind(&addr).unwrap();
+    info!("Listening on: 0.0.0.0:{}.", port);
+
+    let poll = mio::Poll::new().unwrap();
+    poll.register(&sockfd, SOCK, mio::Ready::readable(), mio::PollOpt::level()).unwrap();
+    poll.register(&tunfd, TUN, mio::Ready::readable(), mio::PollOpt::level()).unwrap();
+
+    let listener = config.tcp_handshake_port.map(|tcp_port| {
+        let listener = TcpListener::bind(("0.0.0.0", tcp_port)).unwrap();
+        listener.set_nonblocking(true).unwrap();
+        info!("Accepting handshakes over TCP on: 0.0.0.0:{}.", tcp_port);
+        listener
+    });
+    let listener_rawfd = listener.as_ref().map(|l| l.as_raw_fd());
+    if let Some(ref fd) = listener_rawfd {
+        poll.register(&mio::unix::EventedFd(fd),
+                      TCP_LISTEN,
+                      mio::Ready::readable(),
+                      mio::PollOpt::level())
+            .unwrap();
+    }
+    let mut tcp_handshakes = TcpHandshakes::new();
+
+    let mut events = mio::Events::with_capacity(1024);
+
+    let mut sessions = SessionTable::new(config).unwrap();
+    // RAII so ignore unused variable warning
+    let bridged = sessions.bridged_subnets();
+    let mut _bridge = if bridged.is_empty() {
+        None
+    } else {
+        let bridge = HostBridge::server(&bridged, tun.name(), utils::RetryPolicy::default());
+        Some(try!(bridge.map_err(|e| format!("Unable to route bridged subnets: {}", e))))
+    };
+    let mut queue: FairQueue<Id> = FairQueue::new(FAIR_QUEUE_QUANTUM, config.fair_queue_limit);
+    queue.set_byte_limit(config.queue_memory_limit);
+    if config.queue_latency_target_ms > 0 {
+        queue.set_latency_target(Duration::from_millis(config.queue_latency_target_ms));
+    }
+    let mut throttled = false;
+    let mut limiter = HandshakeLimiter::new(config.handshake_rate,
+                                            config.handshake_burst,
+                                            config.global_handshake_rate,
+                                            config.global_handshake_burst);
+    // Requests over the global rate wait their turn instead of being dropped,
+    // but no longer than clients with several addresses wait for the Response.
+    let mut backlog = match config.handshake_queue {
+        0 => None,
+        capacity => {
+            Some(AdmissionQueue::new(config.global_handshake_rate,
+                                     config.global_handshake_burst,
+                                     capacity,
+                                     Duration::from_secs(tunnel::FALLBACK_TIMEOUT_SECS),
+                                     Instant::now()))
+        }
+    };
+    let mut handshakes: Vec<Handshake> = Vec::new();
+    let mut policy = Policy::new(config).unwrap();
+    // As started with, to warn about changes a reload does not apply.
+    let settings = config_path.and_then(|path| config::load_server_settings(path).ok());
+    let mut reachability = if config.icmp_unreachable {
+        let lookup = SystemLookup::new().unwrap();
+        Some(Reachability::new(Box::new(lookup), Ipv4Addr::new(10, 10, 10, 1)))
+    } else {
+        None
+    };
+    let stats = Stats::with_sink(sink);
+    let filter = unicast_filter(config.drop_non_unicast,
+                                &config.multicast_groups,
+                                config.link_prefix);
+    let mut stats_logger = match config.stats_interval_secs {
+        0 => None,
+        secs => Some(StatsLogger::new(Duration::from_secs(secs), Instant::now())),
+    };
+    let mut replays = ReplayCache::new(Duration::from_millis(config.replay_window_ms),
+                                       config.replay_cache_size);
+    let state_key = match config.state_key_file {
+        Some(ref path) => try!(session::read_state_key(path)),
+        None => String::from(state_key),
+    };
+    if let Some(ref path) = config.state_file {
+        match utils::read_file(path) {
+            Ok(state) => {
+                // E.g. exported before the secret or the state key was rotated,
+                // which invalidates every token in it.
+                match sessions.import(&state_key, &state) {
+                    Ok(count) => info!("Imported {} session(s) from {}.", count, path),
+                    Err(e) => warn!("No session state imported from {}: {}", path, e),
+                }
+            }
+            Err(e) => info!("No session state imported: {}", e),
+        }
+    }
+
+    let tap = try!(tap::open(&config.tap_socket, config.tap_queue));
+    // Without a configured observation domain, the public IPv4 address tells
+    // this server's records apart from those of others at the collector.
+    let domain = config.flow_observation_domain
+        .unwrap_or_else(|| public_ip.trim().parse::<Ipv4Addr>().map(u32::from).unwrap_or(0));
+    let mut flows = config.flow_collector.and_then(|collector| {
+        let exporter = match Exporter::new(&collector, domain) {
+            Ok(exporter) => exporter,
+            Err(e) => {
+                warn!("Not exporting flows to {}: {}", collector, e);
+                return None;
+            }
+        };
+        info!("Exporting flows to {} in observation domain {}.", collector, domain);
+        let table = FlowTable::new(config.max_flows,
+                                   Duration::from_secs(config.flow_active_timeout_secs),
+                                   Duration::from_secs(config.flow_idle_timeout_secs),
+                                   Instant::now());
+        Some((table, exporter))
+    });
+
+    let mut monitor = match config.udp_checksum {
+        ChecksumPolicy::Ignore => None,
+        policy => Some(ChecksumMonitor::new(port, policy).unwrap()),
+    };
+    let mut fragments = match config.outer_fragments {
+        FragmentPolicy::Ignore => None,
+        policy => {
+            match FragmentMonitor::new(&sockfd, policy) {
+                Ok(monitor) => Some(monitor),
+                Err(e) => {
+                    warn!("Not monitoring outer fragments, which needs IP_RECVFRAGSIZE: {}", e);
+                    None
+                }
+            }
+        }
+    };
+
+    let mut buf = [0u8; 1600];
+    let mut encoder = snap::Encoder::new();
+    let mut decoder = snap::Decoder::new();
+    let dictionary = config.compression_dictionary.as_ref().map(|path| {
+        let dictionary = Dictionary::open(path).unwrap();
+        info!("Compression dictionary {:016x} loaded from {}.", dictionary.id(), path);
+        dictionary
+    });
+
+    let mut batch = SendBatch::new(config.udp_gso);
+
+    LISTENING.store(true, Ordering::Relaxed);
+    info!("Ready for transmission.");
+
+    loop {
+        if INTERRUPTED.load(Ordering::Relaxed) {
+            break;
+        }
+
+        if RELOAD_REQUESTED.swap(false, Ordering::Relaxed) {
+            match config_path.map(|path| (path, policy.reload(path))) {
+                Some((path, Ok(rekeyed))) => {
+                    info!("Reloaded the configuration from {}.", path);
+                    let changed = match (&settings, config::load_server_settings(path)) {
+                        (&Some(ref old), Ok(ref new)) => config::unreloaded(old, new),
+                        _ => Vec::new(),
+                    };
+                    if !changed.is_empty() {
+                        warn!("Changes to {} take effect only on restart.", changed.join(", "));
+                    }
+                    // Their tokens go with the old key.
+                    for identifier in rekeyed {
+                        match sessions.revoke(&identifier) {
+                            0 => {}
+                            n => {
+                                info!("Ended {} session(s) of {}, whose key changed.",
+                                      n,
+                                      identifier)
+                            }
+                        }
+                    }
+                }
+                Some((path, Err(e))) => {
+                    error!("Keeping the old configuration, unable to reload {}: {}", path, e)
+                }
+                None => warn!("No configuration file to reload."),
+            }
+        }
+
+        // Clear expired client info
+        sessions.prune();
+        for addr in tcp_handshakes.expire(&poll,
+                                          Instant::now(),
+                                          Duration::from_millis(TCP_HANDSHAKE_TIMEOUT_MS)) {
+            debug!("No Request from {} over TCP in time.", addr);
+        }
+        // Wake up soon to retry sending if the socket was full, and at least
+        // every second to pick up session and reload requests.
+        let mut timeout = if queue.is_empty() {
+            Some(Duration::from_secs(1))
+        } else {
+            Some(Duration::from_millis(1))
+        };
+        if let Some(ref logger) = stats_logger {
+            let due = logger.timeout(Instant::now());
+            timeout = Some(timeout.map_or(due, |t| cmp::min(t, due)));
+        }
+        if let Some(due) = backlog.as_mut().and_then(|b| b.timeout(Instant::now())) {
+            timeout = Some(timeout.map_or(due, |t| cmp::min(t, due)));
+        }
+        poll.poll(&mut events, timeout).unwrap();
+        for event in events.iter() {
+            match event.token() {
+                SOCK => {
+                    let (len, addr, fragment) = match fragments {
+                        Some(_) => fragment::recv_from(&sockfd, &mut buf).unwrap(),
+                        None => {
+                            let (len, addr) = sockfd.recv_from(&mut buf).unwrap();
+                            (len, addr, None)
+                        }
+                    };
+                    stats.received(len);
+                    if let Some(ref mut fragments) = fragments {
+                        if fragments.reject(&addr, len, fragment, stats.sink()) {
+                            stats.dropped();
+                            continue;
+                        }
+                    }
+                    if let Some(ref mut monitor) = monitor {
+                        monitor.drain();
+                        if monitor.reject(&addr, &buf[0..len]) {
+                            stats.dropped();
+                            continue;
+                        }
+                    }
+                    // Answered before anything is authenticated, and limited
+                    // like handshakes.
+                    if let Some(reply) = diagnostic_reply(&buf[0..len]) {
+                        if config.diagnostic_hello && limiter.allow(addr.ip(), Instant::now()) {
+                            debug!("Answering a diagnostic hello from {}.", addr);
+                            match sockfd.send_to(reply, &addr) {
+                                Ok(len) => stats.sent(len),
+                                Err(e) => warn!("Failed to send to {}: {}", addr, e),
+                            }
+                        }
+                        continue;
+                    }
+                    // Data for no session has no keys to open it with.
+                    let number = match split_datagram(&buf[0..len]) {
+                        Ok((Header::Data(id, _), _, _)) if sessions.peek(id).is_none() => {
+                            unsolicited(&sessions, id, 0, &stats);
+                            continue;
+                        }
+                        Ok((Header::Data(_, number), _, _)) => number,
+                        _ => 0,
+                    };
+                    let (msg, keyed) = match policy.open(&mut sessions, &*keys, &mut buf[0..len]) {
+                        Ok(opened) => opened,
+                        Err(e) => {
+                            warn!("Dropping datagram from {}: {}", addr, e);
+                            stats.dropped();
+                            continue;
+                        }
+                    };
+                    match msg {
+                        Message::Request { identifier,
+                                           nonce,
+                                           timestamp,
+                                           ciphers,
+                                           dictionary: offered,
+                                           subnets } => {
+                            if let Err(e) = policy.check_key(identifier.as_ref(), keyed.as_ref()) {
+                                warn!("Rejecting handshake from {}: {}", addr, e);
+                                stats.dropped();
+                                continue;
+                            }
+                            let handshake = Handshake {
+                                identifier: identifier,
+                                keyed: keyed,
+                                addr: addr,
+                                nonce: nonce,
+                                timestamp: timestamp,
+                                ciphers: ciphers,
+                                offered: offered,
+                                subnets: subnets,
+                                received: Instant::now(),
+                                stream: None,
+                            };
+                            pass_on(handshake,
+                                    &mut limiter,
+                                    &mut backlog,
+                                    &mut replays,
+                                    &mut handshakes);
+                        }
+                        Message::Response { .. } => {
+                            warn!("Invalid message {:?} from {}", msg, addr)
+                        }
+                        // Data from clients is not put back in order.
+                        Message::Data { id, token, connection, sequence, encoding, data } => {
+                            if unsolicited(&sessions, id, token, &stats) {
+                                continue;
+                            }
+                            // Opened with the keys of the session, so it is from the
+                            // client. Its keys derive from those of its identity.
+                            let master = policy.keys(keyed.as_ref(), &*keys);
+                            if sessions.is_quiesced(id) {
+                                debug!("Dropping data from quiesced id {}.", id);
+                                stats.dropped();
+                            } else {
+                                sessions.keep_alive(id);
+                                if sessions.bind(id, addr, number) {
+                                    info!("Data for id {} now goes to {}.", id, addr);
+                                }
+                                if let Some(connection) = connection {
+                                    if let Err(e) = sessions.attach(connection, id, addr) {
+                                        warn!("{}", e);
+                                        stats.dropped();
+                                        continue;
+                                    }
+                                }
+                                if sequence.is_some() {
+                                    sessions.use_sequencing(id);
+                                }
+                                if data.is_empty() {
+                                    if config.follow_rebinds &&
+                                       follow_keepalive(&mut sessions,
+                                                        id,
+                                                        addr,
+                                                        number,
+                                                        connection) {
+                                        info!("Data for id {} now goes to {}.", id, addr);
+                                    }
+                                    continue;
+                                }
+                                let mut decompressed_data =
+                                    match decode(encoding, data, &mut decoder, &dictionary) {
+                                        Ok(packet) => packet,
+                                        Err(e) => {
+                                            warn!("Dropping data from id {}: {}", id, e);
+                                            stats.dropped();
+                                            continue;
+                                        }
+                                    };
+                                if drop_oversized(policy.max_inner_packet,
+                                                  &decompressed_data,
+                                                  &stats) {
+                                    debug!("Oversized packet from id {} dropped.", id);
+                                } else if drop_non_unicast(&filter,
+                                                           &decompressed_data,
+                                                           &stats) {
+                                    debug!("Non-unicast packet from id {} dropped.", id);
+                                } else if !policy.acl.allows(&decompressed_data) {
+                                    debug!("Packet from id {} denied by ACL.", id);
+                                    stats.dropped();
+                                } else if !sessions.allow(id,
+                                                          Direction::Upload,
+                                                          decompressed_data.len()) {
+                                    debug!("Upload of id {} rate limited.", id);
+                                    stats.dropped();
+                                } else if let Err(reply) =
+                                              apply_ttl(policy.decrement_ttl,
+                                                        &mut decompressed_data) {
+                                    debug!("TTL of packet from id {} expired.", id);
+                                    stats.dropped();
+                                    let msg = Message::Data {
+                                        id: id,
+                                        token: token,
+                                        connection: None,
+                                        sequence: None,
+                                        encoding: Encoding::Snappy,
+                                        data: encoder.compress_vec(&reply).unwrap(),
+                                    };
+                                    answer(&sockfd, &mut sessions, master, id, &msg, &addr, &stats);
+                                } else if let Some(reply) =
+                                              policy.dns.intercept(&decompressed_data) {
+                                    debug!("DNS query from id {} answered by a rule.",
+                                           id);
+                                    let msg = Message::Data {
+                                        id: id,
+                                        token: token,
+                                        connection: None,
+                                        sequence: None,
+                                        encoding: Encoding::Snappy,
+                                        data: encoder.compress_vec(&reply).unwrap(),
+                                    };
+                                    answer(&sockfd, &mut sessions, master, id, &msg, &addr, &stats);
+                                } else if let Some(reply) =
+                                              reachability.as_mut().and_then(|r| {
+                                                  r.reply(&decompressed_data,
+                                                          Instant::now())
+                                              }) {
+                                    debug!("No route for packet from id {}.", id);
+                                    stats.dropped();
+                                    let msg = Message::Data {
+                                        id: id,
+                                        token: token,
+                                        connection: None,
+                                        sequence: None,
+                                        encoding: Encoding::Snappy,
+                                        data: encoder.compress_vec(&reply).unwrap(),
+                                    };
+                                    answer(&sockfd, &mut sessions, master, id, &msg, &addr, &stats);
+                                } else if write_inner(&mut tun,
+                                                      &decompressed_data,
+                                                      &stats) {
+                                    mirror(&tap, &decompressed_data);
+                                    account(&mut flows, &decompressed_data);
+                                }
+                            }
+                        }
+                    }
+                }
+                TUN => {
+                    // With GSO, read what else is waiting too, to send it in batches.
+                    let mut reads = 0;
+                    let mut vanished = false;
+                    while reads == 0 ||
+                          (batch.is_gso() && reads < TUN_BATCH && is_readable(tun_rawfd)) {
+                        reads += 1;
+                        let len: usize = match read_tun(&mut tun, &mut buf) {
+                            Some(len) => len,
+                            None => {
+                                vanished = true;
+                                break;
+                            }
+                        };
+                        let data = &buf[0..len];
+                        if drop_oversized(policy.max_inner_packet, data, &stats) {
+                            debug!("Dropping oversized packet of {} bytes from TUN.", len);
+                            continue;
+                        }
+                        if drop_non_unicast(&filter, data, &stats) {
+                            continue;
+                        }
+                        let destination = Ipv4Addr::new(data[16], data[17], data[18], data[19]);
+                        let client_id = match sessions.route(destination) {
+                            Some(id) => id,
+                            None => {
+                                debug!("No session bridges the subnet of {}.", destination);
+                                stats.dropped();
+                                continue;
+                            }
+                        };
+
+                        let session = sessions.get(client_id).map(|s| {
+                            (s.token, s.addr, policy.keys(s.identifier.as_ref(), &*keys))
+                        });
+                        match session {
+                            None => {
+                                warn!("Unknown IP packet from TUN for client {}.", client_id);
+                                stats.dropped();
+                            }
+                            Some((token, addr, master)) => {
+                                if sessions.is_quiesced(client_id) {
+                                    debug!("Dropping data for quiesced id {}.", client_id);
+                                    stats.dropped();
+                                    continue;
+                                }
+                                if !sessions.allow(client_id, Direction::Download, len) {
+                                    debug!("Download of id {} rate limited.", client_id);
+                                    stats.dropped();
+                                    continue;
+                                }
+                                let mtu = sessions.downstream_mtu(client_id);
+                                let link = pool::peer(client_id, config.link_prefix)
+                                    .unwrap_or(pool::SERVER_ID);
+                                let link = Ipv4Addr::new(10, 10, 10, link);
+                                let fragments = match fit_downstream(data, mtu, link) {
+                                        Ok(fragments) => fragments,
+                                        Err(reply) => {
+                                            debug!("Packet of {} bytes too large for id {}.",
+                                                   len,
+                                                   client_id);
+                                            stats.dropped();
+                                            write_inner(&mut tun, &reply, &stats);
+                                            continue;
+                                        }
+                                    };
+                                mirror(&tap, data);
+                                account(&mut flows, data);
+                                let pieces = if fragments.is_empty() {
+                                    vec![data]
+                                } else {
+                                    fragments.iter().map(|f| &f[..]).collect()
+                                };
+                                let encoding = encoding_for(&sessions, client_id, &dictionary);
+                                for data in pieces {
+                                    let data = encode(encoding, data, &mut encoder, &dictionary)
+                                        .unwrap();
+                                    let sequence = if sessions.uses_sequencing(client_id) {
+                                        Some(sessions.next_sequence(client_id))
+                                    } else {
+                                        None
+                                    };
+                                    let msg = Message::Data {
+                                        id: client_id,
+                                        token: token,
+                                        connection: None,
+                                        sequence: sequence,
+                                        encoding: encoding,
+                                        data: data,
+                                    };
+                                    let encrypted_msg = sessions.seal(client_id, master, &msg)
+                                        .unwrap();
+                                    if config.fair_queuing {
+                                        if !queue.push(client_id, encrypted_msg) {
+                                            debug!("Queue for client {} is full. Dropping packet.",
+                                                   client_id);
+                                            stats.dropped();
+                                        }
+                                        let evicted = queue.take_evicted();
+                                        if evicted > 0 && !throttled {
+                                            warn!("Over {} bytes queued. Dropping packets from the \
+                                                   largest backlogs.",
+                                                  config.queue_memory_limit);
+                                            throttled = true;
+                                        }
+                                        for _ in 0..evicted {
+                                            stats.dropped();
+                                        }
+                                        continue;
+                                    }
+                                    let delivery = batch.push(&sockfd, addr, &encrypted_msg);
+                                    count_delivery(delivery, &stats);
+                                }
+                            }
+                        }
+                    }
+                    count_delivery(batch.flush(&sockfd), &stats);
+                    if vanished {
+                        poll.deregister(&mio::unix::EventedFd(&tun_rawfd)).unwrap();
+                        // Its routes went with it.
+                        _bridge = None;
+                        tun = match recreate_tun(&tun, config.tun_recreate_attempts, |tun| {
+                            try!(tun.configure(pool::SERVER_ID, 24, 1, config.mtu));
+                            if config.link_prefix != 24 {
+                                for id in pool::server_ids(config.link_prefix) {
+                                    try!(tun.add_address(id));
+                                }
+                            }
+                            Ok(())
+                        }) {
+                            Ok(tun) => tun,
+                            Err(e) => panic!("{}", e),
+                        };
+                        tun_rawfd = tun.as_raw_fd();
+                        poll.register(&mio::unix::EventedFd(&tun_rawfd),
+                                      TUN,
+                                      mio::Ready::readable(),
+                                      mio::PollOpt::level())
+                            .unwrap();
+                        if !bridged.is_empty() {
+                            match HostBridge::server(&bridged,
+                                                     tun.name(),
+                                                     utils::RetryPolicy::default()) {
+                                Ok(bridge) => _bridge = Some(bridge),
+                                Err(e) => warn!("Unable to route bridged subnets again: {}", e),
+                            }
+                        }
+                    }
+                }
+                TCP_LISTEN => {
+                    let listener = listener.as_ref().unwrap();
+                    loop {
+                        let (stream, addr) = match listener.accept() {
+                            Ok(conn) => conn,
+                            Err(ref e) if e.kind() == io::ErrorKind::WouldBlock => break,
+                            Err(e) => {
+                                warn!("Failed to accept TCP connection: {}", e);
+                                break;
+                            }
+                        };
+                        if let Err(e) = tcp_handshakes.add(&poll, stream, addr, Instant::now()) {
+                            debug!("Closing TCP connection from {}: {}", addr, e);
+                        }
+                    }
+                }
+                mio::Token(token) if token >= FIRST_TCP_TOKEN => {
+                    let (stream, addr, mut frame) = match tcp_handshakes.read(&poll, token) {
+                        Ok(Some(read)) => read,
+                        Ok(None) => continue,
+                        Err((addr, e)) => {
+                            warn!("Dropping TCP handshake from {}: {}", addr, e);
+                            continue;
+                        }
+                    };
+                    let handshake = match policy.open(&mut sessions, &*keys, &mut frame) {
+                        Ok((Message::Request { identifier,
+                                               nonce,
+                                               timestamp,
+                                               ciphers,
+                                               dictionary,
+                                               subnets },
+                            keyed)) => {
+                            if let Err(e) = policy.check_key(identifier.as_ref(), keyed.as_ref()) {
+                                warn!("Rejecting TCP handshake from {}: {}", addr, e);
+                                continue;
+                            }
+                            Handshake {
+                                identifier: identifier,
+                                keyed: keyed,
+                                addr: addr,
+                                nonce: nonce,
+                                timestamp: timestamp,
+                                ciphers: ciphers,
+                                offered: dictionary,
+                                subnets: subnets,
+                                received: Instant::now(),
+                                stream: Some(stream),
+                            }
+                        }
+                        Ok((msg, _)) => {
+                            warn!("Invalid message {:?} from {}", msg, addr);
+                            continue;
+                        }
+                        Err(e) => {
+                            warn!("Dropping TCP handshake from {}: {}", addr, e);
+                            continue;
+                        }
+                    };
+                    pass_on(handshake,
+                            &mut limiter,
+                            &mut backlog,
+                            &mut replays,
+                            &mut handshakes);
+                }
+                _ => unreachable!(),
+            }
+        }
+
+        if let Some((op, id)) = take_session_op() {
+            let result = match op {
+                SessionOp::Quiesce => {
+                    sessions.quiesce(id).and_then(|_| {
+                        // Flushed first, so the client gets everything sent
+                        // to it before the snapshot.
+                        let addr = sessions.get(id).unwrap().addr;
+                        for packet in queue.take(&id) {
+                            match sockfd.send_to(&packet, &addr) {
+                                Ok(len) => stats.sent(len),
+                                Err(e) => {
+                                    warn!("Failed to send to {}: {}", addr, e);
+                                    stats.dropped();
+                                }
+                            }
+                        }
+                        match config.migration_file {
+                            Some(ref path) => {
+                                sessions.export_quiesced(&state_key)
+                                    .and_then(|state| utils::write_private_file(path, &state))
+                            }
+                            None => Ok(()),
+                        }
+                    })
+                }
+                SessionOp::Resume => sessions.resume(id),
+                SessionOp::HandOff => sessions.hand_off(id),
+            };
+            match result {
+                Ok(_) => info!("{:?} of id {} done.", op, id),
+                Err(e) => warn!("{:?} of id {} failed: {}", op, id, e),
+            }
+        }
+
+        if let Some(ref mut backlog) = backlog {
+            handshakes.extend(backlog.ready(Instant::now()));
+        }
+        for mut handshake in handshakes.drain(..) {
+            let addr = handshake.addr;
+            let key = policy.keys(handshake.identifier.as_ref(), &*keys);
+            let mut reply =
+                match respond(&mut sessions, &handshake, config.min_cipher, &dictionary) {
+                    Some(reply) => reply,
+                    None => continue,
+                };
+            if handshake.stream.is_some() {
+                if let Message::Response { id, ref mut data_port, .. } = reply {
+                    sessions.await_udp(id);
+                    *data_port = Some(port);
+                }
+            }
+            let encrypted_reply = seal_handshake(None, key, &reply).unwrap();
+            match handshake.stream {
+                // Still nonblocking, but a fresh connection has room for the
+                // Response.
+                Some(ref mut stream) => {
+                    if let Err(e) = write_frame(stream, &encrypted_reply) {
+                        warn!("Failed to reply to {}: {}", addr, e);
+                        continue;
+                    }
+                }
+                // A burst of queued handshakes can fill the socket's buffer;
+                // their clients retry.
+                None => {
+                    match sockfd.send_to(&encrypted_reply, &addr) {
+                        Ok(len) => stats.sent(len),
+                        Err(e) => {
+                            warn!("Failed to reply to {}: {}", addr, e);
+                            stats.dropped();
+                            continue;
+                        }
+                    }
+                }
+            }
+            let received = handshake.received;
+            let trace_id = format!("{:016x}", rand::random::<u64>());
+            debug!("Answered handshake from {} (trace {}).", addr, trace_id);
+            stats.answered_handshake(received.elapsed(), &trace_id);
+        }
+
+        while let Some((client_id, encrypted_msg)) = queue.pop() {
+            let addr = match sessions.get(client_id) {
+                Some(session) => session.addr,
+                None => continue,
+            };
+            match sockfd.send_to(&encrypted_msg, &addr) {
+                Ok(len) => stats.sent(len),
+                Err(ref e) if e.kind() == io::ErrorKind::WouldBlock => {
+                    queue.requeue(client_id, encrypted_msg);
+                    break;
+                }
+                Err(e) => {
+                    warn!("Dropped a datagram the kernel refused: {}", e);
+                    stats.dropped();
+                }
+            }
+        }
+        let expired = queue.take_expired();
+        if expired > 0 {
+            debug!("Dropped {} packet(s) queued for too long.", expired);
+            for _ in 0..expired {
+                stats.dropped();
+            }
+            stats.sink().counter("kytan_queue_latency_drops_total", expired as u64);
+        }
+
+        if throttled && queue.bytes() < config.queue_memory_limit / 2 {
+            info!("Queued bytes back under the limit.");
+            throttled = false;
+        }
+        stats.set_sessions(sessions.len());
+        if let Some(ref mut logger) = stats_logger {
+            logger.tick(&stats, sessions.len(), Instant::now());
+        }
+        if let Some((ref mut table, ref mut exporter)) = flows {
+            export_flows(exporter, &table.expire(Instant::now()), &stats);
+        }
+    }
+
+    if let Some((ref mut table, ref mut exporter)) = flows {
+        export_flows(exporter, &table.flush(), &stats);
+    }
+
+    if !queue.is_empty() {
+        info!("Draining {} queued packet(s).", queue.len());
+        let timeout = Duration::from_millis(config.drain_timeout_ms);
+        let unsent = drain(&mut queue, timeout, |id, packet| {
+            let addr = match sessions.get(id) {
+                Some(session) => session.addr,
+                None => return Ok(()),
+            };
+            sockfd.send_to(packet, &addr).map(|len| stats.sent(len))
+        });
+        if unsent > 0 {
+            warn!("Dropped {} packet(s) still queued after {:?}.", unsent, timeout);
+        }
+    }
+
+    // The audit records are written whether or not the export worked.
+    if let Some(ref path) = config.state_file {
+        let exported = sessions.export(&state_key)
+            .and_then(|state| utils::write_private_file(path, &state));
+        match exported {
+            Ok(_) => info!("Exported {} session(s) to {}.", sessions.len(), path),
+            Err(e) => error!("Unable to export the sessions to {}: {}", path, e),
+        }
+    }
+    sessions.record_shutdown();
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::net::Ipv4Addr;
+    use network::*;
 
     #[test]
     fn resolve_test() {
@@ -387,11 +3062,1147 @@ mod tests {
                    IpAddr::V4(Ipv4Addr::new(127, 0, 0, 1)));
     }
 
+    #[test]
+    fn nat64_test() {
+        let v4 = IpAddr::V4(Ipv4Addr::new(192, 0, 2, 33));
+        let v6: IpAddr = "2001:db8::1".parse().unwrap();
+        let prefix = "64:ff9b::".parse().unwrap();
+        assert_eq!(synthesize(prefix, Ipv4Addr::new(192, 0, 2, 33)),
+                   "64:ff9b::c000:221".parse::<Ipv6Addr>().unwrap());
+        assert_eq!(order_addresses(vec![v4, v6], false, None), vec![v4, v6]);
+        assert_eq!(order_addresses(vec![v4, v6], true, None), vec![v6, v4]);
+        // An IPv4-only server, e.g. a literal address, on an IPv6-only network.
+        let synthesized: IpAddr = "64:ff9b::c000:221".parse().unwrap();
+        assert_eq!(order_addresses(vec![v4], false, Some(prefix)), vec![synthesized]);
+        assert_eq!(order_addresses(vec![v4, synthesized], true, Some(prefix)),
+                   vec![synthesized]);
+        let config = config::Config::parse("[client]\nnat64_prefix = \"64:ff9b::\"").unwrap();
+        assert_eq!(resolve_server("192.0.2.33", &config.client).unwrap(), vec![synthesized]);
+    }
+
+    #[test]
+    #[cfg(target_os = "linux")]
+    fn recreate_tun_test() {
+        use std::cell::Cell;
+        use std::process;
+
+        assert!(utils::is_root());
+        let mut tun = device::Tun::create(16).unwrap();
+        tun.up(1, device::DEFAULT_MTU);
+        // Removed out from under us.
+        assert!(process::Command::new("ip")
+            .args(&["link", "del", tun.name()])
+            .status()
+            .unwrap()
+            .success());
+        let mut buf = [0u8; 1600];
+        assert_eq!(read_tun(&mut tun, &mut buf), None);
+
+        assert!(recreate_tun(&tun, 0, |_| Ok(())).is_err());
+        let configured = Cell::new(0);
+        let recreated = recreate_tun(&tun, 2, |tun| {
+                configured.set(configured.get() + 1);
+                tun.configure(1, 24, 1, 1300)
+            })
+            .unwrap();
+        assert_eq!(configured.get(), 1);
+        assert_eq!(recreated.name(), tun.name());
+        assert_eq!(recreated.mtu().unwrap(), 1300);
+        // Given up on after the attempts run out.
+        let result = recreate_tun(&tun, 2, |_| Err(String::from("no address")));
+        assert!(result.err().unwrap().contains("after 2 attempt(s)"));
+    }
+
+    #[test]
+    fn apply_ttl_test() {
+        let mut packet = vec![0x45, 0, 0, 28, 0, 0, 0x40, 0, 1, 17, 0, 0, 10, 10, 10, 2, 8, 8, 8,
+                              8, 0x30, 0x39, 0, 53, 0, 8, 0, 0];
+        assert_eq!(apply_ttl(false, &mut packet), Ok(()));
+        assert_eq!(packet[8], 1);
+
+        let reply = apply_ttl(true, &mut packet).unwrap_err();
+        assert_eq!(&reply[12..20], &[10, 10, 10, 1, 10, 10, 10, 2]);
+        assert_eq!(&reply[20..22], &[11, 0]);
+        assert_eq!(&reply[28..], &packet[..]);
+
+        packet[8] = 64;
+        assert_eq!(apply_ttl(true, &mut packet), Ok(()));
+        assert_eq!(packet[8], 63);
+    }
+
+    #[test]
+    fn asymmetric_mtu_test() {
+        let config = config::Config::parse("[server]\nmtu = 1400\ndownstream_mtu = 1200")
+            .unwrap();
+        let mut sessions = SessionTable::new(&config.server).unwrap();
+        let id = match sessions.accept(None, "192.0.2.1:5000".parse().unwrap()).unwrap() {
+            Message::Response { id, mtu, .. } => {
+                // Clients may still send packets as large as this.
+                assert_eq!(mtu, 1400);
+                id
+            }
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        let limit = sessions.downstream_mtu(id);
+        let mut packet = vec![0x45, 0, 0x05, 0x78, 0, 1, 0, 0, 64, 17, 0, 0, 8, 8, 8, 8, 10, 10,
+                              10, id];
+        packet.resize(1400, 7);
+
+        let server = Ipv4Addr::new(10, 10, 10, 1);
+        let fragments = fit_downstream(&packet, limit, server).unwrap();
+        assert_eq!(fragments.len(), 2);
+        assert!(fragments.iter().all(|f| f.len() <= 1200));
+        assert_eq!(fragments.iter().map(|f| f.len() - 20).sum::<usize>(), 1380);
+        assert!(fit_downstream(&packet[..1200], limit, server).unwrap().is_empty());
+        assert!(fit_downstream(&packet, None, server).unwrap().is_empty());
+        // Only IPv4 is split here.
+        let mut ipv6 = packet.clone();
+        ipv6[0] = 0x60;
+        assert!(fit_downstream(&ipv6, limit, server).unwrap().is_empty());
+
+        // With DF set, the sender is told to lower its path MTU instead.
+        packet[6] = 0x40;
+        let reply = fit_downstream(&packet, limit, server).unwrap_err();
+        assert_eq!(&reply[12..20], &[10, 10, 10, 1, 8, 8, 8, 8]);
+        // Sent from the server's end of the client's own link.
+        let reply = fit_downstream(&packet, limit, Ipv4Addr::new(10, 10, 10, 5)).unwrap_err();
+        assert_eq!(&reply[12..16], &[10, 10, 10, 5]);
+        assert_eq!(&reply[20..22], &[3, 4]);
+        assert_eq!(&reply[26..28], &[0x04, 0xb0]);
+    }
+
+    #[test]
+    fn drain_test() {
+        let mut queue = FairQueue::new(FAIR_QUEUE_QUANTUM, 64);
+        // Id 3 never becomes writable.
+        queue.push(3, vec![0; 100]);
+        for _ in 0..4 {
+            queue.push(2, vec![0; 100]);
+        }
+        let mut sent = Vec::new();
+        let start = Instant::now();
+        let unsent = drain(&mut queue, Duration::from_millis(100), |id, _| {
+            if id == 3 {
+                return Err(io::Error::new(io::ErrorKind::WouldBlock, "stuck"));
+            }
+            sent.push(id);
+            Ok(())
+        });
+        assert!(start.elapsed() < Duration::from_millis(500));
+        assert_eq!(unsent, 1);
+        assert_eq!(sent, vec![2, 2, 2, 2]);
+
+        let mut empty: FairQueue<Id> = FairQueue::new(FAIR_QUEUE_QUANTUM, 64);
+        assert_eq!(drain(&mut empty, Duration::from_secs(60), |_, _| Ok(())), 0);
+    }
+
+    #[test]
+    fn host_watcher_test() {
+        let start = Instant::now();
+        let old: IpAddr = "192.0.2.1".parse().unwrap();
+        let new: IpAddr = "192.0.2.2".parse().unwrap();
+        let mut watcher = HostWatcher::new("vpn.example.com", Duration::from_secs(60), start);
+
+        let moved = |host: &str| {
+            assert_eq!(host, "vpn.example.com");
+            Ok(vec![new])
+        };
+        assert_eq!(watcher.check(old, start + Duration::from_secs(30), &moved), None);
+        assert_eq!(watcher.check(old, start + Duration::from_secs(60), &moved), Some(new));
+        // Not due again until another interval has passed.
+        assert_eq!(watcher.check(old, start + Duration::from_secs(90), &moved), None);
+
+        let both = |_: &str| Ok(vec![new, old]);
+        assert_eq!(watcher.check(old, start + Duration::from_secs(120), &both), None);
+        let failed = |_: &str| Err(String::from("timed out"));
+        assert_eq!(watcher.check(old, start + Duration::from_secs(180), &failed), None);
+    }
+
+    #[test]
+    fn path_watcher_test() {
+        use std::cell::Cell;
+        let start = Instant::now();
+        let server: SocketAddr = "192.0.2.1:9527".parse().unwrap();
+        let wifi: IpAddr = "192.168.1.20".parse().unwrap();
+        let cellular: IpAddr = "100.64.0.7".parse().unwrap();
+        let mut watcher = PathWatcher::new(wifi, Duration::from_secs(5), start);
+
+        let current = Cell::new(wifi);
+        let probe = |remote: &SocketAddr| {
+            assert_eq!(*remote, server);
+            Ok(current.get())
+        };
+        assert_eq!(watcher.check(&server, start + Duration::from_secs(5), &probe), None);
+        // The handoff is noticed at the next check, and only reported once.
+        current.set(cellular);
+        assert_eq!(watcher.check(&server, start + Duration::from_secs(7), &probe), None);
+        assert_eq!(watcher.check(&server, start + Duration::from_secs(10), &probe),
+                   Some(cellular));
+        assert_eq!(watcher.check(&server, start + Duration::from_secs(15), &probe), None);
+
+        let down = |_: &SocketAddr| Err(io::Error::from_raw_os_error(libc::ENETUNREACH));
+        assert_eq!(watcher.check(&server, start + Duration::from_secs(20), &down), None);
+        current.set(wifi);
+        assert_eq!(watcher.check(&server, start + Duration::from_secs(25), &probe), Some(wifi));
+
+        let local = "127.0.0.1:9".parse().unwrap();
+        assert_eq!(preferred_source(&local).unwrap(), local.ip());
+    }
+
+    #[test]
+    fn reconnect_storm_test() {
+        use ratelimit::AdmissionQueue;
+        let window = Duration::from_secs(10);
+        let mut rng = rand::thread_rng();
+        let delays: Vec<Duration> = (0..5000).map(|_| reconnect_delay(window, &mut rng)).collect();
+        // Spread evenly over the window, a second at a time.
+        let mut buckets = [0; 10];
+        for delay in &delays {
+            assert!(*delay < window);
+            buckets[delay.as_secs() as usize] += 1;
+        }
+        assert!(buckets.iter().all(|&n| n > 350 && n < 650), "{:?}", buckets);
+        assert_eq!(reconnect_delay(Duration::from_secs(0), &mut rng),
+                   Duration::from_secs(0));
+
+        // The server keeps up with jittered clients, its queue staying short,
+        // where unjittered ones would all pile up at once.
+        let start = Instant::now();
+        let mut queue = AdmissionQueue::new(1000.0, 200.0, 5000, window, start);
+        let mut arrivals = delays.clone();
+        arrivals.sort();
+        let mut longest = 0;
+        for ms in 0..10000 {
+            let now = start + Duration::from_millis(ms);
+            while !arrivals.is_empty() && arrivals[0] <= Duration::from_millis(ms) {
+                assert!(queue.push(arrivals.remove(0), now));
+            }
+            queue.ready(now);
+            longest = cmp::max(longest, queue.len());
+        }
+        assert!(longest < 50, "{} handshakes queued", longest);
+
+        let mut bunched = AdmissionQueue::new(1000.0, 200.0, 5000, window, start);
+        for delay in &delays {
+            bunched.push(*delay, start);
+        }
+        bunched.ready(start);
+        assert_eq!(bunched.len(), 4800);
+    }
+
+    #[test]
+    fn recv_handshake_test() {
+        let server = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let client = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let server_addr = server.local_addr().unwrap();
+        let client_addr = client.local_addr().unwrap();
+
+        let running = AtomicBool::new(false);
+
+        let large = vec![7u8; 4000];
+        server.send_to(&large, &client_addr).unwrap();
+        assert_eq!(recv_handshake(&client, &server_addr, &running).unwrap(), large);
+
+        server.send_to(&vec![7u8; MAX_HANDSHAKE_LEN + 1], &client_addr).unwrap();
+        assert!(recv_handshake(&client, &server_addr, &running).is_err());
+
+        // Others are ignored, and the read timeout is kept to.
+        let other = UdpSocket::bind("127.0.0.1:0").unwrap();
+        other.send_to(b"stray", &client_addr).unwrap();
+        client.set_read_timeout(Some(Duration::from_millis(300))).unwrap();
+        let err = recv_handshake(&client, &server_addr, &running).unwrap_err();
+        assert!(err.contains("No response"), "{}", err);
+        assert_eq!(client.read_timeout().unwrap(), Some(Duration::from_millis(300)));
+    }
+
+    static SIGNALLED: AtomicBool = ATOMIC_BOOL_INIT;
+
+    extern "C" fn handle_interrupt(_: libc::c_int) {
+        SIGNALLED.store(true, Ordering::Relaxed);
+    }
+
+    #[test]
+    fn interrupted_handshake_test() {
+        // A server that never answers.
+        let server = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let client = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let server_addr = server.local_addr().unwrap();
+        client.send_to(b"request", &server_addr).unwrap();
+
+        unsafe {
+            libc::signal(libc::SIGINT, handle_interrupt as libc::sighandler_t);
+        }
+        let signaller = thread::spawn(|| {
+            thread::sleep(Duration::from_millis(300));
+            unsafe {
+                libc::raise(libc::SIGINT);
+            }
+        });
+        let start = Instant::now();
+        let err = recv_handshake(&client, &server_addr, &SIGNALLED).unwrap_err();
+        assert!(err.contains("Interrupted"), "{}", err);
+        assert!(start.elapsed() < Duration::from_secs(2));
+        signaller.join().unwrap();
+        unsafe {
+            libc::signal(libc::SIGINT, libc::SIG_DFL);
+        }
+    }
+
+    #[test]
+    fn initiate_test() {
+        let server = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let client = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let server_addr = server.local_addr().unwrap();
+        let responder = thread::spawn(move || {
+            let keys = derive_keys("password");
+            let mut buf = [0u8; 1600];
+            let (len, addr) = server.recv_from(&mut buf).unwrap();
+            let nonce = match open_datagram(&keys, &mut buf[..len]) {
+                Ok(Message::Request { nonce, .. }) => nonce,
+                msg => panic!("Unexpected {:?}", msg),
+            };
+            let reply = Message::Response {
+                id: 9,
+                token: 1,
+                nonces: (nonce, [0; 16]),
+                cipher: cipher::DEFAULT,
+                // An hour ahead of the client, which still connects.
+                timestamp: session::unix_time() + 3600,
+                link_prefix: 31,
+                mtu: 1380,
+                compression: true,
+                dictionary: false,
+                data_port: None,
+            };
+            let reply = seal_handshake(None, &keys, &reply).unwrap();
+            server.send_to(&reply, &addr).unwrap();
+        });
+        let mut log = HandshakeLog::new(true);
+        let assignment = initiate(&client, &server_addr, "password", None, &mut log).unwrap();
+        assert_eq!((assignment.id, assignment.link_prefix), (9, 31));
+        assert_eq!(log.steps(),
+                   &[HandshakeStep::RequestSent, HandshakeStep::ResponseReceived]);
+        responder.join().unwrap();
+    }
+
+    #[test]
+    fn diagnose_test() {
+        let server = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let client = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let server_addr = server.local_addr().unwrap();
+        // A server with another secret: it drops the Requests, but answers
+        // the hello.
+        let responder = thread::spawn(move || {
+            let mut buf = [0u8; 1600];
+            loop {
+                let (len, addr) = server.recv_from(&mut buf).unwrap();
+                if let Some(reply) = diagnostic_reply(&buf[..len]) {
+                    server.send_to(reply, &addr).unwrap();
+                    break;
+                }
+            }
+        });
+        let timeout = Duration::from_millis(50);
+        let mut log = HandshakeLog::new(false);
+        let e = initiate_with_diagnosis(&client,
+                                        &server_addr,
+                                        &derive_keys("password"),
+                                        None,
+                                        None,
+                                        &[cipher::DEFAULT],
+                                        None,
+                                        &[],
+                                        timeout,
+                                        &mut log)
+            .unwrap_err();
+        assert!(e.contains("so it is reachable"), "{}", e);
+        responder.join().unwrap();
+        assert_eq!(log.steps().len(), DIAGNOSTIC_ATTEMPTS);
+        assert_eq!(client.read_timeout().unwrap(), None);
+
+        // Nothing answers at all.
+        let silent = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let e = initiate_with_diagnosis(&client,
+                                        &silent.local_addr().unwrap(),
+                                        &derive_keys("password"),
+                                        None,
+                                        None,
+                                        &[cipher::DEFAULT],
+                                        None,
+                                        &[],
+                                        timeout,
+                                        &mut log)
+            .unwrap_err();
+        assert!(e.contains("did not answer a diagnostic hello"), "{}", e);
+        assert_eq!(diagnostic_reply(b"kytan diagnostic hello!"), None);
+    }
+
+    #[test]
+    fn dictionary_negotiation_test() {
+        let server = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let client = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let server_addr = server.local_addr().unwrap();
+        let ours = Dictionary::new(b"GET / HTTP/1.1\r\n".to_vec()).unwrap();
+        let ours_id = ours.id();
+        let responder = thread::spawn(move || {
+            let keys = derive_keys("password");
+            let dictionary = Some(ours);
+            let mut sessions = SessionTable::new(&config::ServerConfig::default()).unwrap();
+            for _ in 0..2 {
+                let mut buf = [0u8; 1600];
+                let (len, addr) = server.recv_from(&mut buf).unwrap();
+                let (identifier, nonce, offered) = match open_datagram(&keys, &mut buf[..len]) {
+                    Ok(Message::Request { identifier, nonce, dictionary: Some(offered), .. }) => {
+                        (identifier, nonce, offered)
+                    }
+                    msg => panic!("Unexpected {:?}", msg),
+                };
+                let reply = sessions.accept(identifier.as_ref().map(|i| i.as_str()), addr)
+                    .unwrap();
+                let reply = grant_dictionary(&mut sessions, reply, offered, &dictionary);
+                if let Message::Response { id, dictionary, .. } = reply {
+                    assert_eq!(sessions.uses_dictionary(id), dictionary);
+                }
+                let reply = grant_keys(&mut sessions, reply, nonce).unwrap();
+                server.send_to(&seal_handshake(None, &keys, &reply).unwrap(), &addr).unwrap();
+            }
+        });
+        let mut log = HandshakeLog::new(false);
+        for &(offer, accepted) in &[(ours_id, true), (1, false)] {
+            let (_, result) = initiate_with_dictionary(&client,
+                                                       &server_addr,
+                                                       &derive_keys("password"),
+                                                       None,
+                                                       None,
+                                                       &[cipher::DEFAULT],
+                                                       Some(offer),
+                                                       &[],
+                                                       &mut log)
+                .unwrap();
+            assert_eq!(result, accepted);
+        }
+        responder.join().unwrap();
+
+        let mut decoder = snap::Decoder::new();
+        assert!(decode(Encoding::Dictionary, vec![1, 0, 0x45], &mut decoder, &None).is_err());
+    }
+
+    #[test]
+    fn encoding_test() {
+        let dictionary = Some(Dictionary::new(b"GET / HTTP/1.1\r\n".to_vec()).unwrap());
+        let mut encoder = snap::Encoder::new();
+        let mut decoder = snap::Decoder::new();
+        let packet = b"GET / HTTP/1.1\r\nHost: example.com\r\n";
+        for &encoding in &[Encoding::Snappy, Encoding::Dictionary, Encoding::Plain] {
+            let data = encode(encoding, packet, &mut encoder, &dictionary).unwrap();
+            assert_eq!(decode(encoding, data, &mut decoder, &dictionary).unwrap(),
+                       &packet[..]);
+        }
+        // Tagged and numbered data keeps its encoding, whichever it is.
+        let data = encode(Encoding::Dictionary, packet, &mut encoder, &dictionary).unwrap();
+        let msg = Message::Data {
+            id: 9,
+            token: 1,
+            connection: Some(7),
+            sequence: Some(0),
+            encoding: Encoding::Dictionary,
+            data: data,
+        };
+        let keys = derive_keys("password");
+        match open_datagram(&keys, &mut seal_data(&keys, 0, &msg).unwrap()).unwrap() {
+            Message::Data { connection: Some(7), sequence: Some(0), encoding, data, .. } => {
+                assert_eq!(decode(encoding, data, &mut decoder, &dictionary).unwrap(),
+                           &packet[..]);
+            }
+            msg => panic!("Unexpected {:?}", msg),
+        }
+
+        let mut sessions = SessionTable::new(&Default::default()).unwrap();
+        let addr = "192.0.2.1:5000".parse().unwrap();
+        let id = match sessions.accept(None, addr).unwrap() {
+            Message::Response { id, .. } => id,
+            msg => panic!("Unexpected {:?}", msg),
+        };
+        assert_eq!(encoding_for(&sessions, id, &dictionary), Encoding::Snappy);
+        sessions.use_dictionary(id);
+        assert_eq!(encoding_for(&sessions, id, &dictionary), Encoding::Dictionary);
+        assert_eq!(encoding_for(&sessions, id, &None), Encoding::Snappy);
+    }
+
+    #[test]
+    fn bridge_test() {
+        let server = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let client = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let server_addr = server.local_addr().unwrap();
+        let lan = Subnet::parse("192.168.50.0/24").unwrap();
+        let responder = thread::spawn(move || {
+            let keys = derive_keys("password");
+            let mut config = config::ServerConfig::default();
+            config.bridged_subnets.insert(String::from("office"),
+                                          vec![String::from("192.168.50.0/24")]);
+            let mut sessions = SessionTable::new(&config).unwrap();
+            let mut buf = [0u8; 1600];
+            let (len, addr) = server.recv_from(&mut buf).unwrap();
+            let (identifier, nonce, subnets) = match open_datagram(&keys, &mut buf[..len]) {
+                Ok(Message::Request { identifier, nonce, dictionary: None, subnets, .. }) => {
+                    (identifier, nonce, subnets)
+                }
+                msg => panic!("Unexpected {:?}", msg),
+            };
+            let reply = sessions.accept(identifier.as_ref().map(|i| i.as_str()), addr).unwrap();
+            grant_subnets(&mut sessions, &reply, &subnets);
+            let reply = grant_keys(&mut sessions, reply, nonce).unwrap();
+            server.send_to(&seal_handshake(None, &keys, &reply).unwrap(), &addr).unwrap();
+            // Packets from TUN to the subnet go to the client's session,
+            // others still by their address.
+            (sessions.route(Ipv4Addr::new(192, 168, 50, 9)),
+             sessions.route(Ipv4Addr::new(10, 10, 10, 9)))
+        });
+        let mut log = HandshakeLog::new(false);
+        let (assignment, _) = initiate_with_dictionary(&client,
+                                                       &server_addr,
+                                                       &derive_keys("password"),
+                                                       Some("office"),
+                                                       None,
+                                                       &[cipher::DEFAULT],
+                                                       None,
+                                                       &[lan],
+                                                       &mut log)
+            .unwrap();
+        assert_eq!(responder.join().unwrap(), (Some(assignment.id), Some(9)));
+    }
+
+    #[test]
+    fn profile_negotiation_test() {
+        let server = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let client = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let server_addr = server.local_addr().unwrap();
+        let responder = thread::spawn(move || {
+            let config = config::Config::parse(r#"
+                [server]
+                min_cipher = "aes-128-gcm"
+
+                [server.profiles.sensor]
+                min_cipher = "chacha20-poly1305"
+                compression = false
+            "#)
+                .unwrap();
+            let keys = derive_keys("password");
+            let mut sessions = SessionTable::new(&config.server).unwrap();
+            let mut refused = 0;
+            for _ in 0..3 {
+                let mut buf = [0u8; 1600];
+                let (len, addr) = server.recv_from(&mut buf).unwrap();
+                let handshake = match open_datagram(&keys, &mut buf[..len]) {
+                    Ok(Message::Request { identifier, nonce, timestamp, ciphers, .. }) => {
+                        Handshake {
+                            identifier: identifier,
+                            keyed: None,
+                            addr: addr,
+                            nonce: nonce,
+                            timestamp: timestamp,
+                            ciphers: ciphers,
+                            offered: None,
+                            subnets: Vec::new(),
+                            received: Instant::now(),
+                            stream: None,
+                        }
+                    }
+                    msg => panic!("Unexpected {:?}", msg),
+                };
+                let min_cipher = config.server.min_cipher;
+                let reply = respond(&mut sessions, &handshake, min_cipher, &None);
+                let reply = match reply {
+                    Some(reply) => reply,
+                    None => {
+                        refused += 1;
+                        continue;
+                    }
+                };
+                server.send_to(&seal_handshake(None, &keys, &reply).unwrap(), &addr).unwrap();
+            }
+            (sessions, refused)
+        });
+        let mut log = HandshakeLog::new(false);
+        let connect = |identifier, ciphers: &[Cipher], log: &mut HandshakeLog| {
+            initiate_with_dictionary(&client,
+                                     &server_addr,
+                                     &derive_keys("password"),
+                                     Some(identifier),
+                                     None,
+                                     ciphers,
+                                     None,
+                                     &[],
+                                     log)
+                .map(|(a, _)| a)
+        };
+        // A sensor offering only a cipher below its floor is refused.
+        client.set_read_timeout(Some(Duration::from_millis(300))).unwrap();
+        assert!(connect("sensor", &[Cipher::Aes128Gcm], &mut log).is_err());
+        let sensor = connect("sensor",
+                             &[Cipher::Aes128Gcm, Cipher::Chacha20Poly1305],
+                             &mut log)
+            .unwrap();
+        let laptop = connect("laptop", &[Cipher::Aes128Gcm], &mut log).unwrap();
+        assert!(!sensor.compression);
+        assert!(laptop.compression);
+        // Each gets what its policy allows of its offer.
+        assert_eq!(sensor.cipher, Cipher::Chacha20Poly1305);
+        assert_eq!(laptop.cipher, Cipher::Aes128Gcm);
+        let (mut sessions, refused) = responder.join().unwrap();
+        assert_eq!(refused, 1);
+        assert!(!sessions.uses_compression(sensor.id));
+        assert!(sessions.uses_compression(laptop.id));
+        assert_eq!(sessions.peek(sensor.id).unwrap().cipher, Cipher::Chacha20Poly1305);
+        assert_eq!(sessions.peek(laptop.id).unwrap().cipher, Cipher::Aes128Gcm);
+
+        // Their data is sealed under the cipher each negotiated, and no other.
+        let keys = derive_keys("password");
+        for assignment in &[sensor, laptop] {
+            let data = Message::Data {
+                id: assignment.id,
+                token: assignment.token,
+                connection: None,
+                sequence: None,
+                encoding: if assignment.compression {
+                    Encoding::Snappy
+                } else {
+                    Encoding::Plain
+                },
+                data: Vec::new(),
+            };
+            let ciphers = [Cipher::Aes128Gcm, Cipher::Aes256Gcm, Cipher::Chacha20Poly1305];
+            for (number, &cipher) in ciphers.iter().enumerate() {
+                let number = number as u64;
+                let client = session_keys(&keys, cipher, &assignment.nonces, true).unwrap();
+                let mut datagram = seal_data(&*client, number, &data).unwrap();
+                let start = split_datagram(&datagram).unwrap().2;
+                assert_eq!(sessions.open(assignment.id, &keys, number, &mut datagram[start..])
+                               .is_ok(),
+                           cipher == assignment.cipher);
+            }
+        }
+    }
+
+    #[test]
+    fn clock_skew_test() {
+        let peer = "192.0.2.1:5000".parse().unwrap();
+        let now = session::unix_time();
+        assert_eq!(clock_skew(&peer, now, now), 0);
+        assert_eq!(clock_skew(&peer, now + 30, now), 30);
+        assert_eq!(clock_skew(&peer, now - 3600, now), -3600);
+        // A peer whose clock is unset.
+        assert_eq!(clock_skew(&peer, 0, now), -(now as i64));
+
+        // Clients skewed by up to MAX_SKEW_SECS are admitted, others not.
+        let mut sessions = SessionTable::new(&Default::default()).unwrap();
+        let mut replays = ReplayCache::new(Duration::from_secs(5), 16);
+        for &timestamp in &[now + MAX_SKEW_SECS, now - MAX_SKEW_SECS, now + 3600, now - 3600, 0] {
+            let handshake = Handshake {
+                identifier: None,
+                keyed: None,
+                addr: peer,
+                nonce: [timestamp as u8; 16],
+                timestamp: timestamp,
+                ciphers: vec![cipher::DEFAULT],
+                offered: None,
+                subnets: Vec::new(),
+                received: Instant::now(),
+                stream: None,
+            };
+            let reply = if check_replay(&mut replays, &handshake) {
+                respond(&mut sessions, &handshake, cipher::DEFAULT, &None)
+            } else {
+                None
+            };
+            match reply {
+                Some(Message::Response { timestamp: theirs, .. }) => {
+                    assert!(timestamp + MAX_SKEW_SECS >= now && timestamp <= now + MAX_SKEW_SECS);
+                    assert!(theirs >= now && theirs < now + 5)
+                }
+                None => assert!(timestamp + 3600 <= now || timestamp >= now + 3600),
+                msg => panic!("Unexpected {:?}", msg),
+            }
+        }
+    }
+
+    #[test]
+    fn replayed_handshake_test() {
+        let mut sessions = SessionTable::new(&Default::default()).unwrap();
+        let mut replays = ReplayCache::new(Duration::from_secs(5), 16);
+        let now = session::unix_time();
+        let sent = |keyed: Option<&str>, nonce, addr: &str, timestamp| {
+            Handshake {
+                identifier: Some(String::from("laptop")),
+                keyed: keyed.map(String::from),
+                addr: addr.parse().unwrap(),
+                nonce: nonce,
+                timestamp: timestamp,
+                ciphers: vec![cipher::DEFAULT],
+                offered: None,
+                subnets: Vec::new(),
+                received: Instant::now(),
+                stream: None,
+            }
+        };
+        let handshake = |keyed, nonce, addr| sent(keyed, nonce, addr, now);
+        let min_cipher = cipher::DEFAULT;
+        let mut admit = |replays: &mut ReplayCache, handshake| {
+            check_replay(replays, &handshake) &&
+            admit(&mut sessions, &handshake, min_cipher).is_some()
+        };
+        assert!(admit(&mut replays, handshake(None, [1; 16], "192.0.2.1:5000")));
+        // A replay is caught from any address, a retry under a fresh nonce
+        // is not,
+        assert!(!admit(&mut replays, handshake(None, [1; 16], "192.0.2.1:5000")));
+        assert!(!admit(&mut replays, handshake(None, [1; 16], "198.51.100.7:6000")));
+        assert!(admit(&mut replays, handshake(None, [2; 16], "192.0.2.1:5000")));
+        // and the same contents under another key are a handshake of their
+        // own.
+        assert!(admit(&mut replays, handshake(Some("laptop"), [1; 16], "192.0.2.1:5000")));
+
+        // Once the window has passed and the cache forgot it, a captured
+        // Request is too old to get in again from anywhere.
+        let mut forgotten = ReplayCache::new(Duration::from_secs(5), 16);
+        let stale = now - 5 - MAX_SKEW_SECS - 1;
+        assert!(!admit(&mut forgotten, sent(None, [1; 16], "198.51.100.7:6000", stale)));
+        assert_eq!(forgotten.len(), 0);
+        assert!(admit(&mut forgotten, sent(None, [3; 16], "192.0.2.1:5000", now)));
+
+        // Copies of one Request from many sources cannot fill the queue.
+        let mut limiter = HandshakeLimiter::new(10.0, 10.0, 0.0, 0.0);
+        let mut backlog = Some(AdmissionQueue::new(0.0,
+                                                   0.0,
+                                                   2,
+                                                   Duration::from_secs(3),
+                                                   Instant::now()));
+        let mut handshakes = Vec::new();
+        for addr in &["192.0.2.1:5000", "192.0.2.2:5000", "192.0.2.3:5000"] {
+            pass_on(handshake(None, [4; 16], addr),
+                    &mut limiter,
+                    &mut backlog,
+                    &mut forgotten,
+                    &mut handshakes);
+        }
+        assert_eq!(backlog.as_ref().unwrap().len(), 1);
+        pass_on(handshake(None, [5; 16], "192.0.2.4:5000"),
+                &mut limiter,
+                &mut backlog,
+                &mut forgotten,
+                &mut handshakes);
+        assert_eq!(backlog.unwrap().len(), 2);
+        assert!(handshakes.is_empty());
+    }
+
+    // Accepts packets like a TUN device which rejects those that are not IP.
+    struct FakeTun {
+        written: Vec<Vec<u8>>,
+    }
+
+    impl PacketIO for FakeTun {
+        fn read_packet(&mut self, _: &mut [u8]) -> io::Result<usize> {
+            Err(io::Error::new(io::ErrorKind::WouldBlock, "no packets"))
+        }
+
+        fn write_packet(&mut self, packet: &[u8]) -> io::Result<()> {
+            if packet[0] >> 4 != 4 {
+                return Err(io::Error::from_raw_os_error(libc::EINVAL));
+            }
+            self.written.push(packet.to_vec());
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn write_inner_test() {
+        let mut tun = FakeTun { written: Vec::new() };
+        let stats = Stats::new();
+        let mut packet = vec![0x45, 0, 0, 20, 0, 0, 0x40, 0, 64, 17, 0, 0, 10, 10, 10, 2, 10, 10,
+                              10, 1];
+        assert!(write_inner(&mut tun, &packet, &stats));
+        assert!(!write_inner(&mut tun, &packet[..12], &stats));
+        assert!(!write_inner(&mut tun, b"not an ip packet", &stats));
+        packet[3] = 40;
+        assert!(!write_inner(&mut tun, &packet, &stats));
+        // Passes validation, but the device refuses it.
+        let mut v6 = vec![0x60, 0, 0, 0, 0, 0, 17, 64];
+        v6.extend_from_slice(&[0; 32]);
+        assert!(!write_inner(&mut tun, &v6, &stats));
+
+        assert_eq!(tun.written.len(), 1);
+        assert_eq!(stats.snapshot().drops, 4);
+    }
+
+    #[test]
+    fn drop_oversized_test() {
+        use std::sync::Arc;
+        use metrics::PrometheusSink;
+
+        let sink = Arc::new(PrometheusSink::new());
+        let stats = Stats::with_sink(Box::new(sink.clone()));
+        let mut tun = FakeTun { written: Vec::new() };
+        let mut packets = Vec::new();
+        for &len in &[20usize, 1400, 1401, 1500] {
+            let mut packet = vec![0x45, 0, (len >> 8) as u8, len as u8, 0, 0, 0x40, 0, 64, 17, 0,
+                                  0, 10, 10, 10, 2, 10, 10, 10, 1];
+            packet.resize(len, 0);
+            packets.push(packet);
+        }
+        for packet in &packets {
+            if !drop_oversized(1400, packet, &stats) {
+                write_inner(&mut tun, packet, &stats);
+            }
+        }
+        assert_eq!(tun.written, &packets[..2]);
+        assert_eq!(stats.snapshot().drops, 2);
+        assert!(sink.render().contains("kytan_oversized_drops_total 2"), "{}", sink.render());
+        // Without a limit, anything goes.
+        assert!(!drop_oversized(0, &packets[3], &stats));
+    }
+
+    #[test]
+    fn unsolicited_test() {
+        use std::sync::Arc;
+        use metrics::PrometheusSink;
+
+        let sink = Arc::new(PrometheusSink::new());
+        let stats = Stats::with_sink(Box::new(sink.clone()));
+        let mut sessions = SessionTable::new(&Default::default()).unwrap();
+        let token = match sessions.accept(None, "192.0.2.1:5000".parse().unwrap()).unwrap() {
+            Message::Response { id: 253, token, .. } => token,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        // Data before any handshake, and data guessing at a session.
+        assert!(unsolicited(&sessions, 252, token, &stats));
+        assert!(unsolicited(&sessions, 253, token.wrapping_add(1), &stats));
+        assert!(!unsolicited(&sessions, 253, token, &stats));
+        assert_eq!(sessions.len(), 1);
+        assert!(sessions.peek(252).is_none());
+        assert_eq!(stats.snapshot().drops, 2);
+        assert!(sink.render().contains("kytan_unsolicited_drops_total 2"), "{}", sink.render());
+    }
+
+    #[test]
+    fn reload_test() {
+        use std::env;
+        use std::fs;
+        use std::io::Write;
+        use rand;
+
+        let path = env::temp_dir().join(format!("kytan-config-{}.toml", rand::random::<u32>()));
+        let path = path.to_str().unwrap();
+        let write = |contents: &str| {
+            fs::File::create(path).unwrap().write_all(contents.as_bytes()).unwrap();
+        };
+        let denied = [0x45, 0, 0, 20, 0, 0, 0x40, 0, 64, 17, 0, 0, 10, 10, 10, 2, 192, 168, 0, 1];
+        let config = config::Config::parse("[server]\nmax_inner_packet = 1400").unwrap();
+        let mut policy = Policy::new(&config.server).unwrap();
+
+        // The ACL and size limit are fine, the MTU is not: none of it applies.
+        write("[server]\nmtu = 100\nmax_inner_packet = 1300\nacl_default = \"deny\"");
+        assert!(policy.reload(path).is_err());
+        assert_eq!(policy.max_inner_packet, 1400);
+        assert!(policy.acl.allows(&denied));
+        write("[server]\nmax_inner_packet = 1300\n[[server.dns_rules]]\ndomain = \"\"\n\
+               action = \"block\"");
+        assert!(policy.reload(path).is_err());
+        assert_eq!(policy.max_inner_packet, 1400);
+        assert!(policy.dns.is_empty());
+
+        write("[server]\nmax_inner_packet = 1300\nacl_default = \"deny\"");
+        assert!(policy.reload(path).is_ok());
+        assert_eq!(policy.max_inner_packet, 1300);
+        assert!(!policy.acl.allows(&denied));
+        fs::remove_file(path).unwrap();
+        assert!(policy.reload(path).is_err());
+        assert_eq!(policy.max_inner_packet, 1300);
+
+        // Keys replaced or removed are reported, so their sessions can be ended.
+        write("[server.psks]\nlaptop = \"laptop key\"\nphone = \"phone key\"");
+        assert_eq!(policy.reload(path), Ok(Vec::new()));
+        write("[server.psks]\nlaptop = \"new laptop key\"\nsensor = \"sensor key\"");
+        let mut rekeyed = policy.reload(path).unwrap();
+        rekeyed.sort();
+        assert_eq!(rekeyed, vec!["laptop", "phone"]);
+        fs::remove_file(path).unwrap();
+    }
+
+    #[test]
+    fn psk_test() {
+        let config = config::Config::parse("[server.psks]\nlaptop = \"laptop key\"\n\
+                                            phone = \"phone key\"")
+            .unwrap();
+        let policy = Policy::new(&config.server).unwrap();
+        let shared = derive_keys("password");
+        let mut sessions = SessionTable::new(&Default::default()).unwrap();
+        // What the server makes of a Request for `identifier` sealed by `sender` with the
+        // key `key`: the identifier, if the key is the right one for it.
+        let request = |sessions: &mut SessionTable,
+                       sender: Option<&str>,
+                       key: &str,
+                       identifier: &str| {
+            let msg = Message::Request {
+                identifier: Some(String::from(identifier)),
+                nonce: [0; 16],
+                timestamp: 0,
+                ciphers: vec![cipher::DEFAULT],
+                dictionary: None,
+                subnets: Vec::new(),
+            };
+            let mut datagram = seal_handshake(sender, &derive_keys(key), &msg).unwrap();
+            let (msg, keyed) = try!(policy.open(sessions, &shared, &mut datagram));
+            match msg {
+                Message::Request { identifier, .. } => {
+                    try!(policy.check_key(identifier.as_ref(), keyed.as_ref()));
+                    Ok(identifier.unwrap())
+                }
+                msg => Err(format!("{:?}", msg)),
+            }
+        };
+        let mut request = |sender, key, identifier| request(&mut sessions, sender, key, identifier);
+        assert_eq!(request(Some("laptop"), "laptop key", "laptop"), Ok(String::from("laptop")));
+        assert_eq!(request(Some("phone"), "phone key", "phone"), Ok(String::from("phone")));
+        // Another client's key opens nothing, whoever it claims to be.
+        assert!(request(Some("laptop"), "phone key", "laptop").is_err());
+        assert!(request(Some("phone"), "laptop key", "phone").is_err());
+        // Nor does a client's own key get it in as another.
+        assert!(request(Some("laptop"), "laptop key", "phone").is_err());
+        assert!(request(Some("laptop"), "laptop key", "sensor").is_err());
+        // The shared secret is only for clients without a key of their own.
+        assert!(request(None, "password", "laptop").is_err());
+        assert_eq!(request(None, "password", "sensor"), Ok(String::from("sensor")));
+        assert!(request(Some("sensor"), "password", "sensor").is_err());
+
+        // Data names only its session and its number, and is opened with the
+        // session's keys, derived from the key of its identity.
+        let mut sessions = SessionTable::new(&Default::default()).unwrap();
+        let addr = "192.0.2.1:5000".parse().unwrap();
+        let (id, token) = match sessions.accept(Some("laptop"), addr).unwrap() {
+            Message::Response { id, token, .. } => (id, token),
+            msg => panic!("Unexpected {:?}", msg),
+        };
+        let nonces = sessions.pick_nonces(id, [1; 16]).unwrap();
+        let client = session_keys(&derive_keys("laptop key"), cipher::DEFAULT, &nonces, true)
+            .unwrap();
+        let data = |id| {
+            Message::Data {
+                id: id,
+                token: token,
+                connection: None,
+                sequence: None,
+                encoding: Encoding::Plain,
+                data: b"hello".to_vec(),
+            }
+        };
+        let mut datagram = seal_data(&*client, 0, &data(id)).unwrap();
+        let replayed = datagram.clone();
+        assert_eq!(split_datagram(&datagram).unwrap(),
+                   (Header::Data(id, 0), data_nonce(0), 2 + NUMBER_LEN));
+        assert_eq!(policy.open(&mut sessions, &shared, &mut datagram).unwrap(),
+                   (data(id), Some(String::from("laptop"))));
+        // Each number opens once.
+        assert!(policy.open(&mut sessions, &shared, &mut replayed.clone()).is_err());
+        let mut datagram = seal_data(&*client, 1, &data(id)).unwrap();
+        assert!(policy.open(&mut sessions, &shared, &mut datagram).is_ok());
+        // Keys of the shared secret, or the master key itself, open nothing.
+        let other = session_keys(&shared, cipher::DEFAULT, &nonces, true).unwrap();
+        let mut datagram = seal_data(&*other, 2, &data(id)).unwrap();
+        assert!(policy.open(&mut sessions, &shared, &mut datagram).is_err());
+        let mut datagram = seal_data(&derive_keys("laptop key"), 3, &data(id)).unwrap();
+        assert!(policy.open(&mut sessions, &shared, &mut datagram).is_err());
+        // Nor does a header for one session get data in for another, sealed
+        // with its keys or not.
+        let other = match sessions.accept(Some("laptop"), addr).unwrap() {
+            Message::Response { id, .. } => id,
+            msg => panic!("Unexpected {:?}", msg),
+        };
+        let other_keys = session_keys(&derive_keys("laptop key"),
+                                      cipher::DEFAULT,
+                                      &sessions.pick_nonces(other, [2; 16]).unwrap(),
+                                      true)
+            .unwrap();
+        let mut datagram = seal_data(&*other_keys, 0, &data(other)).unwrap();
+        datagram[1] = id;
+        assert!(policy.open(&mut sessions, &shared, &mut datagram).is_err());
+        let mut datagram = seal_data(&*client, 4, &data(other)).unwrap();
+        assert!(policy.open(&mut sessions, &shared, &mut datagram).is_err());
+        // Nor do the server's own keys open what it sent.
+        let mut sealed = sessions.seal(id, &derive_keys("laptop key"), &data(id)).unwrap();
+        assert!(policy.open(&mut sessions, &shared, &mut sealed.clone()).is_err());
+        assert_eq!(open_datagram(&*client, &mut sealed).unwrap(), data(id));
+
+        // Handshake replies go out sealed with the client's own key.
+        let laptop = Some(String::from("laptop"));
+        let msg = Message::Request {
+            identifier: None,
+            nonce: [0; 16],
+            timestamp: 0,
+            ciphers: vec![cipher::DEFAULT],
+            dictionary: None,
+            subnets: Vec::new(),
+        };
+        let mut sealed = seal_handshake(None, policy.keys(laptop.as_ref(), &shared), &msg)
+            .unwrap();
+        assert!(open_datagram(&derive_keys("laptop key"), &mut sealed).is_ok());
+    }
+
+    #[test]
+    fn keepalive_replay_test() {
+        let policy = Policy::new(&Default::default()).unwrap();
+        let shared = derive_keys("password");
+        let mut sessions = SessionTable::new(&Default::default()).unwrap();
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        let moved: SocketAddr = "198.51.100.7:6000".parse().unwrap();
+        let (id, token) = match sessions.accept(None, addr).unwrap() {
+            Message::Response { id, token, .. } => (id, token),
+            msg => panic!("Unexpected {:?}", msg),
+        };
+        let nonces = sessions.pick_nonces(id, [1; 16]).unwrap();
+        let client = session_keys(&shared, cipher::DEFAULT, &nonces, true).unwrap();
+        let keepalive = |number| {
+            let msg = Message::Data {
+                id: id,
+                token: token,
+                connection: None,
+                sequence: None,
+                encoding: Encoding::Plain,
+                data: Vec::new(),
+            };
+            seal_data(&*client, number, &msg).unwrap()
+        };
+        // What the server makes of a keepalive from `from`: whether it moved
+        // the session there.
+        let receive = |sessions: &mut SessionTable,
+                       mut datagram: Vec<u8>,
+                       from|
+                       -> Result<bool, String> {
+            let number = match try!(split_datagram(&datagram)).0 {
+                Header::Data(_, number) => number,
+                header => panic!("Unexpected {:?}", header),
+            };
+            match try!(policy.open(sessions, &shared, &mut datagram)).0 {
+                Message::Data { id, connection, .. } => {
+                    Ok(follow_keepalive(sessions, id, from, number, connection))
+                }
+                msg => panic!("Unexpected {:?}", msg),
+            }
+        };
+
+        assert_eq!(receive(&mut sessions, keepalive(0), addr), Ok(false));
+        let held_back = keepalive(1);
+        let newest = keepalive(2);
+        assert_eq!(receive(&mut sessions, newest.clone(), addr), Ok(false));
+        // Sent again from elsewhere, neither the newest keepalive nor one
+        // that never arrived moves the session.
+        assert!(receive(&mut sessions, newest, moved).is_err());
+        assert_eq!(receive(&mut sessions, held_back, moved), Ok(false));
+        assert_eq!(sessions.peek(id).unwrap().addr, addr);
+        // A newer one does.
+        assert_eq!(receive(&mut sessions, keepalive(3), moved), Ok(true));
+        assert_eq!(sessions.peek(id).unwrap().addr, moved);
+    }
+
+    // Hands out its chunks one read at a time, and would block at each None.
+    struct Trickle(Vec<Option<Vec<u8>>>);
+
+    impl Read for Trickle {
+        fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+            if self.0.is_empty() {
+                return Ok(0);
+            }
+            match self.0.remove(0) {
+                Some(mut chunk) => {
+                    let len = cmp::min(buf.len(), chunk.len());
+                    buf[..len].copy_from_slice(&chunk[..len]);
+                    if len < chunk.len() {
+                        self.0.insert(0, Some(chunk.split_off(len)));
+                    }
+                    Ok(len)
+                }
+                None => Err(io::Error::new(io::ErrorKind::WouldBlock, "later")),
+            }
+        }
+    }
+
+    #[test]
+    fn partial_frame_test() {
+        let mut stream = Trickle(vec![Some(vec![0]),
+                                      None,
+                                      Some(vec![3, b'a']),
+                                      None,
+                                      Some(b"bcd".to_vec())]);
+        let mut buf = Vec::new();
+        assert_eq!(read_partial_frame(&mut stream, &mut buf), Ok(None));
+        assert_eq!(read_partial_frame(&mut stream, &mut buf), Ok(None));
+        assert_eq!(read_partial_frame(&mut stream, &mut buf), Ok(Some(b"abc".to_vec())));
+        // What follows the frame is left unread.
+        assert_eq!(stream.0, vec![Some(b"d".to_vec())]);
+
+        let mut oversized = Trickle(vec![Some(vec![0xff, 0xff])]);
+        assert!(read_partial_frame(&mut oversized, &mut Vec::new()).is_err());
+        let mut closed = Trickle(vec![Some(vec![0, 3, b'a'])]);
+        assert!(read_partial_frame(&mut closed, &mut Vec::new()).is_err());
+    }
+
+    #[test]
+    fn tcp_handshakes_test() {
+        let poll = mio::Poll::new().unwrap();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let server_addr = listener.local_addr().unwrap();
+        let mut handshakes = TcpHandshakes::new();
+        let now = Instant::now();
+        let timeout = Duration::from_millis(TCP_HANDSHAKE_TIMEOUT_MS);
+
+        // One client stalls after a byte of its Request, another sends it whole.
+        let mut stalled = TcpStream::connect(server_addr).unwrap();
+        let (stream, stalled_addr) = listener.accept().unwrap();
+        handshakes.add(&poll, stream, stalled_addr, now).unwrap();
+        stalled.write_all(&[0]).unwrap();
+        let mut client = TcpStream::connect(server_addr).unwrap();
+        let (stream, client_addr) = listener.accept().unwrap();
+        handshakes.add(&poll, stream, client_addr, now + timeout / 2).unwrap();
+        write_frame(&mut client, b"request").unwrap();
+
+        let mut events = mio::Events::with_capacity(16);
+        let mut request = None;
+        let deadline = Instant::now() + Duration::from_secs(5);
+        while request.is_none() && Instant::now() < deadline {
+            poll.poll(&mut events, Some(Duration::from_millis(100))).unwrap();
+            for event in events.iter() {
+                if let Some((_, addr, frame)) = handshakes.read(&poll, event.token().0).unwrap() {
+                    request = Some((addr, frame));
+                }
+            }
+        }
+        assert_eq!(request, Some((client_addr, b"request".to_vec())));
+        // The stalled one is given up on in time, and the other is gone already.
+        assert_eq!(handshakes.expire(&poll, now + timeout / 2, timeout), vec![]);
+        assert_eq!(handshakes.expire(&poll, now + timeout, timeout), vec![stalled_addr]);
+        assert!(handshakes.pending.is_empty());
+        assert!(handshakes.read(&poll, FIRST_TCP_TOKEN).unwrap().is_none());
+
+        // Beyond the limit, connections are closed.
+        let mut clients = Vec::new();
+        for i in 0..MAX_TCP_HANDSHAKES + 1 {
+            clients.push(TcpStream::connect(server_addr).unwrap());
+            let (stream, addr) = listener.accept().unwrap();
+            assert_eq!(handshakes.add(&poll, stream, addr, now).is_ok(),
+                       i < MAX_TCP_HANDSHAKES);
+        }
+    }
+
+    #[test]
+    fn handshake_log_first_test() {
+        HandshakeLog::first(true);
+        assert!(!HandshakeLog::first(true).verbose);
+        assert!(!HandshakeLog::new(false).verbose);
+    }
+
     #[test]
     #[cfg(target_os = "linux")]
     fn integration_test() {
         assert!(utils::is_root());
-        let server = thread::spawn(move || serve(8964, "password"));
+        let server = thread::spawn(move || serve(8964, "password", &Default::default()));
 
         thread::sleep_ms(1000);
         assert!(LISTENING.load(Ordering::Relaxed));
@@ -400,10 +4211,17 @@ mod tests {
         let local_addr: SocketAddr = "0.0.0.0:0".parse::<SocketAddr>().unwrap();
         let local_socket = UdpSocket::bind(&local_addr).unwrap();
 
-        let (id, token) = initiate(&local_socket, &remote_addr, "password").unwrap();
-        assert_eq!(id, 253);
+        let assignment = initiate(&local_socket,
+                                  &remote_addr,
+                                  "password",
+                                  None,
+                                  &mut HandshakeLog::new(true))
+            .unwrap();
+        assert_eq!(assignment.id, 253);
 
-        let client = thread::spawn(move || connect("127.0.0.1", 8964, false, "password"));
+        let client = thread::spawn(move || {
+            connect("127.0.0.1", 8964, false, "password", &Default::default())
+        });
 
         thread::sleep_ms(1000);
         assert!(CONNECTED.load(Ordering::Relaxed));
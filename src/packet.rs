@@ -12,8 +12,11 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+use std::cmp;
 use std::mem;
+use std::net::{Ipv4Addr, SocketAddrV4};
 use std::num::Wrapping;
+use pool;
 
 #[repr(packed)]
 pub struct Ipv4Header {
@@ -115,10 +118,693 @@ pub fn udptcp_cksum<T>(ip: &Ipv4Header, l4: &T) -> u16 {
     cksum as u16
 }
 
+pub const TCP_FIN: u8 = 0x01;
+pub const TCP_SYN: u8 = 0x02;
+pub const TCP_RST: u8 = 0x04;
+pub const TCP_PSH: u8 = 0x08;
+pub const TCP_ACK: u8 = 0x10;
+
+// The fields of an IPv4 TCP segment that a minimal TCP needs.
+#[derive(Debug, PartialEq)]
+pub struct TcpSegment<'a> {
+    pub source: SocketAddrV4,
+    pub destination: SocketAddrV4,
+    pub seq: u32,
+    pub ack: u32,
+    pub flags: u8,
+    pub window: u16,
+    pub options: &'a [u8],
+    pub payload: &'a [u8],
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum UdpChecksum {
+    Valid,
+    Missing,
+    Invalid,
+}
+
+fn be16(buf: &[u8]) -> u16 {
+    ((buf[0] as u16) << 8) | buf[1] as u16
+}
+
+fn be32(buf: &[u8]) -> u32 {
+    ((be16(&buf[0..2]) as u32) << 16) | be16(&buf[2..4]) as u32
+}
+
+fn ones_complement_sum(buf: &[u8], initial: u32) -> u32 {
+    let mut sum = initial;
+    for chunk in buf.chunks(2) {
+        sum += if chunk.len() == 2 {
+            be16(chunk) as u32
+        } else {
+            (chunk[0] as u32) << 8
+        };
+    }
+    while sum >> 16 != 0 {
+        sum = (sum & 0xffff) + (sum >> 16);
+    }
+    sum
+}
+
+// Splits an IPv4 packet (header included) carrying UDP into its header
+// length and UDP datagram.
+fn ipv4_udp(packet: &[u8]) -> Result<(usize, &[u8]), String> {
+    if packet.len() < mem::size_of::<Ipv4Header>() || packet[0] >> 4 != 4 {
+        return Err(String::from("Not an IPv4 packet."));
+    }
+    if packet[9] != 17 {
+        return Err(String::from("Not a UDP packet."));
+    }
+    let ihl = (packet[0] & 0xf) as usize * 4;
+    let total_len = cmp::min(be16(&packet[2..4]) as usize, packet.len());
+    if ihl < mem::size_of::<Ipv4Header>() || total_len < ihl + mem::size_of::<UdpHeader>() {
+        return Err(String::from("Truncated UDP packet."));
+    }
+    let udp = &packet[ihl..total_len];
+    let udp_len = be16(&udp[4..6]) as usize;
+    if udp_len < mem::size_of::<UdpHeader>() || udp_len > udp.len() {
+        return Err(String::from("Invalid UDP length."));
+    }
+    Ok((ihl, &udp[..udp_len]))
+}
+
+// Returns the source port, destination port and payload of an IPv4 UDP packet.
+pub fn udp_parts(packet: &[u8]) -> Result<(u16, u16, &[u8]), String> {
+    let (_, udp) = try!(ipv4_udp(packet));
+    Ok((be16(&udp[0..2]), be16(&udp[2..4]), &udp[mem::size_of::<UdpHeader>()..]))
+}
+
+// Verifies the UDP checksum of an IPv4 packet, header included, as received on
+// a raw socket. A zero checksum means the sender did not compute one.
+pub fn check_udp_checksum(packet: &[u8]) -> Result<UdpChecksum, String> {
+    let (_, udp) = try!(ipv4_udp(packet));
+    if udp[6] == 0 && udp[7] == 0 {
+        return Ok(UdpChecksum::Missing);
+    }
+    let mut sum = ones_complement_sum(&packet[12..20], 0);
+    sum = ones_complement_sum(&[0, 17], sum);
+    sum = ones_complement_sum(&[(udp.len() >> 8) as u8, udp.len() as u8], sum);
+    sum = ones_complement_sum(udp, sum);
+    if sum == 0xffff {
+        Ok(UdpChecksum::Valid)
+    } else {
+        Ok(UdpChecksum::Invalid)
+    }
+}
+
+// Whether `packet` looks like an IPv4 or IPv6 packet the kernel will accept:
+// a known version, and header and length fields that fit the bytes we have.
+pub fn is_valid_ip(packet: &[u8]) -> bool {
+    if packet.is_empty() {
+        return false;
+    }
+    match packet[0] >> 4 {
+        4 => {
+            if packet.len() < 20 {
+                return false;
+            }
+            let ihl = (packet[0] & 0xf) as usize * 4;
+            let total_len = be16(&packet[2..4]) as usize;
+            ihl >= 20 && total_len >= ihl && total_len <= packet.len()
+        }
+        6 => packet.len() >= 40 && 40 + be16(&packet[4..6]) as usize <= packet.len(),
+        _ => false,
+    }
+}
+
+// Decrements the TTL of an IPv4 packet and updates its header checksum.
+// Returns false, leaving the packet untouched, if the TTL would reach zero and
+// the packet must be dropped instead. Other packets are left alone.
+pub fn decrement_ttl(packet: &mut [u8]) -> bool {
+    if packet.len() < 20 || packet[0] >> 4 != 4 {
+        return true;
+    }
+    if packet[8] <= 1 {
+        return false;
+    }
+    packet[8] -= 1;
+    // The TTL is the high byte of its header word (RFC 1141).
+    let mut sum = be16(&packet[10..12]) as u32 + 0x0100;
+    sum = (sum & 0xffff) + (sum >> 16);
+    packet[10] = (sum >> 8) as u8;
+    packet[11] = sum as u8;
+    true
+}
+
+// Builds the ICMP time exceeded message `source` sends back to the sender of
+// an IPv4 packet whose TTL expired, quoting its header and first 8 bytes.
+pub fn time_exceeded(packet: &[u8], source: Ipv4Addr) -> Vec<u8> {
+    // Code 0: TTL exceeded in transit.
+    icmp_error(packet, source, 11, 0, [0; 4])
+}
+
+// Builds the ICMP destination unreachable message with `code` (e.g. 0 for
+// network, 1 for host unreachable) that `source` sends back to the sender of
+// an IPv4 packet it cannot deliver.
+pub fn destination_unreachable(packet: &[u8], source: Ipv4Addr, code: u8) -> Vec<u8> {
+    icmp_error(packet, source, 3, code, [0; 4])
+}
+
+// Builds the ICMP fragmentation needed message that `source` sends back to the
+// sender of an IPv4 packet with DF set that does not fit in `mtu` bytes, so
+// it can lower its path MTU (RFC 1191).
+pub fn fragmentation_needed(packet: &[u8], source: Ipv4Addr, mtu: u16) -> Vec<u8> {
+    icmp_error(packet, source, 3, 4, [0, 0, (mtu >> 8) as u8, mtu as u8])
+}
+
+// The header of the fragments of an IPv4 packet after the first, which only
+// keep the options with the copied flag set (RFC 791).
+fn later_header(header: &[u8]) -> Vec<u8> {
+    let mut later = header[..20].to_vec();
+    let mut i = 20;
+    while i < header.len() {
+        let len = match header[i] {
+            // End of options.
+            0 => break,
+            // No operation.
+            1 => 1,
+            _ => {
+                match header.get(i + 1) {
+                    Some(&len) if len >= 2 && i + len as usize <= header.len() => len as usize,
+                    _ => break,
+                }
+            }
+        };
+        if header[i] & 0x80 != 0 {
+            later.extend_from_slice(&header[i..i + len]);
+        }
+        i += len;
+    }
+    while later.len() % 4 != 0 {
+        later.push(0);
+    }
+    later[0] = 0x40 | (later.len() / 4) as u8;
+    later
+}
+
+// Splits an IPv4 packet into fragments of at most `mtu` bytes each, or returns
+// it whole if it fits. Returns None if it must not be fragmented because DF
+// is set, or cannot be. Only the first fragment carries every option.
+pub fn fragment(packet: &[u8], mtu: usize) -> Option<Vec<Vec<u8>>> {
+    if packet.len() < 20 || packet[0] >> 4 != 4 {
+        return None;
+    }
+    let ihl = (packet[0] & 0xf) as usize * 4;
+    let total_len = cmp::min(be16(&packet[2..4]) as usize, packet.len());
+    if ihl < 20 || total_len < ihl {
+        return None;
+    }
+    if total_len <= mtu {
+        return Some(vec![packet[..total_len].to_vec()]);
+    }
+    if packet[6] & 0x40 != 0 {
+        return None;
+    }
+    // All but the last fragment carry a multiple of 8 bytes.
+    let chunk = mtu.saturating_sub(ihl) & !7;
+    if chunk == 0 {
+        return None;
+    }
+    let more = packet[6] & 0x20 != 0;
+    let offset = (be16(&packet[6..8]) & 0x1fff) as usize;
+    let payload = &packet[ihl..total_len];
+    let later = later_header(&packet[..ihl]);
+    let mut fragments = Vec::new();
+    for (i, data) in payload.chunks(chunk).enumerate() {
+        let header = if i == 0 { &packet[..ihl] } else { &later[..] };
+        let len = header.len() + data.len();
+        let last = (i + 1) * chunk >= payload.len();
+        let flags = if more || !last { 0x2000 } else { 0 };
+        let field = flags | (offset + i * chunk / 8) as u16;
+        let mut fragment = header.to_vec();
+        fragment[2] = (len >> 8) as u8;
+        fragment[3] = len as u8;
+        fragment[6] = (field >> 8) as u8;
+        fragment[7] = field as u8;
+        fragment[10] = 0;
+        fragment[11] = 0;
+        let cksum = !(ones_complement_sum(&fragment, 0) as u16);
+        fragment[10] = (cksum >> 8) as u8;
+        fragment[11] = cksum as u8;
+        fragment.extend_from_slice(data);
+        fragments.push(fragment);
+    }
+    Some(fragments)
+}
+
+fn icmp_error(packet: &[u8],
+              source: Ipv4Addr,
+              icmp_type: u8,
+              code: u8,
+              rest: [u8; 4])
+              -> Vec<u8> {
+    let ihl = (packet[0] & 0xf) as usize * 4;
+    let quoted = &packet[..cmp::min(packet.len(), ihl + 8)];
+    let total_len = 20 + 8 + quoted.len();
+
+    let mut reply = vec![0x45, 0, (total_len >> 8) as u8, total_len as u8, 0, 0, 0, 0, 64, 1, 0, 0];
+    reply.extend_from_slice(&source.octets());
+    reply.extend_from_slice(&packet[12..16]);
+    let cksum = !(ones_complement_sum(&reply, 0) as u16);
+    reply[10] = (cksum >> 8) as u8;
+    reply[11] = cksum as u8;
+
+    reply.extend_from_slice(&[icmp_type, code, 0, 0]);
+    reply.extend_from_slice(&rest);
+    reply.extend_from_slice(quoted);
+    let cksum = !(ones_complement_sum(&reply[20..], 0) as u16);
+    reply[22] = (cksum >> 8) as u8;
+    reply[23] = cksum as u8;
+    reply
+}
+
+// Builds the header of an IPv4 packet carrying `len` bytes of `protocol`.
+fn ipv4_header(source: &Ipv4Addr,
+               destination: &Ipv4Addr,
+               protocol: u8,
+               len: usize)
+               -> Result<Vec<u8>, String> {
+    let total_len = 20 + len;
+    if total_len > 0xffff {
+        return Err(String::from("Packet too large."));
+    }
+    let mut header = vec![0x45, 0, (total_len >> 8) as u8, total_len as u8, 0, 0, 0x40, 0, 64,
+                          protocol, 0, 0];
+    header.extend_from_slice(&source.octets());
+    header.extend_from_slice(&destination.octets());
+    let cksum = !(ones_complement_sum(&header, 0) as u16);
+    header[10] = (cksum >> 8) as u8;
+    header[11] = cksum as u8;
+    Ok(header)
+}
+
+// The UDP or TCP checksum of an IPv4 packet with a 20-byte header.
+fn transport_cksum(packet: &[u8]) -> u16 {
+    let len = packet.len() - 20;
+    let mut sum = ones_complement_sum(&packet[12..20], 0);
+    sum = ones_complement_sum(&[0, packet[9], (len >> 8) as u8, len as u8], sum);
+    sum = ones_complement_sum(&packet[20..], sum);
+    !(sum as u16)
+}
+
+// Builds the IPv4 UDP packet carrying `payload` from `source` to
+// `destination`.
+pub fn udp_packet(source: &SocketAddrV4,
+                  destination: &SocketAddrV4,
+                  payload: &[u8])
+                  -> Result<Vec<u8>, String> {
+    let udp_len = mem::size_of::<UdpHeader>() + payload.len();
+    let mut packet = try!(ipv4_header(source.ip(), destination.ip(), 17, udp_len));
+    packet.extend_from_slice(&[(source.port() >> 8) as u8,
+                               source.port() as u8,
+                               (destination.port() >> 8) as u8,
+                               destination.port() as u8,
+                               (udp_len >> 8) as u8,
+                               udp_len as u8,
+                               0,
+                               0]);
+    packet.extend_from_slice(payload);
+    // Zero would mean no checksum was computed.
+    let cksum = match transport_cksum(&packet) {
+        0 => 0xffff,
+        cksum => cksum,
+    };
+    packet[26] = (cksum >> 8) as u8;
+    packet[27] = cksum as u8;
+    Ok(packet)
+}
+
+// Builds the IPv4 UDP packet answering `packet` with `payload`: from its
+// destination address and port back to its source.
+pub fn udp_reply(packet: &[u8], payload: &[u8]) -> Result<Vec<u8>, String> {
+    let (src_port, dst_port, _) = try!(udp_parts(packet));
+    let src = Ipv4Addr::new(packet[12], packet[13], packet[14], packet[15]);
+    let dst = Ipv4Addr::new(packet[16], packet[17], packet[18], packet[19]);
+    udp_packet(&SocketAddrV4::new(dst, dst_port),
+               &SocketAddrV4::new(src, src_port),
+               payload)
+}
+
+// Builds an IPv4 TCP segment. `options` must be padded to a multiple of four
+// bytes.
+pub fn tcp_packet(source: &SocketAddrV4,
+                  destination: &SocketAddrV4,
+                  seq: u32,
+                  ack: u32,
+                  flags: u8,
+                  window: u16,
+                  options: &[u8],
+                  payload: &[u8])
+                  -> Result<Vec<u8>, String> {
+    let header_len = mem::size_of::<TcpHeader>() + options.len();
+    if options.len() % 4 != 0 || header_len > 60 {
+        return Err(String::from("Invalid TCP options."));
+    }
+    let mut packet =
+        try!(ipv4_header(source.ip(), destination.ip(), 6, header_len + payload.len()));
+    packet.extend_from_slice(&[(source.port() >> 8) as u8,
+                               source.port() as u8,
+                               (destination.port() >> 8) as u8,
+                               destination.port() as u8,
+                               (seq >> 24) as u8,
+                               (seq >> 16) as u8,
+                               (seq >> 8) as u8,
+                               seq as u8,
+                               (ack >> 24) as u8,
+                               (ack >> 16) as u8,
+                               (ack >> 8) as u8,
+                               ack as u8,
+                               ((header_len / 4) << 4) as u8,
+                               flags,
+                               (window >> 8) as u8,
+                               window as u8,
+                               0,
+                               0,
+                               0,
+                               0]);
+    packet.extend_from_slice(options);
+    packet.extend_from_slice(payload);
+    let cksum = transport_cksum(&packet);
+    packet[36] = (cksum >> 8) as u8;
+    packet[37] = cksum as u8;
+    Ok(packet)
+}
+
+// Parses an IPv4 packet, header included, carrying a TCP segment.
+pub fn tcp_parts(packet: &[u8]) -> Result<TcpSegment, String> {
+    if packet.len() < mem::size_of::<Ipv4Header>() || packet[0] >> 4 != 4 {
+        return Err(String::from("Not an IPv4 packet."));
+    }
+    if packet[9] != 6 {
+        return Err(String::from("Not a TCP packet."));
+    }
+    let ihl = (packet[0] & 0xf) as usize * 4;
+    let total_len = cmp::min(be16(&packet[2..4]) as usize, packet.len());
+    if ihl < mem::size_of::<Ipv4Header>() || total_len < ihl + mem::size_of::<TcpHeader>() {
+        return Err(String::from("Truncated TCP packet."));
+    }
+    let tcp = &packet[ihl..total_len];
+    let header_len = (tcp[12] >> 4) as usize * 4;
+    if header_len < mem::size_of::<TcpHeader>() || header_len > tcp.len() {
+        return Err(String::from("Invalid TCP data offset."));
+    }
+    Ok(TcpSegment {
+        source: SocketAddrV4::new(Ipv4Addr::new(packet[12], packet[13], packet[14], packet[15]),
+                                  be16(&tcp[0..2])),
+        destination: SocketAddrV4::new(Ipv4Addr::new(packet[16], packet[17], packet[18],
+                                                     packet[19]),
+                                       be16(&tcp[2..4])),
+        seq: be32(&tcp[4..8]),
+        ack: be32(&tcp[8..12]),
+        flags: tcp[13],
+        window: be16(&tcp[14..16]),
+        options: &tcp[mem::size_of::<TcpHeader>()..header_len],
+        payload: &tcp[header_len..],
+    })
+}
+
+// Whether an inner IPv4 packet is addressed to a single host, i.e. is not
+// broadcast or multicast, on links of 10.10.10.0/24 of `prefix_len`.
+pub fn is_unicast(packet: &[u8], prefix_len: u8) -> bool {
+    if packet.len() < 20 {
+        return false;
+    }
+    let dst = &packet[16..20];
+    let multicast = dst[0] >= 224 && dst[0] <= 239;
+    // 255.255.255.255, or the broadcast address of one of our links.
+    let broadcast = dst == [255, 255, 255, 255] ||
+                    dst[..3] == [10, 10, 10] && pool::is_broadcast(dst[3], prefix_len);
+    !multicast && !broadcast
+}
+
+// Passes unicast inner packets, and multicast ones for the given groups.
+pub struct UnicastFilter {
+    groups: Vec<[u8; 4]>,
+    prefix_len: u8,
+}
+
+impl UnicastFilter {
+    pub fn new(groups: &[Ipv4Addr], prefix_len: u8) -> UnicastFilter {
+        UnicastFilter {
+            groups: groups.iter().map(|g| g.octets()).collect(),
+            prefix_len: prefix_len,
+        }
+    }
+
+    pub fn allows(&self, packet: &[u8]) -> bool {
+        is_unicast(packet, self.prefix_len) ||
+        (packet.len() >= 20 && self.groups.iter().any(|g| g == &packet[16..20]))
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use packet::*;
 
+    // 192.0.2.1:1234 -> 192.0.2.2:8964 carrying "hello", checksum included.
+    fn udp_packet() -> Vec<u8> {
+        let mut packet = vec![0x45, 0, 0, 33, 0, 0, 0x40, 0, 64, 17, 0, 0, 192, 0, 2, 1, 192, 0,
+                              2, 2, 0x04, 0xd2, 0x23, 0x04, 0, 13, 0, 0];
+        packet.extend_from_slice(b"hello");
+        let mut sum = ones_complement_sum(&packet[12..20], 0);
+        sum = ones_complement_sum(&[0, 17, 0, 13], sum);
+        sum = ones_complement_sum(&packet[20..], sum);
+        let cksum = !(sum as u16);
+        packet[26] = (cksum >> 8) as u8;
+        packet[27] = cksum as u8;
+        packet
+    }
+
+    #[test]
+    fn is_valid_ip_test() {
+        let mut packet = udp_packet();
+        assert!(is_valid_ip(&packet));
+        assert!(!is_valid_ip(&packet[..30]));
+        assert!(!is_valid_ip(&[]));
+        packet[0] = 0x44;
+        assert!(!is_valid_ip(&packet));
+        packet[0] = 0x55;
+        assert!(!is_valid_ip(&packet));
+
+        let mut v6 = vec![0x60, 0, 0, 0, 0, 4, 17, 64];
+        v6.extend_from_slice(&[0; 36]);
+        assert!(is_valid_ip(&v6));
+        v6[5] = 5;
+        assert!(!is_valid_ip(&v6));
+    }
+
+    #[test]
+    fn decrement_ttl_test() {
+        let mut packet = udp_packet();
+        let cksum = !(ones_complement_sum(&packet[..20], 0) as u16);
+        packet[10] = (cksum >> 8) as u8;
+        packet[11] = cksum as u8;
+
+        assert!(decrement_ttl(&mut packet));
+        assert_eq!(packet[8], 63);
+        assert_eq!(ones_complement_sum(&packet[..20], 0), 0xffff);
+
+        packet[8] = 1;
+        let expired = packet.clone();
+        assert!(!decrement_ttl(&mut packet));
+        assert_eq!(packet, expired);
+    }
+
+    #[test]
+    fn time_exceeded_test() {
+        let packet = udp_packet();
+        let reply = time_exceeded(&packet, Ipv4Addr::new(10, 10, 10, 1));
+        assert_eq!(reply.len(), 20 + 8 + 28);
+        assert_eq!(be16(&reply[2..4]) as usize, reply.len());
+        assert_eq!(reply[9], 1);
+        assert_eq!(&reply[12..16], &[10, 10, 10, 1]);
+        assert_eq!(&reply[16..20], &packet[12..16]);
+        assert_eq!(ones_complement_sum(&reply[..20], 0), 0xffff);
+        assert_eq!(&reply[20..22], &[11, 0]);
+        assert_eq!(ones_complement_sum(&reply[20..], 0), 0xffff);
+        assert_eq!(&reply[28..], &packet[..28]);
+    }
+
+    #[test]
+    fn destination_unreachable_test() {
+        let packet = udp_packet();
+        let reply = destination_unreachable(&packet, Ipv4Addr::new(10, 10, 10, 1), 1);
+        assert_eq!(&reply[16..20], &packet[12..16]);
+        assert_eq!(&reply[20..22], &[3, 1]);
+        assert_eq!(ones_complement_sum(&reply[20..], 0), 0xffff);
+        assert_eq!(&reply[28..], &packet[..28]);
+    }
+
+    #[test]
+    fn fragmentation_needed_test() {
+        let packet = udp_packet();
+        let reply = fragmentation_needed(&packet, Ipv4Addr::new(10, 10, 10, 1), 1280);
+        assert_eq!(&reply[20..22], &[3, 4]);
+        assert_eq!(be16(&reply[26..28]), 1280);
+        assert_eq!(ones_complement_sum(&reply[20..], 0), 0xffff);
+        assert_eq!(&reply[28..], &packet[..28]);
+    }
+
+    #[test]
+    fn fragment_test() {
+        let mut packet = vec![0x45, 0, 0x03, 0xe8, 0x12, 0x34, 0, 0, 64, 17, 0, 0, 192, 0, 2, 1,
+                              192, 0, 2, 2];
+        packet.extend((0..980).map(|i| i as u8));
+        let fragments = fragment(&packet, 500).unwrap();
+        // 480 bytes fit after the header, a multiple of 8.
+        assert_eq!(fragments.iter().map(|f| f.len()).collect::<Vec<_>>(),
+                   vec![500, 500, 40]);
+        let mut payload = Vec::new();
+        for (i, f) in fragments.iter().enumerate() {
+            assert_eq!(be16(&f[2..4]) as usize, f.len());
+            assert_eq!(&f[4..6], &[0x12, 0x34]);
+            assert_eq!(be16(&f[6..8]) & 0x1fff, i as u16 * 60);
+            assert_eq!(f[6] & 0x20 != 0, i < 2);
+            assert_eq!(ones_complement_sum(&f[..20], 0), 0xffff);
+            payload.extend_from_slice(&f[20..]);
+        }
+        assert_eq!(&payload[..], &packet[20..]);
+
+        // Fragments of a fragment keep its offset, and MF if it had it.
+        let second = fragment(&fragments[1], 100).unwrap();
+        assert_eq!(second.len(), 6);
+        assert_eq!(be16(&second[0][6..8]), 0x2000 | 60);
+        assert_eq!(be16(&second[5][6..8]), 0x2000 | 110);
+
+        assert_eq!(fragment(&packet, 1000).unwrap(), vec![packet.clone()]);
+        packet[6] = 0x40;
+        assert!(fragment(&packet, 500).is_none());
+        assert_eq!(fragment(&packet, 1000).unwrap(), vec![packet.clone()]);
+    }
+
+    #[test]
+    fn fragment_options_test() {
+        // Record route, which is not copied, loose source route, which is,
+        // then padding.
+        let mut packet = vec![0x49, 0, 0, 236, 0x12, 0x34, 0, 0, 64, 17, 0, 0, 192, 0, 2, 1, 192,
+                              0, 2, 2, 7, 7, 4, 0, 0, 0, 0, 0x83, 7, 4, 192, 0, 2, 9, 1, 0];
+        packet.extend((0..200).map(|i| i as u8));
+        let fragments = fragment(&packet, 100).unwrap();
+        assert_eq!(fragments.iter().map(|f| f.len()).collect::<Vec<_>>(),
+                   vec![100, 92, 92, 36]);
+        assert_eq!(&fragments[0][20..36], &packet[20..36]);
+        let mut payload = Vec::new();
+        for f in &fragments[1..] {
+            assert_eq!(f[0], 0x47);
+            assert_eq!(&f[20..28], &[0x83, 7, 4, 192, 0, 2, 9, 0]);
+        }
+        for f in &fragments {
+            let ihl = (f[0] & 0xf) as usize * 4;
+            assert_eq!(ones_complement_sum(&f[..ihl], 0), 0xffff);
+            payload.extend_from_slice(&f[ihl..]);
+        }
+        assert_eq!(&payload[..], &packet[36..]);
+    }
+
+    #[test]
+    fn udp_reply_test() {
+        let packet = udp_packet();
+        let reply = udp_reply(&packet, b"world!").unwrap();
+        assert_eq!(be16(&reply[2..4]) as usize, reply.len());
+        assert_eq!(ones_complement_sum(&reply[..20], 0), 0xffff);
+        assert_eq!(&reply[12..16], &packet[16..20]);
+        assert_eq!(&reply[16..20], &packet[12..16]);
+        assert_eq!(udp_parts(&reply), Ok((8964, 1234, &b"world!"[..])));
+        assert_eq!(check_udp_checksum(&reply), Ok(UdpChecksum::Valid));
+        assert!(udp_reply(&packet[..24], b"").is_err());
+    }
+
+    #[test]
+    fn tcp_packet_test() {
+        let source = "10.10.10.2:49152".parse().unwrap();
+        let destination = "192.0.2.7:80".parse().unwrap();
+        let packet = tcp_packet(&source,
+                                &destination,
+                                0x01020304,
+                                0xa0b0c0d0,
+                                TCP_SYN | TCP_ACK,
+                                1000,
+                                &[2, 4, 5, 0xb4],
+                                b"hi")
+            .unwrap();
+        assert_eq!(packet.len(), 20 + 24 + 2);
+        assert_eq!(be16(&packet[2..4]) as usize, packet.len());
+        assert_eq!(ones_complement_sum(&packet[..20], 0), 0xffff);
+        assert_eq!(transport_cksum(&packet), 0);
+        assert_eq!(tcp_parts(&packet),
+                   Ok(TcpSegment {
+                       source: source,
+                       destination: destination,
+                       seq: 0x01020304,
+                       ack: 0xa0b0c0d0,
+                       flags: TCP_SYN | TCP_ACK,
+                       window: 1000,
+                       options: &[2, 4, 5, 0xb4],
+                       payload: b"hi",
+                   }));
+
+        assert!(tcp_packet(&source, &destination, 0, 0, TCP_ACK, 0, &[1], b"").is_err());
+        assert!(tcp_parts(&packet[..30]).is_err());
+        assert!(tcp_parts(&udp_packet()).is_err());
+    }
+
+    #[test]
+    fn is_unicast_test() {
+        let mut packet = udp_packet();
+        assert!(is_unicast(&packet, 24));
+        for dst in &[[255, 255, 255, 255], [10, 10, 10, 255], [224, 0, 0, 251], [239, 1, 2, 3]] {
+            packet[16..20].copy_from_slice(dst);
+            assert!(!is_unicast(&packet, 24));
+        }
+        assert!(!is_unicast(&packet[..10], 24));
+
+        // The broadcast address follows from the link's prefix.
+        packet[16..20].copy_from_slice(&[10, 10, 10, 7]);
+        assert!(is_unicast(&packet, 24));
+        assert!(!is_unicast(&packet, 30));
+        assert!(is_unicast(&packet, 31));
+        packet[16..20].copy_from_slice(&[10, 10, 10, 255]);
+        assert!(!is_unicast(&packet, 30));
+        assert!(is_unicast(&packet, 31));
+        packet[16..20].copy_from_slice(&[192, 168, 1, 255]);
+        assert!(is_unicast(&packet, 24));
+    }
+
+    #[test]
+    fn unicast_filter_test() {
+        let filter = UnicastFilter::new(&[Ipv4Addr::new(224, 0, 0, 251)], 24);
+        let mut packet = udp_packet();
+        assert!(filter.allows(&packet));
+        packet[16..20].copy_from_slice(&[255, 255, 255, 255]);
+        assert!(!filter.allows(&packet));
+        packet[16..20].copy_from_slice(&[224, 0, 0, 252]);
+        assert!(!filter.allows(&packet));
+        packet[16..20].copy_from_slice(&[224, 0, 0, 251]);
+        assert!(filter.allows(&packet));
+    }
+
+    #[test]
+    fn check_udp_checksum_test() {
+        let packet = udp_packet();
+        assert_eq!(check_udp_checksum(&packet), Ok(UdpChecksum::Valid));
+        assert_eq!(udp_parts(&packet), Ok((1234, 8964, &b"hello"[..])));
+
+        let mut corrupted = packet.clone();
+        corrupted[30] ^= 0x20;
+        assert_eq!(check_udp_checksum(&corrupted), Ok(UdpChecksum::Invalid));
+
+        let mut missing = packet.clone();
+        missing[26] = 0;
+        missing[27] = 0;
+        assert_eq!(check_udp_checksum(&missing), Ok(UdpChecksum::Missing));
+
+        let mut tcp = packet.clone();
+        tcp[9] = 6;
+        assert!(check_udp_checksum(&tcp).is_err());
+        assert!(check_udp_checksum(&packet[..24]).is_err());
+    }
+
     #[test]
     fn raw_cksum_test() {
         assert_eq!(raw_cksum(&[] as *const u8, 0), 0);
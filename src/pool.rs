@@ -0,0 +1,280 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::collections::HashMap;
+use std::net::Ipv4Addr;
+use network::Id;
+
+const FIRST_ID: Id = 2;
+const LAST_ID: Id = 253;
+
+// The server's address on the shared 10.10.10.0/24.
+pub const SERVER_ID: Id = 1;
+
+// Prefix lengths a client's link may have: the shared /24, or a point-to-point
+// /30 or /31 (RFC 3021) per client.
+pub fn check_prefix(prefix_len: u8) -> Result<(), String> {
+    match prefix_len {
+        24 | 30 | 31 => Ok(()),
+        _ => Err(format!("Unsupported link prefix /{}; use 24, 30 or 31.", prefix_len)),
+    }
+}
+
+// Whether clients may be given `id` on links of `prefix_len`. A /31 is split
+// into the server's even and the client's odd address, and a /30 into its
+// network, the server, the client and its broadcast address.
+fn is_client_id(id: Id, prefix_len: u8) -> bool {
+    id >= FIRST_ID && id <= LAST_ID &&
+    match prefix_len {
+        31 => id % 2 == 1,
+        30 => id % 4 == 2,
+        _ => true,
+    }
+}
+
+// Whether `id` is the broadcast address of its link of `prefix_len`, i.e. has
+// every host bit set. Links of a /31 have none.
+pub fn is_broadcast(id: Id, prefix_len: u8) -> bool {
+    if prefix_len < 24 || prefix_len > 30 {
+        return false;
+    }
+    let host = ((1u16 << (32 - prefix_len)) - 1) as u8;
+    id & host == host
+}
+
+// The address at the other end of the link of `id`.
+pub fn peer(id: Id, prefix_len: u8) -> Result<Id, String> {
+    match prefix_len {
+        24 if id != 0 && id != 255 && id != SERVER_ID => Ok(SERVER_ID),
+        31 => Ok(id ^ 1),
+        30 if id % 4 == 1 => Ok(id + 1),
+        30 if id % 4 == 2 => Ok(id - 1),
+        _ => Err(format!("10.10.10.{}/{} has no peer.", id, prefix_len)),
+    }
+}
+
+// The server's ends of every client's link of `prefix_len`.
+pub fn server_ids(prefix_len: u8) -> Vec<Id> {
+    (FIRST_ID..LAST_ID + 1)
+        .filter(|&id| is_client_id(id, prefix_len))
+        .filter_map(|id| peer(id, prefix_len).ok())
+        .filter(|&id| id != SERVER_ID)
+        .collect()
+}
+
+// Hands out the last octet of inner 10.10.10.0/24 addresses. Identifiers with a
+// reservation always get their own address, which is never given to anyone else.
+pub struct IpPool {
+    available: Vec<Id>,
+    reservations: HashMap<String, Id>,
+    capacity: usize,
+}
+
+impl IpPool {
+    pub fn new(reservations: &HashMap<String, Ipv4Addr>) -> Result<IpPool, String> {
+        IpPool::with_prefix(reservations, 24)
+    }
+
+    // Only hands out client ends of links of `prefix_len`.
+    pub fn with_prefix(reservations: &HashMap<String, Ipv4Addr>,
+                       prefix_len: u8)
+                       -> Result<IpPool, String> {
+        try!(check_prefix(prefix_len));
+        let mut reserved: HashMap<String, Id> = HashMap::new();
+        for (identifier, ip) in reservations {
+            let octets = ip.octets();
+            if octets[..3] != [10, 10, 10] || octets[3] < FIRST_ID || octets[3] > LAST_ID {
+                return Err(format!("Reservation {} for {} is outside 10.10.10.{}-{}.",
+                                   ip,
+                                   identifier,
+                                   FIRST_ID,
+                                   LAST_ID));
+            }
+            if !is_client_id(octets[3], prefix_len) {
+                return Err(format!("Reservation {} for {} is not the client end of a /{} link.",
+                                   ip,
+                                   identifier,
+                                   prefix_len));
+            }
+            if let Some((other, _)) = reserved.iter().find(|&(_, &id)| id == octets[3]) {
+                return Err(format!("Reservation {} is shared by {} and {}.", ip, other, identifier));
+            }
+            reserved.insert(identifier.clone(), octets[3]);
+        }
+        let available: Vec<Id> = (FIRST_ID..LAST_ID + 1)
+            .filter(|&id| is_client_id(id, prefix_len))
+            .filter(|id| !reserved.values().any(|r| r == id))
+            .collect();
+        let capacity = available.len() + reserved.len();
+        Ok(IpPool {
+            available: available,
+            reservations: reserved,
+            capacity: capacity,
+        })
+    }
+
+    // How many clients can hold an address at once.
+    pub fn capacity(&self) -> usize {
+        self.capacity
+    }
+
+    pub fn allocate(&mut self, identifier: Option<&str>) -> Option<Id> {
+        if let Some(id) = identifier.and_then(|i| self.reservations.get(i)) {
+            return Some(*id);
+        }
+        self.available.pop()
+    }
+
+    // Marks an address as taken by a session created elsewhere (e.g. imported
+    // from another server). Returns false if it is not available.
+    pub fn claim(&mut self, id: Id, identifier: Option<&str>) -> bool {
+        if let Some(&reserved) = identifier.and_then(|i| self.reservations.get(i)) {
+            return reserved == id;
+        }
+        match self.available.iter().position(|&a| a == id) {
+            Some(index) => {
+                self.available.remove(index);
+                true
+            }
+            None => false,
+        }
+    }
+
+    pub fn release(&mut self, id: Id) {
+        let reserved = self.reservations.values().any(|&r| r == id);
+        if !reserved && !self.available.contains(&id) {
+            self.available.push(id);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::HashMap;
+    use std::net::Ipv4Addr;
+    use pool::*;
+
+    fn reservations(entries: &[(&str, Ipv4Addr)]) -> HashMap<String, Ipv4Addr> {
+        entries.iter().map(|&(i, ip)| (String::from(i), ip)).collect()
+    }
+
+    #[test]
+    fn dynamic_allocation_test() {
+        let mut pool = IpPool::new(&HashMap::new()).unwrap();
+        assert_eq!(pool.allocate(None), Some(253));
+        assert_eq!(pool.allocate(Some("unknown")), Some(252));
+        pool.release(253);
+        assert_eq!(pool.allocate(None), Some(253));
+    }
+
+    #[test]
+    fn exhaustion_test() {
+        let mut pool = IpPool::new(&HashMap::new()).unwrap();
+        for _ in FIRST_ID..LAST_ID + 1 {
+            assert!(pool.allocate(None).is_some());
+        }
+        assert_eq!(pool.allocate(None), None);
+    }
+
+    #[test]
+    fn reservation_test() {
+        let mut pool = IpPool::new(&reservations(&[("laptop", Ipv4Addr::new(10, 10, 10, 253))]))
+            .unwrap();
+
+        // Other clients connecting first never receive the reserved address.
+        for _ in FIRST_ID..LAST_ID {
+            assert!(pool.allocate(None).unwrap() != 253);
+        }
+        assert_eq!(pool.allocate(None), None);
+        assert_eq!(pool.allocate(Some("laptop")), Some(253));
+
+        // Releasing a reserved address does not return it to the dynamic pool.
+        pool.release(253);
+        assert_eq!(pool.allocate(None), None);
+        assert_eq!(pool.allocate(Some("laptop")), Some(253));
+    }
+
+    #[test]
+    fn claim_test() {
+        let mut pool = IpPool::new(&reservations(&[("laptop", Ipv4Addr::new(10, 10, 10, 20))]))
+            .unwrap();
+        assert!(pool.claim(253, None));
+        assert!(!pool.claim(253, None));
+        assert!(!pool.claim(20, None));
+        assert!(pool.claim(20, Some("laptop")));
+        assert!(!pool.claim(21, Some("laptop")));
+        assert_eq!(pool.allocate(None), Some(252));
+    }
+
+    #[test]
+    fn invalid_reservation_test() {
+        assert!(IpPool::new(&reservations(&[("a", Ipv4Addr::new(192, 168, 1, 2))])).is_err());
+        assert!(IpPool::new(&reservations(&[("a", Ipv4Addr::new(10, 10, 10, 1))])).is_err());
+        assert!(IpPool::new(&reservations(&[("a", Ipv4Addr::new(10, 10, 10, 9)),
+                                            ("b", Ipv4Addr::new(10, 10, 10, 9))]))
+            .is_err());
+    }
+
+    #[test]
+    fn point_to_point_test() {
+        let mut pool = IpPool::with_prefix(&HashMap::new(), 31).unwrap();
+        let mut ids = Vec::new();
+        while let Some(id) = pool.allocate(None) {
+            ids.push(id);
+        }
+        assert_eq!(ids.len(), 126);
+        assert!(ids.iter().all(|&id| id % 2 == 1 && peer(id, 31) == Ok(id - 1)));
+        assert_eq!(peer(253, 31), Ok(252));
+        assert_eq!(peer(2, 31), Ok(3));
+
+        let mut pool = IpPool::with_prefix(&HashMap::new(), 30).unwrap();
+        let mut ids = Vec::new();
+        while let Some(id) = pool.allocate(None) {
+            ids.push(id);
+        }
+        // 10.10.10.252/30 would need .254, beyond the last usable address.
+        assert_eq!(ids.len(), 63);
+        assert!(ids.iter().all(|&id| id % 4 == 2 && peer(id, 30) == Ok(id - 1)));
+        assert_eq!(peer(6, 30), Ok(5));
+        assert_eq!(peer(5, 30), Ok(6));
+        assert!(peer(4, 30).is_err());
+        assert!(peer(7, 30).is_err());
+
+        assert_eq!(peer(20, 24), Ok(SERVER_ID));
+        assert!(peer(SERVER_ID, 24).is_err());
+        assert!(IpPool::with_prefix(&HashMap::new(), 29).is_err());
+
+        assert_eq!(server_ids(31)[..3], [2, 4, 6]);
+        assert_eq!(server_ids(30)[..3], [5, 9, 13]);
+        assert!(server_ids(24).is_empty());
+
+        assert!(is_broadcast(255, 24));
+        assert!(!is_broadcast(7, 24));
+        assert!(is_broadcast(7, 30));
+        assert!(is_broadcast(255, 30));
+        assert!(!is_broadcast(6, 30));
+        assert!(!is_broadcast(255, 31));
+    }
+
+    #[test]
+    fn point_to_point_reservation_test() {
+        let laptop = reservations(&[("laptop", Ipv4Addr::new(10, 10, 10, 21))]);
+        let mut pool = IpPool::with_prefix(&laptop, 31).unwrap();
+        assert_eq!(pool.allocate(Some("laptop")), Some(21));
+        assert!(IpPool::with_prefix(&laptop, 30).is_err());
+        assert!(IpPool::with_prefix(&reservations(&[("a", Ipv4Addr::new(10, 10, 10, 20))]), 31)
+            .is_err());
+    }
+}
@@ -0,0 +1,377 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::collections::{HashMap, VecDeque};
+use std::net::IpAddr;
+use std::cmp;
+use std::time::{Duration, Instant};
+use config::RateLimit;
+use device;
+
+// At most this many per-source buckets are kept.
+const MAX_SOURCES: usize = 4096;
+
+fn seconds(d: Duration) -> f64 {
+    d.as_secs() as f64 + d.subsec_nanos() as f64 / 1e9
+}
+
+pub struct TokenBucket {
+    rate: f64,
+    burst: f64,
+    tokens: f64,
+    last: Instant,
+}
+
+impl TokenBucket {
+    // Allows `rate` units per second on average, and bursts of up to `burst`.
+    pub fn new(rate: f64, burst: f64, now: Instant) -> TokenBucket {
+        TokenBucket {
+            rate: rate,
+            burst: burst,
+            tokens: burst,
+            last: now,
+        }
+    }
+
+    fn refill(&mut self, now: Instant) {
+        if now > self.last {
+            self.tokens = (self.tokens + seconds(now - self.last) * self.rate).min(self.burst);
+            self.last = now;
+        }
+    }
+
+    pub fn try_take(&mut self, amount: f64, now: Instant) -> bool {
+        self.refill(now);
+        if self.tokens >= amount {
+            self.tokens -= amount;
+            true
+        } else {
+            false
+        }
+    }
+
+    pub fn is_full(&mut self, now: Instant) -> bool {
+        self.refill(now);
+        self.tokens >= self.burst
+    }
+
+    // How long until `amount` can be taken.
+    pub fn time_until(&mut self, amount: f64, now: Instant) -> Duration {
+        self.refill(now);
+        if self.tokens >= amount {
+            return Duration::from_secs(0);
+        }
+        let secs = (amount - self.tokens) / self.rate;
+        Duration::new(secs as u64, (secs.fract() * 1e9) as u32)
+    }
+}
+
+// Limits how fast handshakes are processed, per source address and overall,
+// so a flood of requests is dropped before any session state is allocated.
+pub struct HandshakeLimiter {
+    rate: f64,
+    burst: f64,
+    sources: HashMap<IpAddr, TokenBucket>,
+    // Sources in the order their buckets were created.
+    order: VecDeque<IpAddr>,
+    global: TokenBucket,
+}
+
+impl HandshakeLimiter {
+    pub fn new(rate: f64, burst: f64, global_rate: f64, global_burst: f64) -> HandshakeLimiter {
+        HandshakeLimiter {
+            rate: rate,
+            burst: burst,
+            sources: HashMap::new(),
+            order: VecDeque::new(),
+            global: TokenBucket::new(global_rate, global_burst, Instant::now()),
+        }
+    }
+
+    pub fn allow(&mut self, source: IpAddr, now: Instant) -> bool {
+        self.allow_source(source, now) && self.global.try_take(1.0, now)
+    }
+
+    // Only checks the limit of `source`, for handshakes that wait for the
+    // global one in an AdmissionQueue.
+    pub fn allow_source(&mut self, source: IpAddr, now: Instant) -> bool {
+        if !self.sources.contains_key(&source) {
+            // Forget the oldest sources while their buckets have refilled,
+            // and at the cap whatever their state, so a flood from distinct
+            // addresses neither grows the map nor slows down each handshake.
+            while let Some(&oldest) = self.order.front() {
+                let refilled = self.sources.get_mut(&oldest).map_or(true, |b| b.is_full(now));
+                if !refilled && self.sources.len() < MAX_SOURCES {
+                    break;
+                }
+                self.order.pop_front();
+                self.sources.remove(&oldest);
+            }
+            self.order.push_back(source);
+        }
+        let (rate, burst) = (self.rate, self.burst);
+        self.sources
+            .entry(source)
+            .or_insert_with(|| TokenBucket::new(rate, burst, now))
+            .try_take(1.0, now)
+    }
+}
+
+// Smooths a spike of handshakes, e.g. every client reconnecting after a
+// restart: those over the rate wait in a bounded queue and are let through in
+// arrival order as tokens accrue, instead of being dropped. Only once the
+// queue is full are more dropped. Items that waited longer than `max_age`,
+// e.g. Requests whose client gave up on them, are dropped without taking a
+// token.
+pub struct AdmissionQueue<T> {
+    bucket: TokenBucket,
+    pending: VecDeque<(Instant, T)>,
+    capacity: usize,
+    max_age: Duration,
+}
+
+impl<T> AdmissionQueue<T> {
+    pub fn new(rate: f64,
+               burst: f64,
+               capacity: usize,
+               max_age: Duration,
+               now: Instant)
+               -> AdmissionQueue<T> {
+        AdmissionQueue {
+            bucket: TokenBucket::new(rate, burst, now),
+            pending: VecDeque::new(),
+            capacity: capacity,
+            max_age: max_age,
+        }
+    }
+
+    // Queues `item`, arrived at `now`. Returns false if the queue is full and
+    // `item` was dropped.
+    pub fn push(&mut self, item: T, now: Instant) -> bool {
+        if self.pending.len() >= self.capacity {
+            return false;
+        }
+        self.pending.push_back((now, item));
+        true
+    }
+
+    // Takes the items admitted by `now`, dropping those too old by then.
+    pub fn ready(&mut self, now: Instant) -> Vec<T> {
+        let mut ready = Vec::new();
+        loop {
+            let arrived = match self.pending.front() {
+                Some(&(arrived, _)) => arrived,
+                None => break,
+            };
+            if now.duration_since(arrived) > self.max_age {
+                self.pending.pop_front();
+            } else if self.bucket.try_take(1.0, now) {
+                ready.push(self.pending.pop_front().unwrap().1);
+            } else {
+                break;
+            }
+        }
+        ready
+    }
+
+    pub fn len(&self) -> usize {
+        self.pending.len()
+    }
+
+    // When to call `ready` again, if anything is waiting.
+    pub fn timeout(&mut self, now: Instant) -> Option<Duration> {
+        if self.pending.is_empty() {
+            None
+        } else {
+            Some(cmp::max(self.bucket.time_until(1.0, now), Duration::from_millis(1)))
+        }
+    }
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Direction {
+    // From the client into the tunnel.
+    Upload,
+    // From the tunnel to the client.
+    Download,
+}
+
+fn byte_bucket(rate: u64, now: Instant) -> Option<TokenBucket> {
+    match rate {
+        0 => None,
+        // Allow a second's worth of traffic in a burst, and always at least
+        // one packet.
+        rate => Some(TokenBucket::new(rate as f64,
+                                      cmp::max(rate, device::MAX_MTU as u64) as f64,
+                                      now)),
+    }
+}
+
+// Throttles the traffic of one session, with separate caps per direction.
+pub struct SessionLimiter {
+    upload: Option<TokenBucket>,
+    download: Option<TokenBucket>,
+}
+
+impl SessionLimiter {
+    pub fn new(limit: &RateLimit, now: Instant) -> SessionLimiter {
+        SessionLimiter {
+            upload: byte_bucket(limit.upload, now),
+            download: byte_bucket(limit.download, now),
+        }
+    }
+
+    pub fn allow(&mut self, direction: Direction, bytes: usize, now: Instant) -> bool {
+        let bucket = match direction {
+            Direction::Upload => self.upload.as_mut(),
+            Direction::Download => self.download.as_mut(),
+        };
+        bucket.map_or(true, |b| b.try_take(bytes as f64, now))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::net::IpAddr;
+    use std::time::{Duration, Instant};
+    use config::RateLimit;
+    use ratelimit::*;
+
+    #[test]
+    fn session_limiter_test() {
+        let now = Instant::now();
+        let mut limiter = SessionLimiter::new(&RateLimit {
+                                                  upload: 3000,
+                                                  download: 15000,
+                                              },
+                                              now);
+        let uploaded = (0..100).filter(|_| limiter.allow(Direction::Upload, 1000, now)).count();
+        assert_eq!(uploaded, 3);
+        let downloaded = (0..100).filter(|_| limiter.allow(Direction::Download, 1000, now)).count();
+        assert_eq!(downloaded, 15);
+        assert!(!limiter.allow(Direction::Download, 1000, now));
+        assert!(limiter.allow(Direction::Upload, 1000, now + Duration::from_secs(1)));
+
+        let mut unlimited = SessionLimiter::new(&RateLimit::default(), now);
+        assert!((0..100).all(|_| unlimited.allow(Direction::Upload, 1500, now)));
+    }
+
+    #[test]
+    fn token_bucket_test() {
+        let start = Instant::now();
+        let mut bucket = TokenBucket::new(10.0, 2.0, start);
+        assert!(bucket.try_take(1.0, start));
+        assert!(bucket.try_take(1.0, start));
+        assert!(!bucket.try_take(1.0, start));
+        assert!(!bucket.is_full(start));
+        assert!(bucket.try_take(1.0, start + Duration::from_millis(100)));
+        assert!(bucket.is_full(start + Duration::from_secs(10)));
+    }
+
+    #[test]
+    fn skew_test() {
+        let start = Instant::now() + Duration::from_secs(10);
+        let mut bucket = TokenBucket::new(10.0, 2.0, start);
+        assert!(bucket.try_take(2.0, start));
+        // An earlier time neither refills the bucket nor panics.
+        assert!(!bucket.try_take(1.0, start - Duration::from_secs(5)));
+        assert!(bucket.try_take(1.0, start + Duration::from_millis(100)));
+    }
+
+    #[test]
+    fn per_source_limit_test() {
+        let mut limiter = HandshakeLimiter::new(1.0, 3.0, 1000.0, 1000.0);
+        let now = Instant::now();
+        let flooder: IpAddr = "192.0.2.1".parse().unwrap();
+        let other: IpAddr = "192.0.2.2".parse().unwrap();
+
+        let allowed = (0..100).filter(|_| limiter.allow(flooder, now)).count();
+        assert_eq!(allowed, 3);
+        assert!(limiter.allow(other, now));
+        assert!(limiter.allow(flooder, now + Duration::from_secs(1)));
+    }
+
+    #[test]
+    fn global_limit_test() {
+        let mut limiter = HandshakeLimiter::new(1.0, 1.0, 1.0, 5.0);
+        let now = Instant::now();
+        let allowed = (0..10u8)
+            .filter(|&i| limiter.allow(IpAddr::from([192, 0, 2, i]), now))
+            .count();
+        assert_eq!(allowed, 5);
+    }
+
+    #[test]
+    fn admission_queue_test() {
+        let start = Instant::now();
+        let mut queue = AdmissionQueue::new(10.0, 5.0, 50, Duration::from_secs(60), start);
+        assert_eq!(queue.timeout(start), None);
+        for i in 0..60 {
+            if i < 50 {
+                assert!(queue.push(i, start));
+            } else {
+                assert!(!queue.push(i, start));
+            }
+        }
+        // The burst goes through at once, the rest at the rate.
+        assert_eq!(queue.ready(start), vec![0, 1, 2, 3, 4]);
+        assert_eq!(queue.timeout(start), Some(Duration::from_millis(100)));
+        assert_eq!(queue.ready(start + Duration::from_millis(250)), vec![5, 6]);
+        assert_eq!(queue.len(), 43);
+        let admitted = queue.ready(start + Duration::from_secs(10));
+        assert_eq!(admitted.len(), 5);
+        assert_eq!(admitted[0], 7);
+    }
+
+    #[test]
+    fn admission_queue_age_test() {
+        let start = Instant::now();
+        let mut queue = AdmissionQueue::new(1.0, 1.0, 10, Duration::from_secs(3), start);
+        assert!(queue.push("first", start));
+        assert!(queue.push("stale", start));
+        assert!(queue.push("fresh", start + Duration::from_secs(2)));
+        assert_eq!(queue.ready(start), vec!["first"]);
+        // By the time a token accrues, the one that waited too long has been
+        // given up on by its client, and goes without spending the token.
+        assert_eq!(queue.ready(start + Duration::from_millis(3500)), vec!["fresh"]);
+        assert_eq!(queue.len(), 0);
+        assert_eq!(queue.timeout(start + Duration::from_secs(4)), None);
+    }
+
+    #[test]
+    fn source_eviction_test() {
+        let mut limiter = HandshakeLimiter::new(1.0, 1.0, 1e9, 1e9);
+        let now = Instant::now();
+        for i in 0..MAX_SOURCES as u32 {
+            limiter.allow(IpAddr::from([10, (i >> 16) as u8, (i >> 8) as u8, i as u8]), now);
+        }
+        let later = now + Duration::from_secs(5);
+        assert!(limiter.allow("192.0.2.1".parse().unwrap(), later));
+        assert_eq!(limiter.sources.len(), 1);
+    }
+
+    #[test]
+    fn source_cap_test() {
+        let mut limiter = HandshakeLimiter::new(1.0, 1.0, 1e9, 1e9);
+        let now = Instant::now();
+        for i in 0..3 * MAX_SOURCES as u32 {
+            limiter.allow(IpAddr::from([10, (i >> 16) as u8, (i >> 8) as u8, i as u8]), now);
+            assert!(limiter.sources.len() <= MAX_SOURCES);
+        }
+        assert_eq!(limiter.order.len(), limiter.sources.len());
+        // The newest sources are still limited.
+        assert!(!limiter.allow(IpAddr::from([10, 0, 0x2f, 0xff]), now));
+    }
+}
@@ -0,0 +1,186 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::collections::HashMap;
+use std::io;
+use std::net::{Ipv4Addr, SocketAddr, SocketAddrV4, UdpSocket};
+use std::time::{Duration, Instant};
+use libc;
+use packet;
+
+const CODE_NET_UNREACHABLE: u8 = 0;
+const CODE_HOST_UNREACHABLE: u8 = 1;
+// How long the outcome of a lookup is trusted, so a route coming back (or
+// going away) is noticed soon without looking up every packet.
+const CACHE_TTL_SECS: u64 = 5;
+const MAX_CACHED: usize = 4096;
+
+// Asks the host routing table whether it has a route to a destination.
+pub trait RouteLookup {
+    fn lookup(&self, destination: Ipv4Addr) -> io::Result<()>;
+}
+
+// Looks routes up by connecting a UDP socket, which picks a route without
+// sending anything and fails with ENETUNREACH or EHOSTUNREACH if there is
+// none.
+pub struct SystemLookup {
+    socket: UdpSocket,
+}
+
+impl SystemLookup {
+    pub fn new() -> io::Result<SystemLookup> {
+        Ok(SystemLookup { socket: try!(UdpSocket::bind("0.0.0.0:0")) })
+    }
+}
+
+impl RouteLookup for SystemLookup {
+    fn lookup(&self, destination: Ipv4Addr) -> io::Result<()> {
+        self.socket.connect(SocketAddr::V4(SocketAddrV4::new(destination, 9)))
+    }
+}
+
+// Answers inner packets the server has no route for with an ICMP destination
+// unreachable, so applications behind clients fail fast instead of waiting
+// for a timeout.
+pub struct Reachability {
+    lookup: Box<RouteLookup>,
+    source: Ipv4Addr,
+    // The ICMP code for unreachable destinations, or None, and when it was
+    // looked up.
+    cache: HashMap<Ipv4Addr, (Option<u8>, Instant)>,
+}
+
+impl Reachability {
+    // Replies come from `source`, e.g. the server's inner address.
+    pub fn new(lookup: Box<RouteLookup>, source: Ipv4Addr) -> Reachability {
+        Reachability {
+            lookup: lookup,
+            source: source,
+            cache: HashMap::new(),
+        }
+    }
+
+    fn unreachable(&mut self, destination: Ipv4Addr, now: Instant) -> Option<u8> {
+        if let Some(&(code, at)) = self.cache.get(&destination) {
+            if now.duration_since(at) < Duration::from_secs(CACHE_TTL_SECS) {
+                return code;
+            }
+        }
+        let code = match self.lookup.lookup(destination) {
+            Err(ref e) if e.raw_os_error() == Some(libc::ENETUNREACH) => {
+                Some(CODE_NET_UNREACHABLE)
+            }
+            Err(ref e) if e.raw_os_error() == Some(libc::EHOSTUNREACH) => {
+                Some(CODE_HOST_UNREACHABLE)
+            }
+            // Anything else is not ours to judge; the packet goes on.
+            _ => None,
+        };
+        if self.cache.len() >= MAX_CACHED {
+            self.cache.clear();
+        }
+        self.cache.insert(destination, (code, now));
+        code
+    }
+
+    // The ICMP message to send back instead of forwarding `packet`, an inner
+    // IPv4 packet, if there is no route to its destination. ICMP errors are
+    // never answered with another.
+    pub fn reply(&mut self, packet: &[u8], now: Instant) -> Option<Vec<u8>> {
+        if packet.len() < 20 || packet[0] >> 4 != 4 {
+            return None;
+        }
+        let ihl = (packet[0] & 0xf) as usize * 4;
+        if packet[9] == 1 && packet.get(ihl).map_or(true, |&t| t != 8) {
+            return None;
+        }
+        let destination = Ipv4Addr::new(packet[16], packet[17], packet[18], packet[19]);
+        self.unreachable(destination, now)
+            .map(|code| packet::destination_unreachable(packet, self.source, code))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::cell::Cell;
+    use std::io;
+    use std::net::Ipv4Addr;
+    use std::rc::Rc;
+    use std::time::{Duration, Instant};
+    use libc;
+    use reachability::*;
+
+    // Only 192.0.2.0/24 is routed; 198.51.100.1 is a known host that is down.
+    struct FakeLookup {
+        lookups: Rc<Cell<usize>>,
+    }
+
+    impl RouteLookup for FakeLookup {
+        fn lookup(&self, destination: Ipv4Addr) -> io::Result<()> {
+            self.lookups.set(self.lookups.get() + 1);
+            match destination.octets() {
+                [192, 0, 2, _] => Ok(()),
+                [198, 51, 100, 1] => Err(io::Error::from_raw_os_error(libc::EHOSTUNREACH)),
+                _ => Err(io::Error::from_raw_os_error(libc::ENETUNREACH)),
+            }
+        }
+    }
+
+    fn packet(protocol: u8, destination: [u8; 4], first: u8) -> Vec<u8> {
+        let mut packet = vec![0x45, 0, 0, 28, 0, 0, 0x40, 0, 64, protocol, 0, 0, 10, 10, 10, 2];
+        packet.extend_from_slice(&destination);
+        packet.extend_from_slice(&[first, 0, 0, 0, 0, 0, 0, 0]);
+        packet
+    }
+
+    #[test]
+    fn unreachable_test() {
+        let lookups = Rc::new(Cell::new(0));
+        let mut reachability = Reachability::new(Box::new(FakeLookup { lookups: lookups.clone() }),
+                                                 Ipv4Addr::new(10, 10, 10, 1));
+        let now = Instant::now();
+
+        let sent = packet(17, [203, 0, 113, 9], 0);
+        let reply = reachability.reply(&sent, now).unwrap();
+        assert_eq!(&reply[12..16], &[10, 10, 10, 1]);
+        assert_eq!(&reply[16..20], &[10, 10, 10, 2]);
+        assert_eq!(&reply[20..22], &[3, 0]);
+        assert_eq!(&reply[28..], &sent[..]);
+
+        let reply = reachability.reply(&packet(6, [198, 51, 100, 1], 0), now).unwrap();
+        assert_eq!(&reply[20..22], &[3, 1]);
+        assert!(reachability.reply(&packet(17, [192, 0, 2, 7], 0), now).is_none());
+
+        // Pings are answered, ICMP errors are not.
+        assert!(reachability.reply(&packet(1, [203, 0, 113, 9], 8), now).is_some());
+        assert!(reachability.reply(&packet(1, [203, 0, 113, 9], 3), now).is_none());
+        assert!(reachability.reply(&[0x60; 40], now).is_none());
+    }
+
+    #[test]
+    fn cache_test() {
+        let lookups = Rc::new(Cell::new(0));
+        let mut reachability = Reachability::new(Box::new(FakeLookup { lookups: lookups.clone() }),
+                                                 Ipv4Addr::new(10, 10, 10, 1));
+        let now = Instant::now();
+        for _ in 0..3 {
+            reachability.reply(&packet(17, [203, 0, 113, 9], 0), now);
+        }
+        assert_eq!(lookups.get(), 1);
+        reachability.reply(&packet(17, [203, 0, 113, 9], 0),
+                           now + Duration::from_secs(CACHE_TTL_SECS));
+        assert_eq!(lookups.get(), 2);
+    }
+}
@@ -0,0 +1,135 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::collections::hash_map::DefaultHasher;
+use std::hash::{Hash, Hasher};
+use std::net::{IpAddr, SocketAddr};
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering, ATOMIC_BOOL_INIT, ATOMIC_USIZE_INIT};
+use rand;
+
+static ENABLED: AtomicBool = ATOMIC_BOOL_INIT;
+// Mixed into every mask, so masked addresses cannot be looked up in a table
+// of precomputed hashes.
+static KEY: AtomicUsize = ATOMIC_USIZE_INIT;
+
+// Turns masking of log lines on or off for the whole process.
+pub fn set_enabled(enabled: bool) {
+    if enabled && KEY.load(Ordering::Relaxed) == 0 {
+        KEY.store(rand::random::<usize>() | 1, Ordering::Relaxed);
+    }
+    ENABLED.store(enabled, Ordering::Relaxed);
+}
+
+pub fn enabled() -> bool {
+    ENABLED.load(Ordering::Relaxed)
+}
+
+// The same value always gets the same mask within a process, so lines about
+// one peer can still be correlated.
+fn mask(value: &str) -> String {
+    let mut hasher = DefaultHasher::new();
+    KEY.load(Ordering::Relaxed).hash(&mut hasher);
+    value.hash(&mut hasher);
+    format!("<redacted:{:06x}>", hasher.finish() & 0xffffff)
+}
+
+fn is_interface_name(word: &str) -> bool {
+    let digits = if word.starts_with("utun") {
+        &word[4..]
+    } else if word.starts_with("tun") {
+        &word[3..]
+    } else {
+        return false;
+    };
+    !digits.is_empty() && digits.bytes().all(|b| b >= b'0' && b <= b'9')
+}
+
+fn scrub_word(word: &str) -> String {
+    if let Ok(addr) = word.parse::<SocketAddr>() {
+        return format!("{}:{}", mask(&addr.ip().to_string()), addr.port());
+    }
+    if word.parse::<IpAddr>().is_ok() || is_interface_name(word) {
+        return mask(word);
+    }
+    String::from(word)
+}
+
+// Masks IP addresses and TUN interface names in `line`. Ports are kept. Keys
+// and secrets are never logged in the first place.
+pub fn scrub(line: &str) -> String {
+    let is_word_char = |c: char| c.is_alphanumeric() || ".:[]".contains(c);
+    let mut out = String::with_capacity(line.len());
+    let mut rest = line;
+    while !rest.is_empty() {
+        let end = rest.find(|c: char| !is_word_char(c)).unwrap_or(rest.len());
+        if end == 0 {
+            let c = rest.chars().next().unwrap();
+            out.push(c);
+            rest = &rest[c.len_utf8()..];
+            continue;
+        }
+        // Punctuation ending a sentence is not part of the address.
+        let word = &rest[..end];
+        let trimmed = word.trim_right_matches(|c| c == '.' || c == ':');
+        out.push_str(&scrub_word(trimmed));
+        out.push_str(&word[trimmed.len()..]);
+        rest = &rest[end..];
+    }
+    out
+}
+
+// What a logger should print for `line`.
+pub fn apply(line: &str) -> String {
+    if enabled() {
+        scrub(line)
+    } else {
+        String::from(line)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use redact::*;
+
+    #[test]
+    fn scrub_test() {
+        let line = scrub("Got request from 192.0.2.1:5000. Assigning IP address: 10.10.10.2.");
+        assert!(!line.contains("192.0.2.1"));
+        assert!(!line.contains("10.10.10.2"));
+        assert!(line.starts_with("Got request from <redacted:"));
+        assert!(line.contains(":5000. Assigning IP address: <redacted:"));
+        assert!(line.ends_with(">."));
+
+        let line = scrub("TUN device tun0 initialized. Internal IP: 10.10.10.2/24. MTU: 1400.");
+        assert!(!line.contains("tun0"));
+        assert!(line.contains("/24. MTU: 1400."));
+        assert!(!scrub("Invalid message from [2001:db8::1]:8964").contains("2001:db8::1"));
+
+        // The same address masks the same way.
+        assert_eq!(scrub("192.0.2.1"), scrub("tunnel to 192.0.2.1")[10..]);
+        assert_eq!(scrub("Ready for transmission."), "Ready for transmission.");
+        assert_eq!(scrub("Stats: in 10 pps 1500 B/s."), "Stats: in 10 pps 1500 B/s.");
+    }
+
+    #[test]
+    fn apply_test() {
+        let line = "Public IP: 203.0.113.9";
+        assert_eq!(apply(line), line);
+        set_enabled(true);
+        assert!(apply(line).starts_with("Public IP: <redacted:"));
+        set_enabled(false);
+        assert_eq!(apply(line), line);
+    }
+}
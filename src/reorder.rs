@@ -0,0 +1,164 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::collections::BTreeMap;
+use std::time::{Duration, Instant};
+
+// Puts packets that overtook each other on the way, e.g. over several paths,
+// back in order of their sequence numbers. Packets wait behind a gap for at
+// most `timeout`, and at most `window` sequence numbers ahead of it; past
+// either, the gap is given up as lost.
+pub struct ReorderBuffer<T> {
+    window: u64,
+    timeout: Duration,
+    // The sequence number released next. Numbering starts at zero.
+    next: u64,
+    // Packets waiting behind a gap, and when each arrived.
+    waiting: BTreeMap<u64, (T, Instant)>,
+    // Sequence numbers given up on.
+    lost: u64,
+}
+
+impl<T> ReorderBuffer<T> {
+    pub fn new(window: usize, timeout: Duration) -> ReorderBuffer<T> {
+        ReorderBuffer {
+            window: window as u64,
+            timeout: timeout,
+            next: 0,
+            waiting: BTreeMap::new(),
+            lost: 0,
+        }
+    }
+
+    pub fn len(&self) -> usize {
+        self.waiting.len()
+    }
+
+    pub fn lost(&self) -> u64 {
+        self.lost
+    }
+
+    // Takes the packet numbered `sequence` and returns those that can be
+    // released now, in order.
+    pub fn push(&mut self, sequence: u64, packet: T, now: Instant) -> Vec<T> {
+        if sequence < self.next {
+            // Too late to be put back in order, but better late than lost.
+            return vec![packet];
+        }
+        let mut released = Vec::new();
+        // Too far ahead: skip as much of the gap as it takes to fit.
+        while sequence - self.next >= self.window {
+            released.extend(self.skip());
+        }
+        self.waiting.entry(sequence).or_insert((packet, now));
+        released.extend(self.release());
+        released
+    }
+
+    // Returns the packets released because the gap in front of them timed
+    // out, in order.
+    pub fn expire(&mut self, now: Instant) -> Vec<T> {
+        let mut released = Vec::new();
+        while self.timeout(now) == Some(Duration::from_secs(0)) {
+            released.extend(self.skip());
+        }
+        released
+    }
+
+    // How long until `expire` has something to release, if anything waits.
+    pub fn timeout(&self, now: Instant) -> Option<Duration> {
+        // The oldest arrival has waited longest for the gap.
+        self.waiting.values().map(|&(_, arrived)| arrived).min().map(|arrived| {
+            let deadline = arrived + self.timeout;
+            if deadline > now {
+                deadline - now
+            } else {
+                Duration::from_secs(0)
+            }
+        })
+    }
+
+    // Gives up on the gap in front of the first waiting packet, or on the
+    // next sequence number if none waits, and releases what follows it.
+    fn skip(&mut self) -> Vec<T> {
+        let resume = self.waiting.keys().next().cloned().unwrap_or(self.next + 1);
+        self.lost += resume - self.next;
+        self.next = resume;
+        self.release()
+    }
+
+    fn release(&mut self) -> Vec<T> {
+        let mut released = Vec::new();
+        while let Some((packet, _)) = self.waiting.remove(&self.next) {
+            released.push(packet);
+            self.next += 1;
+        }
+        released
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::{Duration, Instant};
+    use reorder::*;
+
+    #[test]
+    fn reorder_test() {
+        let mut buffer = ReorderBuffer::new(8, Duration::from_millis(50));
+        let now = Instant::now();
+        assert!(buffer.push(1, 1, now).is_empty());
+        assert_eq!(buffer.push(0, 0, now), vec![0, 1]);
+        assert!(buffer.push(3, 3, now).is_empty());
+        assert!(buffer.push(4, 4, now).is_empty());
+        assert_eq!(buffer.len(), 2);
+        assert_eq!(buffer.push(2, 2, now), vec![2, 3, 4]);
+        assert_eq!(buffer.push(5, 5, now), vec![5]);
+        // A duplicate, or one whose gap was given up on, goes straight through.
+        assert_eq!(buffer.push(3, 3, now), vec![3]);
+        assert_eq!(buffer.lost(), 0);
+        assert_eq!(buffer.timeout(now), None);
+    }
+
+    #[test]
+    fn gap_timeout_test() {
+        let timeout = Duration::from_millis(50);
+        let mut buffer = ReorderBuffer::new(8, timeout);
+        let now = Instant::now();
+        buffer.push(0, 0, now);
+        // 1 never arrives.
+        assert!(buffer.push(2, 2, now).is_empty());
+        assert!(buffer.push(3, 3, now + Duration::from_millis(10)).is_empty());
+        assert_eq!(buffer.timeout(now), Some(timeout));
+        assert!(buffer.expire(now + Duration::from_millis(49)).is_empty());
+        assert_eq!(buffer.expire(now + timeout), vec![2, 3]);
+        assert_eq!(buffer.lost(), 1);
+        assert_eq!(buffer.len(), 0);
+        assert_eq!(buffer.push(4, 4, now + timeout), vec![4]);
+    }
+
+    #[test]
+    fn window_test() {
+        let mut buffer = ReorderBuffer::new(4, Duration::from_secs(1));
+        let now = Instant::now();
+        buffer.push(0, 0, now);
+        buffer.push(2, 2, now);
+        buffer.push(3, 3, now);
+        // 6 is too far ahead of the gap at 1, which is given up. 4 times out.
+        assert_eq!(buffer.push(6, 6, now), vec![2, 3]);
+        assert_eq!(buffer.push(5, 5, now), Vec::<u32>::new());
+        assert_eq!(buffer.expire(now + Duration::from_secs(1)), vec![5, 6]);
+        assert_eq!(buffer.lost(), 2);
+    }
+}
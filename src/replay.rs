@@ -0,0 +1,243 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::collections::hash_map::RandomState;
+use std::collections::{HashSet, VecDeque};
+use std::hash::{BuildHasher, Hash, Hasher};
+use std::time::{Duration, Instant};
+use session::MAX_SKEW_SECS;
+
+// Remembers handshakes seen recently so a replayed one is not processed twice,
+// whichever address it comes from. Handshakes carry their sender's clock, and
+// only fresh ones are remembered, and accepted, at all.
+// Entries expire after `window`, and the oldest are evicted once `capacity` is
+// reached, so a flood of distinct handshakes cannot grow it without bound.
+pub struct ReplayCache {
+    // How old a handshake may be by its sender's clock, in seconds.
+    max_age: u64,
+    window: Duration,
+    capacity: usize,
+    // Keyed per process, so fingerprints cannot be predicted from outside.
+    hasher: RandomState,
+    seen: HashSet<u64>,
+    order: VecDeque<(Instant, u64)>,
+}
+
+impl ReplayCache {
+    // For handshakes that get `window` to arrive in, on top of MAX_SKEW_SECS
+    // for clocks to disagree. They are remembered for as long as one is
+    // fresh: from MAX_SKEW_SECS before the time it carries to `max_age`
+    // after, and a second either way for clocks counting whole seconds.
+    pub fn new(window: Duration, capacity: usize) -> ReplayCache {
+        let rounded = window.as_secs() + if window.subsec_nanos() > 0 { 1 } else { 0 };
+        let max_age = rounded + MAX_SKEW_SECS;
+        ReplayCache {
+            max_age: max_age,
+            window: Duration::from_secs(max_age + MAX_SKEW_SECS + 2),
+            capacity: capacity,
+            hasher: RandomState::new(),
+            seen: HashSet::new(),
+            order: VecDeque::new(),
+        }
+    }
+
+    pub fn len(&self) -> usize {
+        self.seen.len()
+    }
+
+    // Whether a handshake sent at `sent` by its sender's clock is fresh by
+    // ours at `now`, in seconds since the epoch. An older one may have been
+    // forgotten already, so `check` could not tell it is a replay.
+    pub fn is_fresh(&self, sent: u64, now: u64) -> bool {
+        sent <= now.saturating_add(MAX_SKEW_SECS) && sent.saturating_add(self.max_age) >= now
+    }
+
+    fn expire(&mut self, now: Instant) {
+        while let Some(&(at, fp)) = self.order.front() {
+            // Callers may pass times from different sources, so one earlier
+            // than an entry counts as no time having passed.
+            let age = if now > at { now - at } else { Duration::from_secs(0) };
+            if age < self.window && self.order.len() < self.capacity {
+                break;
+            }
+            self.order.pop_front();
+            self.seen.remove(&fp);
+        }
+    }
+
+    // Records the contents of a handshake opened under the encryption
+    // `context`, e.g. the pre-shared key it was sealed with, so the same
+    // contents under another key are another handshake. Returns false if the
+    // same one was already seen within the window.
+    pub fn check(&mut self, context: &[u8], handshake: &[u8], now: Instant) -> bool {
+        if self.capacity == 0 {
+            return true;
+        }
+        let mut hasher = self.hasher.build_hasher();
+        context.hash(&mut hasher);
+        handshake.hash(&mut hasher);
+        let fp = hasher.finish();
+
+        self.expire(now);
+        if !self.seen.insert(fp) {
+            return false;
+        }
+        self.order.push_back((now, fp));
+        true
+    }
+}
+
+// Bits of `Window`, i.e. how far behind the newest packet one may arrive.
+const WINDOW_LEN: u64 = 64;
+
+// Remembers which data packets of a session arrived, by the number each
+// direction gives its packets, so one replayed or duplicated on the way is
+// dropped while one merely reordered still gets through. Packets more than
+// `WINDOW_LEN` behind the newest are dropped too.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Serialize, Deserialize)]
+pub struct Window {
+    // One past the newest number seen, so zero means none was.
+    next: u64,
+    // Bit i is set if `next - 1 - i` was seen.
+    seen: u64,
+}
+
+impl Window {
+    pub fn new() -> Window {
+        Window::default()
+    }
+
+    // Whether `number` would be the newest packet yet.
+    pub fn is_newest(&self, number: u64) -> bool {
+        number >= self.next
+    }
+
+    // Whether `number` is the newest packet accepted yet.
+    pub fn is_latest(&self, number: u64) -> bool {
+        self.next == number.wrapping_add(1)
+    }
+
+    // Records packet `number`. Returns false if it was seen already or is
+    // too old to tell.
+    pub fn accept(&mut self, number: u64) -> bool {
+        if number >= self.next {
+            let shift = number - self.next + 1;
+            self.seen = if shift >= WINDOW_LEN { 0 } else { self.seen << shift };
+            self.seen |= 1;
+            self.next = number + 1;
+            return true;
+        }
+        let behind = self.next - 1 - number;
+        if behind >= WINDOW_LEN || self.seen & (1 << behind) != 0 {
+            return false;
+        }
+        self.seen |= 1 << behind;
+        true
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::{Duration, Instant};
+    use replay::*;
+
+    #[test]
+    fn replay_test() {
+        let mut cache = ReplayCache::new(Duration::from_secs(2), 16);
+        let now = Instant::now();
+
+        assert!(cache.check(b"shared", b"request", now));
+        assert!(!cache.check(b"shared", b"request", now + Duration::from_secs(1)));
+        // The same contents under another key are not a replay,
+        assert!(cache.check(b"laptop", b"request", now));
+        assert!(!cache.check(b"laptop", b"request", now));
+        // nor may contexts and contents run into each other.
+        assert!(cache.check(b"sharedrequest", b"", now));
+        let window = cache.window;
+        assert!(cache.check(b"shared", b"request", now + window));
+    }
+
+    #[test]
+    fn freshness_test() {
+        let cache = ReplayCache::new(Duration::from_millis(5000), 16);
+        let now = 1_500_000_000;
+        assert!(cache.is_fresh(now, now));
+        assert!(cache.is_fresh(now - 5 - MAX_SKEW_SECS, now));
+        assert!(!cache.is_fresh(now - 6 - MAX_SKEW_SECS, now));
+        assert!(cache.is_fresh(now + MAX_SKEW_SECS, now));
+        assert!(!cache.is_fresh(now + MAX_SKEW_SECS + 1, now));
+        assert!(!cache.is_fresh(0, now));
+        assert!(!cache.is_fresh(u64::max_value(), now));
+        // Whatever is fresh stays remembered, even across skew and rounding.
+        assert!(cache.window >= Duration::from_secs(5 + 2 * MAX_SKEW_SECS + 2));
+    }
+
+    #[test]
+    fn skew_test() {
+        let mut cache = ReplayCache::new(Duration::from_secs(2), 16);
+        let now = Instant::now() + Duration::from_secs(10);
+
+        assert!(cache.check(b"", b"request", now));
+        // Times going back still catch the replay instead of panicking.
+        assert!(!cache.check(b"", b"request", now - Duration::from_secs(5)));
+        assert!(cache.check(b"", b"other", now - Duration::from_secs(5)));
+        let window = cache.window;
+        assert!(cache.check(b"", b"request", now + window));
+    }
+
+    #[test]
+    fn eviction_test() {
+        let mut cache = ReplayCache::new(Duration::from_secs(2), 100);
+        let now = Instant::now();
+
+        for i in 0..10000u32 {
+            let datagram = [(i >> 8) as u8, i as u8];
+            assert!(cache.check(b"", &datagram, now));
+            assert!(cache.len() <= 100);
+        }
+        // Only the newest entries survive a flood.
+        assert!(!cache.check(b"", &[(9999u32 >> 8) as u8, 9999u32 as u8], now));
+        assert!(cache.check(b"", &[0, 0], now));
+
+        let window = cache.window;
+        cache.check(b"", b"late", now + window);
+        assert_eq!(cache.len(), 1);
+    }
+
+    #[test]
+    fn window_test() {
+        let mut window = Window::new();
+        assert!(window.is_newest(0));
+        assert!(window.accept(0));
+        assert!(!window.accept(0));
+        // Reordered packets get in once each.
+        assert!(window.accept(3));
+        assert!(!window.is_newest(2));
+        assert!(window.accept(2));
+        assert!(window.accept(1));
+        assert!(!window.accept(2));
+        assert!(window.is_newest(4));
+        assert!(window.is_latest(3));
+        assert!(!window.is_latest(2));
+
+        // Far ahead, the old ones fall out of the window.
+        assert!(window.accept(100));
+        assert!(!window.accept(3));
+        assert!(!window.accept(36));
+        assert!(window.accept(37));
+        assert!(window.accept(99));
+        assert!(!window.accept(100));
+    }
+}
@@ -0,0 +1,387 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::collections::{HashMap, VecDeque};
+use std::hash::Hash;
+use std::time::{Duration, Instant};
+use codel::Codel;
+
+// Deficit round-robin over per-key packet queues: every backlogged key gets
+// to send roughly `quantum` bytes per round, so one busy session cannot starve
+// the others of the shared socket.
+pub struct FairQueue<K: Eq + Hash + Clone> {
+    quantum: usize,
+    limit: usize,
+    // Packets, and when each was queued.
+    queues: HashMap<K, VecDeque<(Vec<u8>, Instant)>>,
+    deficits: HashMap<K, usize>,
+    active: VecDeque<K>,
+    len: usize,
+    bytes: usize,
+    byte_limit: usize,
+    evicted: usize,
+    // With a latency target, each key's queue is managed by CoDel, whose
+    // state outlives the queue running empty.
+    latency_target: Option<Duration>,
+    codels: HashMap<K, Codel>,
+    expired: usize,
+}
+
+impl<K: Eq + Hash + Clone> FairQueue<K> {
+    // `limit` bounds the number of packets queued per key.
+    pub fn new(quantum: usize, limit: usize) -> FairQueue<K> {
+        FairQueue {
+            quantum: quantum,
+            limit: limit,
+            queues: HashMap::new(),
+            deficits: HashMap::new(),
+            active: VecDeque::new(),
+            len: 0,
+            bytes: 0,
+            byte_limit: usize::max_value(),
+            evicted: 0,
+            latency_target: None,
+            codels: HashMap::new(),
+            expired: 0,
+        }
+    }
+
+    // Drops packets that waited too long in a key's queue, as CoDel decides,
+    // to keep the wait near `target` rather than sending them stale.
+    pub fn set_latency_target(&mut self, target: Duration) {
+        self.latency_target = Some(target);
+    }
+
+    // Returns how many packets were dropped for waiting too long since the
+    // last call.
+    pub fn take_expired(&mut self) -> usize {
+        let expired = self.expired;
+        self.expired = 0;
+        expired
+    }
+
+    // Caps the bytes queued across all keys. Beyond it, packets are evicted
+    // from the longest queues, which belong to whoever is flooding.
+    pub fn set_byte_limit(&mut self, limit: usize) {
+        self.byte_limit = limit;
+    }
+
+    pub fn bytes(&self) -> usize {
+        self.bytes
+    }
+
+    // Returns how many packets were evicted since the last call.
+    pub fn take_evicted(&mut self) -> usize {
+        let evicted = self.evicted;
+        self.evicted = 0;
+        evicted
+    }
+
+    fn remove_key(&mut self, key: &K) {
+        self.queues.remove(key);
+        self.deficits.remove(key);
+        if let Some(index) = self.active.iter().position(|k| k == key) {
+            self.active.remove(index);
+        }
+    }
+
+    // Drops the newest packet of the longest queue. Returns false if there
+    // was nothing to drop.
+    fn evict(&mut self) -> bool {
+        let key = match self.queues.iter().max_by_key(|&(_, q)| q.len()) {
+            Some((key, _)) => key.clone(),
+            None => return false,
+        };
+        let (packet, empty) = {
+            let queue = self.queues.get_mut(&key).unwrap();
+            (queue.pop_back().unwrap().0, queue.is_empty())
+        };
+        if empty {
+            self.remove_key(&key);
+        }
+        self.len -= 1;
+        self.bytes -= packet.len();
+        self.evicted += 1;
+        true
+    }
+
+    pub fn len(&self) -> usize {
+        self.len
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len == 0
+    }
+
+    // Returns false, dropping the packet, if the key's queue is full or the
+    // packet alone exceeds the byte limit.
+    pub fn push(&mut self, key: K, packet: Vec<u8>) -> bool {
+        self.push_at(key, packet, Instant::now())
+    }
+
+    // Like `push`, for a packet queued at `now`.
+    pub fn push_at(&mut self, key: K, packet: Vec<u8>, now: Instant) -> bool {
+        if packet.len() > self.byte_limit {
+            return false;
+        }
+        let full = self.queues.get(&key).map_or(false, |q| q.len() >= self.limit);
+        if full {
+            return false;
+        }
+        while self.bytes + packet.len() > self.byte_limit {
+            if !self.evict() {
+                break;
+            }
+        }
+        let queue = self.queues.entry(key.clone()).or_insert_with(VecDeque::new);
+        if queue.is_empty() {
+            self.active.push_back(key.clone());
+            if let Some(codel) = self.codels.get_mut(&key) {
+                codel.idle();
+            }
+            self.deficits.insert(key, 0);
+        }
+        self.bytes += packet.len();
+        queue.push_back((packet, now));
+        self.len += 1;
+        true
+    }
+
+    pub fn pop(&mut self) -> Option<(K, Vec<u8>)> {
+        self.pop_at(Instant::now())
+    }
+
+    // Like `pop`, at `now`.
+    pub fn pop_at(&mut self, now: Instant) -> Option<(K, Vec<u8>)> {
+        loop {
+            let key = match self.active.front() {
+                Some(key) => key.clone(),
+                None => return None,
+            };
+            self.expire(&key, now);
+            let head_len = self.queues[&key].front().unwrap().0.len();
+            let deficit = self.deficits.get_mut(&key).unwrap();
+            if *deficit < head_len {
+                *deficit += self.quantum;
+                self.active.pop_front();
+                self.active.push_back(key);
+                continue;
+            }
+            *deficit -= head_len;
+
+            let packet = {
+                let queue = self.queues.get_mut(&key).unwrap();
+                queue.pop_front().unwrap().0
+            };
+            if self.queues[&key].is_empty() {
+                self.active.pop_front();
+                self.queues.remove(&key);
+                self.deficits.remove(&key);
+            }
+            self.len -= 1;
+            self.bytes -= packet.len();
+            return Some((key, packet));
+        }
+    }
+
+    // Drops the packets at the head of `key`'s queue that CoDel finds too
+    // stale to send at `now`. The last one is always kept, so the queue
+    // stays active.
+    fn expire(&mut self, key: &K, now: Instant) {
+        let target = match self.latency_target {
+            Some(target) => target,
+            None => return,
+        };
+        let codel = self.codels.entry(key.clone()).or_insert_with(|| Codel::new(target, now));
+        let queue = self.queues.get_mut(key).unwrap();
+        while let Some(&(_, queued)) = queue.front() {
+            let sojourn = if now > queued {
+                now - queued
+            } else {
+                Duration::from_secs(0)
+            };
+            if !codel.should_drop(sojourn, queue.len() - 1, now) {
+                break;
+            }
+            let (packet, _) = queue.pop_front().unwrap();
+            self.len -= 1;
+            self.bytes -= packet.len();
+            self.expired += 1;
+        }
+    }
+
+    // Removes and returns the packets queued for `key`, oldest first.
+    pub fn take(&mut self, key: &K) -> Vec<Vec<u8>> {
+        let packets: Vec<Vec<u8>> = match self.queues.get_mut(key) {
+            Some(queue) => queue.drain(..).map(|(packet, _)| packet).collect(),
+            None => return Vec::new(),
+        };
+        self.codels.remove(key);
+        self.remove_key(key);
+        self.len -= packets.len();
+        self.bytes -= packets.iter().map(|p| p.len()).sum::<usize>();
+        packets
+    }
+
+    // Puts back a packet returned by `pop` that could not be sent, so it is
+    // the next one popped.
+    pub fn requeue(&mut self, key: K, packet: Vec<u8>) {
+        if !self.queues.contains_key(&key) {
+            self.active.push_front(key.clone());
+        } else if self.active.front() != Some(&key) {
+            let index = self.active.iter().position(|k| *k == key).unwrap();
+            self.active.remove(index);
+            self.active.push_front(key.clone());
+        }
+        *self.deficits.entry(key.clone()).or_insert(0) += packet.len();
+        self.bytes += packet.len();
+        // It is sent next, so how long it waited no longer matters.
+        self.queues.entry(key).or_insert_with(VecDeque::new).push_front((packet, Instant::now()));
+        self.len += 1;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use scheduler::*;
+
+    #[test]
+    fn fifo_test() {
+        let mut queue = FairQueue::new(1500, 8);
+        assert!(queue.is_empty());
+        queue.push(1, vec![1]);
+        queue.push(1, vec![2]);
+        assert_eq!(queue.len(), 2);
+        assert_eq!(queue.pop(), Some((1, vec![1])));
+        assert_eq!(queue.pop(), Some((1, vec![2])));
+        assert_eq!(queue.pop(), None);
+    }
+
+    #[test]
+    fn limit_test() {
+        let mut queue = FairQueue::new(1500, 2);
+        assert!(queue.push(1, vec![0; 10]));
+        assert!(queue.push(1, vec![0; 10]));
+        assert!(!queue.push(1, vec![0; 10]));
+        assert!(queue.push(2, vec![0; 10]));
+        assert_eq!(queue.len(), 3);
+    }
+
+    #[test]
+    fn byte_limit_test() {
+        let mut queue = FairQueue::new(1500, 1000);
+        queue.set_byte_limit(10000);
+        // Session 1 floods; session 2 sends a little.
+        for _ in 0..100 {
+            assert!(queue.push(1, vec![1; 1000]));
+            assert!(queue.bytes() <= 10000);
+        }
+        assert!(queue.push(2, vec![2; 1000]));
+        assert!(queue.push(2, vec![2; 1000]));
+        assert_eq!(queue.bytes(), 10000);
+        assert_eq!(queue.len(), 10);
+        assert_eq!(queue.take_evicted(), 92);
+        assert_eq!(queue.take_evicted(), 0);
+        assert!(!queue.push(3, vec![3; 10001]));
+
+        let mut sent = [0usize; 3];
+        while let Some((key, _)) = queue.pop() {
+            sent[key] += 1;
+        }
+        assert_eq!(sent, [0, 8, 2]);
+        assert_eq!(queue.bytes(), 0);
+    }
+
+    #[test]
+    fn requeue_test() {
+        let mut queue = FairQueue::new(100, 8);
+        queue.push(1, vec![1; 100]);
+        queue.push(2, vec![2; 100]);
+        let (key, packet) = queue.pop().unwrap();
+        queue.requeue(key, packet.clone());
+        assert_eq!(queue.pop(), Some((key, packet)));
+        assert_eq!(queue.len(), 1);
+    }
+
+    #[test]
+    fn fairness_test() {
+        // Session 1 offers ten times the load of session 2, in larger packets.
+        let mut queue = FairQueue::new(1500, 1000);
+        for i in 0..1000 {
+            queue.push(1, vec![0; 1400]);
+            if i % 10 == 0 {
+                queue.push(2, vec![0; 700]);
+                queue.push(2, vec![0; 700]);
+            }
+        }
+
+        let mut sent = [0usize; 3];
+        while sent[1] + sent[2] < 100 * 1400 {
+            let (key, packet) = queue.pop().unwrap();
+            sent[key] += packet.len();
+        }
+        let share = sent[2] as f64 / (sent[1] + sent[2]) as f64;
+        assert!(share > 0.45 && share < 0.55, "share of session 2: {}", share);
+    }
+
+    #[test]
+    fn latency_target_test() {
+        use std::time::{Duration, Instant};
+
+        // A tenth more packets arrive than the link sends, for a minute.
+        // Each packet carries the millisecond it was queued in.
+        let target = Duration::from_millis(5);
+        let mut queue = FairQueue::new(1500, 100000);
+        queue.set_latency_target(target);
+        let start = Instant::now();
+        let (mut sent, mut waits) = (0, Vec::new());
+        for ms in 0..60000u64 {
+            let now = start + Duration::from_millis(ms);
+            let arrivals = if ms % 10 == 0 { 2 } else { 1 };
+            for _ in 0..arrivals {
+                assert!(queue.push_at(1, vec![(ms >> 8) as u8, ms as u8], now));
+            }
+            let (_, packet) = queue.pop_at(now).unwrap();
+            sent += 1;
+            if ms >= 10000 {
+                waits.push(ms - ((packet[0] as u64) << 8 | packet[1] as u64));
+            }
+        }
+        // Unmanaged, the wait would grow to six seconds. With CoDel, once it
+        // caught up, it stays within a few target latencies, and the link
+        // never idles: about the excess is dropped, nothing more.
+        let average = waits.iter().sum::<u64>() as f64 / waits.len() as f64;
+        let longest = *waits.iter().max().unwrap();
+        assert!(average < 30.0, "average wait: {} ms", average);
+        assert!(longest < 50, "longest wait: {} ms", longest);
+        assert_eq!(sent, 60000);
+        let expired = queue.take_expired();
+        assert!(expired > 5900 && expired <= 6000, "{} packets expired", expired);
+        assert!(queue.len() < 50, "{} packets left queued", queue.len());
+    }
+
+    #[test]
+    fn take_test() {
+        let mut queue = FairQueue::new(1500, 8);
+        queue.push(1, vec![1; 10]);
+        queue.push(2, vec![2; 20]);
+        queue.push(1, vec![3; 30]);
+        assert_eq!(queue.take(&1), vec![vec![1; 10], vec![3; 30]]);
+        assert_eq!(queue.take(&1), Vec::<Vec<u8>>::new());
+        assert_eq!((queue.len(), queue.bytes()), (1, 20));
+        assert_eq!(queue.pop(), Some((2, vec![2; 20])));
+        assert_eq!(queue.pop(), None);
+    }
+}
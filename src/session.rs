@@ -0,0 +1,1303 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::cmp;
+use std::collections::{HashMap, HashSet};
+use std::net::{Ipv4Addr, SocketAddr};
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+use bincode::{serialize, deserialize, Infinite};
+use rand::{thread_rng, Rng};
+use ring::rand::{SystemRandom, SecureRandom};
+use audit::{AuditLog, Event, Record};
+use bridge::{Subnet, SubnetRoutes};
+use cipher::{self, Cipher, KeySchedule};
+use config;
+use keystore::{KeyStore, MemoryKeyStore};
+use network::{self, ConnectionId, HandshakeNonce, Id, Token, Message};
+use pool::IpPool;
+use ratelimit::{Direction, SessionLimiter};
+use replay::Window;
+use utils;
+
+// Sessions are forgotten after this many seconds without traffic.
+const SESSION_LIFETIME: u64 = 60;
+
+const EXPORT_SALT: &[u8] = b"kytan session export";
+const EXPORT_NONCE_LEN: usize = 12;
+const EXPORT_TAG_LEN: usize = 16;
+// Shortest key accepted in a `state_key_file`.
+const MIN_STATE_KEY_LEN: usize = 16;
+
+#[derive(Clone, Debug, PartialEq, Serialize, Deserialize)]
+pub struct Session {
+    pub identifier: Option<String>,
+    pub token: Token,
+    pub addr: SocketAddr,
+    pub mtu: u16,
+    // The client's and our nonce from the handshake, which the keys of the
+    // session derive from.
+    pub nonces: (HandshakeNonce, HandshakeNonce),
+    pub cipher: Cipher,
+    // The number of the next data packet we send, and which of the client's
+    // arrived. Exported along, so a server taking the session over neither
+    // reuses a nonce nor takes a replay.
+    pub sent: u64,
+    pub received: Window,
+}
+
+// How often a session's token has been taken over by another server, or by
+// this one after a restart, without its client handshaking again.
+#[derive(Clone, Copy, Debug, PartialEq, Serialize, Deserialize)]
+pub struct Resumption {
+    // When the token was issued, in seconds since the epoch, as other servers
+    // have no use for our Instants.
+    pub issued: u64,
+    pub uses: u32,
+}
+
+// How far apart the clocks of well-run hosts may be, in seconds. Times
+// judged across hosts, such as the age of a token issued by another server,
+// allow for this much, and more is logged when a peer's clock is seen.
+pub const MAX_SKEW_SECS: u64 = 60;
+
+pub fn unix_time() -> u64 {
+    SystemTime::now().duration_since(UNIX_EPOCH).map(|d| d.as_secs()).unwrap_or(0)
+}
+
+// The server's view of its clients: who holds which inner address, and what
+// was negotiated with them.
+pub struct SessionTable {
+    pool: IpPool,
+    sessions: HashMap<Id, Session>,
+    last_seen: HashMap<Id, Instant>,
+    mtu: u16,
+    link_prefix: u8,
+    mtus: HashMap<String, u16>,
+    downstream_mtu: u16,
+    downstream_mtus: HashMap<String, u16>,
+    limiters: HashMap<Id, SessionLimiter>,
+    // The keys of each session, derived when first needed, e.g. after an
+    // import.
+    keys: HashMap<Id, Box<KeyStore>>,
+    // Sessions established over TCP whose UDP address is not known yet.
+    unbound: HashSet<Id>,
+    // Connection IDs tagging data of a session, and the addresses each
+    // session's tagged data arrived from.
+    connections: HashMap<ConnectionId, Id>,
+    paths: HashMap<Id, Vec<SocketAddr>>,
+    // Sessions that agreed to compress data with the preset dictionary.
+    dictionary: HashSet<Id>,
+    // The number of the next packet to each session that numbers its data.
+    sequences: HashMap<Id, u64>,
+    profiles: HashMap<String, config::Profile>,
+    // Sessions whose profile exempts their data from compression.
+    uncompressed: HashSet<Id>,
+    // Sessions frozen for migration to another server.
+    quiesced: HashSet<Id>,
+    rate_limit: config::RateLimit,
+    rate_limits: HashMap<String, config::RateLimit>,
+    // When each session started, and the inner bytes it sent and received.
+    started: HashMap<Id, Instant>,
+    traffic: HashMap<Id, (u64, u64)>,
+    resumptions: HashMap<Id, Resumption>,
+    // Imported sessions whose token is this old, in seconds, or was resumed
+    // this many times already are turned away, so their clients have to
+    // handshake again. Zero means no limit.
+    resumption_max_age: u64,
+    resumption_max_uses: u32,
+    // Subnets bridged behind clients, and which session each is routed to.
+    subnets: SubnetRoutes,
+    audit: Option<AuditLog>,
+}
+
+impl SessionTable {
+    pub fn new(config: &config::ServerConfig) -> Result<SessionTable, String> {
+        let pool = try!(IpPool::with_prefix(&config.reservations, config.link_prefix));
+        // Sized up front, so a connection storm does not rehash them as they
+        // grow. Never more than the pool can hand out.
+        let capacity = cmp::min(config.expected_sessions, pool.capacity());
+        Ok(SessionTable {
+            pool: pool,
+            sessions: HashMap::with_capacity(capacity),
+            last_seen: HashMap::with_capacity(capacity),
+            mtu: config.mtu,
+            link_prefix: config.link_prefix,
+            mtus: config.mtus.clone(),
+            downstream_mtu: config.downstream_mtu,
+            downstream_mtus: config.downstream_mtus.clone(),
+            limiters: HashMap::with_capacity(capacity),
+            keys: HashMap::with_capacity(capacity),
+            unbound: HashSet::new(),
+            connections: HashMap::new(),
+            paths: HashMap::new(),
+            dictionary: HashSet::new(),
+            sequences: HashMap::new(),
+            profiles: config.profiles.clone(),
+            uncompressed: HashSet::new(),
+            quiesced: HashSet::new(),
+            rate_limit: config.rate_limit,
+            rate_limits: config.rate_limits.clone(),
+            started: HashMap::with_capacity(capacity),
+            traffic: HashMap::with_capacity(capacity),
+            resumptions: HashMap::with_capacity(capacity),
+            resumption_max_age: config.resumption_max_age_secs,
+            resumption_max_uses: config.resumption_max_uses,
+            subnets: try!(SubnetRoutes::new(&config.bridged_subnets)),
+            audit: match config.audit_log {
+                Some(ref path) => Some(try!(AuditLog::open(path))),
+                None => None,
+            },
+        })
+    }
+
+    // Records the connect and disconnect of every session to `log`.
+    pub fn set_audit_log(&mut self, log: AuditLog) {
+        self.audit = Some(log);
+    }
+
+    fn audit(&mut self, id: Id, event: Event) {
+        let (log, session) = match (self.audit.as_mut(), self.sessions.get(&id)) {
+            (Some(log), Some(session)) => (log, session),
+            _ => return,
+        };
+        let (rx_bytes, tx_bytes) = self.traffic.get(&id).cloned().unwrap_or((0, 0));
+        // Up to the session's last traffic, not the end of its idle timeout.
+        let duration = match (self.started.get(&id), self.last_seen.get(&id)) {
+            (Some(&started), Some(&seen)) if seen > started => seen - started,
+            _ => Duration::from_secs(0),
+        };
+        log.record(&Record {
+            event: event,
+            identifier: session.identifier.clone(),
+            source: session.addr,
+            address: Ipv4Addr::new(10, 10, 10, id),
+            cipher: session.cipher,
+            rx_bytes: rx_bytes,
+            tx_bytes: tx_bytes,
+            duration: duration,
+        });
+    }
+
+    // Creates a session for a client's Request and returns the Response to
+    // send back.
+    pub fn accept(&mut self,
+                  identifier: Option<&str>,
+                  addr: SocketAddr)
+                  -> Result<Message, String> {
+        let id = try!(self.pool
+            .allocate(identifier)
+            .ok_or(format!("No IP address left for request from {}.", addr)));
+        if self.quiesced.contains(&id) {
+            return Err(format!("Session for 10.10.10.{} is being migrated. Ignoring request \
+                                from {}.",
+                               id,
+                               addr));
+        }
+        let mtu = identifier.and_then(|i| self.mtus.get(i)).cloned().unwrap_or(self.mtu);
+        let session = Session {
+            identifier: identifier.map(String::from),
+            token: thread_rng().gen::<Token>(),
+            addr: addr,
+            mtu: mtu,
+            nonces: ([0; 16], [0; 16]),
+            cipher: cipher::DEFAULT,
+            sent: 0,
+            received: Window::new(),
+        };
+        let (token, mtu) = (session.token, session.mtu);
+        self.insert(id, session);
+        self.resumptions.insert(id,
+                                Resumption {
+                                    issued: unix_time(),
+                                    uses: 0,
+                                });
+        let compression = self.profile(identifier).compression;
+        if !compression {
+            self.uncompressed.insert(id);
+        }
+        Ok(Message::Response {
+            id: id,
+            token: token,
+            nonces: ([0; 16], [0; 16]),
+            cipher: cipher::DEFAULT,
+            timestamp: unix_time(),
+            link_prefix: self.link_prefix,
+            mtu: mtu,
+            compression: compression,
+            dictionary: false,
+            data_port: None,
+        })
+    }
+
+    // Has session `id` use `cipher`, the one picked from its client's offer.
+    pub fn use_cipher(&mut self, id: Id, cipher: Cipher) {
+        if let Some(session) = self.sessions.get_mut(&id) {
+            session.cipher = cipher;
+            self.keys.remove(&id);
+        }
+    }
+
+    // Picks our nonce for the keys of session `id`, to go with the client's
+    // `nonce` from its Request. Returns both, for the Response.
+    pub fn pick_nonces(&mut self,
+                       id: Id,
+                       nonce: HandshakeNonce)
+                       -> Result<(HandshakeNonce, HandshakeNonce), String> {
+        let picked = try!(network::handshake_nonce());
+        let session = try!(self.sessions.get_mut(&id).ok_or(format!("Unknown id {}.", id)));
+        // New keys number their data afresh.
+        session.nonces = (nonce, picked);
+        session.sent = 0;
+        session.received = Window::new();
+        self.keys.remove(&id);
+        Ok(session.nonces)
+    }
+
+    // The keys of session `id`, derived from `keys`, those of its client's
+    // identity, if not yet.
+    fn keys(&mut self, id: Id, keys: &KeyStore) -> Result<&KeyStore, String> {
+        if !self.keys.contains_key(&id) {
+            let session = try!(self.sessions.get(&id).ok_or(format!("Unknown id {}.", id)));
+            let derived = try!(network::session_keys(keys,
+                                                     session.cipher,
+                                                     &session.nonces,
+                                                     false));
+            self.keys.insert(id, derived);
+        }
+        Ok(&**self.keys.get(&id).unwrap())
+    }
+
+    // Seals data to session `id` as its next packet. `keys` are those of its
+    // client's identity.
+    pub fn seal(&mut self, id: Id, keys: &KeyStore, msg: &Message) -> Result<Vec<u8>, String> {
+        let number = match self.sessions.get_mut(&id) {
+            Some(session) => {
+                session.sent += 1;
+                session.sent - 1
+            }
+            None => return Err(format!("Unknown id {}.", id)),
+        };
+        network::seal_data(try!(self.keys(id, keys)), number, msg)
+    }
+
+    // Opens data from session `id` numbered `number` in place, unless it
+    // arrived already.
+    pub fn open(&mut self,
+                id: Id,
+                keys: &KeyStore,
+                number: u64,
+                sealed: &mut [u8])
+                -> Result<Message, String> {
+        let msg = try!(network::open_message(try!(self.keys(id, keys)),
+                                             &network::data_nonce(number),
+                                             sealed));
+        let fresh = self.sessions.get_mut(&id).map_or(false, |s| s.received.accept(number));
+        if !fresh {
+            return Err(format!("Data numbered {} for id {} is a replay.", number, id));
+        }
+        Ok(msg)
+    }
+
+    // The profile of the client identified as `identifier`, or the default
+    // one.
+    pub fn profile(&self, identifier: Option<&str>) -> config::Profile {
+        identifier.and_then(|i| self.profiles.get(i)).cloned().unwrap_or_default()
+    }
+
+    // Whether data to session `id` is compressed. It is unless its profile
+    // says otherwise; not exported, like the dictionary.
+    pub fn uses_compression(&self, id: Id) -> bool {
+        !self.uncompressed.contains(&id)
+    }
+
+    // The largest inner packet sent to session `id`, if limited below what
+    // it may send.
+    pub fn downstream_mtu(&self, id: Id) -> Option<u16> {
+        let identifier = self.sessions.get(&id).and_then(|s| s.identifier.as_ref());
+        match identifier.and_then(|i| self.downstream_mtus.get(i)).cloned() {
+            Some(mtu) => Some(mtu),
+            None if self.downstream_mtu != 0 => Some(self.downstream_mtu),
+            None => None,
+        }
+    }
+
+    fn insert(&mut self, id: Id, session: Session) {
+        let limit = session.identifier
+            .as_ref()
+            .and_then(|i| self.rate_limits.get(i))
+            .unwrap_or(&self.rate_limit);
+        self.limiters.insert(id, SessionLimiter::new(limit, Instant::now()));
+        self.keys.remove(&id);
+        self.audit(id, Event::Disconnect { reason: "replaced" });
+        self.dictionary.remove(&id);
+        self.sequences.remove(&id);
+        self.uncompressed.remove(&id);
+        self.subnets.withdraw(id);
+        self.sessions.insert(id, session);
+        self.last_seen.insert(id, Instant::now());
+        self.started.insert(id, Instant::now());
+        self.traffic.remove(&id);
+        self.audit(id, Event::Connect);
+    }
+
+    // Routes the subnets session `id` advertised in its handshake to it, as
+    // far as its identifier may bridge them. Returns those it may not.
+    pub fn advertise(&mut self, id: Id, subnets: &[Subnet]) -> Vec<Subnet> {
+        let identifier = match self.sessions.get(&id) {
+            Some(session) => session.identifier.clone(),
+            None => return subnets.to_vec(),
+        };
+        self.subnets.advertise(id, identifier.as_ref().map(|i| i.as_str()), subnets)
+    }
+
+    // The session inner packets to `destination` go to: the one bridging a
+    // subnet holding it, or else the one holding the address. None for a
+    // bridged subnet without a session behind it now.
+    pub fn route(&self, destination: Ipv4Addr) -> Option<Id> {
+        match self.subnets.route(destination) {
+            Some(id) => Some(id),
+            None if self.subnets.is_bridged(destination) => None,
+            None => Some(destination.octets()[3]),
+        }
+    }
+
+    // Every subnet a client may bridge.
+    pub fn bridged_subnets(&self) -> Vec<Subnet> {
+        self.subnets.allowed()
+    }
+
+    // Looks up a session and keeps it alive, unless it is quiesced.
+    pub fn get(&mut self, id: Id) -> Option<&Session> {
+        self.keep_alive(id);
+        self.sessions.get(&id)
+    }
+
+    // Looks up a session without keeping it alive, e.g. for data not yet
+    // known to be from it.
+    pub fn peek(&self, id: Id) -> Option<&Session> {
+        self.sessions.get(&id)
+    }
+
+    pub fn keep_alive(&mut self, id: Id) {
+        if self.sessions.contains_key(&id) && !self.quiesced.contains(&id) {
+            self.last_seen.insert(id, Instant::now());
+        }
+    }
+
+    // Marks a session whose handshake came over TCP, so its data address is
+    // taken from its first UDP data. That is under the session's keys, which
+    // come from nonces fresh to its handshake, and a copy is refused by
+    // number, so only the client can bind it.
+    pub fn await_udp(&mut self, id: Id) {
+        if self.sessions.contains_key(&id) {
+            self.unbound.insert(id);
+        }
+    }
+
+    // Records the UDP address of a session marked by `await_udp`, on data
+    // numbered `number` from there, if newer than any data yet. Returns
+    // whether the address was set.
+    pub fn bind(&mut self, id: Id, addr: SocketAddr, number: u64) -> bool {
+        let latest = self.sessions.get(&id).map_or(false, |s| s.received.is_latest(number));
+        if self.quiesced.contains(&id) || !latest || !self.unbound.remove(&id) {
+            return false;
+        }
+        match self.sessions.get_mut(&id) {
+            Some(session) => {
+                session.addr = addr;
+                true
+            }
+            None => false,
+        }
+    }
+
+    // Moves a session to `addr`, where its client now is, on data numbered
+    // `number` from there. Only the newest data yet moves it: older data may
+    // have been held back and sent again from elsewhere. Returns whether it
+    // moved.
+    pub fn rebind(&mut self, id: Id, addr: SocketAddr, number: u64) -> bool {
+        if self.quiesced.contains(&id) {
+            return false;
+        }
+        match self.sessions.get_mut(&id) {
+            Some(ref mut session) if session.addr != addr && session.received.is_latest(number) => {
+                session.addr = addr;
+                true
+            }
+            _ => false,
+        }
+    }
+
+    // Attributes data tagged with `connection` that arrived from `addr` to the
+    // session `id`, whichever path it took. A connection ID belongs to the
+    // first session that used it.
+    pub fn attach(&mut self,
+                  connection: ConnectionId,
+                  id: Id,
+                  addr: SocketAddr)
+                  -> Result<(), String> {
+        if !self.sessions.contains_key(&id) {
+            return Err(format!("Unknown id {} for connection {:x}.", id, connection));
+        }
+        if self.quiesced.contains(&id) {
+            return Err(format!("Id {} is quiesced.", id));
+        }
+        let owner = *self.connections.entry(connection).or_insert(id);
+        if owner != id {
+            return Err(format!("Connection {:x} belongs to id {}, not {}.", connection, owner, id));
+        }
+        let paths = self.paths.entry(id).or_insert_with(Vec::new);
+        if !paths.contains(&addr) {
+            paths.push(addr);
+        }
+        Ok(())
+    }
+
+    // Marks a session as compressing data with the preset dictionary. Not
+    // exported, so imported sessions are sent data without it.
+    pub fn use_dictionary(&mut self, id: Id) {
+        if self.sessions.contains_key(&id) && !self.quiesced.contains(&id) {
+            self.dictionary.insert(id);
+        }
+    }
+
+    pub fn uses_dictionary(&self, id: Id) -> bool {
+        self.dictionary.contains(&id)
+    }
+
+    // Marks a session as numbering its data, so the client can put what we
+    // send back in order. Not exported either.
+    pub fn use_sequencing(&mut self, id: Id) {
+        if self.sessions.contains_key(&id) && !self.quiesced.contains(&id) {
+            self.sequences.entry(id).or_insert(0);
+        }
+    }
+
+    pub fn uses_sequencing(&self, id: Id) -> bool {
+        self.sequences.contains_key(&id)
+    }
+
+    // The number of the next packet sent to a session marked by
+    // `use_sequencing`.
+    pub fn next_sequence(&mut self, id: Id) -> u64 {
+        let next = self.sequences.entry(id).or_insert(0);
+        *next += 1;
+        *next - 1
+    }
+
+    // The addresses tagged data of a session has arrived from.
+    pub fn paths(&self, id: Id) -> &[SocketAddr] {
+        self.paths.get(&id).map_or(&[], |p| p.as_slice())
+    }
+
+    pub fn len(&self) -> usize {
+        self.sessions.len()
+    }
+
+    // How many sessions fit before the table has to grow.
+    pub fn capacity(&self) -> usize {
+        self.sessions.capacity()
+    }
+
+    // Whether a packet of `bytes` to or from a session fits in its rate limit.
+    // Packets that do count towards the session's traffic. Quiesced sessions
+    // take no packets.
+    pub fn allow(&mut self, id: Id, direction: Direction, bytes: usize) -> bool {
+        if self.quiesced.contains(&id) {
+            return false;
+        }
+        let allowed = self.limiters
+            .get_mut(&id)
+            .map_or(true, |l| l.allow(direction, bytes, Instant::now()));
+        if allowed && self.sessions.contains_key(&id) {
+            let traffic = self.traffic.entry(id).or_insert((0, 0));
+            match direction {
+                Direction::Upload => traffic.0 += bytes as u64,
+                Direction::Download => traffic.1 += bytes as u64,
+            }
+        }
+        allowed
+    }
+
+    // Clears expired sessions and returns their addresses to the pool.
+    pub fn prune(&mut self) {
+        self.expire(Instant::now());
+    }
+
+    fn expire(&mut self, now: Instant) {
+        let lifetime = Duration::from_secs(SESSION_LIFETIME);
+        // Quiesced sessions see no traffic, but are not idle.
+        let expired: Vec<Id> = self.last_seen
+            .iter()
+            .filter(|&(id, &seen)| now >= seen + lifetime && !self.quiesced.contains(id))
+            .map(|(&id, _)| id)
+            .collect();
+        for id in expired {
+            self.audit(id, Event::Disconnect { reason: "expired" });
+            self.remove(id);
+        }
+    }
+
+    fn remove(&mut self, id: Id) {
+        self.sessions.remove(&id);
+        self.started.remove(&id);
+        self.traffic.remove(&id);
+        self.resumptions.remove(&id);
+        self.last_seen.remove(&id);
+        self.limiters.remove(&id);
+        self.keys.remove(&id);
+        self.unbound.remove(&id);
+        self.paths.remove(&id);
+        self.dictionary.remove(&id);
+        self.sequences.remove(&id);
+        self.uncompressed.remove(&id);
+        self.quiesced.remove(&id);
+        self.subnets.withdraw(id);
+        self.connections.retain(|_, owner| *owner != id);
+        self.pool.release(id);
+    }
+
+    // Freezes a session so it can be snapshotted for migration: it takes no
+    // more data in either direction, and neither its address, its traffic
+    // counters nor its lifetime change until it is resumed or handed off.
+    // Packets already queued for it are the caller's to flush.
+    pub fn quiesce(&mut self, id: Id) -> Result<(), String> {
+        if !self.sessions.contains_key(&id) {
+            return Err(format!("Unknown id {}.", id));
+        }
+        self.quiesced.insert(id);
+        Ok(())
+    }
+
+    pub fn is_quiesced(&self, id: Id) -> bool {
+        self.quiesced.contains(&id)
+    }
+
+    // Lets a quiesced session carry on here, e.g. if the migration failed.
+    pub fn resume(&mut self, id: Id) -> Result<(), String> {
+        if !self.quiesced.remove(&id) {
+            return Err(format!("Id {} is not quiesced.", id));
+        }
+        self.last_seen.insert(id, Instant::now());
+        Ok(())
+    }
+
+    // Gives up a quiesced session once another server has taken it over,
+    // freeing its address here.
+    pub fn hand_off(&mut self, id: Id) -> Result<(), String> {
+        if !self.quiesced.contains(&id) {
+            return Err(format!("Id {} must be quiesced before it is handed off.", id));
+        }
+        self.audit(id, Event::Disconnect { reason: "handed-off" });
+        self.remove(id);
+        Ok(())
+    }
+
+    // Ends the sessions of the client identified as `identifier`, e.g. once
+    // its pre-shared key was replaced, so their tokens stop working and it
+    // has to handshake again with the new key. Returns how many ended.
+    pub fn revoke(&mut self, identifier: &str) -> usize {
+        let ids: Vec<Id> = self.sessions
+            .iter()
+            .filter(|&(_, s)| s.identifier.as_ref().map_or(false, |i| i == identifier))
+            .map(|(&id, _)| id)
+            .collect();
+        for &id in &ids {
+            self.audit(id, Event::Disconnect { reason: "revoked" });
+            self.remove(id);
+        }
+        ids.len()
+    }
+
+    fn resumption(&self, id: Id) -> Resumption {
+        self.resumptions.get(&id).cloned().unwrap_or(Resumption {
+            issued: unix_time(),
+            uses: 0,
+        })
+    }
+
+    // Whether an imported token may be used again, or is too old or used up.
+    // The server that issued it may have been a little ahead or behind.
+    fn may_resume(&self, resumption: &Resumption) -> bool {
+        let age = unix_time().saturating_sub(resumption.issued);
+        (self.resumption_max_age == 0 || age < self.resumption_max_age + MAX_SKEW_SECS) &&
+        (self.resumption_max_uses == 0 || resumption.uses < self.resumption_max_uses)
+    }
+
+    // Records the end of every session as the server shuts down. The sessions
+    // themselves are kept, so they can still be exported.
+    pub fn record_shutdown(&mut self) {
+        let ids: Vec<Id> = self.sessions.keys().cloned().collect();
+        for id in ids {
+            self.audit(id, Event::Disconnect { reason: "shutdown" });
+        }
+    }
+
+    // Serializes all sessions so a standby server can take them over without
+    // clients having to handshake again. The state is encrypted and
+    // authenticated with a key derived from the shared secret, since the
+    // session tokens in it are enough to impersonate the clients.
+    pub fn export(&self, secret: &str) -> Result<Vec<u8>, String> {
+        seal_sessions(secret,
+                      self.sessions.iter().map(|(id, s)| (id, s, self.resumption(*id))).collect())
+    }
+
+    // Exports only the quiesced sessions, in the same format as `export`.
+    // Nothing about them changes until they are resumed, so the snapshot is
+    // consistent however long it takes to move it.
+    pub fn export_quiesced(&self, secret: &str) -> Result<Vec<u8>, String> {
+        seal_sessions(secret,
+                      self.sessions
+                          .iter()
+                          .filter(|&(id, _)| self.quiesced.contains(id))
+                          .map(|(id, s)| (id, s, self.resumption(*id)))
+                          .collect())
+    }
+
+    // Takes over sessions exported by another server. Returns how many were
+    // imported; those whose token is past its age or number of uses are left
+    // out.
+    pub fn import(&mut self, secret: &str, state: &[u8]) -> Result<usize, String> {
+        if state.len() < EXPORT_NONCE_LEN + EXPORT_TAG_LEN {
+            return Err(String::from("Session state is truncated."));
+        }
+        let keys = export_keys(secret);
+        let (nonce, sealed) = state.split_at(EXPORT_NONCE_LEN);
+        let mut sealed = sealed.to_vec();
+        let decrypted = try!(keys.open(nonce, &mut sealed)
+            .map_err(|_| "Session state was not exported with this secret or is corrupted."));
+        let sessions: Vec<(Id, Session, Resumption)> =
+            try!(deserialize(decrypted).map_err(|e| e.to_string()));
+
+        let mut count = 0;
+        for (id, session, resumption) in sessions {
+            if !self.may_resume(&resumption) {
+                info!("Token of the session for 10.10.10.{} is past its limits. Its client has \
+                       to handshake again.",
+                      id);
+                continue;
+            }
+            // The others are imported all the same, rather than leaving some
+            // imported and reporting none.
+            if !self.pool.claim(id, session.identifier.as_ref().map(|i| i.as_str())) {
+                warn!("Not importing the session for 10.10.10.{}, which conflicts with an \
+                       existing one.",
+                      id);
+                continue;
+            }
+            self.insert(id, session);
+            self.resumptions.insert(id,
+                                    Resumption {
+                                        issued: resumption.issued,
+                                        uses: resumption.uses + 1,
+                                    });
+            count += 1;
+        }
+        Ok(count)
+    }
+}
+
+// Reads the local key sealing exported sessions in place of the shared
+// secret, e.g. the output of `openssl rand -hex 32`. A trailing newline is
+// not part of it.
+pub fn read_state_key(path: &str) -> Result<String, String> {
+    let contents = try!(utils::read_file(path));
+    let key = try!(String::from_utf8(contents)
+        .map_err(|_| format!("{}: State keys must be text, e.g. hex.", path)));
+    let key = key.trim_right_matches(|c| c == '\n' || c == '\r');
+    if key.len() < MIN_STATE_KEY_LEN {
+        return Err(format!("{}: State keys must be at least {} bytes long.",
+                           path,
+                           MIN_STATE_KEY_LEN));
+    }
+    Ok(String::from(key))
+}
+
+// Exported state has keys of its own, with a salt of its own, so they never
+// coincide with those of handshakes.
+fn export_keys(secret: &str) -> MemoryKeyStore {
+    MemoryKeyStore::new(KeySchedule::from_password(secret, EXPORT_SALT), "session state")
+}
+
+fn seal_sessions(secret: &str,
+                 sessions: Vec<(&Id, &Session, Resumption)>)
+                 -> Result<Vec<u8>, String> {
+    let mut sealed = try!(serialize(&sessions, Infinite).map_err(|e| e.to_string()));
+
+    let keys = export_keys(secret);
+    let mut nonce = [0u8; EXPORT_NONCE_LEN];
+    try!(SystemRandom::new().fill(&mut nonce).map_err(|_| "SystemRandom::fill"));
+
+    try!(keys.seal(&nonce, &mut sealed));
+
+    let mut state = nonce.to_vec();
+    state.extend_from_slice(&sealed);
+    Ok(state)
+}
+
+#[cfg(test)]
+mod tests {
+    use std::net::SocketAddr;
+    use std::time::{Duration, Instant};
+    use config;
+    use network::Message;
+    use session::*;
+
+    #[test]
+    fn accept_test() {
+        let mut table = SessionTable::new(&Default::default()).unwrap();
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        match table.accept(None, addr).unwrap() {
+            Message::Response { id, token, mtu, compression: true, dictionary: false, .. } => {
+                assert_eq!(id, 253);
+                assert_eq!(mtu, config::ServerConfig::default().mtu);
+                let session = table.get(id).unwrap();
+                assert_eq!(session.token, token);
+                assert_eq!(session.addr, addr);
+            }
+            msg => panic!("Unexpected message {:?}", msg),
+        }
+        assert!(table.get(252).is_none());
+        assert_eq!(table.len(), 1);
+
+        // Clients are told the prefix of their link.
+        let config = config::Config::parse("[server]\nlink_prefix = 31").unwrap();
+        let mut table = SessionTable::new(&config.server).unwrap();
+        match table.accept(None, addr).unwrap() {
+            Message::Response { id: 253, link_prefix: 31, .. } => {}
+            msg => panic!("Unexpected message {:?}", msg),
+        }
+    }
+
+    #[test]
+    fn peek_test() {
+        let mut table = SessionTable::new(&Default::default()).unwrap();
+        table.accept(None, "192.0.2.1:5000".parse().unwrap()).unwrap();
+        let lifetime = Duration::from_secs(SESSION_LIFETIME);
+        table.last_seen.insert(253, Instant::now() - lifetime);
+        assert!(table.peek(253).is_some());
+        table.expire(Instant::now());
+        assert!(table.peek(253).is_none());
+        assert_eq!(table.len(), 0);
+    }
+
+    #[test]
+    fn per_client_mtu_test() {
+        let config = config::Config::parse(r#"
+            [server]
+            mtu = 1400
+
+            [server.mtus]
+            laptop = 1280
+        "#)
+            .unwrap();
+        let mut table = SessionTable::new(&config.server).unwrap();
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+
+        let mtu_of = |msg: Message| match msg {
+            Message::Response { mtu, .. } => mtu,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        assert_eq!(mtu_of(table.accept(Some("laptop"), addr).unwrap()), 1280);
+        assert_eq!(mtu_of(table.accept(Some("phone"), addr).unwrap()), 1400);
+        assert_eq!(mtu_of(table.accept(None, addr).unwrap()), 1400);
+    }
+
+    #[test]
+    fn downstream_mtu_test() {
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        let id_of = |msg: Message| match msg {
+            Message::Response { id, .. } => id,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        let mut table = SessionTable::new(&Default::default()).unwrap();
+        let id = id_of(table.accept(None, addr).unwrap());
+        assert_eq!(table.downstream_mtu(id), None);
+
+        let config = config::Config::parse(r#"
+            [server]
+            downstream_mtu = 1300
+            [server.downstream_mtus]
+            phone = 1200
+        "#)
+            .unwrap();
+        let mut table = SessionTable::new(&config.server).unwrap();
+        let phone = id_of(table.accept(Some("phone"), addr).unwrap());
+        let laptop = id_of(table.accept(Some("laptop"), addr).unwrap());
+        assert_eq!(table.downstream_mtu(phone), Some(1200));
+        assert_eq!(table.downstream_mtu(laptop), Some(1300));
+    }
+
+    #[test]
+    fn attach_test() {
+        let mut table = SessionTable::new(&Default::default()).unwrap();
+        let wifi: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        let cellular: SocketAddr = "198.51.100.7:6000".parse().unwrap();
+        let id_of = |reply| match reply {
+            Message::Response { id, .. } => id,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        let id = id_of(table.accept(None, wifi).unwrap());
+        let other = id_of(table.accept(None, cellular).unwrap());
+
+        table.attach(0xabcd, id, wifi).unwrap();
+        table.attach(0xabcd, id, cellular).unwrap();
+        table.attach(0xabcd, id, wifi).unwrap();
+        assert_eq!(table.paths(id), &[wifi, cellular]);
+        assert!(table.attach(0xabcd, other, cellular).is_err());
+        assert!(table.paths(other).is_empty());
+        assert!(table.attach(0x1234, 200, wifi).is_err());
+    }
+
+    #[test]
+    fn profile_test() {
+        let config = config::Config::parse(r#"
+            [server.profiles.sensor]
+            min_cipher = "aes-128-gcm"
+            compression = false
+        "#)
+            .unwrap();
+        let mut table = SessionTable::new(&config.server).unwrap();
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        assert_eq!(table.profile(Some("sensor")).min_cipher,
+                   Some(::cipher::Cipher::Aes128Gcm));
+        assert_eq!(table.profile(Some("laptop")), config::Profile::default());
+        let id = match table.accept(Some("sensor"), addr).unwrap() {
+            Message::Response { id, compression: false, .. } => id,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        assert!(!table.uses_compression(id));
+        let other = match table.accept(Some("laptop"), addr).unwrap() {
+            Message::Response { id, compression: true, .. } => id,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        assert!(table.uses_compression(other));
+    }
+
+    #[test]
+    fn sequencing_test() {
+        let mut table = SessionTable::new(&Default::default()).unwrap();
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        let id = match table.accept(None, addr).unwrap() {
+            Message::Response { id, .. } => id,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        assert!(!table.uses_sequencing(id));
+        table.use_sequencing(id);
+        table.use_sequencing(200);
+        assert!(table.uses_sequencing(id));
+        assert!(!table.uses_sequencing(200));
+        assert_eq!((table.next_sequence(id), table.next_sequence(id)), (0, 1));
+        // Marking it again does not start over.
+        table.use_sequencing(id);
+        assert_eq!(table.next_sequence(id), 2);
+    }
+
+    #[test]
+    fn bind_test() {
+        let mut table = SessionTable::new(&Default::default()).unwrap();
+        let tcp_addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        let udp_addr: SocketAddr = "192.0.2.1:6000".parse().unwrap();
+        let id = match table.accept(None, tcp_addr).unwrap() {
+            Message::Response { id, .. } => id,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        assert!(table.sessions.get_mut(&id).unwrap().received.accept(1));
+        assert!(table.sessions.get_mut(&id).unwrap().received.accept(0));
+        assert!(!table.bind(id, udp_addr, 1));
+        table.await_udp(id);
+        // Older data, held back and sent from elsewhere, binds nothing,
+        assert!(!table.bind(id, tcp_addr, 0));
+        assert!(table.bind(id, udp_addr, 1));
+        assert_eq!(table.get(id).unwrap().addr, udp_addr);
+        // and the address is set once.
+        assert!(table.sessions.get_mut(&id).unwrap().received.accept(2));
+        assert!(!table.bind(id, tcp_addr, 2));
+        assert_eq!(table.get(id).unwrap().addr, udp_addr);
+    }
+
+    #[test]
+    fn rebind_test() {
+        let mut table = SessionTable::new(&Default::default()).unwrap();
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        let rebound: SocketAddr = "192.0.2.1:6000".parse().unwrap();
+        table.accept(None, addr).unwrap();
+        {
+            let received = &mut table.sessions.get_mut(&253).unwrap().received;
+            assert!(received.accept(1));
+            assert!(received.accept(0));
+        }
+        assert!(!table.rebind(253, addr, 1));
+        // Data older than the newest, though fresh, leaves it in place.
+        assert!(!table.rebind(253, rebound, 0));
+        assert!(table.rebind(253, rebound, 1));
+        assert_eq!(table.get(253).unwrap().addr, rebound);
+        assert!(!table.rebind(252, rebound, 1));
+        // Quiesced sessions stay where they are until resumed.
+        table.quiesce(253).unwrap();
+        assert!(!table.rebind(253, addr, 1));
+        assert_eq!(table.peek(253).unwrap().addr, rebound);
+    }
+
+    #[test]
+    fn per_client_rate_limit_test() {
+        let config = config::Config::parse(r#"
+            [server.rate_limits.laptop]
+            upload = 2000
+        "#)
+            .unwrap();
+        let mut table = SessionTable::new(&config.server).unwrap();
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        let id_of = |msg: Message| match msg {
+            Message::Response { id, .. } => id,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        let laptop = id_of(table.accept(Some("laptop"), addr).unwrap());
+        let phone = id_of(table.accept(Some("phone"), addr).unwrap());
+
+        assert!(table.allow(laptop, Direction::Upload, 1500));
+        assert!(!table.allow(laptop, Direction::Upload, 1500));
+        assert!(table.allow(laptop, Direction::Download, 1500));
+        assert!((0..10).all(|_| table.allow(phone, Direction::Upload, 1500)));
+    }
+
+    #[test]
+    fn audit_test() {
+        use std::env;
+        use std::fs;
+        use std::time::{Duration, Instant};
+        use rand;
+        use audit;
+        use utils;
+
+        let path = env::temp_dir().join(format!("kytan-audit-{}.log", rand::random::<u32>()));
+        let path = path.to_str().unwrap();
+        let config = config::Config::parse(&format!("[server]\naudit_log = {:?}", path)).unwrap();
+        let mut table = SessionTable::new(&config.server).unwrap();
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        let id = match table.accept(Some("laptop"), addr).unwrap() {
+            Message::Response { id, .. } => id,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        assert!(table.allow(id, Direction::Upload, 1000));
+        assert!(table.allow(id, Direction::Download, 3000));
+        table.expire(Instant::now() + Duration::from_secs(SESSION_LIFETIME));
+        assert_eq!(table.len(), 0);
+
+        let contents = String::from_utf8(utils::read_file(path).unwrap()).unwrap();
+        assert_eq!(audit::verify(&contents).unwrap().0, 2);
+        let lines: Vec<&str> = contents.lines().collect();
+        let fields = format!("identifier=\"laptop\" source=192.0.2.1:5000 address=10.10.10.{} \
+                              cipher=aes-256-gcm",
+                             id);
+        assert!(lines[0].contains(&format!("event=connect {} rx_bytes=0 tx_bytes=0 \
+                                            duration_ms=0",
+                                           fields)),
+                "{}",
+                lines[0]);
+        assert!(lines[1].contains(&format!("event=disconnect reason=expired {} rx_bytes=1000 \
+                                            tx_bytes=3000 duration_ms=",
+                                           fields)),
+                "{}",
+                lines[1]);
+        fs::remove_file(path).unwrap();
+    }
+
+    #[test]
+    fn import_conflict_test() {
+        let mut primary = SessionTable::new(&Default::default()).unwrap();
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        primary.accept(Some("laptop"), addr).unwrap();
+        primary.accept(None, addr).unwrap();
+        let state = primary.export("password").unwrap();
+
+        // The standby handed out 10.10.10.253 itself in the meantime.
+        let mut standby = SessionTable::new(&Default::default()).unwrap();
+        let other: SocketAddr = "198.51.100.7:6000".parse().unwrap();
+        standby.accept(None, other).unwrap();
+        assert_eq!(standby.import("password", &state).unwrap(), 1);
+        assert_eq!(standby.peek(253).unwrap().addr, other);
+        assert_eq!(standby.peek(252), primary.peek(252));
+    }
+
+    #[test]
+    fn export_import_test() {
+        let mut primary = SessionTable::new(&Default::default()).unwrap();
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        primary.accept(Some("laptop"), addr).unwrap();
+        primary.accept(None, addr).unwrap();
+        let state = primary.export("password").unwrap();
+
+        let mut standby = SessionTable::new(&Default::default()).unwrap();
+        assert!(standby.import("wrong", &state).is_err());
+        assert_eq!(standby.import("password", &state).unwrap(), 2);
+
+        // Data with the tokens handed out by the primary is accepted.
+        for id in &[253, 252] {
+            assert_eq!(standby.get(*id), primary.get(*id));
+        }
+
+        // Imported addresses are not handed to new clients.
+        match standby.accept(None, addr).unwrap() {
+            Message::Response { id, .. } => assert_eq!(id, 251),
+            msg => panic!("Unexpected message {:?}", msg),
+        }
+    }
+
+    #[test]
+    fn session_keys_test() {
+        use network;
+
+        let keys = network::derive_keys("password");
+        let mut sessions = SessionTable::new(&Default::default()).unwrap();
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        let (id, token) = match sessions.accept(None, addr).unwrap() {
+            Message::Response { id, token, .. } => (id, token),
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        let nonces = sessions.pick_nonces(id, [1; 16]).unwrap();
+        assert_eq!(nonces.0, [1; 16]);
+        let client = network::session_keys(&keys, cipher::DEFAULT, &nonces, true).unwrap();
+        let msg = Message::Data {
+            id: id,
+            token: token,
+            connection: None,
+            sequence: None,
+            encoding: network::Encoding::Plain,
+            data: b"hello".to_vec(),
+        };
+
+        // Each direction has its keys, and numbers its data itself.
+        let mut sealed = sessions.seal(id, &keys, &msg).unwrap();
+        let second = sessions.seal(id, &keys, &msg).unwrap();
+        assert_eq!(network::split_datagram(&second).unwrap().0,
+                   network::Header::Data(id, 1));
+        assert_eq!(network::open_datagram(&*client, &mut sealed).unwrap(), msg);
+        let mut datagram = network::seal_data(&*client, 5, &msg).unwrap();
+        let replayed = datagram.clone();
+        assert_eq!(sessions.open(id, &keys, 5, &mut datagram[10..]).unwrap(), msg);
+        assert!(sessions.open(id, &keys, 5, &mut replayed.clone()[10..]).is_err());
+
+        // The window and counters go along with an exported session.
+        let mut standby = SessionTable::new(&Default::default()).unwrap();
+        standby.import("password", &sessions.export("password").unwrap()).unwrap();
+        assert!(standby.open(id, &keys, 5, &mut replayed.clone()[10..]).is_err());
+        let mut datagram = network::seal_data(&*client, 6, &msg).unwrap();
+        assert_eq!(standby.open(id, &keys, 6, &mut datagram[10..]).unwrap(), msg);
+        let mut sealed = standby.seal(id, &keys, &msg).unwrap();
+        assert_eq!(network::split_datagram(&sealed).unwrap().0,
+                   network::Header::Data(id, 2));
+        assert_eq!(network::open_datagram(&*client, &mut sealed).unwrap(), msg);
+
+        // New nonces for the session mean new keys.
+        sessions.pick_nonces(id, [2; 16]).unwrap();
+        let mut datagram = network::seal_data(&*client, 7, &msg).unwrap();
+        assert!(sessions.open(id, &keys, 7, &mut datagram[10..]).is_err());
+    }
+
+    #[test]
+    fn quiesce_test() {
+        use std::time::{Duration, Instant};
+
+        let config = config::Config::parse(r#"
+            [server.reservations]
+            laptop = "10.10.10.20"
+        "#)
+            .unwrap();
+        let mut table = SessionTable::new(&config.server).unwrap();
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        let id = match table.accept(Some("laptop"), addr).unwrap() {
+            Message::Response { id, .. } => id,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        let other = match table.accept(None, addr).unwrap() {
+            Message::Response { id, .. } => id,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        table.await_udp(id);
+        assert!(table.allow(id, Direction::Upload, 1000));
+        table.quiesce(id).unwrap();
+        assert!(table.quiesce(200).is_err());
+        let before = table.export_quiesced("password").unwrap();
+
+        // Nothing a client sends changes a quiesced session.
+        assert!(!table.allow(id, Direction::Upload, 1000));
+        assert!(!table.allow(id, Direction::Download, 1000));
+        assert!(!table.bind(id, "192.0.2.1:6000".parse().unwrap(), 0));
+        assert!(table.attach(0xabcd, id, addr).is_err());
+        table.use_dictionary(id);
+        assert!(table.accept(Some("laptop"), "198.51.100.7:6000".parse().unwrap()).is_err());
+        table.expire(Instant::now() + Duration::from_secs(SESSION_LIFETIME));
+        assert_eq!(table.get(other), None);
+        assert_eq!(table.traffic.get(&id), Some(&(1000, 0)));
+        let after = table.export_quiesced("password").unwrap();
+
+        let mut first = SessionTable::new(&config.server).unwrap();
+        let mut second = SessionTable::new(&config.server).unwrap();
+        assert_eq!(first.import("password", &before).unwrap(), 1);
+        assert_eq!(second.import("password", &after).unwrap(), 1);
+        assert_eq!(first.get(id), table.get(id));
+        assert_eq!(second.get(id), table.get(id));
+        assert!(!first.uses_dictionary(id));
+
+        // Handed off, the session and its address are gone from here.
+        assert!(table.hand_off(other).is_err());
+        table.hand_off(id).unwrap();
+        assert_eq!(table.len(), 0);
+        assert!(table.resume(id).is_err());
+        assert!(table.accept(Some("laptop"), addr).is_ok());
+    }
+
+    #[test]
+    fn resume_test() {
+        let mut table = SessionTable::new(&Default::default()).unwrap();
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        let id = match table.accept(None, addr).unwrap() {
+            Message::Response { id, .. } => id,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        table.quiesce(id).unwrap();
+        assert!(table.is_quiesced(id));
+        table.resume(id).unwrap();
+        assert!(!table.is_quiesced(id));
+        assert!(table.allow(id, Direction::Upload, 1000));
+        assert!(table.export_quiesced("password").is_ok());
+    }
+
+    #[test]
+    fn resumption_limits_test() {
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        let config = config::Config::parse("[server]\nresumption_max_age_secs = 3600\n\
+                                            resumption_max_uses = 2")
+            .unwrap();
+        let mut table = SessionTable::new(&config.server).unwrap();
+        let laptop = match table.accept(Some("laptop"), addr).unwrap() {
+            Message::Response { id, .. } => id,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        let phone = match table.accept(Some("phone"), addr).unwrap() {
+            Message::Response { id, .. } => id,
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        // The phone's token was issued long ago, even allowing for skew.
+        table.resumptions.get_mut(&phone).unwrap().issued -= 3600 + MAX_SKEW_SECS;
+
+        let mut state = table.export("password").unwrap();
+        for uses in 1..3 {
+            let mut standby = SessionTable::new(&config.server).unwrap();
+            assert_eq!(standby.import("password", &state).unwrap(), 1);
+            assert!(standby.peek(phone).is_none());
+            assert_eq!(standby.resumption(laptop).uses, uses);
+            state = standby.export("password").unwrap();
+        }
+        // Used up: the laptop has to handshake again, and can.
+        let mut standby = SessionTable::new(&config.server).unwrap();
+        assert_eq!(standby.import("password", &state).unwrap(), 0);
+        assert!(standby.peek(laptop).is_none());
+        match standby.accept(Some("laptop"), addr).unwrap() {
+            Message::Response { id, .. } => assert_eq!(standby.resumption(id).uses, 0),
+            msg => panic!("Unexpected message {:?}", msg),
+        }
+
+        // Without limits, tokens are resumed however old.
+        let mut unlimited = SessionTable::new(&Default::default()).unwrap();
+        assert_eq!(unlimited.import("password", &table.export("password").unwrap()).unwrap(),
+                   2);
+    }
+
+    #[test]
+    fn clock_skew_test() {
+        use std::time::{Duration, Instant};
+
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        let config = config::Config::parse("[server]\nresumption_max_age_secs = 3600").unwrap();
+        // Tokens from a primary whose clock is off by up to MAX_SKEW_SECS
+        // either way, even those nearly as old as allowed, are resumed.
+        let skew = MAX_SKEW_SECS as i64;
+        for &(offset, age) in &[(skew, 0), (-skew, 0), (skew, 3590), (-skew, 3590)] {
+            let mut primary = SessionTable::new(&config.server).unwrap();
+            let id = match primary.accept(Some("laptop"), addr).unwrap() {
+                Message::Response { id, .. } => id,
+                msg => panic!("Unexpected message {:?}", msg),
+            };
+            let issued = unix_time() as i64 + offset - age;
+            primary.resumptions.get_mut(&id).unwrap().issued = issued as u64;
+
+            let mut standby = SessionTable::new(&config.server).unwrap();
+            assert_eq!(standby.import("password", &primary.export("password").unwrap())
+                           .unwrap(),
+                       1);
+            // Lifetimes go by the monotonic clock, which skew leaves alone.
+            standby.expire(Instant::now());
+            assert!(standby.peek(id).is_some());
+            standby.expire(Instant::now() + Duration::from_secs(SESSION_LIFETIME));
+            assert!(standby.peek(id).is_none());
+        }
+    }
+
+    #[test]
+    fn revoke_test() {
+        let mut table = SessionTable::new(&Default::default()).unwrap();
+        let addr: SocketAddr = "192.0.2.1:5000".parse().unwrap();
+        table.accept(Some("laptop"), addr).unwrap();
+        table.accept(Some("phone"), addr).unwrap();
+        table.accept(None, addr).unwrap();
+        assert_eq!(table.revoke("laptop"), 1);
+        assert_eq!(table.revoke("laptop"), 0);
+        assert_eq!(table.len(), 2);
+        assert!(table.accept(Some("laptop"), addr).is_ok());
+    }
+
+    #[test]
+    fn import_tampered_test() {
+        let mut primary = SessionTable::new(&Default::default()).unwrap();
+        primary.accept(None, "192.0.2.1:5000".parse().unwrap()).unwrap();
+        let mut state = primary.export("password").unwrap();
+        let last = state.len() - 1;
+        state[last] ^= 1;
+
+        let mut standby = SessionTable::new(&Default::default()).unwrap();
+        assert!(standby.import("password", &state).is_err());
+        assert!(standby.import("password", &state[..4]).is_err());
+        assert_eq!(standby.len(), 0);
+    }
+
+    #[test]
+    fn state_key_test() {
+        use std::env;
+        use std::fs;
+        use rand;
+        use utils;
+
+        let path = env::temp_dir().join(format!("kytan-state-key-{}", rand::random::<u32>()));
+        let path = path.to_str().unwrap();
+        utils::write_private_file(path, b"0123456789abcdef0123456789abcdef\n").unwrap();
+        let key = read_state_key(path).unwrap();
+        assert_eq!(key, "0123456789abcdef0123456789abcdef");
+
+        let mut primary = SessionTable::new(&Default::default()).unwrap();
+        primary.accept(None, "192.0.2.1:5000".parse().unwrap()).unwrap();
+        let mut state = primary.export(&key).unwrap();
+        let mut standby = SessionTable::new(&Default::default()).unwrap();
+        assert!(standby.import("password", &state).is_err());
+        assert_eq!(standby.import(&key, &state).unwrap(), 1);
+        state[EXPORT_NONCE_LEN] ^= 1;
+        assert!(SessionTable::new(&Default::default()).unwrap().import(&key, &state).is_err());
+
+        utils::write_private_file(path, b"short\n").unwrap();
+        assert!(read_state_key(path).is_err());
+        fs::remove_file(path).unwrap();
+    }
+}
@@ -0,0 +1,1168 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// A SOCKS5 proxy (RFC 1928) whose connections leave through the tunnel, for
+// applications to use the VPN one by one instead of through the routing
+// table. Connections are carried by a minimal TCP of our own, and datagrams
+// of UDP associations wrapped in IP packets, from the tunnel's inner
+// address; no TUN device is needed. Hostnames are looked up through the
+// tunnel too.
+
+use std::cmp;
+use std::collections::{HashMap, VecDeque};
+use std::io::{self, Read, Write};
+use std::net::{Ipv4Addr, Shutdown, SocketAddr, SocketAddrV4};
+use std::os::unix::io::AsRawFd;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::{Duration, Instant};
+use mio;
+use rand;
+use device::PacketIO;
+use dns;
+use network;
+use packet;
+use stack::{State, TcpConnection};
+
+const VERSION: u8 = 5;
+const METHOD_NONE: u8 = 0;
+const METHOD_UNACCEPTABLE: u8 = 0xff;
+const COMMAND_CONNECT: u8 = 1;
+const COMMAND_UDP_ASSOCIATE: u8 = 3;
+const ADDRESS_IPV4: u8 = 1;
+const ADDRESS_DOMAIN: u8 = 3;
+const ADDRESS_IPV6: u8 = 4;
+const REPLY_SUCCEEDED: u8 = 0;
+const REPLY_FAILURE: u8 = 1;
+const REPLY_HOST_UNREACHABLE: u8 = 4;
+const REPLY_CONNECTION_REFUSED: u8 = 5;
+const REPLY_COMMAND_UNSUPPORTED: u8 = 7;
+const REPLY_ADDRESS_UNSUPPORTED: u8 = 8;
+
+// Tokens of our own, counted from the first one we are given.
+const LISTENER: usize = 0;
+const RELAY: usize = 1;
+const FIRST_CLIENT: usize = 2;
+// Connections are looked at this often for retransmissions, even when
+// nothing else happens.
+pub const TICK_MS: u64 = 50;
+const DNS_PORT: u16 = 53;
+// A lookup is sent again after this long without an answer, until it was
+// sent this many times.
+const LOOKUP_RETRY_MS: u64 = 1000;
+const LOOKUP_ATTEMPTS: u32 = 3;
+// How long looked up names are remembered, whatever their TTL.
+const NAME_TTL_SECS: u64 = 60;
+const MAX_NAMES: usize = 1024;
+// Bytes buffered from an application before we stop reading from it.
+const CLIENT_BUFFER: usize = 64 * 1024;
+// Inner ports are taken from here up, for connections and associations.
+const FIRST_PORT: u16 = 49152;
+
+#[derive(Debug, PartialEq)]
+enum Target {
+    Ip(SocketAddrV4),
+    Domain(String, u16),
+}
+
+fn be16(buf: &[u8]) -> u16 {
+    ((buf[0] as u16) << 8) | buf[1] as u16
+}
+
+// Parses an address as found in requests and UDP headers: its type, the
+// address itself and the port. Returns the target and the bytes it took, None
+// if more are needed, or the reply code to refuse it with.
+fn parse_address(buf: &[u8]) -> Result<Option<(Target, usize)>, u8> {
+    let len = match buf.first() {
+        Some(&ADDRESS_IPV4) => 1 + 4 + 2,
+        Some(&ADDRESS_DOMAIN) => {
+            match buf.get(1) {
+                Some(&name_len) => 2 + name_len as usize + 2,
+                None => return Ok(None),
+            }
+        }
+        // The tunnel only carries IPv4.
+        Some(&ADDRESS_IPV6) => return Err(REPLY_ADDRESS_UNSUPPORTED),
+        Some(_) => return Err(REPLY_ADDRESS_UNSUPPORTED),
+        None => return Ok(None),
+    };
+    if buf.len() < len {
+        return Ok(None);
+    }
+    let port = be16(&buf[len - 2..len]);
+    let target = if buf[0] == ADDRESS_IPV4 {
+        Target::Ip(SocketAddrV4::new(Ipv4Addr::new(buf[1], buf[2], buf[3], buf[4]), port))
+    } else {
+        Target::Domain(String::from_utf8_lossy(&buf[2..len - 2]).into_owned(), port)
+    };
+    Ok(Some((target, len)))
+}
+
+fn encode_address(address: &SocketAddrV4) -> Vec<u8> {
+    let mut encoded = vec![ADDRESS_IPV4];
+    encoded.extend_from_slice(&address.ip().octets());
+    encoded.extend_from_slice(&[(address.port() >> 8) as u8, address.port() as u8]);
+    encoded
+}
+
+// Parses the methods a client offers. Returns the bytes they took and whether
+// going without authentication is among them, or None if more are needed.
+fn parse_greeting(buf: &[u8]) -> Result<Option<(usize, bool)>, String> {
+    if buf.len() < 2 {
+        return Ok(None);
+    }
+    if buf[0] != VERSION {
+        return Err(format!("Unsupported SOCKS version {}.", buf[0]));
+    }
+    let len = 2 + buf[1] as usize;
+    if buf.len() < len {
+        return Ok(None);
+    }
+    Ok(Some((len, buf[2..len].contains(&METHOD_NONE))))
+}
+
+// Parses a request into its command and target, and the bytes it took.
+fn parse_request(buf: &[u8]) -> Result<Option<(u8, Target, usize)>, u8> {
+    if buf.len() < 3 {
+        return Ok(None);
+    }
+    if buf[0] != VERSION {
+        return Err(REPLY_FAILURE);
+    }
+    Ok(try!(parse_address(&buf[3..])).map(|(target, len)| (buf[1], target, 3 + len)))
+}
+
+fn reply(code: u8, bound: &SocketAddrV4) -> Vec<u8> {
+    let mut reply = vec![VERSION, code, 0];
+    reply.extend(encode_address(bound));
+    reply
+}
+
+fn unspecified() -> SocketAddrV4 {
+    SocketAddrV4::new(Ipv4Addr::new(0, 0, 0, 0), 0)
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+enum Phase {
+    Greeting,
+    Request,
+    // Waiting for the address of the host to connect to.
+    Resolving,
+    Connecting,
+    Connected,
+    Associated,
+    // Refused; what is left for the application is sent before hanging up.
+    Closing,
+}
+
+struct Client {
+    stream: mio::net::TcpStream,
+    peer: SocketAddr,
+    phase: Phase,
+    // Read from the application and not handled yet, and waiting to be
+    // written to it.
+    input: Vec<u8>,
+    output: Vec<u8>,
+    eof: bool,
+    broken: bool,
+    shut_down: bool,
+    tcp: Option<TcpConnection>,
+    // The inner port of its connection or association.
+    port: Option<u16>,
+    // Where the application sends its datagrams from, once it did.
+    udp_peer: Option<SocketAddr>,
+    // Where to connect to, or None if the host could not be looked up, once
+    // the lookup is done.
+    resolved: Option<Option<SocketAddrV4>>,
+    interest: mio::Ready,
+}
+
+// A hostname being looked up for a client, asking from an inner port of its
+// own.
+struct Lookup {
+    token: usize,
+    id: u16,
+    name: String,
+    // The port to connect or send to there.
+    port: u16,
+    // For UDP associations, the payload of the datagram waiting for it.
+    datagram: Option<Vec<u8>>,
+    packet: Vec<u8>,
+    sent: Instant,
+    attempts: u32,
+}
+
+impl Client {
+    fn fill(&mut self) {
+        let mut buf = [0u8; 16384];
+        while !self.eof && self.input.len() < CLIENT_BUFFER {
+            match self.stream.read(&mut buf) {
+                Ok(0) => self.eof = true,
+                Ok(len) => self.input.extend_from_slice(&buf[..len]),
+                Err(ref e) if e.kind() == io::ErrorKind::WouldBlock => return,
+                Err(e) => {
+                    debug!("SOCKS client {} failed: {}", self.peer, e);
+                    self.eof = true;
+                    self.broken = true;
+                }
+            }
+        }
+    }
+
+    fn flush(&mut self) {
+        while !self.output.is_empty() && !self.broken {
+            match self.stream.write(&self.output) {
+                Ok(len) => {
+                    self.output.drain(..len);
+                }
+                Err(ref e) if e.kind() == io::ErrorKind::WouldBlock => return,
+                Err(e) => {
+                    debug!("SOCKS client {} failed: {}", self.peer, e);
+                    self.broken = true;
+                }
+            }
+        }
+    }
+}
+
+// Serves SOCKS clients alongside whatever else is polled. Like a TUN device,
+// it is written the packets from the tunnel for its connections and read
+// those they send through it.
+pub struct Proxy {
+    address: Ipv4Addr,
+    mss: u16,
+    resolver: SocketAddrV4,
+    listener: mio::net::TcpListener,
+    // Relays the datagrams of every UDP association.
+    relay: mio::net::UdpSocket,
+    first_token: usize,
+    clients: HashMap<usize, Client>,
+    // Which client each inner port belongs to.
+    ports: HashMap<u16, usize>,
+    // By the inner port they ask from.
+    lookups: HashMap<u16, Lookup>,
+    names: HashMap<String, (Ipv4Addr, Instant)>,
+    next_token: usize,
+    next_port: u16,
+    // Sent by connections, to be read.
+    queue: VecDeque<Vec<u8>>,
+}
+
+impl Proxy {
+    // Listens for SOCKS clients on `listen`, reaching destinations from
+    // `address`, the tunnel's inner address, in packets no larger than `mtu`.
+    // Hostnames are looked up by asking `resolver`.
+    pub fn new(address: Ipv4Addr,
+               mtu: u16,
+               listen: &SocketAddr,
+               resolver: Ipv4Addr)
+               -> io::Result<Proxy> {
+        let listener = try!(mio::net::TcpListener::bind(listen));
+        let relay = try!(mio::net::UdpSocket::bind(&SocketAddr::new(listen.ip(), 0)));
+        Ok(Proxy {
+            address: address,
+            // Room for the IP and TCP headers.
+            mss: mtu - 40,
+            resolver: SocketAddrV4::new(resolver, DNS_PORT),
+            listener: listener,
+            relay: relay,
+            first_token: 0,
+            clients: HashMap::new(),
+            ports: HashMap::new(),
+            lookups: HashMap::new(),
+            names: HashMap::new(),
+            next_token: 0,
+            next_port: FIRST_PORT,
+            queue: VecDeque::new(),
+        })
+    }
+
+    pub fn local_addr(&self) -> io::Result<SocketAddr> {
+        self.listener.local_addr()
+    }
+
+    // Has `poll` wait for clients too, under tokens from `first` up.
+    pub fn register(&mut self, poll: &mio::Poll, first: usize) -> io::Result<()> {
+        try!(poll.register(&self.listener,
+                           mio::Token(first + LISTENER),
+                           mio::Ready::readable(),
+                           mio::PollOpt::level()));
+        try!(poll.register(&self.relay,
+                           mio::Token(first + RELAY),
+                           mio::Ready::readable(),
+                           mio::PollOpt::level()));
+        self.first_token = first;
+        self.next_token = first + FIRST_CLIENT;
+        Ok(())
+    }
+
+    // Handles an event of `poll` for one of our tokens.
+    pub fn ready(&mut self, poll: &mio::Poll, token: mio::Token, readiness: mio::Ready) {
+        match token.0.wrapping_sub(self.first_token) {
+            LISTENER => self.accept(poll),
+            RELAY => {
+                let mut out = Vec::new();
+                self.read_relay(Instant::now(), &mut out);
+                self.queue.extend(out);
+            }
+            _ => {
+                if let Some(client) = self.clients.get_mut(&token.0) {
+                    if readiness.is_readable() {
+                        client.fill();
+                    }
+                }
+            }
+        }
+    }
+
+    // Moves connections and lookups along, after events and at least every
+    // TICK_MS.
+    pub fn service(&mut self, poll: &mio::Poll, now: Instant) {
+        let mut out = Vec::new();
+        self.retry_lookups(now, &mut out);
+        let tokens: Vec<usize> = self.clients.keys().cloned().collect();
+        for token in tokens {
+            let mut client = self.clients.remove(&token).unwrap();
+            if self.advance(poll, token, &mut client, now, &mut out) {
+                self.clients.insert(token, client);
+                continue;
+            }
+            debug!("SOCKS client {} done.", client.peer);
+            if let Some(ref mut tcp) = client.tcp {
+                tcp.abort(&mut out);
+            }
+            self.ports.retain(|_, t| *t != token);
+            self.lookups.retain(|_, l| l.token != token);
+            let _ = poll.deregister(&client.stream);
+        }
+        self.queue.extend(out);
+    }
+
+    // For new connections.
+    pub fn set_mtu(&mut self, mtu: u16) {
+        self.mss = mtu - 40;
+    }
+
+    // Moves to a new inner address, losing the clients of the old one.
+    pub fn set_address(&mut self, address: Ipv4Addr) {
+        if address != self.address {
+            self.address = address;
+            self.clients.clear();
+            self.ports.clear();
+            self.lookups.clear();
+        }
+    }
+
+    // Resets every connection, e.g. before shutting down.
+    pub fn close(&mut self) {
+        let mut out = Vec::new();
+        for client in self.clients.values_mut() {
+            if let Some(ref mut tcp) = client.tcp {
+                tcp.abort(&mut out);
+            }
+        }
+        self.queue.extend(out);
+    }
+
+    // Serves clients through `tunnel` until `stop` is set, then resets the
+    // connections left. Reading from `tunnel` must not block, or only
+    // briefly.
+    pub fn run<T: PacketIO + AsRawFd>(&mut self,
+                                      tunnel: &mut T,
+                                      stop: &AtomicBool)
+                                      -> io::Result<()> {
+        let poll = try!(mio::Poll::new());
+        let tunnel_fd = tunnel.as_raw_fd();
+        try!(poll.register(&mio::unix::EventedFd(&tunnel_fd),
+                           mio::Token(0),
+                           mio::Ready::readable(),
+                           mio::PollOpt::level()));
+        try!(self.register(&poll, 1));
+        let mut events = mio::Events::with_capacity(1024);
+        let mut buf = [0u8; 1600];
+        while !stop.load(Ordering::Relaxed) {
+            try!(poll.poll(&mut events, Some(Duration::from_millis(TICK_MS))));
+            for event in events.iter() {
+                if event.token() != mio::Token(0) {
+                    self.ready(&poll, event.token(), event.readiness());
+                    continue;
+                }
+                match tunnel.read_packet(&mut buf) {
+                    Ok(len) => try!(self.write_packet(&buf[..len])),
+                    Err(ref e) if e.kind() == io::ErrorKind::WouldBlock ||
+                                  e.kind() == io::ErrorKind::TimedOut => {}
+                    Err(ref e) if e.kind() == io::ErrorKind::InvalidData => {
+                        warn!("Dropping datagram: {}", e)
+                    }
+                    Err(e) => return Err(e),
+                }
+            }
+            self.service(&poll, Instant::now());
+            try!(self.send(tunnel));
+        }
+        self.close();
+        self.send(tunnel)
+    }
+
+    fn send<T: PacketIO>(&mut self, tunnel: &mut T) -> io::Result<()> {
+        while let Some(packet) = self.queue.pop_front() {
+            match tunnel.write_packet(&packet) {
+                Ok(_) => {}
+                // Lost like any packet; TCP sends it again.
+                Err(ref e) if network::is_transient(e) => debug!("Server unreachable: {}", e),
+                Err(e) => return Err(e),
+            }
+        }
+        Ok(())
+    }
+
+    fn accept(&mut self, poll: &mio::Poll) {
+        loop {
+            let (stream, peer) = match self.listener.accept() {
+                Ok(accepted) => accepted,
+                Err(ref e) if e.kind() == io::ErrorKind::WouldBlock => return,
+                Err(e) => {
+                    warn!("Unable to accept SOCKS client: {}", e);
+                    return;
+                }
+            };
+            let token = self.next_token;
+            self.next_token += 1;
+            if let Err(e) = poll.register(&stream,
+                                          mio::Token(token),
+                                          mio::Ready::readable(),
+                                          mio::PollOpt::level()) {
+                warn!("Unable to poll SOCKS client {}: {}", peer, e);
+                continue;
+            }
+            debug!("SOCKS client {} connected.", peer);
+            self.clients.insert(token,
+                                Client {
+                                    stream: stream,
+                                    peer: peer,
+                                    phase: Phase::Greeting,
+                                    input: Vec::new(),
+                                    output: Vec::new(),
+                                    eof: false,
+                                    broken: false,
+                                    shut_down: false,
+                                    tcp: None,
+                                    port: None,
+                                    udp_peer: None,
+                                    resolved: None,
+                                    interest: mio::Ready::readable(),
+                                });
+        }
+    }
+
+    // Hands a packet from the tunnel to the connection, association or
+    // lookup it is for.
+    fn input(&mut self, packet: &[u8], now: Instant, out: &mut Vec<Vec<u8>>) {
+        if packet.len() < 20 || packet[16..20] != self.address.octets() {
+            return;
+        }
+        if let Ok(segment) = packet::tcp_parts(packet) {
+            let token = self.ports.get(&segment.destination.port()).cloned();
+            if let Some(client) = token.and_then(|t| self.clients.get_mut(&t)) {
+                if let Some(ref mut tcp) = client.tcp {
+                    if tcp.remote() == segment.source {
+                        tcp.input(&segment, now, out);
+                    }
+                }
+            }
+        } else if let Ok((src_port, dst_port, payload)) = packet::udp_parts(packet) {
+            let source = SocketAddrV4::new(Ipv4Addr::new(packet[12], packet[13], packet[14],
+                                                         packet[15]),
+                                           src_port);
+            if self.lookups.contains_key(&dst_port) {
+                if source == self.resolver {
+                    self.answer(dst_port, payload, now, out);
+                }
+                return;
+            }
+            let token = self.ports.get(&dst_port).cloned();
+            if let Some(client) = token.and_then(|t| self.clients.get(&t)) {
+                if let Some(udp_peer) = client.udp_peer {
+                    let mut datagram = vec![0, 0, 0];
+                    datagram.extend(encode_address(&source));
+                    datagram.extend_from_slice(payload);
+                    if let Err(e) = self.relay.send_to(&datagram, &udp_peer) {
+                        debug!("Unable to relay datagram to {}: {}", udp_peer, e);
+                    }
+                }
+            }
+        }
+    }
+
+    // Asks the resolver for the address of `name`, for the client of
+    // `token`. A datagram waiting for another lookup of the same name is
+    // replaced by this one's.
+    fn look_up(&mut self,
+               token: usize,
+               name: &str,
+               port: u16,
+               datagram: Option<Vec<u8>>,
+               now: Instant,
+               out: &mut Vec<Vec<u8>>)
+               -> bool {
+        if datagram.is_some() {
+            if let Some(lookup) = self.lookups
+                .values_mut()
+                .find(|l| l.token == token && l.name == name && l.datagram.is_some()) {
+                lookup.port = port;
+                lookup.datagram = datagram;
+                return true;
+            }
+        }
+        let id = rand::random();
+        let query = match dns::encode_query(id, name) {
+            Some(query) => query,
+            None => return false,
+        };
+        let from = self.allocate_port(token);
+        let packet = match packet::udp_packet(&SocketAddrV4::new(self.address, from),
+                                              &self.resolver,
+                                              &query) {
+            Ok(packet) => packet,
+            Err(_) => {
+                self.ports.remove(&from);
+                return false;
+            }
+        };
+        debug!("Looking up {} through the tunnel.", name);
+        out.push(packet.clone());
+        self.lookups.insert(from,
+                            Lookup {
+                                token: token,
+                                id: id,
+                                name: String::from(name),
+                                port: port,
+                                datagram: datagram,
+                                packet: packet,
+                                sent: now,
+                                attempts: 1,
+                            });
+        true
+    }
+
+    fn retry_lookups(&mut self, now: Instant, out: &mut Vec<Vec<u8>>) {
+        let retry = Duration::from_millis(LOOKUP_RETRY_MS);
+        let due: Vec<u16> = self.lookups
+            .iter()
+            .filter(|&(_, l)| now.duration_since(l.sent) >= retry)
+            .map(|(&port, _)| port)
+            .collect();
+        for port in due {
+            let give_up = {
+                let lookup = self.lookups.get_mut(&port).unwrap();
+                if lookup.attempts < LOOKUP_ATTEMPTS {
+                    lookup.attempts += 1;
+                    lookup.sent = now;
+                    out.push(lookup.packet.clone());
+                    false
+                } else {
+                    debug!("No answer looking up {}.", lookup.name);
+                    true
+                }
+            };
+            if give_up {
+                self.finish_lookup(port, None, now, out);
+            }
+        }
+    }
+
+    fn answer(&mut self, port: u16, payload: &[u8], now: Instant, out: &mut Vec<Vec<u8>>) {
+        let (id, addresses) = match dns::parse_answer(payload) {
+            Some(answer) => answer,
+            None => return,
+        };
+        if self.lookups[&port].id != id {
+            return;
+        }
+        self.finish_lookup(port, addresses.first().cloned(), now, out);
+    }
+
+    fn finish_lookup(&mut self,
+                     port: u16,
+                     address: Option<Ipv4Addr>,
+                     now: Instant,
+                     out: &mut Vec<Vec<u8>>) {
+        let lookup = self.lookups.remove(&port).unwrap();
+        self.ports.remove(&port);
+        if let Some(address) = address {
+            if self.names.len() >= MAX_NAMES {
+                self.names.clear();
+            }
+            self.names.insert(lookup.name.clone(), (address, now));
+        }
+        let client = match self.clients.get_mut(&lookup.token) {
+            Some(client) => client,
+            None => return,
+        };
+        let port = lookup.port;
+        match (lookup.datagram, address) {
+            (Some(payload), Some(address)) => {
+                let source = SocketAddrV4::new(self.address, client.port.unwrap());
+                let destination = SocketAddrV4::new(address, port);
+                match packet::udp_packet(&source, &destination, &payload) {
+                    Ok(packet) => out.push(packet),
+                    Err(e) => debug!("Dropping SOCKS datagram for {}: {}", destination, e),
+                }
+            }
+            (Some(_), None) => debug!("Dropping SOCKS datagram for {}.", lookup.name),
+            (None, address) => {
+                client.resolved = Some(address.map(|a| SocketAddrV4::new(a, port)))
+            }
+        }
+    }
+
+    // The address `name` was looked up to lately.
+    fn cached(&self, name: &str, now: Instant) -> Option<Ipv4Addr> {
+        match self.names.get(name) {
+            Some(&(address, at)) if now.duration_since(at) <
+                                    Duration::from_secs(NAME_TTL_SECS) => Some(address),
+            _ => None,
+        }
+    }
+
+    // Sends datagrams from applications on to their destinations.
+    fn read_relay(&mut self, now: Instant, out: &mut Vec<Vec<u8>>) {
+        let mut buf = [0u8; 65536];
+        loop {
+            let (len, from) = match self.relay.recv_from(&mut buf) {
+                Ok(received) => received,
+                Err(ref e) if e.kind() == io::ErrorKind::WouldBlock => return,
+                Err(e) => {
+                    warn!("Unable to read SOCKS datagram: {}", e);
+                    return;
+                }
+            };
+            // The association of an application is the one it asked for over
+            // a connection from the same address.
+            let token = self.clients
+                .iter()
+                .find(|&(_, c)| {
+                    c.phase == Phase::Associated &&
+                    c.udp_peer.map_or(c.peer.ip() == from.ip(), |p| p == from)
+                })
+                .map(|(&token, _)| token);
+            let (token, port) = match token {
+                Some(token) => {
+                    let client = self.clients.get_mut(&token).unwrap();
+                    client.udp_peer = Some(from);
+                    (token, client.port.unwrap())
+                }
+                None => continue,
+            };
+            // Fragmented datagrams are not supported, which RFC 1928 allows.
+            if len < 3 || buf[..3] != [0, 0, 0] {
+                continue;
+            }
+            let (target, header_len) = match parse_address(&buf[3..len]) {
+                Ok(Some(parsed)) => parsed,
+                _ => continue,
+            };
+            let payload = &buf[3 + header_len..len];
+            let destination = match target {
+                Target::Ip(destination) => destination,
+                Target::Domain(ref name, dst_port) => {
+                    match self.cached(name, now) {
+                        Some(address) => SocketAddrV4::new(address, dst_port),
+                        None => {
+                            self.look_up(token, name, dst_port, Some(payload.to_vec()), now, out);
+                            continue;
+                        }
+                    }
+                }
+            };
+            let source = SocketAddrV4::new(self.address, port);
+            match packet::udp_packet(&source, &destination, payload) {
+                Ok(packet) => out.push(packet),
+                Err(e) => debug!("Dropping SOCKS datagram for {}: {}", destination, e),
+            }
+        }
+    }
+
+    fn allocate_port(&mut self, token: usize) -> u16 {
+        loop {
+            let port = self.next_port;
+            self.next_port = if port == 65535 { FIRST_PORT } else { port + 1 };
+            if !self.ports.contains_key(&port) {
+                self.ports.insert(port, token);
+                return port;
+            }
+        }
+    }
+
+    // Moves a client along. Returns whether to keep it.
+    fn advance(&mut self,
+               poll: &mio::Poll,
+               token: usize,
+               client: &mut Client,
+               now: Instant,
+               out: &mut Vec<Vec<u8>>)
+               -> bool {
+        loop {
+            let phase = client.phase;
+            match phase {
+                Phase::Greeting => {
+                    match parse_greeting(&client.input) {
+                        Ok(Some((len, true))) => {
+                            client.input.drain(..len);
+                            client.output.extend_from_slice(&[VERSION, METHOD_NONE]);
+                            client.phase = Phase::Request;
+                        }
+                        Ok(Some((_, false))) => {
+                            client.output.extend_from_slice(&[VERSION, METHOD_UNACCEPTABLE]);
+                            client.phase = Phase::Closing;
+                        }
+                        Ok(None) => {}
+                        Err(e) => {
+                            debug!("SOCKS client {}: {}", client.peer, e);
+                            return false;
+                        }
+                    }
+                }
+                Phase::Request => {
+                    match parse_request(&client.input) {
+                        Ok(Some((command, target, len))) => {
+                            client.input.drain(..len);
+                            self.request(token, client, command, &target, now, out);
+                        }
+                        Ok(None) => {}
+                        Err(code) => {
+                            client.output.extend(reply(code, &unspecified()));
+                            client.phase = Phase::Closing;
+                        }
+                    }
+                }
+                Phase::Resolving => {
+                    match client.resolved.take() {
+                        Some(Some(destination)) => self.connect(token, client, destination, now),
+                        Some(None) => {
+                            client.output.extend(reply(REPLY_HOST_UNREACHABLE, &unspecified()));
+                            client.phase = Phase::Closing;
+                        }
+                        None => {}
+                    }
+                }
+                Phase::Connecting => {
+                    let tcp = client.tcp.as_mut().unwrap();
+                    tcp.poll(now, out);
+                    match tcp.state() {
+                        State::SynSent => {}
+                        State::Established => {
+                            client.output.extend(reply(REPLY_SUCCEEDED, &tcp.local()));
+                            client.phase = Phase::Connected;
+                        }
+                        State::Closed => {
+                            let code = if tcp.was_reset() {
+                                REPLY_CONNECTION_REFUSED
+                            } else {
+                                REPLY_HOST_UNREACHABLE
+                            };
+                            client.output.extend(reply(code, &unspecified()));
+                            client.phase = Phase::Closing;
+                        }
+                    }
+                }
+                Phase::Connected => {
+                    let tcp = client.tcp.as_mut().unwrap();
+                    let written = tcp.write(&client.input);
+                    client.input.drain(..written);
+                    if client.eof && client.input.is_empty() {
+                        tcp.close();
+                    }
+                    tcp.poll(now, out);
+                    if client.output.len() < CLIENT_BUFFER {
+                        client.output.extend(tcp.read());
+                    }
+                    if tcp.state() == State::Closed && (tcp.was_reset() || client.broken) {
+                        return false;
+                    }
+                }
+                Phase::Associated => {
+                    // Nothing more is expected on the connection, which only
+                    // keeps the association alive.
+                    client.input.clear();
+                    if client.eof {
+                        return false;
+                    }
+                }
+                Phase::Closing => {}
+            }
+            if client.phase == phase {
+                break;
+            }
+        }
+
+        client.flush();
+        if client.broken {
+            return false;
+        }
+        if client.output.is_empty() {
+            match client.tcp {
+                Some(ref tcp) if client.phase == Phase::Connected => {
+                    if tcp.peer_closed() && !client.shut_down {
+                        let _ = client.stream.shutdown(Shutdown::Write);
+                        client.shut_down = true;
+                    }
+                    if tcp.state() == State::Closed {
+                        return false;
+                    }
+                }
+                _ => {}
+            }
+            if client.phase == Phase::Closing {
+                return false;
+            }
+        }
+
+        let mut interest = mio::Ready::empty();
+        if !client.eof && client.input.len() < CLIENT_BUFFER {
+            interest = interest | mio::Ready::readable();
+        }
+        if !client.output.is_empty() {
+            interest = interest | mio::Ready::writable();
+        }
+        if interest != client.interest {
+            client.interest = interest;
+            if poll.reregister(&client.stream,
+                            mio::Token(token),
+                            interest,
+                            mio::PollOpt::level())
+                .is_err() {
+                return false;
+            }
+        }
+        true
+    }
+
+    fn request(&mut self,
+               token: usize,
+               client: &mut Client,
+               command: u8,
+               target: &Target,
+               now: Instant,
+               out: &mut Vec<Vec<u8>>) {
+        match command {
+            COMMAND_CONNECT => {
+                match *target {
+                    Target::Ip(destination) => self.connect(token, client, destination, now),
+                    Target::Domain(ref name, port) => {
+                        if let Some(address) = self.cached(name, now) {
+                            self.connect(token, client, SocketAddrV4::new(address, port), now);
+                        } else if self.look_up(token, name, port, None, now, out) {
+                            client.phase = Phase::Resolving;
+                        } else {
+                            client.output.extend(reply(REPLY_HOST_UNREACHABLE, &unspecified()));
+                            client.phase = Phase::Closing;
+                        }
+                    }
+                }
+            }
+            COMMAND_UDP_ASSOCIATE => {
+                let bound = match self.relay.local_addr() {
+                    Ok(SocketAddr::V4(bound)) => bound,
+                    _ => unspecified(),
+                };
+                client.port = Some(self.allocate_port(token));
+                client.output.extend(reply(REPLY_SUCCEEDED, &bound));
+                client.phase = Phase::Associated;
+            }
+            _ => {
+                client.output.extend(reply(REPLY_COMMAND_UNSUPPORTED, &unspecified()));
+                client.phase = Phase::Closing;
+            }
+        }
+    }
+
+    fn connect(&mut self,
+               token: usize,
+               client: &mut Client,
+               destination: SocketAddrV4,
+               now: Instant) {
+        let port = self.allocate_port(token);
+        debug!("SOCKS client {} connecting to {}.", client.peer, destination);
+        client.port = Some(port);
+        client.tcp = Some(TcpConnection::connect(SocketAddrV4::new(self.address, port),
+                                                 destination,
+                                                 rand::random(),
+                                                 self.mss,
+                                                 now));
+        client.phase = Phase::Connecting;
+    }
+}
+
+impl PacketIO for Proxy {
+    // Never blocks, failing with WouldBlock when there is no packet to read.
+    fn read_packet(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        match self.queue.pop_front() {
+            Some(packet) => {
+                let len = cmp::min(buf.len(), packet.len());
+                buf[..len].copy_from_slice(&packet[..len]);
+                Ok(len)
+            }
+            None => Err(io::Error::new(io::ErrorKind::WouldBlock, "No packet to read.")),
+        }
+    }
+
+    fn write_packet(&mut self, packet: &[u8]) -> io::Result<()> {
+        let mut out = Vec::new();
+        self.input(packet, Instant::now(), &mut out);
+        self.queue.extend(out);
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::io::{self, Read, Write};
+    use std::net::{SocketAddr, TcpStream, UdpSocket};
+    use std::os::unix::io::{AsRawFd, RawFd};
+    use std::os::unix::net::UnixDatagram;
+    use std::sync::Arc;
+    use std::sync::atomic::{AtomicBool, Ordering};
+    use std::thread;
+    use std::time::Duration;
+    use device::PacketIO;
+    use dns;
+    use packet::{self, TCP_ACK, TCP_PSH, TCP_SYN};
+    use socks::*;
+
+    // Stands in for the tunnel; the packets come out at the other end of the
+    // pair.
+    struct Wire(UnixDatagram);
+
+    impl PacketIO for Wire {
+        fn read_packet(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+            self.0.recv(buf)
+        }
+
+        fn write_packet(&mut self, packet: &[u8]) -> io::Result<()> {
+            self.0.send(packet).map(|_| ())
+        }
+    }
+
+    impl AsRawFd for Wire {
+        fn as_raw_fd(&self) -> RawFd {
+            self.0.as_raw_fd()
+        }
+    }
+
+    // Starts a proxy for 10.10.10.2. Returns its address, the far end of its
+    // tunnel, and what stops it.
+    fn start() -> (SocketAddr, UnixDatagram, Arc<AtomicBool>, thread::JoinHandle<()>) {
+        let (near, far) = UnixDatagram::pair().unwrap();
+        near.set_nonblocking(true).unwrap();
+        far.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        let mut proxy = Proxy::new(Ipv4Addr::new(10, 10, 10, 2),
+                                   1280,
+                                   &"127.0.0.1:0".parse().unwrap(),
+                                   Ipv4Addr::new(192, 0, 2, 53))
+            .unwrap();
+        let address = proxy.local_addr().unwrap();
+        let stop = Arc::new(AtomicBool::new(false));
+        let stopped = stop.clone();
+        let handle = thread::spawn(move || proxy.run(&mut Wire(near), &stopped).unwrap());
+        (address, far, stop, handle)
+    }
+
+    fn greet(address: &SocketAddr) -> TcpStream {
+        let mut client = TcpStream::connect(address).unwrap();
+        client.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        client.write_all(&[5, 2, 2, 0]).unwrap();
+        let mut answer = [0u8; 2];
+        client.read_exact(&mut answer).unwrap();
+        assert_eq!(answer, [5, 0]);
+        client
+    }
+
+    #[test]
+    fn parse_test() {
+        assert_eq!(parse_greeting(&[5, 2, 2]), Ok(None));
+        assert_eq!(parse_greeting(&[5, 2, 2, 0, 9]), Ok(Some((4, true))));
+        assert_eq!(parse_greeting(&[5, 1, 2]), Ok(Some((3, false))));
+        assert!(parse_greeting(&[4, 1, 0]).is_err());
+
+        let request = [5, 1, 0, 3, 11, b'e', b'x', b'a', b'm', b'p', b'l', b'e', b'.', b'c', b'o',
+                       b'm', 1, 187];
+        assert_eq!(parse_request(&request[..17]), Ok(None));
+        assert_eq!(parse_request(&request),
+                   Ok(Some((COMMAND_CONNECT,
+                            Target::Domain(String::from("example.com"), 443),
+                            request.len()))));
+        assert_eq!(parse_request(&[5, 3, 0, 1, 192, 0, 2, 7, 0, 53]),
+                   Ok(Some((COMMAND_UDP_ASSOCIATE,
+                            Target::Ip("192.0.2.7:53".parse().unwrap()),
+                            10))));
+        assert_eq!(parse_request(&[5, 1, 0, 4, 0]), Err(REPLY_ADDRESS_UNSUPPORTED));
+        assert_eq!(reply(REPLY_SUCCEEDED, &"10.10.10.2:49152".parse().unwrap()),
+                   vec![5, 0, 0, 1, 10, 10, 10, 2, 0xc0, 0]);
+    }
+
+    #[test]
+    fn connect_test() {
+        let (address, far, stop, proxy) = start();
+        // The destination, on the far side of the tunnel, shouts back what it
+        // is sent.
+        let destination = thread::spawn(move || {
+            let mut buf = [0u8; 1600];
+            let len = far.recv(&mut buf).unwrap();
+            let syn = packet::tcp_parts(&buf[..len]).unwrap();
+            assert_eq!(syn.flags, TCP_SYN);
+            assert_eq!(*syn.source.ip(), Ipv4Addr::new(10, 10, 10, 2));
+            let (local, remote) = (syn.destination, syn.source);
+            assert_eq!(local, "192.0.2.7:80".parse().unwrap());
+            let syn_ack = packet::tcp_packet(&local,
+                                             &remote,
+                                             5000,
+                                             syn.seq.wrapping_add(1),
+                                             TCP_SYN | TCP_ACK,
+                                             8192,
+                                             &[],
+                                             b"")
+                .unwrap();
+            far.send(&syn_ack).unwrap();
+            loop {
+                let len = far.recv(&mut buf).unwrap();
+                let segment = packet::tcp_parts(&buf[..len]).unwrap();
+                if segment.payload.is_empty() {
+                    continue;
+                }
+                let shout = packet::tcp_packet(&local,
+                                               &remote,
+                                               5001,
+                                               segment.seq
+                                                   .wrapping_add(segment.payload.len() as u32),
+                                               TCP_ACK | TCP_PSH,
+                                               8192,
+                                               &[],
+                                               &segment.payload.to_ascii_uppercase())
+                    .unwrap();
+                far.send(&shout).unwrap();
+                return;
+            }
+        });
+
+        let mut client = greet(&address);
+        client.write_all(&[5, 1, 0, 1, 192, 0, 2, 7, 0, 80]).unwrap();
+        let mut answer = [0u8; 10];
+        client.read_exact(&mut answer).unwrap();
+        assert_eq!(&answer[..8], &[5, REPLY_SUCCEEDED, 0, 1, 10, 10, 10, 2]);
+        client.write_all(b"hello").unwrap();
+        let mut shouted = [0u8; 5];
+        client.read_exact(&mut shouted).unwrap();
+        assert_eq!(&shouted, b"HELLO");
+
+        destination.join().unwrap();
+        stop.store(true, Ordering::Relaxed);
+        proxy.join().unwrap();
+    }
+
+    #[test]
+    fn udp_associate_test() {
+        let (address, far, stop, proxy) = start();
+        let mut client = greet(&address);
+        client.write_all(&[5, 3, 0, 1, 0, 0, 0, 0, 0, 0]).unwrap();
+        let mut answer = [0u8; 10];
+        client.read_exact(&mut answer).unwrap();
+        assert_eq!(&answer[..4], &[5, REPLY_SUCCEEDED, 0, 1]);
+        let relay = SocketAddr::new(Ipv4Addr::new(answer[4], answer[5], answer[6], answer[7])
+                                        .into(),
+                                    ((answer[8] as u16) << 8) | answer[9] as u16);
+
+        let socket = UdpSocket::bind("127.0.0.1:0").unwrap();
+        socket.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        let header = [0, 0, 0, 1, 192, 0, 2, 7, 0, 53];
+        socket.send_to(&[&header[..], b"query"].concat(), relay).unwrap();
+
+        let mut buf = [0u8; 1600];
+        let len = far.recv(&mut buf).unwrap();
+        assert_eq!(&buf[12..20], &[10, 10, 10, 2, 192, 0, 2, 7]);
+        let (_, dst_port, payload) = packet::udp_parts(&buf[..len]).unwrap();
+        assert_eq!((dst_port, payload), (53, &b"query"[..]));
+        far.send(&packet::udp_reply(&buf[..len], b"answer").unwrap()).unwrap();
+
+        let len = socket.recv(&mut buf).unwrap();
+        assert_eq!(&buf[..len], &[&header[..], b"answer"].concat()[..]);
+
+        stop.store(true, Ordering::Relaxed);
+        proxy.join().unwrap();
+    }
+
+    #[test]
+    fn connect_by_name_test() {
+        let (address, far, stop, proxy) = start();
+        let mut client = greet(&address);
+        let mut request = vec![5, 1, 0, 3, 11];
+        request.extend_from_slice(b"example.com");
+        request.extend_from_slice(&[0, 80]);
+        client.write_all(&request).unwrap();
+
+        // Looked up through the tunnel, asked again when the first answer is
+        // lost.
+        let mut buf = [0u8; 1600];
+        let len = far.recv(&mut buf).unwrap();
+        let first = buf[..len].to_vec();
+        assert_eq!(&first[12..20], &[10, 10, 10, 2, 192, 0, 2, 53]);
+        let len = far.recv(&mut buf).unwrap();
+        assert_eq!(&buf[..len], &first[..]);
+        let (_, dst_port, query) = packet::udp_parts(&first).unwrap();
+        assert_eq!(dst_port, 53);
+        let name = &query[12..query.len() - 4];
+        assert_eq!(name, &b"\x07example\x03com\x00"[..]);
+        // One A record, pointing at the question's name.
+        let mut answer = vec![query[0], query[1], 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0];
+        answer.extend_from_slice(&query[12..]);
+        answer.extend_from_slice(&[0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 7]);
+        far.send(&packet::udp_reply(&first, &answer).unwrap()).unwrap();
+        assert_eq!(dns::parse_answer(&answer),
+                   Some((((query[0] as u16) << 8) | query[1] as u16,
+                         vec![Ipv4Addr::new(192, 0, 2, 7)])));
+
+        let len = far.recv(&mut buf).unwrap();
+        let syn = packet::tcp_parts(&buf[..len]).unwrap();
+        assert_eq!(syn.flags, TCP_SYN);
+        assert_eq!(syn.destination, "192.0.2.7:80".parse().unwrap());
+
+        stop.store(true, Ordering::Relaxed);
+        proxy.join().unwrap();
+    }
+
+    #[test]
+    fn unresolved_name_test() {
+        let (address, far, stop, proxy) = start();
+        let mut client = greet(&address);
+        let mut request = vec![5, 1, 0, 3, 7];
+        request.extend_from_slice(b"invalid");
+        request.extend_from_slice(&[0, 80]);
+        client.write_all(&request).unwrap();
+
+        let mut buf = [0u8; 1600];
+        let len = far.recv(&mut buf).unwrap();
+        let (_, _, query) = packet::udp_parts(&buf[..len]).unwrap();
+        // No such name.
+        let mut answer = vec![query[0], query[1], 0x81, 0x83, 0, 1, 0, 0, 0, 0, 0, 0];
+        answer.extend_from_slice(&query[12..]);
+        far.send(&packet::udp_reply(&buf[..len], &answer).unwrap()).unwrap();
+
+        let mut answer = [0u8; 10];
+        client.read_exact(&mut answer).unwrap();
+        assert_eq!(&answer[..2], &[5, REPLY_HOST_UNREACHABLE]);
+
+        stop.store(true, Ordering::Relaxed);
+        proxy.join().unwrap();
+    }
+}
@@ -0,0 +1,493 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::cmp;
+use std::collections::VecDeque;
+use std::mem;
+use std::net::SocketAddrV4;
+use std::time::{Duration, Instant};
+use packet::{self, TcpSegment, TCP_ACK, TCP_FIN, TCP_PSH, TCP_RST, TCP_SYN};
+
+// Bytes received but not taken yet. What is left of it is the window we
+// offer.
+const RECEIVE_BUFFER: usize = 65535;
+// Bytes accepted from the application but not acknowledged yet.
+const SEND_BUFFER: usize = 256 * 1024;
+const INITIAL_RTO_MS: u64 = 1000;
+const MAX_RTO_MS: u64 = 16000;
+// Retransmissions of the same data before the connection is given up.
+const MAX_RETRIES: u32 = 6;
+// What the peer is assumed to take if its SYN announces nothing (RFC 879).
+const DEFAULT_MSS: usize = 536;
+const OPTION_END: u8 = 0;
+const OPTION_NOP: u8 = 1;
+const OPTION_MSS: u8 = 2;
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum State {
+    SynSent,
+    Established,
+    Closed,
+}
+
+// The MSS announced in the options of a SYN, if any.
+fn announced_mss(options: &[u8]) -> Option<usize> {
+    let mut i = 0;
+    while i < options.len() {
+        match options[i] {
+            OPTION_END => return None,
+            OPTION_NOP => i += 1,
+            kind => {
+                let len = match options.get(i + 1) {
+                    Some(&len) if len >= 2 => len as usize,
+                    _ => return None,
+                };
+                if kind == OPTION_MSS && len == 4 && i + 4 <= options.len() {
+                    return Some(((options[i + 2] as usize) << 8) | options[i + 3] as usize);
+                }
+                i += len;
+            }
+        }
+    }
+    None
+}
+
+// A TCP connection opened from an inner address, exchanging IP packets
+// directly so it needs no TUN device. It is deliberately minimal: segments
+// arriving out of order are dropped for the peer to send again, everything
+// from the first unacknowledged byte is resent when the retransmission
+// timeout expires, and the peer's window is the only congestion control.
+pub struct TcpConnection {
+    local: SocketAddrV4,
+    remote: SocketAddrV4,
+    state: State,
+    mss: usize,
+    // The oldest unacknowledged sequence number, and the next to be sent.
+    snd_una: u32,
+    snd_nxt: u32,
+    snd_wnd: usize,
+    rcv_nxt: u32,
+    // Everything from snd_una on, sent or not.
+    outgoing: VecDeque<u8>,
+    // Whether the application is done writing, and the fate of our FIN.
+    closing: bool,
+    fin_sent: bool,
+    fin_acked: bool,
+    // Bytes from the peer, in order, for the application to read.
+    incoming: Vec<u8>,
+    peer_closed: bool,
+    reset: bool,
+    // The window we last told the peer about.
+    offered: usize,
+    rto: Duration,
+    retries: u32,
+    // When the oldest data in flight was last (re)sent, or acknowledged.
+    sent_at: Instant,
+}
+
+impl TcpConnection {
+    // The SYN goes out with the first `poll`. `iss` is the initial sequence
+    // number; `mss` the most we take in one segment.
+    pub fn connect(local: SocketAddrV4,
+                   remote: SocketAddrV4,
+                   iss: u32,
+                   mss: u16,
+                   now: Instant)
+                   -> TcpConnection {
+        TcpConnection {
+            local: local,
+            remote: remote,
+            state: State::SynSent,
+            mss: mss as usize,
+            snd_una: iss,
+            snd_nxt: iss,
+            snd_wnd: 0,
+            rcv_nxt: 0,
+            outgoing: VecDeque::new(),
+            closing: false,
+            fin_sent: false,
+            fin_acked: false,
+            incoming: Vec::new(),
+            peer_closed: false,
+            reset: false,
+            offered: RECEIVE_BUFFER,
+            rto: Duration::from_millis(INITIAL_RTO_MS),
+            retries: 0,
+            sent_at: now,
+        }
+    }
+
+    pub fn local(&self) -> SocketAddrV4 {
+        self.local
+    }
+
+    pub fn remote(&self) -> SocketAddrV4 {
+        self.remote
+    }
+
+    pub fn state(&self) -> State {
+        self.state
+    }
+
+    // Whether the peer reset the connection.
+    pub fn was_reset(&self) -> bool {
+        self.reset
+    }
+
+    // Whether the peer has sent everything it will.
+    pub fn peer_closed(&self) -> bool {
+        self.peer_closed
+    }
+
+    // Queues as much of `data` as there is room for, and returns how much
+    // that was.
+    pub fn write(&mut self, data: &[u8]) -> usize {
+        if self.closing || self.state == State::Closed {
+            return 0;
+        }
+        let len = cmp::min(data.len(), SEND_BUFFER - self.outgoing.len());
+        self.outgoing.extend(&data[..len]);
+        len
+    }
+
+    // Takes the bytes received so far.
+    pub fn read(&mut self) -> Vec<u8> {
+        mem::replace(&mut self.incoming, Vec::new())
+    }
+
+    // Sends a FIN once everything written has been sent.
+    pub fn close(&mut self) {
+        self.closing = true;
+    }
+
+    // Gives up on the connection, telling the peer.
+    pub fn abort(&mut self, out: &mut Vec<Vec<u8>>) {
+        if self.state != State::Closed {
+            let seq = self.snd_nxt;
+            let segment = self.segment(TCP_RST | TCP_ACK, seq, &[], &[]);
+            out.push(segment);
+            self.state = State::Closed;
+        }
+    }
+
+    fn window(&self) -> usize {
+        RECEIVE_BUFFER - self.incoming.len()
+    }
+
+    fn in_flight(&self) -> usize {
+        self.snd_nxt.wrapping_sub(self.snd_una) as usize
+    }
+
+    fn segment(&mut self, flags: u8, seq: u32, options: &[u8], payload: &[u8]) -> Vec<u8> {
+        self.offered = self.window();
+        let ack = if flags & TCP_ACK != 0 { self.rcv_nxt } else { 0 };
+        packet::tcp_packet(&self.local,
+                           &self.remote,
+                           seq,
+                           ack,
+                           flags,
+                           cmp::min(self.offered, 0xffff) as u16,
+                           options,
+                           payload)
+            .unwrap()
+    }
+
+    fn ack(&mut self, out: &mut Vec<Vec<u8>>) {
+        let seq = self.snd_nxt;
+        let segment = self.segment(TCP_ACK, seq, &[], &[]);
+        out.push(segment);
+    }
+
+    // Handles a segment from the peer, queueing any answer in `out`.
+    pub fn input(&mut self, segment: &TcpSegment, now: Instant, out: &mut Vec<Vec<u8>>) {
+        if segment.flags & TCP_RST != 0 {
+            // Only believed if it is for what we sent, or the next thing the
+            // peer would send, so it cannot easily be forged.
+            let acceptable = match self.state {
+                State::SynSent => segment.flags & TCP_ACK != 0 && segment.ack == self.snd_nxt,
+                State::Established => segment.seq == self.rcv_nxt,
+                State::Closed => false,
+            };
+            if acceptable {
+                self.state = State::Closed;
+                self.reset = true;
+            }
+            return;
+        }
+        match self.state {
+            State::SynSent => {
+                if segment.flags & (TCP_SYN | TCP_ACK) == TCP_SYN | TCP_ACK &&
+                   segment.ack == self.snd_nxt {
+                    let mss = announced_mss(segment.options).unwrap_or(DEFAULT_MSS);
+                    self.mss = cmp::min(self.mss, mss);
+                    self.rcv_nxt = segment.seq.wrapping_add(1);
+                    self.snd_una = segment.ack;
+                    self.snd_wnd = segment.window as usize;
+                    self.state = State::Established;
+                    self.retries = 0;
+                    self.rto = Duration::from_millis(INITIAL_RTO_MS);
+                    self.sent_at = now;
+                    self.ack(out);
+                }
+                return;
+            }
+            State::Closed => return,
+            State::Established => {}
+        }
+
+        if segment.flags & TCP_ACK != 0 {
+            let acked = segment.ack.wrapping_sub(self.snd_una) as usize;
+            if acked <= self.in_flight() {
+                if acked > 0 {
+                    let data = cmp::min(acked, self.outgoing.len());
+                    self.outgoing.drain(..data);
+                    if self.fin_sent && segment.ack == self.snd_nxt {
+                        self.fin_acked = true;
+                    }
+                    self.snd_una = segment.ack;
+                    self.retries = 0;
+                    self.rto = Duration::from_millis(INITIAL_RTO_MS);
+                    self.sent_at = now;
+                }
+                self.snd_wnd = segment.window as usize;
+            }
+        }
+
+        let fin = segment.flags & TCP_FIN != 0;
+        // Anything taking sequence space is acknowledged, even if it was
+        // old or out of order, so the peer learns what we are missing.
+        if !segment.payload.is_empty() || fin || segment.flags & TCP_SYN != 0 {
+            if segment.seq == self.rcv_nxt && !self.peer_closed {
+                let len = cmp::min(segment.payload.len(), self.window());
+                self.incoming.extend_from_slice(&segment.payload[..len]);
+                self.rcv_nxt = self.rcv_nxt.wrapping_add(len as u32);
+                if fin && len == segment.payload.len() {
+                    self.rcv_nxt = self.rcv_nxt.wrapping_add(1);
+                    self.peer_closed = true;
+                }
+            }
+            self.ack(out);
+        }
+        if self.fin_acked && self.peer_closed {
+            self.state = State::Closed;
+        }
+    }
+
+    // Backs the retransmission timeout off, or gives up if that happened
+    // too often. Returns whether to carry on.
+    fn back_off(&mut self, out: &mut Vec<Vec<u8>>) -> bool {
+        self.retries += 1;
+        if self.retries > MAX_RETRIES {
+            self.abort(out);
+            return false;
+        }
+        self.rto = cmp::min(self.rto * 2, Duration::from_millis(MAX_RTO_MS));
+        true
+    }
+
+    // Sends what is due at `now`: the SYN, new data the peer has room for,
+    // retransmissions, the FIN and window updates.
+    pub fn poll(&mut self, now: Instant, out: &mut Vec<Vec<u8>>) {
+        let expired = self.in_flight() > 0 && now.duration_since(self.sent_at) >= self.rto;
+        match self.state {
+            State::Closed => return,
+            State::SynSent => {
+                if self.in_flight() == 0 || (expired && self.back_off(out)) {
+                    let options = [OPTION_MSS, 4, (self.mss >> 8) as u8, self.mss as u8];
+                    let seq = self.snd_una;
+                    let segment = self.segment(TCP_SYN, seq, &options, &[]);
+                    out.push(segment);
+                    self.snd_nxt = self.snd_una.wrapping_add(1);
+                    self.sent_at = now;
+                }
+                return;
+            }
+            State::Established => {}
+        }
+
+        if expired {
+            if !self.back_off(out) {
+                return;
+            }
+            // Go back to the first unacknowledged byte.
+            self.snd_nxt = self.snd_una;
+            self.fin_sent = false;
+        }
+        // A peer with no room left is still sent a byte now and then, to
+        // learn when it has room again.
+        let window = cmp::max(self.snd_wnd, 1);
+        while !self.fin_sent {
+            let offset = self.in_flight();
+            if offset >= self.outgoing.len() || offset >= window {
+                break;
+            }
+            let len = cmp::min(self.mss,
+                               cmp::min(self.outgoing.len(), window) - offset);
+            let payload: Vec<u8> = self.outgoing.iter().skip(offset).take(len).cloned().collect();
+            if offset == 0 {
+                self.sent_at = now;
+            }
+            let seq = self.snd_nxt;
+            let segment = self.segment(TCP_ACK | TCP_PSH, seq, &[], &payload);
+            out.push(segment);
+            self.snd_nxt = self.snd_nxt.wrapping_add(len as u32);
+        }
+        if self.closing && !self.fin_sent && self.in_flight() == self.outgoing.len() {
+            if self.in_flight() == 0 {
+                self.sent_at = now;
+            }
+            let seq = self.snd_nxt;
+            let segment = self.segment(TCP_FIN | TCP_ACK, seq, &[], &[]);
+            out.push(segment);
+            self.snd_nxt = self.snd_nxt.wrapping_add(1);
+            self.fin_sent = true;
+        }
+        // Tell a peer that ran out of room once the application caught up.
+        if self.offered < self.mss && self.window() >= self.mss {
+            self.ack(out);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::{Duration, Instant};
+    use packet::{self, TCP_ACK, TCP_FIN, TCP_PSH, TCP_RST, TCP_SYN};
+    use stack::*;
+
+    fn peer(seq: u32, ack: u32, flags: u8, payload: &[u8]) -> Vec<u8> {
+        packet::tcp_packet(&"192.0.2.7:80".parse().unwrap(),
+                           &"10.10.10.2:49152".parse().unwrap(),
+                           seq,
+                           ack,
+                           flags,
+                           8192,
+                           &[OPTION_MSS, 4, 0x02, 0x00],
+                           payload)
+            .unwrap()
+    }
+
+    fn connection(now: Instant) -> TcpConnection {
+        TcpConnection::connect("10.10.10.2:49152".parse().unwrap(),
+                               "192.0.2.7:80".parse().unwrap(),
+                               100,
+                               1200,
+                               now)
+    }
+
+    #[test]
+    fn handshake_test() {
+        let now = Instant::now();
+        let mut connection = connection(now);
+        let mut out = Vec::new();
+        connection.poll(now, &mut out);
+        let syn = packet::tcp_parts(&out[0]).unwrap();
+        assert_eq!((syn.seq, syn.flags), (100, TCP_SYN));
+        assert_eq!(announced_mss(syn.options), Some(1200));
+
+        // A reset for something else is ignored.
+        out.clear();
+        connection.input(&packet::tcp_parts(&peer(0, 7, TCP_RST | TCP_ACK, b"")).unwrap(),
+                         now,
+                         &mut out);
+        assert_eq!(connection.state(), State::SynSent);
+        connection.input(&packet::tcp_parts(&peer(5000, 101, TCP_SYN | TCP_ACK, b"")).unwrap(),
+                         now,
+                         &mut out);
+        assert_eq!(connection.state(), State::Established);
+        let ack = packet::tcp_parts(&out[0]).unwrap();
+        assert_eq!((ack.seq, ack.ack, ack.flags), (101, 5001, TCP_ACK));
+
+        // Segments are no larger than the peer's MSS of 512.
+        out.clear();
+        assert_eq!(connection.write(&[7; 1000]), 1000);
+        connection.poll(now, &mut out);
+        let sizes: Vec<usize> =
+            out.iter().map(|p| packet::tcp_parts(p).unwrap().payload.len()).collect();
+        assert_eq!(sizes, vec![512, 488]);
+
+        out.clear();
+        connection.input(&packet::tcp_parts(&peer(5001, 1101, TCP_ACK | TCP_PSH, b"reply"))
+                             .unwrap(),
+                         now,
+                         &mut out);
+        assert_eq!(connection.read(), b"reply".to_vec());
+        assert_eq!(packet::tcp_parts(&out[0]).unwrap().ack, 5006);
+
+        // Both sides close.
+        out.clear();
+        connection.close();
+        connection.poll(now, &mut out);
+        let fin = packet::tcp_parts(&out[0]).unwrap();
+        assert_eq!((fin.seq, fin.flags), (1101, TCP_FIN | TCP_ACK));
+        connection.input(&packet::tcp_parts(&peer(5006, 1102, TCP_FIN | TCP_ACK, b"")).unwrap(),
+                         now,
+                         &mut out);
+        assert_eq!(connection.state(), State::Closed);
+        assert!(connection.peer_closed());
+        assert!(!connection.was_reset());
+    }
+
+    #[test]
+    fn retransmit_test() {
+        let now = Instant::now();
+        let mut connection = connection(now);
+        let mut out = Vec::new();
+        connection.poll(now, &mut out);
+        connection.input(&packet::tcp_parts(&peer(5000, 101, TCP_SYN | TCP_ACK, b"")).unwrap(),
+                         now,
+                         &mut out);
+        connection.write(b"lost");
+        out.clear();
+        connection.poll(now, &mut out);
+        assert_eq!(out.len(), 1);
+
+        // Nothing is resent before the timeout, then everything unacknowledged
+        // is, with the timeout doubling each time.
+        out.clear();
+        connection.poll(now + Duration::from_millis(999), &mut out);
+        assert!(out.is_empty());
+        let mut at = now + Duration::from_millis(INITIAL_RTO_MS);
+        for retry in 0..MAX_RETRIES {
+            connection.poll(at, &mut out);
+            let resent = out.pop().unwrap();
+            let segment = packet::tcp_parts(&resent).unwrap();
+            assert_eq!((segment.seq, segment.payload), (101, &b"lost"[..]));
+            at += Duration::from_millis(INITIAL_RTO_MS << (retry + 1));
+        }
+        connection.poll(at, &mut out);
+        assert_eq!(packet::tcp_parts(&out[0]).unwrap().flags, TCP_RST | TCP_ACK);
+        assert_eq!(connection.state(), State::Closed);
+        assert!(!connection.was_reset());
+
+        // Data out of order is not taken, but acknowledged.
+        let mut connection = self::connection(now);
+        connection.poll(now, &mut out);
+        connection.input(&packet::tcp_parts(&peer(5000, 101, TCP_SYN | TCP_ACK, b"")).unwrap(),
+                         now,
+                         &mut out);
+        out.clear();
+        connection.input(&packet::tcp_parts(&peer(5004, 101, TCP_ACK, b"late")).unwrap(),
+                         now,
+                         &mut out);
+        assert!(connection.read().is_empty());
+        assert_eq!(packet::tcp_parts(&out[0]).unwrap().ack, 5001);
+        connection.input(&packet::tcp_parts(&peer(5001, 0, TCP_RST, b"")).unwrap(),
+                         now,
+                         &mut out);
+        assert_eq!(connection.state(), State::Closed);
+        assert!(connection.was_reset());
+    }
+}
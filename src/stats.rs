@@ -0,0 +1,317 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::sync::{Mutex, RwLock};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::{Duration, Instant};
+use metrics::{MetricsSink, NoopSink};
+
+// Traffic counters. "In" is what arrived from peers over UDP and "out" what
+// was sent to them. They are atomics so they can be read from anywhere
+// without holding up the data path. Every update is also reported to a
+// MetricsSink.
+pub struct Stats {
+    bytes_in: AtomicUsize,
+    packets_in: AtomicUsize,
+    bytes_out: AtomicUsize,
+    packets_out: AtomicUsize,
+    drops: AtomicUsize,
+    // Updates share it and snapshots take it exclusively, so a snapshot never
+    // sees half of an update, e.g. the bytes of a packet but not the packet.
+    updating: RwLock<()>,
+    // The counters as of the last `collect(true)`. Collecting subtracts them
+    // instead of zeroing the counters, which snapshots and StatsLogger read.
+    collected: Mutex<StatsSnapshot>,
+    sink: Box<MetricsSink>,
+}
+
+#[derive(Clone, Copy, Debug, Default, PartialEq)]
+pub struct StatsSnapshot {
+    pub bytes_in: u64,
+    pub packets_in: u64,
+    pub bytes_out: u64,
+    pub packets_out: u64,
+    pub drops: u64,
+}
+
+impl StatsSnapshot {
+    fn since(&self, earlier: &StatsSnapshot) -> StatsSnapshot {
+        StatsSnapshot {
+            bytes_in: self.bytes_in.wrapping_sub(earlier.bytes_in),
+            packets_in: self.packets_in.wrapping_sub(earlier.packets_in),
+            bytes_out: self.bytes_out.wrapping_sub(earlier.bytes_out),
+            packets_out: self.packets_out.wrapping_sub(earlier.packets_out),
+            drops: self.drops.wrapping_sub(earlier.drops),
+        }
+    }
+}
+
+impl Stats {
+    pub fn new() -> Stats {
+        Stats::with_sink(Box::new(NoopSink))
+    }
+
+    pub fn with_sink(sink: Box<MetricsSink>) -> Stats {
+        Stats {
+            bytes_in: AtomicUsize::new(0),
+            packets_in: AtomicUsize::new(0),
+            bytes_out: AtomicUsize::new(0),
+            packets_out: AtomicUsize::new(0),
+            drops: AtomicUsize::new(0),
+            updating: RwLock::new(()),
+            collected: Mutex::new(StatsSnapshot::default()),
+            sink: sink,
+        }
+    }
+
+    pub fn set_sink(&mut self, sink: Box<MetricsSink>) {
+        self.sink = sink;
+    }
+
+    // For metrics that have no counter here.
+    pub fn sink(&self) -> &MetricsSink {
+        &*self.sink
+    }
+
+    pub fn received(&self, bytes: usize) {
+        {
+            let _updating = self.updating.read().unwrap();
+            self.bytes_in.fetch_add(bytes, Ordering::Relaxed);
+            self.packets_in.fetch_add(1, Ordering::Relaxed);
+        }
+        self.sink.counter("kytan_rx_packets_total", 1);
+        self.sink.counter("kytan_rx_bytes_total", bytes as u64);
+        self.sink.histogram("kytan_rx_packet_bytes", bytes as f64);
+    }
+
+    pub fn sent(&self, bytes: usize) {
+        {
+            let _updating = self.updating.read().unwrap();
+            self.bytes_out.fetch_add(bytes, Ordering::Relaxed);
+            self.packets_out.fetch_add(1, Ordering::Relaxed);
+        }
+        self.sink.counter("kytan_tx_packets_total", 1);
+        self.sink.counter("kytan_tx_bytes_total", bytes as u64);
+        self.sink.histogram("kytan_tx_packet_bytes", bytes as f64);
+    }
+
+    pub fn dropped(&self) {
+        self.drops.fetch_add(1, Ordering::Relaxed);
+        self.sink.counter("kytan_drops_total", 1);
+    }
+
+    // Reports how long a handshake waited for its answer, tagged with a trace
+    // ID that is also logged, so an exemplar leads to the log lines.
+    pub fn answered_handshake(&self, latency: Duration, trace_id: &str) {
+        self.sink.histogram_with_exemplar("kytan_handshake_seconds",
+                                          seconds(latency),
+                                          &[("trace_id", trace_id)]);
+    }
+
+    pub fn set_sessions(&self, sessions: usize) {
+        self.sink.gauge("kytan_sessions", sessions as f64);
+    }
+
+    // The counters since we started.
+    pub fn snapshot(&self) -> StatsSnapshot {
+        let _updating = self.updating.write().unwrap();
+        self.totals()
+    }
+
+    fn totals(&self) -> StatsSnapshot {
+        let read = |counter: &AtomicUsize| counter.load(Ordering::Relaxed) as u64;
+        StatsSnapshot {
+            bytes_in: read(&self.bytes_in),
+            packets_in: read(&self.packets_in),
+            bytes_out: read(&self.bytes_out),
+            packets_out: read(&self.packets_out),
+            drops: read(&self.drops),
+        }
+    }
+
+    // Returns the counters since the last reset and, if `reset`, starts them
+    // over all at once, so a collector reporting per interval gets each one's
+    // delta directly. Snapshots still count from the start.
+    pub fn collect(&self, reset: bool) -> StatsSnapshot {
+        let _updating = self.updating.write().unwrap();
+        let totals = self.totals();
+        let mut collected = self.collected.lock().unwrap();
+        let delta = totals.since(&collected);
+        if reset {
+            *collected = totals;
+        }
+        delta
+    }
+}
+
+fn seconds(d: Duration) -> f64 {
+    d.as_secs() as f64 + d.subsec_nanos() as f64 / 1e9
+}
+
+// Logs a one-line summary of traffic since the previous one, every `interval`.
+pub struct StatsLogger {
+    interval: Duration,
+    last: Instant,
+    previous: StatsSnapshot,
+}
+
+impl StatsLogger {
+    pub fn new(interval: Duration, now: Instant) -> StatsLogger {
+        StatsLogger {
+            interval: interval,
+            last: now,
+            previous: StatsSnapshot::default(),
+        }
+    }
+
+    // How long the event loop may sleep before the next summary is due.
+    pub fn timeout(&self, now: Instant) -> Duration {
+        let due = self.last + self.interval;
+        if due > now {
+            due - now
+        } else {
+            Duration::from_secs(0)
+        }
+    }
+
+    // Logs and returns the summary if one is due.
+    pub fn tick(&mut self, stats: &Stats, sessions: usize, now: Instant) -> Option<String> {
+        if now < self.last + self.interval {
+            return None;
+        }
+        let current = stats.snapshot();
+        let elapsed = seconds(now - self.last).max(1e-3);
+        let rate = |new: u64, old: u64| new.saturating_sub(old) as f64 / elapsed;
+        let line = format!("Stats: in {:.0} pps {:.0} B/s, out {:.0} pps {:.0} B/s, {} dropped, \
+                            {} session(s).",
+                           rate(current.packets_in, self.previous.packets_in),
+                           rate(current.bytes_in, self.previous.bytes_in),
+                           rate(current.packets_out, self.previous.packets_out),
+                           rate(current.bytes_out, self.previous.bytes_out),
+                           current.drops.saturating_sub(self.previous.drops),
+                           sessions);
+        info!("{}", line);
+        self.last = now;
+        self.previous = current;
+        Some(line)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::{Duration, Instant};
+    use stats::*;
+
+    #[test]
+    fn stats_test() {
+        let stats = Stats::new();
+        stats.received(100);
+        stats.received(50);
+        stats.sent(10);
+        stats.dropped();
+        assert_eq!(stats.snapshot(),
+                   StatsSnapshot {
+                       bytes_in: 150,
+                       packets_in: 2,
+                       bytes_out: 10,
+                       packets_out: 1,
+                       drops: 1,
+                   });
+    }
+
+    #[test]
+    fn collect_test() {
+        let stats = Stats::new();
+        stats.received(100);
+        stats.sent(10);
+        stats.sent(20);
+        stats.dropped();
+        let expected = StatsSnapshot {
+            bytes_in: 100,
+            packets_in: 1,
+            bytes_out: 30,
+            packets_out: 2,
+            drops: 1,
+        };
+        assert_eq!(stats.collect(false), expected);
+        assert_eq!(stats.collect(true), expected);
+        assert_eq!(stats.collect(false), StatsSnapshot::default());
+        // Snapshots are left alone.
+        assert_eq!(stats.snapshot(), expected);
+        stats.received(5);
+        assert_eq!(stats.collect(true).bytes_in, 5);
+        assert_eq!(stats.snapshot().bytes_in, 105);
+    }
+
+    #[test]
+    fn concurrent_collect_test() {
+        use std::sync::Arc;
+        use std::thread;
+
+        let stats = Arc::new(Stats::new());
+        let writers: Vec<_> = (0..4)
+            .map(|_| {
+                let stats = stats.clone();
+                thread::spawn(move || for _ in 0..10000 {
+                    stats.received(3);
+                })
+            })
+            .collect();
+        let mut packets = 0;
+        while packets < 40000 {
+            // Never the bytes of a packet without the packet.
+            let snapshot = stats.collect(true);
+            assert_eq!(snapshot.bytes_in, snapshot.packets_in * 3);
+            packets += snapshot.packets_in;
+        }
+        for writer in writers {
+            writer.join().unwrap();
+        }
+        assert_eq!(packets, 40000);
+        assert_eq!(stats.collect(false), StatsSnapshot::default());
+        assert_eq!(stats.snapshot().packets_in, 40000);
+    }
+
+    #[test]
+    fn stats_logger_test() {
+        let start = Instant::now();
+        let stats = Stats::new();
+        let mut logger = StatsLogger::new(Duration::from_secs(10), start);
+
+        stats.received(1000);
+        assert_eq!(logger.tick(&stats, 1, start + Duration::from_secs(5)), None);
+        assert_eq!(logger.timeout(start + Duration::from_secs(5)),
+                   Duration::from_secs(5));
+        assert_eq!(logger.tick(&stats, 1, start + Duration::from_secs(10)),
+                   Some(String::from("Stats: in 0 pps 100 B/s, out 0 pps 0 B/s, 0 dropped, \
+                                      1 session(s).")));
+        assert_eq!(logger.tick(&stats, 1, start + Duration::from_secs(15)), None);
+
+        stats.sent(500);
+        stats.dropped();
+        assert_eq!(logger.tick(&stats, 2, start + Duration::from_secs(20)),
+                   Some(String::from("Stats: in 0 pps 0 B/s, out 0 pps 50 B/s, 1 dropped, \
+                                      2 session(s).")));
+
+        // A collector resetting its counters in between changes nothing.
+        stats.received(2000);
+        stats.collect(true);
+        stats.received(1000);
+        stats.collect(true);
+        assert_eq!(logger.tick(&stats, 2, start + Duration::from_secs(30)),
+                   Some(String::from("Stats: in 0 pps 300 B/s, out 0 pps 0 B/s, 0 dropped, \
+                                      2 session(s).")));
+    }
+}
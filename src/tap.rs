@@ -0,0 +1,201 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::io;
+use std::os::unix::net::UnixDatagram;
+use std::sync::Arc;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::mpsc::{self, SyncSender, TrySendError};
+use std::thread;
+use device::PacketIO;
+
+// Sends each mirrored packet as one datagram to an analyzer listening on a
+// unix socket.
+pub struct UnixTap {
+    socket: UnixDatagram,
+}
+
+impl UnixTap {
+    pub fn connect(path: &str) -> io::Result<UnixTap> {
+        let socket = try!(UnixDatagram::unbound());
+        try!(socket.connect(path));
+        Ok(UnixTap { socket: socket })
+    }
+}
+
+impl PacketIO for UnixTap {
+    fn read_packet(&mut self, _: &mut [u8]) -> io::Result<usize> {
+        Err(io::Error::new(io::ErrorKind::Other, "A tap is write-only"))
+    }
+
+    fn write_packet(&mut self, packet: &[u8]) -> io::Result<()> {
+        self.socket.send(packet).map(|_| ())
+    }
+}
+
+// Mirrors copies of inner packets to a secondary PacketIO, e.g. an IDS. The
+// copies are written from another thread through a bounded queue; when the
+// analyzer falls behind and the queue is full, copies are dropped so the data
+// path never waits for it.
+pub struct Tap {
+    sender: SyncSender<Vec<u8>>,
+    dropped: Arc<AtomicUsize>,
+}
+
+impl Tap {
+    pub fn new<T: PacketIO + Send + 'static>(mut sink: T, capacity: usize) -> Tap {
+        let (sender, receiver) = mpsc::sync_channel::<Vec<u8>>(capacity);
+        let dropped = Arc::new(AtomicUsize::new(0));
+        let failed = dropped.clone();
+        thread::spawn(move || {
+            for packet in receiver {
+                if let Err(e) = sink.write_packet(&packet) {
+                    debug!("Tap write failed: {}", e);
+                    failed.fetch_add(1, Ordering::Relaxed);
+                }
+            }
+        });
+        Tap {
+            sender: sender,
+            dropped: dropped,
+        }
+    }
+
+    pub fn mirror(&self, packet: &[u8]) {
+        match self.sender.try_send(packet.to_vec()) {
+            Ok(_) => {}
+            Err(TrySendError::Full(_)) |
+            Err(TrySendError::Disconnected(_)) => {
+                self.dropped.fetch_add(1, Ordering::Relaxed);
+            }
+        }
+    }
+
+    // Copies that never reached the analyzer.
+    pub fn dropped(&self) -> usize {
+        self.dropped.load(Ordering::Relaxed)
+    }
+}
+
+// Opens the tap configured by `path`, if any.
+pub fn open(path: &Option<String>, capacity: usize) -> Result<Option<Tap>, String> {
+    match *path {
+        Some(ref path) => {
+            let sink = try!(UnixTap::connect(path).map_err(|e| format!("{}: {}", path, e)));
+            info!("Mirroring inner packets to {}.", path);
+            Ok(Some(Tap::new(sink, capacity)))
+        }
+        None => Ok(None),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::io;
+    use std::sync::{Arc, Mutex};
+    use std::sync::mpsc::{self, Receiver};
+    use std::thread;
+    use std::time::Duration;
+    use rand;
+    use device::PacketIO;
+    use tap::*;
+
+    struct Recorder {
+        packets: Arc<Mutex<Vec<Vec<u8>>>>,
+        // Each write waits for a go-ahead, to simulate a slow analyzer.
+        gate: Option<Receiver<()>>,
+    }
+
+    impl PacketIO for Recorder {
+        fn read_packet(&mut self, _: &mut [u8]) -> io::Result<usize> {
+            unimplemented!()
+        }
+
+        fn write_packet(&mut self, packet: &[u8]) -> io::Result<()> {
+            if let Some(ref gate) = self.gate {
+                gate.recv().unwrap();
+            }
+            self.packets.lock().unwrap().push(packet.to_vec());
+            Ok(())
+        }
+    }
+
+    fn wait_for(packets: &Arc<Mutex<Vec<Vec<u8>>>>, count: usize) {
+        for _ in 0..500 {
+            if packets.lock().unwrap().len() >= count {
+                return;
+            }
+            thread::sleep(Duration::from_millis(10));
+        }
+        panic!("Tap did not write {} packets", count);
+    }
+
+    #[test]
+    fn tap_test() {
+        let packets = Arc::new(Mutex::new(Vec::new()));
+        let tap = Tap::new(Recorder {
+                               packets: packets.clone(),
+                               gate: None,
+                           },
+                           16);
+        let forwarded = vec![vec![0x45, 1], vec![0x45, 2], vec![0x45, 3]];
+        for packet in &forwarded {
+            tap.mirror(packet);
+        }
+        wait_for(&packets, 3);
+        assert_eq!(*packets.lock().unwrap(), forwarded);
+        assert_eq!(tap.dropped(), 0);
+    }
+
+    #[test]
+    fn slow_tap_test() {
+        let packets = Arc::new(Mutex::new(Vec::new()));
+        let (go, gate) = mpsc::channel();
+        let tap = Tap::new(Recorder {
+                               packets: packets.clone(),
+                               gate: Some(gate),
+                           },
+                           4);
+        // The analyzer is stuck, so all but a few copies are dropped without
+        // blocking.
+        for i in 0..100u8 {
+            tap.mirror(&[0x45, i]);
+        }
+        assert!(tap.dropped() >= 100 - 5);
+        for _ in 0..100 {
+            let _ = go.send(());
+        }
+        wait_for(&packets, 100 - tap.dropped());
+        assert_eq!(packets.lock().unwrap()[0], vec![0x45, 0]);
+    }
+
+    #[test]
+    fn unix_tap_test() {
+        use std::env;
+        use std::fs;
+        use std::os::unix::net::UnixDatagram;
+
+        let path = env::temp_dir().join(format!("kytan-tap-{}.sock", rand::random::<u32>()));
+        let _ = fs::remove_file(&path);
+        let analyzer = UnixDatagram::bind(&path).unwrap();
+        let tap = open(&Some(path.to_str().unwrap().to_string()), 16).unwrap().unwrap();
+        tap.mirror(b"\x45packet");
+        let mut buf = [0u8; 64];
+        analyzer.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        let len = analyzer.recv(&mut buf).unwrap();
+        assert_eq!(&buf[..len], b"\x45packet");
+        fs::remove_file(&path).unwrap();
+    }
+}
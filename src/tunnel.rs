@@ -0,0 +1,1204 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::cmp;
+use std::collections::VecDeque;
+use std::io;
+use std::mem;
+use std::net::{IpAddr, SocketAddr, TcpStream, UdpSocket};
+use std::os::unix::io::{AsRawFd, RawFd};
+use std::sync::atomic::Ordering;
+use std::time::{Duration, Instant};
+use libc;
+use rand;
+use snap;
+use bridge::Subnet;
+use config;
+use device::{self, PacketIO};
+use dictionary::Dictionary;
+use keystore::KeyStore;
+use metrics::MetricsSink;
+use pool;
+use reorder::ReorderBuffer;
+use replay::Window;
+use stats::Stats;
+use network::{self, ConnectionId, Encoding, Header, Id, Token, Message, HandshakeLog,
+              HandshakeStep};
+
+// Bytes added to an inner packet on its way to the server: outer IP and UDP
+// headers, the header with the session's id and the packet's number, the Data
+// message framing, the AEAD tag, and some slack for incompressible packets
+// growing a little when compressed.
+pub const OVERHEAD: u16 = 20 + 8 + 10 + 21 + 16 + 15;
+
+// How long to wait for the server's Accept when handshaking over TCP.
+const TCP_HANDSHAKE_TIMEOUT_SECS: u64 = 5;
+// How long to wait for each Response, and for the reply to a diagnostic
+// hello, with `diagnose_handshake`.
+const DIAGNOSTIC_TIMEOUT_SECS: u64 = 2;
+// How long the handshake with one of several addresses of the server may
+// take before the next one is tried. Servers stop queueing Requests for
+// longer.
+pub const FALLBACK_TIMEOUT_SECS: u64 = 3;
+
+#[cfg(target_os = "macos")]
+const IP_DONTFRAG: libc::c_int = 28;
+
+fn setsockopt_int(socket: &UdpSocket,
+                  level: libc::c_int,
+                  name: libc::c_int,
+                  value: libc::c_int)
+                  -> io::Result<()> {
+    let res = unsafe {
+        libc::setsockopt(socket.as_raw_fd(),
+                         level,
+                         name,
+                         &value as *const _ as *const libc::c_void,
+                         mem::size_of_val(&value) as libc::socklen_t)
+    };
+    if res < 0 {
+        return Err(io::Error::last_os_error());
+    }
+    Ok(())
+}
+
+fn getsockopt_int(socket: &UdpSocket, level: libc::c_int, name: libc::c_int) -> io::Result<i32> {
+    let mut value: libc::c_int = 0;
+    let mut len = mem::size_of_val(&value) as libc::socklen_t;
+    let res = unsafe {
+        libc::getsockopt(socket.as_raw_fd(),
+                         level,
+                         name,
+                         &mut value as *mut _ as *mut libc::c_void,
+                         &mut len)
+    };
+    if res < 0 {
+        return Err(io::Error::last_os_error());
+    }
+    Ok(value)
+}
+
+// Sets DF on outgoing packets, so oversized datagrams fail with EMSGSIZE
+// instead of being fragmented on the way.
+#[cfg(target_os = "linux")]
+fn set_dont_fragment(socket: &UdpSocket) -> io::Result<()> {
+    setsockopt_int(socket, libc::IPPROTO_IP, libc::IP_MTU_DISCOVER, libc::IP_PMTUDISC_DO)
+}
+
+#[cfg(target_os = "macos")]
+fn set_dont_fragment(socket: &UdpSocket) -> io::Result<()> {
+    setsockopt_int(socket, libc::IPPROTO_IP, IP_DONTFRAG, 1)
+}
+
+// The path MTU the kernel learned from ICMP "fragmentation needed" messages.
+#[cfg(target_os = "linux")]
+fn path_mtu(socket: &UdpSocket) -> io::Result<u16> {
+    getsockopt_int(socket, libc::IPPROTO_IP, libc::IP_MTU).map(|mtu| mtu as u16)
+}
+
+#[cfg(target_os = "macos")]
+fn path_mtu(_: &UdpSocket) -> io::Result<u16> {
+    Err(io::Error::new(io::ErrorKind::Other, "Path MTU is not available"))
+}
+
+// An established session with a server. Packets written to it are compressed,
+// encrypted and sent to the server; packets read from it are the inner IP
+// packets the server sent back. No TUN device is involved, so programs can
+// embed it to speak IP through the VPN without any privileges.
+pub struct Tunnel {
+    socket: UdpSocket,
+    remote_addr: SocketAddr,
+    // The port given to `open`, which `reconnect` dials again.
+    server_port: u16,
+    // Tags every data packet, if enabled.
+    connection: Option<ConnectionId>,
+    id: Id,
+    token: Token,
+    mtu: u16,
+    link_prefix: u8,
+    // What the server sends us is limited to this, if configured.
+    downstream_mtu: u16,
+    // Whether the socket is connected to the server with DF set.
+    path_mtu_discovery: bool,
+    // Responses that arrived after the handshake, e.g. retransmitted ones.
+    late_handshakes: u64,
+    stats: Stats,
+    // The keys of the session, derived from those of the handshake.
+    keys: Box<KeyStore>,
+    // The number of the next data packet we send, and which of the server's
+    // arrived.
+    sent: u64,
+    received: Window,
+    encoder: snap::Encoder,
+    decoder: snap::Decoder,
+    // The preset dictionary, if the server accepted it.
+    dictionary: Option<Dictionary>,
+    // False if our profile on the server exempts data from compression.
+    compression: bool,
+    // Puts numbered packets from the server back in order, if enabled. Data
+    // sent with it enabled is numbered too, which asks the server to number
+    // what it sends back.
+    reorder: Option<ReorderBuffer<Vec<u8>>>,
+    // Packets the reorder buffer released but `recv` has not returned yet.
+    ready: VecDeque<Vec<u8>>,
+    sequence: u64,
+    // When we last sent the server anything, for keepalives.
+    last_sent: Instant,
+}
+
+fn invalid_data<E: ToString>(e: E) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, e.to_string())
+}
+
+impl Tunnel {
+    pub fn open(host: &str,
+                port: u16,
+                secret: &str,
+                config: &config::ClientConfig)
+                -> Result<Tunnel, String> {
+        let mut log = HandshakeLog::first(config.log_handshake);
+        Tunnel::open_with_log(host, port, secret, config, &mut log)
+    }
+
+    pub fn open_with_log(host: &str,
+                         port: u16,
+                         secret: &str,
+                         config: &config::ClientConfig,
+                         log: &mut HandshakeLog)
+                         -> Result<Tunnel, String> {
+        Tunnel::open_with_keystore(host, port, &network::derive_keys(secret), config, log)
+    }
+
+    // Like `open_with_log`, handshaking with the shared keys `keys` instead of
+    // those derived from a secret, e.g. keys kept in an HSM. A pre-shared key
+    // in `config` still takes precedence.
+    pub fn open_with_keystore(host: &str,
+                              port: u16,
+                              keys: &KeyStore,
+                              config: &config::ClientConfig,
+                              log: &mut HandshakeLog)
+                              -> Result<Tunnel, String> {
+        let addresses = try!(network::resolve_server(host, config));
+        if addresses.is_empty() {
+            return Err(format!("{} has no address.", host));
+        }
+        let listed: Vec<String> = addresses.iter().map(|ip| ip.to_string()).collect();
+        log.step(HandshakeStep::Resolve,
+                 &format!("Server {} resolved to {} on port {}.",
+                          host,
+                          listed.join(", "),
+                          port));
+        Tunnel::dial_any(&addresses,
+                         port,
+                         keys,
+                         config,
+                         Duration::from_secs(FALLBACK_TIMEOUT_SECS),
+                         log)
+    }
+
+    // Tries the addresses in turn until a handshake completes, giving each
+    // but the last `timeout` to.
+    fn dial_any(addresses: &[IpAddr],
+                port: u16,
+                keys: &KeyStore,
+                config: &config::ClientConfig,
+                timeout: Duration,
+                log: &mut HandshakeLog)
+                -> Result<Tunnel, String> {
+        let (last, others) = addresses.split_last().unwrap();
+        for &ip in others {
+            match Tunnel::dial(ip, port, keys, config, Some(timeout), log) {
+                Ok(tunnel) => return Ok(tunnel),
+                Err(e) => {
+                    if network::INTERRUPTED.load(Ordering::Relaxed) {
+                        return Err(e);
+                    }
+                    warn!("Unable to connect to {}, trying the next address: {}", ip, e);
+                }
+            }
+        }
+        Tunnel::dial(*last, port, keys, config, None, log)
+    }
+
+    // Handshakes with the server at `remote_ip`, failing after `timeout` if
+    // given.
+    fn dial(remote_ip: IpAddr,
+            port: u16,
+            shared: &KeyStore,
+            config: &config::ClientConfig,
+            timeout: Option<Duration>,
+            log: &mut HandshakeLog)
+            -> Result<Tunnel, String> {
+        let mut remote_addr = SocketAddr::new(remote_ip, port);
+
+        let local_addr: SocketAddr = match remote_ip {
+            IpAddr::V4(_) => "0.0.0.0:0".parse().unwrap(),
+            IpAddr::V6(_) => "[::]:0".parse().unwrap(),
+        };
+        let socket = try!(UdpSocket::bind(&local_addr).map_err(|e| e.to_string()));
+        try!(socket.set_read_timeout(timeout).map_err(|e| e.to_string()));
+        log.step(HandshakeStep::Dial,
+                 &format!("UDP socket bound to {}.",
+                          try!(socket.local_addr().map_err(|e| e.to_string()))));
+
+        let identifier = config.identifier.as_ref().map(|i| i.as_str());
+        let psk = config.psk.as_ref().map(|p| p.as_str());
+        if psk.is_some() && identifier.is_none() {
+            return Err(String::from("A pre-shared key needs an identifier to go with it."));
+        }
+        let mut dictionary = match config.compression_dictionary {
+            Some(ref path) => Some(try!(Dictionary::open(path))),
+            None => None,
+        };
+        let offer = dictionary.as_ref().map(|d| d.id());
+        let subnets = try!(Subnet::parse_all(&config.bridged_subnets));
+        let (assignment, accepted) = match config.handshake_port {
+            Some(handshake_port) => {
+                let handshake_addr = SocketAddr::new(remote_ip, handshake_port);
+                let stream = match timeout {
+                    Some(timeout) => TcpStream::connect_timeout(&handshake_addr, timeout),
+                    None => TcpStream::connect(&handshake_addr),
+                };
+                let mut stream = try!(stream.map_err(|e| e.to_string()));
+                let timeout = Some(Duration::from_secs(TCP_HANDSHAKE_TIMEOUT_SECS));
+                try!(stream.set_read_timeout(timeout).map_err(|e| e.to_string()));
+                let (assignment, accepted, data_port) = try!(network::initiate_tcp(&mut stream,
+                                                                                   shared,
+                                                                                   identifier,
+                                                                                   psk,
+                                                                                   &config.ciphers,
+                                                                                   offer,
+                                                                                   &subnets,
+                                                                                   log));
+                remote_addr.set_port(data_port);
+                (assignment, accepted)
+            }
+            None => {
+                if config.diagnose_handshake {
+                    let timeout = Duration::from_secs(DIAGNOSTIC_TIMEOUT_SECS);
+                    try!(network::initiate_with_diagnosis(&socket,
+                                                          &remote_addr,
+                                                          shared,
+                                                          identifier,
+                                                          psk,
+                                                          &config.ciphers,
+                                                          offer,
+                                                          &subnets,
+                                                          timeout,
+                                                          log))
+                } else {
+                    try!(network::initiate_with_dictionary(&socket,
+                                                           &remote_addr,
+                                                           shared,
+                                                           identifier,
+                                                           psk,
+                                                           &config.ciphers,
+                                                           offer,
+                                                           &subnets,
+                                                           log))
+                }
+            }
+        };
+        if dictionary.is_some() && !accepted {
+            info!("The server does not share our compression dictionary.");
+            dictionary = None;
+        }
+        try!(socket.set_read_timeout(None).map_err(|e| e.to_string()));
+        try!(pool::check_prefix(assignment.link_prefix));
+        let own = psk.map(network::derive_keys);
+        let keys = own.as_ref().map_or(shared, |keys| keys as &KeyStore);
+        let keys = try!(network::session_keys(keys,
+                                              assignment.cipher,
+                                              &assignment.nonces,
+                                              true));
+
+        if config.path_mtu_discovery {
+            // Connected, so the kernel tracks the path MTU to the server.
+            try!(socket.connect(&remote_addr).map_err(|e| e.to_string()));
+            try!(set_dont_fragment(&socket).map_err(|e| e.to_string()));
+        }
+
+        let mut tunnel = Tunnel {
+            socket: socket,
+            remote_addr: remote_addr,
+            server_port: port,
+            connection: if config.connection_id {
+                Some(rand::random())
+            } else {
+                None
+            },
+            id: assignment.id,
+            token: assignment.token,
+            mtu: assignment.mtu,
+            link_prefix: assignment.link_prefix,
+            downstream_mtu: config.downstream_mtu,
+            path_mtu_discovery: config.path_mtu_discovery,
+            late_handshakes: 0,
+            stats: Stats::new(),
+            keys: keys,
+            sent: 0,
+            received: Window::new(),
+            encoder: snap::Encoder::new(),
+            decoder: snap::Decoder::new(),
+            dictionary: dictionary,
+            compression: assignment.compression,
+            reorder: match config.reorder_window {
+                0 => None,
+                window => {
+                    Some(ReorderBuffer::new(window,
+                                            Duration::from_millis(config.reorder_timeout_ms)))
+                }
+            },
+            ready: VecDeque::new(),
+            sequence: 0,
+            last_sent: Instant::now(),
+        };
+        if config.handshake_port.is_some() {
+            // An empty packet, so the server learns where to send our data.
+            let bind_msg = Message::Data {
+                id: tunnel.id,
+                token: tunnel.token,
+                connection: None,
+                sequence: None,
+                encoding: Encoding::Plain,
+                data: Vec::new(),
+            };
+            try!(tunnel.send_message(&bind_msg).map_err(|e| e.to_string()));
+        }
+        Ok(tunnel)
+    }
+
+    // Performs a new handshake with the server at `remote_ip`, e.g. after its
+    // hostname started resolving elsewhere. The session is replaced only if
+    // the handshake succeeds; stats and metrics carry over.
+    pub fn reconnect(&mut self,
+                     remote_ip: IpAddr,
+                     secret: &str,
+                     config: &config::ClientConfig,
+                     log: &mut HandshakeLog)
+                     -> Result<(), String> {
+        self.reconnect_with_keystore(remote_ip, &network::derive_keys(secret), config, log)
+    }
+
+    // Like `reconnect`, handshaking with the shared keys `keys`.
+    pub fn reconnect_with_keystore(&mut self,
+                                   remote_ip: IpAddr,
+                                   keys: &KeyStore,
+                                   config: &config::ClientConfig,
+                                   log: &mut HandshakeLog)
+                                   -> Result<(), String> {
+        let mut fresh = try!(Tunnel::dial(remote_ip, self.server_port, keys, config, None, log));
+        mem::swap(&mut fresh.stats, &mut self.stats);
+        *self = fresh;
+        Ok(())
+    }
+
+    pub fn connection_id(&self) -> Option<ConnectionId> {
+        self.connection
+    }
+
+    pub fn id(&self) -> Id {
+        self.id
+    }
+
+    pub fn token(&self) -> Token {
+        self.token
+    }
+
+    // The MTU the server assigned to this session, unless changed since.
+    pub fn mtu(&self) -> u16 {
+        self.mtu
+    }
+
+    // Prefix length of our link to the server, as it told us.
+    pub fn link_prefix(&self) -> u8 {
+        self.link_prefix
+    }
+
+    // The MTU for the TUN device: the lower of ours and the downstream one,
+    // so packets fit both ways.
+    pub fn tun_mtu(&self) -> u16 {
+        match self.downstream_mtu {
+            0 => self.mtu,
+            downstream => cmp::min(self.mtu, downstream),
+        }
+    }
+
+    // Packets larger than the new MTU are refused by `send` from now on.
+    pub fn set_mtu(&mut self, mtu: u16) -> Result<(), String> {
+        try!(device::check_mtu(mtu));
+        self.mtu = mtu;
+        Ok(())
+    }
+
+    // Lowers the MTU to fit the path MTU the kernel learned, after `send`
+    // failed with EMSGSIZE. Returns the new MTU if it changed.
+    pub fn update_path_mtu(&mut self) -> io::Result<Option<u16>> {
+        let path_mtu = try!(path_mtu(&self.socket));
+        Ok(self.apply_path_mtu(path_mtu))
+    }
+
+    fn apply_path_mtu(&mut self, path_mtu: u16) -> Option<u16> {
+        let mtu = cmp::max(path_mtu.saturating_sub(OVERHEAD), device::MIN_MTU);
+        if mtu >= self.mtu {
+            return None;
+        }
+        self.mtu = mtu;
+        Some(mtu)
+    }
+
+    pub fn late_handshakes(&self) -> u64 {
+        self.late_handshakes
+    }
+
+    // Counts the inner packets carried by this tunnel.
+    pub fn stats(&self) -> &Stats {
+        &self.stats
+    }
+
+    // Reports traffic on this tunnel to `sink` from now on.
+    pub fn set_metrics(&mut self, sink: Box<MetricsSink>) {
+        sink.gauge("kytan_mtu", self.mtu as f64);
+        self.stats.set_sink(sink);
+    }
+
+    pub fn remote_addr(&self) -> SocketAddr {
+        self.remote_addr
+    }
+
+    pub fn set_read_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        self.socket.set_read_timeout(timeout)
+    }
+
+    // How long until a gap in the packets from the server times out, if one
+    // holds any up.
+    pub fn reorder_timeout(&self, now: Instant) -> Option<Duration> {
+        self.reorder.as_ref().and_then(|r| r.timeout(now))
+    }
+
+    // Copies the next packet released from the reorder buffer, e.g. once a
+    // gap timed out, into `buf`. Returns None if there is none.
+    pub fn next_ready(&mut self, buf: &mut [u8]) -> io::Result<Option<usize>> {
+        if let Some(ref mut reorder) = self.reorder {
+            self.ready.extend(reorder.expire(Instant::now()));
+        }
+        let packet = match self.ready.pop_front() {
+            Some(packet) => packet,
+            None => return Ok(None),
+        };
+        if packet.len() > buf.len() {
+            return Err(invalid_data(format!("Packet of {} bytes does not fit in buffer",
+                                            packet.len())));
+        }
+        buf[..packet.len()].copy_from_slice(&packet);
+        self.stats.received(packet.len());
+        Ok(Some(packet.len()))
+    }
+
+    // Receives a single datagram from the server. Returns None if it did not
+    // carry a packet for this session, or one that has to wait for others in
+    // the reorder buffer; call `next_ready` for the other packets it
+    // released.
+    pub fn recv(&mut self, buf: &mut [u8]) -> io::Result<Option<usize>> {
+        let mut datagram = [0u8; 1600];
+        let (len, addr) = try!(self.socket.recv_from(&mut datagram));
+        let (header, nonce, start) = try!(network::split_datagram(&datagram[0..len])
+            .map_err(invalid_data));
+        let number = match header {
+            Header::Data(_, number) => number,
+            Header::Handshake(_) => {
+                // Not opened: it is sealed with the keys of the handshake,
+                // which the session does not keep.
+                debug!("Ignoring late handshake response from {}.", addr);
+                self.late_handshakes += 1;
+                self.stats.sink().counter("kytan_late_handshakes_total", 1);
+                return Ok(None);
+            }
+        };
+        let msg = try!(network::open_message(&*self.keys, &nonce, &mut datagram[start..len])
+            .map_err(invalid_data));
+        if !self.received.accept(number) {
+            debug!("Dropping replayed data numbered {} from {}.", number, addr);
+            self.stats.dropped();
+            return Ok(None);
+        }
+        match msg {
+            Message::Data { token: server_token, sequence, encoding, data, .. } => {
+                if server_token != self.token {
+                    warn!("Token mismatched. Received: {}. Expected: {}",
+                          server_token,
+                          self.token);
+                    self.stats.dropped();
+                    return Ok(None);
+                }
+                let packet = try!(network::decode(encoding,
+                                                  data,
+                                                  &mut self.decoder,
+                                                  &self.dictionary)
+                    .map_err(invalid_data));
+                if let Some(sequence) = sequence {
+                    match self.reorder {
+                        Some(ref mut reorder) => {
+                            self.ready.extend(reorder.push(sequence, packet, Instant::now()))
+                        }
+                        None => self.ready.push_back(packet),
+                    }
+                    return self.next_ready(buf);
+                }
+                if packet.len() > buf.len() {
+                    return Err(invalid_data(format!("Packet of {} bytes does not fit in buffer",
+                                                    packet.len())));
+                }
+                buf[..packet.len()].copy_from_slice(&packet);
+                self.stats.received(packet.len());
+                Ok(Some(packet.len()))
+            }
+            _ => {
+                warn!("Invalid message {:?} from {}", msg, addr);
+                self.stats.dropped();
+                Ok(None)
+            }
+        }
+    }
+
+    pub fn send(&mut self, packet: &[u8]) -> io::Result<()> {
+        if packet.len() > self.mtu as usize {
+            return Err(io::Error::new(io::ErrorKind::InvalidInput,
+                                      format!("Packet of {} bytes exceeds MTU {}",
+                                              packet.len(),
+                                              self.mtu)));
+        }
+        let encoding = if !self.compression {
+            Encoding::Plain
+        } else if self.dictionary.is_some() {
+            Encoding::Dictionary
+        } else {
+            Encoding::Snappy
+        };
+        let data = try!(network::encode(encoding, packet, &mut self.encoder, &self.dictionary)
+            .map_err(invalid_data));
+        let sequence = if self.reorder.is_some() {
+            self.sequence += 1;
+            Some(self.sequence - 1)
+        } else {
+            None
+        };
+        let msg = Message::Data {
+            id: self.id,
+            token: self.token,
+            connection: self.connection,
+            sequence: sequence,
+            encoding: encoding,
+            data: data,
+        };
+        try!(self.send_message(&msg));
+        self.stats.sent(packet.len());
+        Ok(())
+    }
+
+    // Sends an empty data packet if nothing was sent for `interval`, so NAT
+    // mappings on the way stay open and a server following rebinds learns
+    // of a new one. Returns whether one was sent.
+    pub fn keepalive(&mut self, interval: Duration, now: Instant) -> io::Result<bool> {
+        if now < self.last_sent + interval {
+            return Ok(false);
+        }
+        let msg = Message::Data {
+            id: self.id,
+            token: self.token,
+            connection: self.connection,
+            sequence: None,
+            encoding: Encoding::Plain,
+            data: Vec::new(),
+        };
+        try!(self.send_message(&msg));
+        Ok(true)
+    }
+
+    fn send_message(&mut self, msg: &Message) -> io::Result<()> {
+        let encrypted_msg = try!(network::seal_data(&*self.keys, self.sent, msg)
+            .map_err(invalid_data));
+        self.sent += 1;
+        if self.path_mtu_discovery {
+            try!(self.socket.send(&encrypted_msg));
+        } else {
+            try!(self.socket.send_to(&encrypted_msg, &self.remote_addr));
+        }
+        self.last_sent = Instant::now();
+        Ok(())
+    }
+}
+
+impl AsRawFd for Tunnel {
+    fn as_raw_fd(&self) -> RawFd {
+        self.socket.as_raw_fd()
+    }
+}
+
+impl PacketIO for Tunnel {
+    fn read_packet(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        loop {
+            if let Some(len) = try!(self.next_ready(buf)) {
+                return Ok(len);
+            }
+            // Waits no longer than a gap holds packets up.
+            let wait = match self.reorder_timeout(Instant::now()) {
+                Some(wait) => wait,
+                None => {
+                    if let Some(len) = try!(self.recv(buf)) {
+                        return Ok(len);
+                    }
+                    continue;
+                }
+            };
+            let timeout = try!(self.socket.read_timeout());
+            try!(self.socket.set_read_timeout(Some(cmp::max(wait, Duration::from_millis(1)))));
+            let result = self.recv(buf);
+            try!(self.socket.set_read_timeout(timeout));
+            match result {
+                Ok(Some(len)) => return Ok(len),
+                Ok(None) => {}
+                Err(ref e) if e.kind() == io::ErrorKind::WouldBlock ||
+                              e.kind() == io::ErrorKind::TimedOut => {}
+                Err(e) => return Err(e),
+            }
+        }
+    }
+
+    fn write_packet(&mut self, packet: &[u8]) -> io::Result<()> {
+        self.send(packet)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::net::UdpSocket;
+    use std::sync::{Arc, Mutex};
+    use std::sync::atomic::{AtomicUsize, Ordering as AtomicOrdering};
+    use std::thread;
+    use std::time::Duration;
+    use cipher::{self, Cipher};
+    use device::PacketIO;
+    use keystore::{KeyStore, MemoryKeyStore};
+    use network::*;
+    use tunnel::*;
+
+    fn response(id: Id, token: Token, mtu: u16) -> Message {
+        Message::Response {
+            id: id,
+            token: token,
+            nonces: ([0; 16], [0; 16]),
+            cipher: cipher::DEFAULT,
+            timestamp: 0,
+            link_prefix: 24,
+            mtu: mtu,
+            compression: true,
+            dictionary: false,
+            data_port: None,
+        }
+    }
+
+    // Answers the Request in `datagram` with `reply`, like a server would.
+    // Returns the identifier it named, the sealed Response, and the keys of
+    // the session as the server uses them.
+    fn accept(keys: &KeyStore,
+              datagram: &mut [u8],
+              mut reply: Message)
+              -> (Option<String>, Vec<u8>, Box<KeyStore>) {
+        let (identifier, nonce) = match open_datagram(keys, datagram).unwrap() {
+            Message::Request { identifier, nonce, .. } => (identifier, nonce),
+            msg => panic!("Unexpected message {:?}", msg),
+        };
+        if let Message::Response { ref mut nonces, .. } = reply {
+            *nonces = (nonce, [9; 16]);
+        }
+        let session = match reply {
+            Message::Response { ref nonces, cipher, .. } => {
+                session_keys(keys, cipher, nonces, false).unwrap()
+            }
+            _ => panic!("Unexpected reply {:?}", reply),
+        };
+        (identifier, seal_handshake(None, keys, &reply).unwrap(), session)
+    }
+
+    // Accepts one client as id 42 and echoes back every data packet it sends,
+    // preceded by a retransmitted Response and a message with the wrong token,
+    // which the client must skip.
+    fn fake_server(secret: &'static str, packets: usize) -> (u16, thread::JoinHandle<()>) {
+        fake_server_on("127.0.0.1:0", secret, packets)
+    }
+
+    fn fake_server_on(addr: &str,
+                      secret: &'static str,
+                      packets: usize)
+                      -> (u16, thread::JoinHandle<()>) {
+        let socket = UdpSocket::bind(addr).unwrap();
+        let port = socket.local_addr().unwrap().port();
+        let handle = thread::spawn(move || {
+            let keys = derive_keys(secret);
+            let mut buf = [0u8; 1600];
+
+            let (len, addr) = socket.recv_from(&mut buf).unwrap();
+            let (identifier, reply, session) = accept(&keys,
+                                                      &mut buf[0..len],
+                                                      response(42, 7, 1280));
+            assert_eq!(identifier, None);
+            socket.send_to(&reply, &addr).unwrap();
+
+            for i in 0..packets as u64 {
+                let (len, addr) = socket.recv_from(&mut buf).unwrap();
+                let (encoding, data) = match open_datagram(&*session, &mut buf[0..len]).unwrap() {
+                    Message::Data { id: 42, token: 7, encoding, data, .. } => (encoding, data),
+                    msg => panic!("Unexpected message {:?}", msg),
+                };
+                socket.send_to(&reply, &addr).unwrap();
+                let stray = seal_data(&*session,
+                                      2 * i,
+                                      &Message::Data {
+                                          id: 42,
+                                          token: 8,
+                                          connection: None,
+                                          sequence: None,
+                                          encoding: encoding,
+                                          data: data.clone(),
+                                      })
+                    .unwrap();
+                socket.send_to(&stray, &addr).unwrap();
+                let echo = seal_data(&*session,
+                                     2 * i + 1,
+                                     &Message::Data {
+                                         id: 42,
+                                         token: 7,
+                                         connection: None,
+                                         sequence: None,
+                                         encoding: encoding,
+                                         data: data,
+                                     })
+                    .unwrap();
+                socket.send_to(&echo, &addr).unwrap();
+            }
+        });
+        (port, handle)
+    }
+
+    #[test]
+    fn tunnel_echo_test() {
+        let (port, server) = fake_server("password", 2);
+        let mut log = HandshakeLog::new(true);
+        let mut tunnel =
+            Tunnel::open_with_log("127.0.0.1", port, "password", &Default::default(), &mut log)
+                .unwrap();
+        assert_eq!(log.steps(),
+                   &[HandshakeStep::Resolve,
+                     HandshakeStep::Dial,
+                     HandshakeStep::RequestSent,
+                     HandshakeStep::ResponseReceived]);
+        tunnel.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        assert_eq!(tunnel.id(), 42);
+        assert_eq!(tunnel.token(), 7);
+        assert_eq!(tunnel.mtu(), 1280);
+
+        let mut buf = [0u8; 1600];
+        for packet in &[&b"first packet"[..], &[0x45u8; 200][..]] {
+            tunnel.write_packet(packet).unwrap();
+            let len = tunnel.read_packet(&mut buf).unwrap();
+            assert_eq!(&buf[0..len], *packet);
+        }
+        server.join().unwrap();
+        assert_eq!(tunnel.late_handshakes(), 2);
+        assert_eq!(tunnel.stats().snapshot().packets_in, 2);
+        assert_eq!(tunnel.stats().snapshot().drops, 2);
+
+        tunnel.set_mtu(576).unwrap();
+        assert_eq!(tunnel.mtu(), 576);
+        assert!(tunnel.send(&[0x45u8; 600]).is_err());
+        assert!(tunnel.set_mtu(100).is_err());
+        assert_eq!(tunnel.mtu(), 576);
+    }
+
+    #[derive(Default)]
+    struct RecordingSink {
+        events: Mutex<Vec<String>>,
+    }
+
+    impl MetricsSink for RecordingSink {
+        fn counter(&self, name: &str, value: u64) {
+            self.events.lock().unwrap().push(format!("counter {} {}", name, value));
+        }
+
+        fn gauge(&self, name: &str, value: f64) {
+            self.events.lock().unwrap().push(format!("gauge {} {}", name, value));
+        }
+
+        fn histogram(&self, name: &str, value: f64) {
+            self.events.lock().unwrap().push(format!("histogram {} {}", name, value));
+        }
+    }
+
+    #[test]
+    fn metrics_test() {
+        let (port, server) = fake_server("password", 1);
+        let mut tunnel = Tunnel::open("127.0.0.1", port, "password", &Default::default())
+            .unwrap();
+        tunnel.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        let sink = Arc::new(RecordingSink::default());
+        tunnel.set_metrics(Box::new(sink.clone()));
+
+        let mut buf = [0u8; 1600];
+        tunnel.write_packet(b"0123456789").unwrap();
+        tunnel.read_packet(&mut buf).unwrap();
+        server.join().unwrap();
+
+        assert_eq!(*sink.events.lock().unwrap(),
+                   vec!["gauge kytan_mtu 1280",
+                        "counter kytan_tx_packets_total 1",
+                        "counter kytan_tx_bytes_total 10",
+                        "histogram kytan_tx_packet_bytes 10",
+                        "counter kytan_late_handshakes_total 1",
+                        "counter kytan_drops_total 1",
+                        "counter kytan_rx_packets_total 1",
+                        "counter kytan_rx_bytes_total 10",
+                        "histogram kytan_rx_packet_bytes 10"]);
+    }
+
+    // Counts the handshakes sealed and opened with the shared keys, and the
+    // sessions derived from them.
+    struct CountingKeyStore {
+        keys: MemoryKeyStore,
+        seals: Arc<AtomicUsize>,
+        opens: Arc<AtomicUsize>,
+        derives: Arc<AtomicUsize>,
+    }
+
+    impl KeyStore for CountingKeyStore {
+        fn seal(&self, nonce: &[u8], data: &mut Vec<u8>) -> Result<(), String> {
+            self.seals.fetch_add(1, AtomicOrdering::SeqCst);
+            self.keys.seal(nonce, data)
+        }
+
+        fn open<'a>(&self, nonce: &[u8], data: &'a mut [u8]) -> Result<&'a mut [u8], String> {
+            self.opens.fetch_add(1, AtomicOrdering::SeqCst);
+            self.keys.open(nonce, data)
+        }
+
+        fn derive(&self,
+                  cipher: Cipher,
+                  context: &[u8],
+                  sealing: &str,
+                  opening: &str)
+                  -> Result<Box<KeyStore>, String> {
+            self.derives.fetch_add(1, AtomicOrdering::SeqCst);
+            self.keys.derive(cipher, context, sealing, opening)
+        }
+    }
+
+    #[test]
+    fn keystore_test() {
+        let (port, server) = fake_server("password", 1);
+        let (seals, opens, derives) = (Arc::new(AtomicUsize::new(0)),
+                                       Arc::new(AtomicUsize::new(0)),
+                                       Arc::new(AtomicUsize::new(0)));
+        let keys = CountingKeyStore {
+            keys: derive_keys("password"),
+            seals: seals.clone(),
+            opens: opens.clone(),
+            derives: derives.clone(),
+        };
+        let mut log = HandshakeLog::new(false);
+        let mut tunnel =
+            Tunnel::open_with_keystore("127.0.0.1", port, &keys, &Default::default(), &mut log)
+                .unwrap();
+        tunnel.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        // The Request and Response, and the session keyed from the store.
+        assert_eq!(seals.load(AtomicOrdering::SeqCst), 1);
+        assert_eq!(opens.load(AtomicOrdering::SeqCst), 1);
+        assert_eq!(derives.load(AtomicOrdering::SeqCst), 1);
+
+        let mut buf = [0u8; 1600];
+        tunnel.write_packet(b"kept in a device").unwrap();
+        let len = tunnel.read_packet(&mut buf).unwrap();
+        assert_eq!(&buf[0..len], b"kept in a device");
+        server.join().unwrap();
+        // Data goes through the session keys only.
+        assert_eq!(seals.load(AtomicOrdering::SeqCst), 1);
+    }
+
+    #[test]
+    #[cfg(target_os = "linux")]
+    fn path_mtu_test() {
+        use config::ClientConfig;
+        use libc;
+
+        let (port, server) = fake_server("password", 1);
+        let config = ClientConfig { path_mtu_discovery: true, ..Default::default() };
+        let mut tunnel = Tunnel::open("127.0.0.1", port, "password", &config).unwrap();
+        tunnel.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        assert_eq!(getsockopt_int(&tunnel.socket, libc::IPPROTO_IP, libc::IP_MTU_DISCOVER)
+                       .unwrap(),
+                   libc::IP_PMTUDISC_DO);
+
+        let mut buf = [0u8; 1600];
+        tunnel.write_packet(b"over a connected socket").unwrap();
+        let len = tunnel.read_packet(&mut buf).unwrap();
+        assert_eq!(&buf[0..len], b"over a connected socket");
+        server.join().unwrap();
+
+        // An ICMP "fragmentation needed" advertising 1200 bytes.
+        assert_eq!(tunnel.apply_path_mtu(1200), Some(1200 - OVERHEAD));
+        assert_eq!(tunnel.mtu(), 1200 - OVERHEAD);
+        assert_eq!(tunnel.apply_path_mtu(1400), None);
+        assert_eq!(tunnel.apply_path_mtu(100), Some(device::MIN_MTU));
+    }
+
+    #[test]
+    fn tun_mtu_test() {
+        use config::ClientConfig;
+
+        let (port, server) = fake_server("password", 1);
+        let config = ClientConfig { downstream_mtu: 600, ..Default::default() };
+        let mut tunnel = Tunnel::open("127.0.0.1", port, "password", &config).unwrap();
+        assert_eq!(tunnel.mtu(), 1280);
+        assert_eq!(tunnel.tun_mtu(), 600);
+        // What we send is still only limited by our own MTU.
+        tunnel.send(&[7; 700]).unwrap();
+        server.join().unwrap();
+        tunnel.set_mtu(580).unwrap();
+        assert_eq!(tunnel.tun_mtu(), 580);
+    }
+
+    #[test]
+    fn keepalive_test() {
+        use std::time::Instant;
+
+        let socket = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let port = socket.local_addr().unwrap().port();
+        let server = thread::spawn(move || {
+            let keys = derive_keys("password");
+            let mut buf = [0u8; 1600];
+            let (len, addr) = socket.recv_from(&mut buf).unwrap();
+            let (_, reply, session) = accept(&keys, &mut buf[0..len], response(42, 7, 1280));
+            socket.send_to(&reply, &addr).unwrap();
+            let (len, _) = socket.recv_from(&mut buf).unwrap();
+            match open_datagram(&*session, &mut buf[0..len]).unwrap() {
+                Message::Data { id: 42, token: 7, ref data, .. } if data.is_empty() => {}
+                msg => panic!("Unexpected message {:?}", msg),
+            }
+        });
+
+        let mut tunnel = Tunnel::open("127.0.0.1", port, "password", &Default::default())
+            .unwrap();
+        let interval = Duration::from_secs(25);
+        let now = Instant::now();
+        assert!(!tunnel.keepalive(interval, now).unwrap());
+        assert!(tunnel.keepalive(interval, now + interval).unwrap());
+        server.join().unwrap();
+        // Not again until it has been idle for another interval.
+        assert!(!tunnel.keepalive(interval, now + interval).unwrap());
+        assert_eq!(tunnel.stats().snapshot().packets_out, 0);
+    }
+
+    #[test]
+    fn tcp_handshake_test() {
+        use std::net::TcpListener;
+        use config::ClientConfig;
+
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let handshake_port = listener.local_addr().unwrap().port();
+        let data = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let data_port = data.local_addr().unwrap().port();
+        let data_port_number = data_port;
+        let server = thread::spawn(move || {
+            let keys = derive_keys("password");
+            let (mut stream, _) = listener.accept().unwrap();
+            let mut frame = read_frame(&mut stream).unwrap();
+            // Picks the cipher offered, under which the data is sealed.
+            let mut reply = response(42, 7, 1280);
+            if let Message::Response { ref mut data_port, ref mut cipher, .. } = reply {
+                *data_port = Some(data_port_number);
+                *cipher = Cipher::Chacha20Poly1305;
+            }
+            let (identifier, reply, session) = accept(&keys, &mut frame, reply);
+            assert_eq!(identifier, None);
+            write_frame(&mut stream, &reply).unwrap();
+
+            // The empty packet binding the client's UDP address, then data.
+            let mut buf = [0u8; 1600];
+            let (len, _) = data.recv_from(&mut buf).unwrap();
+            match open_datagram(&*session, &mut buf[0..len]).unwrap() {
+                Message::Data { id: 42, token: 7, ref data, .. } if data.is_empty() => {}
+                msg => panic!("Unexpected message {:?}", msg),
+            }
+            let (len, addr) = data.recv_from(&mut buf).unwrap();
+            let echo = open_datagram(&*session, &mut buf[0..len]).unwrap();
+            data.send_to(&seal_data(&*session, 0, &echo).unwrap(), &addr).unwrap();
+        });
+
+        let config = ClientConfig {
+            handshake_port: Some(handshake_port),
+            ciphers: vec![Cipher::Chacha20Poly1305],
+            ..Default::default()
+        };
+        let mut tunnel = Tunnel::open("127.0.0.1", handshake_port, "password", &config).unwrap();
+        tunnel.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        assert_eq!(tunnel.remote_addr().port(), data_port);
+        assert_eq!(tunnel.id(), 42);
+        assert_eq!(tunnel.mtu(), 1280);
+
+        let mut buf = [0u8; 1600];
+        tunnel.write_packet(b"data over udp").unwrap();
+        let len = tunnel.read_packet(&mut buf).unwrap();
+        assert_eq!(&buf[0..len], b"data over udp");
+        server.join().unwrap();
+    }
+
+    #[test]
+    #[cfg(target_os = "linux")]
+    fn reconnect_test() {
+        let (port, first) = fake_server("password", 1);
+        // Same port, but the hostname now resolves to another address.
+        let (_, second) = fake_server_on(&format!("127.0.0.2:{}", port), "password", 1);
+        let mut tunnel = Tunnel::open("127.0.0.1", port, "password", &Default::default())
+            .unwrap();
+        tunnel.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+
+        let mut buf = [0u8; 1600];
+        tunnel.write_packet(b"before").unwrap();
+        tunnel.read_packet(&mut buf).unwrap();
+        first.join().unwrap();
+
+        let mut log = HandshakeLog::new(false);
+        tunnel.reconnect("127.0.0.2".parse().unwrap(),
+                       "password",
+                       &Default::default(),
+                       &mut log)
+            .unwrap();
+        tunnel.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        assert_eq!(tunnel.remote_addr(),
+                   format!("127.0.0.2:{}", port).parse().unwrap());
+        tunnel.write_packet(b"after").unwrap();
+        let len = tunnel.read_packet(&mut buf).unwrap();
+        assert_eq!(&buf[0..len], b"after");
+        second.join().unwrap();
+        assert_eq!(tunnel.stats().snapshot().packets_in, 2);
+    }
+
+    #[test]
+    #[cfg(target_os = "linux")]
+    fn fallback_test() {
+        let (port, server) = fake_server("password", 1);
+        // Swallows the Request sent to the first address.
+        let _silent = UdpSocket::bind(("127.0.0.3", port)).unwrap();
+        let addresses = ["127.0.0.3".parse().unwrap(), "127.0.0.1".parse().unwrap()];
+        let mut log = HandshakeLog::new(false);
+        let mut tunnel = Tunnel::dial_any(&addresses,
+                                          port,
+                                          &derive_keys("password"),
+                                          &Default::default(),
+                                          Duration::from_millis(200),
+                                          &mut log)
+            .unwrap();
+        assert_eq!(tunnel.remote_addr(), format!("127.0.0.1:{}", port).parse().unwrap());
+        tunnel.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        let mut buf = [0u8; 1600];
+        tunnel.write_packet(b"fallback").unwrap();
+        let len = tunnel.read_packet(&mut buf).unwrap();
+        assert_eq!(&buf[0..len], b"fallback");
+        server.join().unwrap();
+    }
+
+    #[test]
+    #[cfg(target_os = "linux")]
+    fn send_during_reconnect_test() {
+        use config::ClientConfig;
+
+        let (port, first) = fake_server("password", 1);
+        // Connected, so the kernel reports the server going away.
+        let config = ClientConfig { path_mtu_discovery: true, ..Default::default() };
+        let mut tunnel = Tunnel::open("127.0.0.1", port, "password", &config).unwrap();
+        tunnel.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        let mut buf = [0u8; 1600];
+        tunnel.write_packet(b"before").unwrap();
+        tunnel.read_packet(&mut buf).unwrap();
+        first.join().unwrap();
+
+        // The server is gone; the first send draws a port unreachable and the
+        // next one reports it.
+        let errors: Vec<io::Error> = (0..3)
+            .filter_map(|_| tunnel.send(b"in flight").err())
+            .collect();
+        assert!(!errors.is_empty());
+        assert!(errors.iter().all(network::is_transient), "{:?}", errors);
+
+        let (second_port, second) = fake_server("password", 1);
+        tunnel.server_port = second_port;
+        let mut log = HandshakeLog::new(false);
+        tunnel.reconnect("127.0.0.1".parse().unwrap(), "password", &config, &mut log)
+            .unwrap();
+        tunnel.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        tunnel.write_packet(b"after").unwrap();
+        let len = tunnel.read_packet(&mut buf).unwrap();
+        assert_eq!(&buf[0..len], b"after");
+        second.join().unwrap();
+    }
+
+    #[test]
+    fn reorder_test() {
+        let socket = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let port = socket.local_addr().unwrap().port();
+        let server = thread::spawn(move || {
+            let keys = derive_keys("password");
+            let mut buf = [0u8; 1600];
+            let (len, addr) = socket.recv_from(&mut buf).unwrap();
+            let (_, reply, session) = accept(&keys, &mut buf[0..len], response(42, 7, 1280));
+            socket.send_to(&reply, &addr).unwrap();
+
+            // Asks for numbered data by numbering its own, tagged too.
+            let (len, addr) = socket.recv_from(&mut buf).unwrap();
+            match open_datagram(&*session, &mut buf[0..len]).unwrap() {
+                Message::Data { id: 42, token: 7, connection: Some(_), sequence: Some(0), .. } => {}
+                msg => panic!("Unexpected message {:?}", msg),
+            }
+            // 1 overtakes 0, and 2 is lost.
+            let mut encoder = snap::Encoder::new();
+            for (i, &(sequence, data)) in [(1, &b"second"[..]), (0, b"first"), (3, b"fourth")]
+                .iter()
+                .enumerate() {
+                let msg = Message::Data {
+                    id: 42,
+                    token: 7,
+                    connection: None,
+                    sequence: Some(sequence),
+                    encoding: Encoding::Snappy,
+                    data: encoder.compress_vec(data).unwrap(),
+                };
+                socket.send_to(&seal_data(&*session, i as u64, &msg).unwrap(), &addr).unwrap();
+            }
+        });
+
+        let mut config = ::config::ClientConfig::default();
+        config.reorder_window = 8;
+        config.connection_id = true;
+        let mut tunnel = Tunnel::open("127.0.0.1", port, "password", &config).unwrap();
+        tunnel.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        tunnel.write_packet(b"hello").unwrap();
+        let mut buf = [0u8; 1600];
+        for expected in &[&b"first"[..], b"second", b"fourth"] {
+            let len = tunnel.read_packet(&mut buf).unwrap();
+            assert_eq!(&buf[0..len], *expected);
+        }
+        assert_eq!(tunnel.stats().snapshot().packets_in, 3);
+        server.join().unwrap();
+    }
+}
@@ -0,0 +1,420 @@
+// Copyright 2016-2017 Chang Lan
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+use std::net::Ipv4Addr;
+use std::process::{Command, Stdio};
+use std::sync::Arc;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::thread;
+use std::time::{Duration, Instant};
+use utils::{self, RetryPolicy, Route};
+
+// Flows are hashed by the kernel into this many buckets, each routed through
+// one uplink, so moving a bucket moves only the flows in it.
+pub const BUCKETS: usize = 16;
+const MARK_OFFSET: u32 = 0x6b00;
+const FIRST_TABLE: u32 = 27520;
+// Seeds the flow hash.
+const HASH_SEED: &str = "0x6b797461";
+// The inner addresses of clients.
+const CLIENT_NETWORK: &str = "10.10.10.0/24";
+
+#[derive(Deserialize, Clone, Debug, PartialEq)]
+pub struct UplinkConfig {
+    pub interface: String,
+    pub gateway: Ipv4Addr,
+}
+
+#[derive(Deserialize, Clone, Copy, Debug, PartialEq)]
+#[serde(rename_all = "kebab-case")]
+pub enum Policy {
+    // Spread flows over all healthy uplinks.
+    FlowHash,
+    // Send everything through the first healthy uplink, in configured order.
+    Failover,
+}
+
+// Which uplink each bucket of flows leaves through, given which uplinks are
+// healthy.
+pub struct Balancer {
+    policy: Policy,
+    healthy: Vec<bool>,
+    buckets: Vec<usize>,
+}
+
+impl Balancer {
+    // All uplinks start out healthy.
+    pub fn new(uplinks: usize, policy: Policy) -> Balancer {
+        let mut balancer = Balancer {
+            policy: policy,
+            healthy: vec![true; uplinks],
+            buckets: vec![0; BUCKETS],
+        };
+        balancer.assign();
+        balancer
+    }
+
+    pub fn uplink(&self, bucket: usize) -> usize {
+        self.buckets[bucket]
+    }
+
+    pub fn is_healthy(&self, uplink: usize) -> bool {
+        self.healthy[uplink]
+    }
+
+    // Records the outcome of a health check. Returns the buckets that moved
+    // to another uplink as a result.
+    pub fn set_healthy(&mut self, uplink: usize, healthy: bool) -> Vec<usize> {
+        if self.healthy[uplink] == healthy {
+            return Vec::new();
+        }
+        self.healthy[uplink] = healthy;
+        let before = self.buckets.clone();
+        self.assign();
+        (0..BUCKETS).filter(|&b| self.buckets[b] != before[b]).collect()
+    }
+
+    // Buckets stay on their own uplink while it is healthy, so a failure only
+    // moves the flows of the failed uplink: to the least loaded healthy ones.
+    // With no healthy uplink left, nothing moves, as there is nowhere better.
+    fn assign(&mut self) {
+        let healthy: Vec<usize> = (0..self.healthy.len()).filter(|&u| self.healthy[u]).collect();
+        if healthy.is_empty() {
+            return;
+        }
+        let mut load = vec![0; self.healthy.len()];
+        let mut orphans = Vec::new();
+        for bucket in 0..BUCKETS {
+            let home = match self.policy {
+                Policy::FlowHash => bucket % self.healthy.len(),
+                Policy::Failover => healthy[0],
+            };
+            if self.healthy[home] {
+                self.buckets[bucket] = home;
+                load[home] += 1;
+            } else {
+                orphans.push(bucket);
+            }
+        }
+        for bucket in orphans {
+            let uplink = *healthy.iter().min_by_key(|&&u| (load[u], u)).unwrap();
+            self.buckets[bucket] = uplink;
+            load[uplink] += 1;
+        }
+    }
+}
+
+fn args(args: &[&str]) -> Vec<String> {
+    args.iter().map(|a| String::from(*a)).collect()
+}
+
+fn mark(bucket: usize) -> String {
+    format!("{:#x}", MARK_OFFSET + bucket as u32)
+}
+
+fn table(bucket: usize) -> String {
+    (FIRST_TABLE + bucket as u32).to_string()
+}
+
+// The command pointing a bucket's routing table at an uplink.
+fn route_step(bucket: usize, uplink: &UplinkConfig) -> Vec<String> {
+    args(&["ip", "route", "replace", "default", "via", &uplink.gateway.to_string(), "dev",
+           &uplink.interface, "table", &table(bucket)])
+}
+
+// The commands, in order, that balance traffic from clients arriving on
+// `tun`: each flow is marked with the bucket its addresses, ports and
+// protocol hash to, and a rule per bucket routes marked packets by a table of
+// its own. Traffic to other clients, the server itself and the networks of
+// `routes` is left unmarked, to be routed as usual. Each step comes with the
+// command undoing it.
+fn setup_steps(tun: &str,
+               uplinks: &[UplinkConfig],
+               balancer: &Balancer,
+               routes: &[Route])
+               -> Vec<(Vec<String>, Vec<String>)> {
+    let mut steps = Vec::new();
+    for route in routes {
+        let network = format!("{}/{}", route.network, route.prefix_len);
+        let bypass = |action| {
+            args(&["iptables", "-w", "-t", "mangle", action, "PREROUTING", "-i", tun, "-d",
+                   &network, "-j", "RETURN"])
+        };
+        steps.push((bypass("-A"), bypass("-D")));
+    }
+    let hmark = |action| {
+        args(&["iptables", "-w", "-t", "mangle", action, "PREROUTING", "-i", tun, "!", "-d",
+               CLIENT_NETWORK, "-m", "addrtype", "!", "--dst-type", "LOCAL", "-j", "HMARK",
+               "--hmark-tuple", "src,dst,sport,dport,proto", "--hmark-mod",
+               &BUCKETS.to_string(), "--hmark-offset", &mark(0), "--hmark-rnd", HASH_SEED])
+    };
+    steps.push((hmark("-A"), hmark("-D")));
+    for uplink in uplinks {
+        let masquerade = |action| {
+            args(&["iptables", "-w", "-t", "nat", action, "POSTROUTING", "-s", CLIENT_NETWORK,
+                   "-o", &uplink.interface, "-j", "MASQUERADE"])
+        };
+        steps.push((masquerade("-A"), masquerade("-D")));
+    }
+    for bucket in 0..BUCKETS {
+        let rule = |action| {
+            args(&["ip", "rule", action, "fwmark", &mark(bucket), "table", &table(bucket)])
+        };
+        steps.push((rule("add"), rule("del")));
+    }
+    for bucket in 0..BUCKETS {
+        steps.push((route_step(bucket, &uplinks[balancer.uplink(bucket)]),
+                    args(&["ip", "route", "del", "default", "table", &table(bucket)])));
+    }
+    steps
+}
+
+// Decides whether an uplink can currently reach the internet.
+pub trait HealthCheck {
+    fn check(&self, uplink: &UplinkConfig) -> bool;
+}
+
+// Pings `target` out of each uplink's interface.
+pub struct PingCheck {
+    pub target: Ipv4Addr,
+    pub timeout: Duration,
+}
+
+impl HealthCheck for PingCheck {
+    fn check(&self, uplink: &UplinkConfig) -> bool {
+        Command::new("ping")
+            .args(&["-n", "-q", "-c", "1", "-W", &self.timeout.as_secs().to_string(), "-I",
+                    &uplink.interface, &self.target.to_string()])
+            .stdout(Stdio::null())
+            .stderr(Stdio::null())
+            .status()
+            .map(|status| status.success())
+            .unwrap_or(false)
+    }
+}
+
+// Checks every uplink and reroutes the buckets of those whose health changed.
+// Returns the route commands to run.
+fn check_all(uplinks: &[UplinkConfig],
+             checker: &HealthCheck,
+             balancer: &mut Balancer)
+             -> Vec<Vec<String>> {
+    let mut moved = Vec::new();
+    for (i, uplink) in uplinks.iter().enumerate() {
+        let healthy = checker.check(uplink);
+        if healthy != balancer.is_healthy(i) {
+            if healthy {
+                info!("Uplink {} is back.", uplink.interface);
+            } else {
+                warn!("Uplink {} failed its health check. Draining it.", uplink.interface);
+            }
+            moved.extend(balancer.set_healthy(i, healthy));
+            if (0..uplinks.len()).all(|u| !balancer.is_healthy(u)) {
+                error!("No healthy uplink left. Keeping the current routes.");
+            }
+        }
+    }
+    moved.sort();
+    moved.dedup();
+    moved.iter().map(|&b| route_step(b, &uplinks[balancer.uplink(b)])).collect()
+}
+
+// Balances the traffic of clients over several uplinks for as long as it
+// lives, checking their health from another thread every `interval`.
+pub struct UplinkBalancer {
+    stop: Arc<AtomicBool>,
+    thread: Option<thread::JoinHandle<()>>,
+}
+
+impl UplinkBalancer {
+    pub fn start(tun: &str,
+                 uplinks: &[UplinkConfig],
+                 policy: Policy,
+                 checker: Box<HealthCheck + Send>,
+                 interval: Duration)
+                 -> Result<UplinkBalancer, String> {
+        if !cfg!(target_os = "linux") {
+            return Err(String::from("Balancing uplinks is only supported on Linux."));
+        }
+        let route_policy = RetryPolicy::default();
+        let mut balancer = Balancer::new(uplinks.len(), policy);
+        // The networks the server reaches other than by its default route,
+        // as they are now.
+        let routes: Vec<Route> = try!(utils::list_routes(&route_policy))
+            .into_iter()
+            .filter(|r| r.prefix_len > 0 && r.interface.as_ref().map_or(true, |i| i != tun))
+            .collect();
+        let mut undo = Vec::new();
+        for (step, undo_step) in setup_steps(tun, uplinks, &balancer, &routes) {
+            if let Err(e) = utils::run_step(&step, &route_policy) {
+                teardown(undo, &route_policy);
+                return Err(e);
+            }
+            undo.push(undo_step);
+        }
+
+        let stop = Arc::new(AtomicBool::new(false));
+        let stopped = stop.clone();
+        let uplinks = uplinks.to_vec();
+        let thread = thread::spawn(move || {
+            let mut next_check = Instant::now();
+            while !stopped.load(Ordering::Relaxed) {
+                if Instant::now() >= next_check {
+                    for step in check_all(&uplinks, &*checker, &mut balancer) {
+                        if let Err(e) = utils::run_step(&step, &route_policy) {
+                            error!("Failed to reroute flows: {}", e);
+                        }
+                    }
+                    next_check = Instant::now() + interval;
+                }
+                thread::sleep(Duration::from_millis(100));
+            }
+            teardown(undo, &route_policy);
+        });
+        Ok(UplinkBalancer {
+            stop: stop,
+            thread: Some(thread),
+        })
+    }
+}
+
+fn teardown(mut undo: Vec<Vec<String>>, policy: &RetryPolicy) {
+    while let Some(step) = undo.pop() {
+        if let Err(e) = utils::run_step(&step, policy) {
+            error!("Failed to restore routes: {}", e);
+        }
+    }
+}
+
+impl Drop for UplinkBalancer {
+    fn drop(&mut self) {
+        self.stop.store(true, Ordering::Relaxed);
+        if let Some(thread) = self.thread.take() {
+            let _ = thread.join();
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::cell::RefCell;
+    use std::collections::HashSet;
+    use uplink::*;
+
+    fn uplinks() -> Vec<UplinkConfig> {
+        ["eth0", "eth1", "wwan0"]
+            .iter()
+            .enumerate()
+            .map(|(i, name)| {
+                UplinkConfig {
+                    interface: String::from(*name),
+                    gateway: Ipv4Addr::new(192, 0, 2, 1 + i as u8),
+                }
+            })
+            .collect()
+    }
+
+    fn load(balancer: &Balancer, uplink: usize) -> usize {
+        (0..BUCKETS).filter(|&b| balancer.uplink(b) == uplink).count()
+    }
+
+    struct FakeCheck {
+        down: RefCell<HashSet<String>>,
+    }
+
+    impl HealthCheck for FakeCheck {
+        fn check(&self, uplink: &UplinkConfig) -> bool {
+            !self.down.borrow().contains(&uplink.interface)
+        }
+    }
+
+    #[test]
+    fn distribute_test() {
+        let mut balancer = Balancer::new(3, Policy::FlowHash);
+        assert_eq!((load(&balancer, 0), load(&balancer, 1), load(&balancer, 2)), (6, 5, 5));
+
+        // The failed uplink is drained; only its buckets move, evenly.
+        let before: Vec<usize> = (0..BUCKETS).map(|b| balancer.uplink(b)).collect();
+        let moved = balancer.set_healthy(1, false);
+        assert_eq!(moved.len(), 5);
+        assert_eq!(load(&balancer, 1), 0);
+        assert_eq!(load(&balancer, 0) + load(&balancer, 2), BUCKETS);
+        assert!((load(&balancer, 0) as isize - load(&balancer, 2) as isize).abs() <= 1);
+        for bucket in (0..BUCKETS).filter(|b| !moved.contains(b)) {
+            assert_eq!(balancer.uplink(bucket), before[bucket]);
+        }
+
+        // Back to where they were once it recovers.
+        assert_eq!(balancer.set_healthy(1, true), moved);
+        assert!(balancer.set_healthy(1, true).is_empty());
+
+        // With every uplink down, traffic stays where it was.
+        balancer.set_healthy(0, false);
+        balancer.set_healthy(1, false);
+        assert!(balancer.set_healthy(2, false).is_empty());
+        assert_eq!(load(&balancer, 2), BUCKETS);
+    }
+
+    #[test]
+    fn failover_test() {
+        let mut balancer = Balancer::new(3, Policy::Failover);
+        assert_eq!(load(&balancer, 0), BUCKETS);
+        balancer.set_healthy(0, false);
+        assert_eq!(load(&balancer, 1), BUCKETS);
+        balancer.set_healthy(0, true);
+        assert_eq!(load(&balancer, 0), BUCKETS);
+    }
+
+    #[test]
+    fn check_all_test() {
+        let uplinks = uplinks();
+        let mut balancer = Balancer::new(3, Policy::FlowHash);
+        let checker = FakeCheck { down: RefCell::new(HashSet::new()) };
+        assert!(check_all(&uplinks, &checker, &mut balancer).is_empty());
+
+        checker.down.borrow_mut().insert(String::from("eth1"));
+        let steps = check_all(&uplinks, &checker, &mut balancer);
+        assert_eq!(steps.len(), 5);
+        assert!(steps.iter().all(|s| !s.contains(&String::from("eth1"))));
+        assert_eq!(steps[0].join(" "),
+                   "ip route replace default via 192.0.2.3 dev wwan0 table 27521");
+    }
+
+    #[test]
+    fn setup_steps_test() {
+        let balancer = Balancer::new(3, Policy::FlowHash);
+        let routes = vec![Route {
+                              network: Ipv4Addr::new(192, 168, 1, 0),
+                              prefix_len: 24,
+                              interface: Some(String::from("eth0")),
+                          }];
+        let steps = setup_steps("tun0", &uplinks(), &balancer, &routes);
+        assert_eq!(steps.len(), 2 + 3 + 2 * BUCKETS);
+        assert_eq!(steps[0].0.join(" "),
+                   "iptables -w -t mangle -A PREROUTING -i tun0 -d 192.168.1.0/24 -j RETURN");
+        assert_eq!(steps[0].1.join(" "),
+                   "iptables -w -t mangle -D PREROUTING -i tun0 -d 192.168.1.0/24 -j RETURN");
+        assert_eq!(steps[1].0.join(" "),
+                   "iptables -w -t mangle -A PREROUTING -i tun0 ! -d 10.10.10.0/24 -m addrtype \
+                    ! --dst-type LOCAL -j HMARK --hmark-tuple src,dst,sport,dport,proto \
+                    --hmark-mod 16 --hmark-offset 0x6b00 --hmark-rnd 0x6b797461");
+        assert_eq!(steps[4].0.join(" "),
+                   "iptables -w -t nat -A POSTROUTING -s 10.10.10.0/24 -o wwan0 -j MASQUERADE");
+        assert_eq!(steps[5].0.join(" "), "ip rule add fwmark 0x6b00 table 27520");
+        assert_eq!(steps[5].1.join(" "), "ip rule del fwmark 0x6b00 table 27520");
+        assert_eq!(steps[5 + BUCKETS + 2].0.join(" "),
+                   "ip route replace default via 192.0.2.3 dev wwan0 table 27522");
+    }
+}
@@ -12,13 +12,103 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-use std::process::Command;
+use std::cmp;
+use std::fmt;
+use std::fs::{self, File, OpenOptions};
+use std::io::{self, Read, Write};
+use std::net::{IpAddr, Ipv4Addr};
+use std::os::unix::fs::{OpenOptionsExt, PermissionsExt};
+use std::process::{Command, Output, Stdio};
+use std::thread;
+use std::time::{Duration, Instant};
 use libc;
 
 pub fn is_root() -> bool {
     unsafe { libc::geteuid() == 0 }
 }
 
+const CAP_NET_ADMIN: u32 = 12;
+
+// Whether a capability set in /proc/<pid>/status, e.g. "CapEff", includes
+// CAP_NET_ADMIN.
+fn has_net_admin(proc_status: &str, set: &str) -> bool {
+    let prefix = format!("{}:", set);
+    proc_status.lines()
+        .find(|line| line.starts_with(&prefix))
+        .and_then(|line| u64::from_str_radix(line[prefix.len()..].trim(), 16).ok())
+        .map_or(false, |caps| caps & (1 << CAP_NET_ADMIN) != 0)
+}
+
+fn check_privileges_with(root: bool, proc_status: Option<&str>) -> Result<(), String> {
+    let hint = "kytan creates a TUN device and changes routes, which needs CAP_NET_ADMIN. \
+                Run it with sudo or grant it with `setcap cap_net_admin+ep`; in a \
+                container, start it with --cap-add=NET_ADMIN and --device=/dev/net/tun. \
+                Programs that only need to send packets can embed kytan::tunnel::Tunnel, \
+                which needs no privileges.";
+    // Where the capability sets are known, CAP_NET_ADMIN is what counts, so
+    // a process granted it without root may run too. It also has to be
+    // inheritable then, to pass it on to the ip and route commands we run.
+    match proc_status {
+        Some(status) if !has_net_admin(status, "CapEff") => {
+            match root {
+                true => Err(format!("Running as root, but without CAP_NET_ADMIN. {}", hint)),
+                false => Err(format!("Not running as root, nor with CAP_NET_ADMIN. {}", hint)),
+            }
+        }
+        Some(status) if !root && !has_net_admin(status, "CapInh") => {
+            Err(format!("Not running as root, and CAP_NET_ADMIN is not inheritable, which the \
+                         commands changing routes need. Grant it with `setcap \
+                         cap_net_admin+eip`. {}",
+                        hint))
+        }
+        Some(_) => Ok(()),
+        None if root => Ok(()),
+        None => Err(format!("Not running as root. {}", hint)),
+    }
+}
+
+// Fails early, with advice, when we lack the privileges to bring up the
+// tunnel, instead of failing with EPERM halfway through.
+pub fn check_privileges() -> Result<(), String> {
+    let status = if cfg!(target_os = "linux") {
+        read_file("/proc/self/status").ok().and_then(|b| String::from_utf8(b).ok())
+    } else {
+        None
+    };
+    try!(check_privileges_with(is_root(), status.as_ref().map(|s| s.as_str())));
+    if !is_root() {
+        try!(keep_net_admin());
+    }
+    Ok(())
+}
+
+// Raises CAP_NET_ADMIN into the ambient set, so the commands we run keep it
+// when we were granted it without root.
+#[cfg(target_os = "linux")]
+fn keep_net_admin() -> Result<(), String> {
+    const PR_CAP_AMBIENT: libc::c_int = 47;
+    const PR_CAP_AMBIENT_RAISE: libc::c_ulong = 2;
+    let ret = unsafe {
+        libc::prctl(PR_CAP_AMBIENT,
+                    PR_CAP_AMBIENT_RAISE,
+                    CAP_NET_ADMIN as libc::c_ulong,
+                    0 as libc::c_ulong,
+                    0 as libc::c_ulong)
+    };
+    match ret {
+        0 => Ok(()),
+        _ => {
+            Err(format!("Unable to pass CAP_NET_ADMIN on to commands: {}",
+                        io::Error::last_os_error()))
+        }
+    }
+}
+
+#[cfg(not(target_os = "linux"))]
+fn keep_net_admin() -> Result<(), String> {
+    Ok(())
+}
+
 pub fn enable_ipv4_forwarding() -> Result<(), String> {
     let sysctl_arg = if cfg!(target_os = "linux") {
         "net.ipv4.ip_forward=1"
@@ -45,133 +135,838 @@ fn enable_ipv4_forwarding_test() {
     enable_ipv4_forwarding().unwrap();
 }
 
+#[derive(Clone, Copy, Debug, PartialEq)]
 pub enum RouteType {
     Net,
     Host,
 }
 
+impl RouteType {
+    fn flag(&self) -> &'static str {
+        match *self {
+            RouteType::Net => "-net",
+            RouteType::Host => "-host",
+        }
+    }
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Family {
+    Inet,
+    Inet6,
+}
+
+impl Family {
+    fn of(route: &str) -> Family {
+        if route.contains(':') {
+            Family::Inet6
+        } else {
+            Family::Inet
+        }
+    }
+}
+
+// Where a route sends traffic: to a router's address, out of an interface
+// (e.g. a point-to-point link without one), or both, as link-local IPv6
+// routers need.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Gateway {
+    pub family: Family,
+    pub address: Option<IpAddr>,
+    pub interface: Option<String>,
+}
+
+impl Gateway {
+    pub fn via(address: IpAddr) -> Gateway {
+        Gateway {
+            family: match address {
+                IpAddr::V4(_) => Family::Inet,
+                IpAddr::V6(_) => Family::Inet6,
+            },
+            address: Some(address),
+            interface: None,
+        }
+    }
+
+    // Reads the default route from `ip route list` output in Linux, or
+    // `route -n get default` output in macOS.
+    pub fn parse(family: Family, output: &str) -> Option<Gateway> {
+        if cfg!(target_os = "macos") {
+            parse_route_get(family, output)
+        } else {
+            parse_ip_route(family, output)
+        }
+    }
+
+    // Reads every default route, in the order they are listed. `route -n get`
+    // only lists the one in use.
+    pub fn parse_all(family: Family, output: &str) -> Vec<Gateway> {
+        if cfg!(target_os = "macos") {
+            parse_route_get(family, output).into_iter().collect()
+        } else {
+            output.lines().filter_map(|line| parse_ip_route(family, line)).collect()
+        }
+    }
+
+    fn new(family: Family,
+           address: Option<IpAddr>,
+           interface: Option<String>)
+           -> Option<Gateway> {
+        if address.is_none() && interface.is_none() {
+            return None;
+        }
+        Some(Gateway {
+            family: family,
+            address: address,
+            interface: interface,
+        })
+    }
+}
+
+// e.g. "default via 192.168.1.1 dev eth0 proto dhcp" or "default dev ppp0".
+fn parse_ip_route(family: Family, output: &str) -> Option<Gateway> {
+    let line = match output.lines().map(|l| l.trim()).find(|l| !l.is_empty()) {
+        Some(line) => line,
+        None => return None,
+    };
+    let words: Vec<&str> = line.split_whitespace().collect();
+    let mut address = None;
+    let mut interface = None;
+    for pair in words.windows(2) {
+        match pair[0] {
+            "via" => address = pair[1].parse().ok(),
+            "dev" => interface = Some(String::from(pair[1])),
+            _ => {}
+        }
+    }
+    Gateway::new(family, address, interface)
+}
+
+// "gateway: 192.168.1.1" and "interface: en0" lines; point-to-point links
+// have no gateway line.
+fn parse_route_get(family: Family, output: &str) -> Option<Gateway> {
+    let mut address = None;
+    let mut interface = None;
+    for line in output.lines() {
+        let mut fields = line.splitn(2, ':').map(|f| f.trim());
+        match (fields.next(), fields.next()) {
+            (Some("gateway"), Some(value)) => {
+                // Link-local routers are printed scoped, e.g. fe80::1%en0.
+                address = value.split('%').next().and_then(|a| a.parse().ok());
+            }
+            (Some("interface"), Some(value)) => interface = Some(String::from(value)),
+            _ => {}
+        }
+    }
+    Gateway::new(family, address, interface)
+}
+
+impl fmt::Display for Gateway {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match (&self.address, &self.interface) {
+            (&Some(ref address), &Some(ref interface)) => {
+                write!(f, "{} dev {}", address, interface)
+            }
+            (&Some(ref address), &None) => write!(f, "{}", address),
+            (&None, &Some(ref interface)) => write!(f, "dev {}", interface),
+            (&None, &None) => write!(f, "none"),
+        }
+    }
+}
+
+// An IPv4 route the host has, other than the default one.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Route {
+    pub network: Ipv4Addr,
+    pub prefix_len: u8,
+    pub interface: Option<String>,
+}
+
+impl Route {
+    // Reads `ip -4 route list` output in Linux, or `netstat -rn -f inet`
+    // output in macOS.
+    pub fn parse_all(output: &str) -> Vec<Route> {
+        if cfg!(target_os = "macos") {
+            parse_netstat(output)
+        } else {
+            parse_ip_routes(output)
+        }
+    }
+
+    pub fn overlaps(&self, network: Ipv4Addr, prefix_len: u8) -> bool {
+        let len = cmp::min(self.prefix_len, prefix_len) as u32;
+        let mask = if len == 0 { 0 } else { !0u32 << (32 - len) };
+        u32::from(self.network) & mask == u32::from(network) & mask
+    }
+}
+
+impl fmt::Display for Route {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        try!(write!(f, "{}/{}", self.network, self.prefix_len));
+        if let Some(ref interface) = self.interface {
+            try!(write!(f, " dev {}", interface));
+        }
+        Ok(())
+    }
+}
+
+// e.g. "192.168.1.0/24 dev eth0 proto kernel scope link src 192.168.1.5", or
+// "unreachable 10.0.0.0/8". Host routes have no prefix length.
+fn parse_ip_routes(output: &str) -> Vec<Route> {
+    let mut routes = Vec::new();
+    for line in output.lines() {
+        let mut words: Vec<&str> = line.split_whitespace().collect();
+        if words.first().map_or(false, |w| w.parse::<Ipv4Addr>().is_err() && !w.contains('/')) {
+            // A route type, or "default".
+            words.remove(0);
+        }
+        let destination = match words.first() {
+            Some(destination) => destination,
+            None => continue,
+        };
+        let mut parts = destination.splitn(2, '/');
+        let network = parts.next().and_then(|n| n.parse().ok());
+        let prefix_len = parts.next().map_or(Some(32), |l| l.parse().ok());
+        let interface = words.windows(2)
+            .find(|pair| pair[0] == "dev")
+            .map(|pair| String::from(pair[1]));
+        if let (Some(network), Some(prefix_len)) = (network, prefix_len) {
+            routes.push(Route {
+                network: network,
+                prefix_len: prefix_len,
+                interface: interface,
+            });
+        }
+    }
+    routes
+}
+
+// e.g. "192.168.1          link#4             UCS             en0", where
+// networks leave out their trailing zero octets unless a prefix length is
+// given.
+fn parse_netstat(output: &str) -> Vec<Route> {
+    let mut routes = Vec::new();
+    for line in output.lines() {
+        let words: Vec<&str> = line.split_whitespace().collect();
+        let destination = match words.first() {
+            Some(destination) => destination,
+            None => continue,
+        };
+        let mut parts = destination.splitn(2, '/');
+        let octets: Vec<u8> = match parts.next()
+            .unwrap()
+            .split('.')
+            .map(|o| o.parse().ok())
+            .collect::<Option<Vec<u8>>>() {
+            Some(ref octets) if octets.len() <= 4 => octets.clone(),
+            _ => continue,
+        };
+        let prefix_len = match parts.next().map(|l| l.parse()) {
+            Some(Ok(prefix_len)) => prefix_len,
+            Some(Err(_)) => continue,
+            None => 8 * octets.len() as u8,
+        };
+        let mut padded = [0; 4];
+        padded[..octets.len()].copy_from_slice(&octets);
+        routes.push(Route {
+            network: Ipv4Addr::from(padded),
+            prefix_len: prefix_len,
+            interface: words.get(3).map(|i| String::from(*i)),
+        });
+    }
+    routes
+}
+
+// The operations DefaultGateway needs from the host routing table, so that it
+// can be exercised against a fake table in tests.
+pub trait Routing {
+    fn get_default_gateway(&self, family: Family) -> Result<Gateway, String>;
+    // All default routes, including one into the tunnel.
+    fn get_default_gateways(&self, family: Family) -> Result<Vec<Gateway>, String> {
+        self.get_default_gateway(family).map(|gateway| vec![gateway])
+    }
+    fn list_routes(&self) -> Result<Vec<Route>, String>;
+    fn add_route(&self,
+                 route_type: RouteType,
+                 route: &str,
+                 gateway: &Gateway)
+                 -> Result<(), String>;
+    fn delete_route(&self, route_type: RouteType, route: &str) -> Result<(), String>;
+}
+
+pub struct SystemRouting {
+    pub policy: RetryPolicy,
+}
+
+impl Routing for SystemRouting {
+    fn get_default_gateway(&self, family: Family) -> Result<Gateway, String> {
+        get_default_gateway(family, &self.policy)
+    }
+
+    fn get_default_gateways(&self, family: Family) -> Result<Vec<Gateway>, String> {
+        get_default_gateways(family, &self.policy)
+    }
+
+    fn list_routes(&self) -> Result<Vec<Route>, String> {
+        list_routes(&self.policy)
+    }
+
+    fn add_route(&self,
+                 route_type: RouteType,
+                 route: &str,
+                 gateway: &Gateway)
+                 -> Result<(), String> {
+        add_route(route_type, route, gateway, &self.policy)
+    }
+
+    fn delete_route(&self, route_type: RouteType, route: &str) -> Result<(), String> {
+        delete_route(route_type, route, &self.policy)
+    }
+}
+
+// Refuses a tunnel address `address`/`prefix_len` overlapping a route the host
+// already has, e.g. a LAN on the same subnet, as either would then break
+// subtly. With `allow`, only warns.
+pub fn check_route_conflict(routing: &Routing,
+                            address: Ipv4Addr,
+                            prefix_len: u8,
+                            allow: bool)
+                            -> Result<(), String> {
+    let routes = match routing.list_routes() {
+        Ok(routes) => routes,
+        Err(e) => {
+            warn!("Unable to check the routing table for conflicts: {}", e);
+            return Ok(());
+        }
+    };
+    let overlapping = routes.iter().find(|r| r.prefix_len > 0 && r.overlaps(address, prefix_len));
+    let conflict = match overlapping {
+        Some(conflict) => conflict,
+        None => return Ok(()),
+    };
+    let message = format!("The tunnel address {}/{} overlaps the local route {}.",
+                          address,
+                          prefix_len,
+                          conflict);
+    if allow {
+        warn!("{} Traffic for it may take the wrong one.", message);
+        Ok(())
+    } else {
+        Err(format!("{} Move the local network, or set allow_route_conflicts to connect \
+                     anyway.",
+                    message))
+    }
+}
+
 pub struct DefaultGateway {
-    origin: String,
+    routing: Box<Routing>,
+    // The IPv4 default route the tunnel replaces. Hosts reaching the server
+    // over IPv6, e.g. through NAT64, may have none.
+    origin: Option<Gateway>,
+    // Where the host route keeping the server reachable outside the tunnel
+    // goes: the default gateway of the server address's family.
+    pin: Gateway,
     remote: String,
+    // The tunnel's end of the link, where the default route now points.
+    gateway: Gateway,
+    // How many of the route changes in `create` were made, so that dropping a
+    // half-built gateway undoes exactly those.
+    applied: usize,
 }
 
 impl DefaultGateway {
-    pub fn create(gateway: &str, remote: &str) -> DefaultGateway {
-        let origin = get_default_gateway().unwrap();
-        info!("Original default gateway: {}.", origin);
-        add_route(RouteType::Host, remote, &origin).unwrap();
-        delete_default_gateway().unwrap();
-        set_default_gateway(gateway).unwrap();
-        DefaultGateway {
+    pub fn create(routing: Box<Routing>,
+                  gateway: &str,
+                  remote: &str)
+                  -> Result<DefaultGateway, String> {
+        DefaultGateway::create_interruptible(routing, gateway, remote, || false)
+    }
+
+    // Like `create`, but gives up before each route change once `interrupted`
+    // returns true. Changes already made are rolled back on any failure.
+    pub fn create_interruptible<F>(routing: Box<Routing>,
+                                   gateway: &str,
+                                   remote: &str,
+                                   interrupted: F)
+                                   -> Result<DefaultGateway, String>
+        where F: Fn() -> bool
+    {
+        let gateway = Gateway::via(try!(gateway.parse()
+            .map_err(|_| format!("Invalid gateway address {}.", gateway))));
+        // Nothing is touched until we know there is a route to restore later.
+        let family = Family::of(remote);
+        let pin = try!(routing.get_default_gateway(family));
+        let origin = match family {
+            Family::Inet => Some(pin.clone()),
+            Family::Inet6 => routing.get_default_gateway(Family::Inet).ok(),
+        };
+        match origin {
+            Some(ref origin) => info!("Original default gateway: {}.", origin),
+            None => info!("No IPv4 default gateway. Reaching {} via {}.", remote, pin),
+        }
+        let mut gw = DefaultGateway {
+            routing: routing,
             origin: origin,
+            pin: pin,
             remote: String::from(remote),
+            gateway: gateway,
+            applied: 0,
+        };
+        for step in 0..3 {
+            if interrupted() {
+                return Err(String::from("Interrupted while changing routes."));
+            }
+            try!(match (step, gw.origin.is_some()) {
+                (0, _) => gw.routing.add_route(RouteType::Host, &gw.remote, &gw.pin),
+                (1, true) => gw.routing.delete_route(RouteType::Net, "default"),
+                (1, false) => Ok(()),
+                _ => gw.routing.add_route(RouteType::Net, "default", &gw.gateway),
+            });
+            gw.applied += 1;
+        }
+        Ok(gw)
+    }
+
+    // Moves the host route keeping the server reachable outside the tunnel to
+    // its new address.
+    pub fn set_remote(&mut self, remote: &str) -> Result<(), String> {
+        if self.applied >= 1 {
+            let family = Family::of(remote);
+            if family != self.pin.family {
+                self.pin = try!(self.routing.get_default_gateway(family));
+            }
+            try!(self.routing.add_route(RouteType::Host, remote, &self.pin));
+            if let Err(e) = self.routing.delete_route(RouteType::Host, &self.remote) {
+                warn!("Failed to delete route to {}: {}", self.remote, e);
+            }
+        }
+        self.remote = String::from(remote);
+        Ok(())
+    }
+
+    // After the host moved to another network, routes the traffic to the
+    // server via the gateway there, the default route other than ours into
+    // the tunnel. Returns the new gateway if it changed.
+    pub fn repin(&mut self) -> Result<Option<Gateway>, String> {
+        if self.applied < 1 {
+            return Ok(None);
+        }
+        let family = Family::of(&self.remote);
+        let gateways = try!(self.routing.get_default_gateways(family));
+        let pin = match gateways.into_iter().find(|g| *g != self.gateway) {
+            Some(pin) => pin,
+            None => return Err(format!("No route to {} besides the tunnel.", self.remote)),
+        };
+        if pin == self.pin {
+            return Ok(None);
+        }
+        if let Err(e) = self.routing.delete_route(RouteType::Host, &self.remote) {
+            warn!("Failed to delete route to {}: {}", self.remote, e);
+        }
+        try!(self.routing.add_route(RouteType::Host, &self.remote, &pin));
+        self.pin = pin.clone();
+        Ok(Some(pin))
+    }
+
+    // Points the default route into the tunnel again, after the kernel
+    // removed it along with a TUN device that vanished.
+    pub fn reapply(&self) -> Result<(), String> {
+        if self.applied < 3 {
+            return Ok(());
         }
+        self.routing.add_route(RouteType::Net, "default", &self.gateway)
     }
 }
 
 impl Drop for DefaultGateway {
     fn drop(&mut self) {
-        delete_default_gateway().unwrap();
-        set_default_gateway(&self.origin).unwrap();
-        delete_route(RouteType::Host, &self.remote).unwrap();
+        let mut results = Vec::new();
+        if self.applied >= 3 {
+            results.push(self.routing.delete_route(RouteType::Net, "default"));
+        }
+        if let (true, &Some(ref origin)) = (self.applied >= 2, &self.origin) {
+            results.push(self.routing.add_route(RouteType::Net, "default", origin));
+        }
+        if self.applied >= 1 {
+            results.push(self.routing.delete_route(RouteType::Host, &self.remote));
+        }
+        for result in results {
+            if let Err(e) = result {
+                error!("Failed to restore routes: {}", e);
+            }
+        }
     }
 }
 
-pub fn delete_route(route_type: RouteType, route: &str) -> Result<(), String> {
-    let mode = match route_type {
-        RouteType::Net => "-net",
-        RouteType::Host => "-host",
-    };
-    info!("Deleting route: {} {}.", mode, route);
-    let status = if cfg!(target_os = "linux") {
-        Command::new("route")
-            .arg("-n")
-            .arg("del")
-            .arg(mode)
-            .arg(route)
-            .status()
-            .unwrap()
-    } else if cfg!(target_os = "macos") {
-        Command::new("route")
-            .arg("-n")
-            .arg("delete")
-            .arg(mode)
-            .arg(route)
-            .status()
-            .unwrap()
-    } else {
-        unimplemented!()
-    };
-    if status.success() {
+// Route commands can fail transiently (e.g. the routing table is locked by
+// another process), so each one is run with a timeout and retried with
+// exponential backoff before giving up.
+#[derive(Clone, Debug)]
+pub struct RetryPolicy {
+    pub attempts: u32,
+    pub backoff: Duration,
+    pub timeout: Duration,
+}
+
+impl Default for RetryPolicy {
+    fn default() -> RetryPolicy {
+        RetryPolicy {
+            attempts: 3,
+            backoff: Duration::from_millis(100),
+            timeout: Duration::from_secs(5),
+        }
+    }
+}
+
+impl RetryPolicy {
+    pub fn run<T, F>(&self, what: &str, mut f: F) -> Result<T, String>
+        where F: FnMut(Duration) -> Result<T, String>
+    {
+        let mut backoff = self.backoff;
+        let mut attempt = 1;
+        loop {
+            match f(self.timeout) {
+                Ok(v) => return Ok(v),
+                Err(e) => {
+                    if attempt >= self.attempts {
+                        return Err(format!("{} failed after {} attempt(s): {}", what, attempt, e));
+                    }
+                    warn!("{} failed (attempt {}/{}): {}. Retrying in {:?}.",
+                          what,
+                          attempt,
+                          self.attempts,
+                          e,
+                          backoff);
+                    thread::sleep(backoff);
+                    backoff = backoff * 2;
+                    attempt += 1;
+                }
+            }
+        }
+    }
+}
+
+fn run_command(cmd: &mut Command, timeout: Duration) -> Result<Output, String> {
+    let mut child = try!(cmd.stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .map_err(|e| e.to_string()));
+    let start = Instant::now();
+    loop {
+        match try!(child.try_wait().map_err(|e| e.to_string())) {
+            Some(_) => return child.wait_with_output().map_err(|e| e.to_string()),
+            None if start.elapsed() >= timeout => {
+                let _ = child.kill();
+                let _ = child.wait();
+                return Err(format!("timed out after {:?}", timeout));
+            }
+            None => thread::sleep(Duration::from_millis(10)),
+        }
+    }
+}
+
+fn run_route_command(cmd: &mut Command, timeout: Duration) -> Result<(), String> {
+    let output = try!(run_command(cmd, timeout));
+    if output.status.success() {
         Ok(())
     } else {
-        Err(format!("route: {}", status))
+        Err(format!("route: {}: {}",
+                    output.status,
+                    String::from_utf8_lossy(&output.stderr).trim()))
     }
 }
 
-pub fn add_route(route_type: RouteType, route: &str, gateway: &str) -> Result<(), String> {
-    let mode = match route_type {
-        RouteType::Net => "-net",
-        RouteType::Host => "-host",
+// Arguments of the `route` command changing `route`, for Linux or macOS. A
+// route is added when `gateway` is given and deleted otherwise. The family
+// follows the gateway, or the destination when deleting.
+fn route_args(linux: bool,
+              route_type: RouteType,
+              route: &str,
+              gateway: Option<&Gateway>)
+              -> Vec<String> {
+    let family = gateway.map_or(Family::of(route), |g| g.family);
+    let mut args: Vec<String> = vec![String::from("-n")];
+    let action = match (gateway.is_some(), linux) {
+        (true, _) => "add",
+        (false, true) => "del",
+        (false, false) => "delete",
     };
-    info!("Adding route: {} {} gateway {}.", mode, route, gateway);
-    let status = if cfg!(target_os = "linux") {
-        Command::new("route")
-            .arg("-n")
-            .arg("add")
-            .arg(mode)
-            .arg(route)
-            .arg("gw")
-            .arg(gateway)
-            .status()
-            .unwrap()
-    } else if cfg!(target_os = "macos") {
-        Command::new("route")
-            .arg("-n")
-            .arg("add")
-            .arg(mode)
-            .arg(route)
-            .arg(gateway)
-            .status()
-            .unwrap()
+    if linux && family == Family::Inet6 {
+        // net-tools takes IPv6 routes as prefixes.
+        args.extend(vec![String::from("-A"), String::from("inet6"), String::from(action)]);
+        args.push(match route_type {
+            RouteType::Host if route != "default" => format!("{}/128", route),
+            _ => String::from(route),
+        });
     } else {
-        unimplemented!()
+        args.push(String::from(action));
+        if family == Family::Inet6 {
+            args.push(String::from("-inet6"));
+        }
+        args.push(String::from(route_type.flag()));
+        args.push(String::from(route));
+    }
+    let gateway = match gateway {
+        Some(gateway) => gateway,
+        None => return args,
     };
-    if status.success() {
-        Ok(())
-    } else {
-        Err(format!("route: {}", status))
+    match (linux, &gateway.address, &gateway.interface) {
+        (true, address, interface) => {
+            if let Some(ref address) = *address {
+                args.extend(vec![String::from("gw"), address.to_string()]);
+            }
+            if let Some(ref interface) = *interface {
+                args.extend(vec![String::from("dev"), interface.clone()]);
+            }
+        }
+        (false, &Some(IpAddr::V6(ref address)), &Some(ref interface)) if
+            address.segments()[0] & 0xffc0 == 0xfe80 => {
+            args.push(format!("{}%{}", address, interface));
+        }
+        (false, &Some(ref address), &Some(ref interface)) => {
+            args.extend(vec![address.to_string(), String::from("-ifscope"), interface.clone()]);
+        }
+        (false, &Some(ref address), &None) => args.push(address.to_string()),
+        (false, &None, &Some(ref interface)) => {
+            args.extend(vec![String::from("-interface"), interface.clone()]);
+        }
+        (false, &None, &None) => {}
     }
+    args
 }
 
-pub fn set_default_gateway(gateway: &str) -> Result<(), String> {
-    add_route(RouteType::Net, "default", gateway)
+fn run_route(what: &str, args: Vec<String>, policy: &RetryPolicy) -> Result<(), String> {
+    policy.run(what,
+               |timeout| run_route_command(Command::new("route").args(&args), timeout))
 }
 
-pub fn delete_default_gateway() -> Result<(), String> {
-    delete_route(RouteType::Net, "default")
+pub fn delete_route(route_type: RouteType, route: &str, policy: &RetryPolicy) -> Result<(), String> {
+    if !cfg!(target_os = "linux") && !cfg!(target_os = "macos") {
+        unimplemented!()
+    }
+    info!("Deleting route: {} {}.", route_type.flag(), route);
+    run_route("route delete",
+              route_args(cfg!(target_os = "linux"), route_type, route, None),
+              policy)
 }
 
-pub fn get_default_gateway() -> Result<String, String> {
-    let cmd = if cfg!(target_os = "linux") {
-        "ip -4 route list 0/0 | awk '{print $3}'"
-    } else if cfg!(target_os = "macos") {
-        "route -n get default | grep gateway | awk '{print $2}'"
-    } else {
+pub fn add_route(route_type: RouteType,
+                 route: &str,
+                 gateway: &Gateway,
+                 policy: &RetryPolicy)
+                 -> Result<(), String> {
+    if !cfg!(target_os = "linux") && !cfg!(target_os = "macos") {
         unimplemented!()
+    }
+    info!("Adding route: {} {} gateway {}.", route_type.flag(), route, gateway);
+    run_route("route add",
+              route_args(cfg!(target_os = "linux"), route_type, route, Some(gateway)),
+              policy)
+}
+
+pub fn set_default_gateway(gateway: &Gateway, policy: &RetryPolicy) -> Result<(), String> {
+    add_route(RouteType::Net, "default", gateway, policy)
+}
+
+pub fn delete_default_gateway(policy: &RetryPolicy) -> Result<(), String> {
+    delete_route(RouteType::Net, "default", policy)
+}
+
+// The output of the shell command `cmd`, which only reads the routing table.
+fn query_routes(what: &str, cmd: &str, policy: &RetryPolicy) -> Result<String, String> {
+    let output = try!(policy.run(what, |timeout| {
+        let output = try!(run_command(Command::new("bash").arg("-c").arg(cmd), timeout));
+        if output.status.success() {
+            Ok(output)
+        } else {
+            Err(String::from_utf8_lossy(&output.stderr).into_owned())
+        }
+    }));
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+}
+
+pub fn list_routes(policy: &RetryPolicy) -> Result<Vec<Route>, String> {
+    let cmd = match (cfg!(target_os = "linux"), cfg!(target_os = "macos")) {
+        (true, _) => "ip -4 route list",
+        (_, true) => "netstat -rn -f inet",
+        _ => unimplemented!(),
     };
-    let output = Command::new("bash")
-        .arg("-c")
-        .arg(cmd)
-        .output()
-        .unwrap();
-    if output.status.success() {
-        Ok(String::from_utf8(output.stdout).unwrap().trim_right().to_string())
-    } else {
-        Err(String::from_utf8(output.stderr).unwrap())
+    Ok(Route::parse_all(&try!(query_routes("route listing", cmd, policy))))
+}
+
+fn list_default_routes(family: Family, policy: &RetryPolicy) -> Result<String, String> {
+    let cmd = match (cfg!(target_os = "linux"), cfg!(target_os = "macos"), family) {
+        (true, _, Family::Inet) => "ip -4 route list 0/0",
+        (true, _, Family::Inet6) => "ip -6 route list ::/0",
+        // Fails without a default route, which is reported by the caller.
+        (_, true, Family::Inet) => "route -n get default || true",
+        (_, true, Family::Inet6) => "route -n get -inet6 default || true",
+        _ => unimplemented!(),
+    };
+    query_routes("default gateway lookup", cmd, policy)
+}
+
+pub fn get_default_gateways(family: Family, policy: &RetryPolicy) -> Result<Vec<Gateway>, String> {
+    list_default_routes(family, policy).map(|stdout| Gateway::parse_all(family, &stdout))
+}
+
+pub fn get_default_gateway(family: Family, policy: &RetryPolicy) -> Result<Gateway, String> {
+    let stdout = try!(list_default_routes(family, policy));
+    match Gateway::parse(family, &stdout) {
+        Some(gateway) => Ok(gateway),
+        None => {
+            Err(String::from("No default gateway found. Check that this host has network \
+                              connectivity (a default route) before connecting."))
+        }
     }
 }
 
+// Firewall mark and routing table of traffic sent through the tunnel by port.
+const PORT_ROUTING_MARK: &str = "0x6b74";
+const PORT_ROUTING_TABLE: &str = "27508";
+const PORT_ROUTING_CHAIN: &str = "kytan-ports";
+
+fn command(args: &[&str]) -> Vec<String> {
+    args.iter().map(|a| String::from(*a)).collect()
+}
+
+// The rule that keeps the tunnel's own packets to the server out of it, even
+// when the server listens on one of the tunneled ports.
+fn port_routing_exclusion(action: &str, remote: &str) -> Vec<String> {
+    command(&["iptables", "-w", "-t", "mangle", action, PORT_ROUTING_CHAIN, "-d", remote, "-j",
+              "RETURN"])
+}
+
+// The commands, in order, that send locally originated TCP and UDP traffic to
+// `ports` through `tun` whatever its destination: packets are marked in the
+// mangle table, and a rule looks up marked packets in a table of our own
+// whose default route is the tunnel. Their source address is rewritten to
+// the tunnel's, as it was picked for the original route.
+fn port_routing_steps(ports: &[u16], tun: &str, remote: &str) -> Vec<Vec<String>> {
+    let mut steps = vec![command(&["iptables", "-w", "-t", "mangle", "-N", PORT_ROUTING_CHAIN]),
+                         port_routing_exclusion("-A", remote)];
+    for port in ports {
+        for protocol in &["tcp", "udp"] {
+            steps.push(command(&["iptables", "-w", "-t", "mangle", "-A", PORT_ROUTING_CHAIN,
+                                 "-p", protocol, "--dport", &port.to_string(), "-j", "MARK",
+                                 "--set-mark", PORT_ROUTING_MARK]));
+        }
+    }
+    steps.push(command(&["iptables", "-w", "-t", "mangle", "-A", "OUTPUT", "-j",
+                         PORT_ROUTING_CHAIN]));
+    steps.push(command(&["iptables", "-w", "-t", "nat", "-A", "POSTROUTING", "-o", tun, "-m",
+                         "mark", "--mark", PORT_ROUTING_MARK, "-j", "MASQUERADE"]));
+    steps.push(command(&["ip", "rule", "add", "fwmark", PORT_ROUTING_MARK, "table",
+                         PORT_ROUTING_TABLE]));
+    steps.push(command(&["ip", "route", "add", "default", "dev", tun, "table",
+                         PORT_ROUTING_TABLE]));
+    steps
+}
+
+// The command undoing a step of `port_routing_steps`.
+fn undo_step(step: &[String]) -> Vec<String> {
+    step.iter()
+        .map(|arg| {
+            String::from(match arg.as_str() {
+                "-A" => "-D",
+                "-N" => "-X",
+                "add" => "del",
+                arg => arg,
+            })
+        })
+        .collect()
+}
+
+// Runs a command given as its arguments, e.g. from `port_routing_steps`.
+pub fn run_step(step: &[String], policy: &RetryPolicy) -> Result<(), String> {
+    info!("Running {}.", step.join(" "));
+    policy.run(&step[0], |timeout| {
+        let output = try!(run_command(Command::new(&step[0]).args(&step[1..]), timeout));
+        if output.status.success() {
+            Ok(())
+        } else {
+            Err(format!("{}: {}: {}",
+                        step[0],
+                        output.status,
+                        String::from_utf8_lossy(&output.stderr).trim()))
+        }
+    })
+}
+
+// Routes traffic to a list of destination ports through the tunnel, leaving
+// everything else on the original route, for as long as it lives. Linux only,
+// as it relies on firewall marks and policy routing.
+pub struct PortRouting {
+    policy: RetryPolicy,
+    // The steps taken so far, undone in reverse when dropped.
+    applied: Vec<Vec<String>>,
+}
+
+impl PortRouting {
+    pub fn create(ports: &[u16],
+                  tun: &str,
+                  remote: &str,
+                  policy: RetryPolicy)
+                  -> Result<PortRouting, String> {
+        if !cfg!(target_os = "linux") {
+            return Err(String::from("Routing by port is only supported on Linux."));
+        }
+        let mut routing = PortRouting {
+            policy: policy,
+            applied: Vec::new(),
+        };
+        for step in port_routing_steps(ports, tun, remote) {
+            try!(run_step(&step, &routing.policy));
+            routing.applied.push(step);
+        }
+        Ok(routing)
+    }
+
+    // Keeps the tunnel's packets to the server's new address out of it.
+    pub fn set_remote(&mut self, remote: &str) -> Result<(), String> {
+        // The exclusion is the second step, and the first rule of the chain.
+        if self.applied.len() >= 2 {
+            let mut replace = port_routing_exclusion("-R", remote);
+            replace.insert(6, String::from("1"));
+            try!(run_step(&replace, &self.policy));
+            self.applied[1] = port_routing_exclusion("-A", remote);
+        }
+        Ok(())
+    }
+}
+
+impl Drop for PortRouting {
+    fn drop(&mut self) {
+        while let Some(step) = self.applied.pop() {
+            if let Err(e) = run_step(&undo_step(&step), &self.policy) {
+                error!("Failed to restore routes: {}", e);
+            }
+        }
+    }
+}
+
+pub fn read_file(path: &str) -> Result<Vec<u8>, String> {
+    let mut contents = Vec::new();
+    let mut file = try!(File::open(path).map_err(|e| format!("{}: {}", path, e)));
+    try!(file.read_to_end(&mut contents).map_err(|e| format!("{}: {}", path, e)));
+    Ok(contents)
+}
+
+// Writes a file only the current user can read, for contents such as session
+// tokens.
+pub fn write_private_file(path: &str, contents: &[u8]) -> Result<(), String> {
+    let mut file = try!(OpenOptions::new()
+        .write(true)
+        .create(true)
+        .truncate(true)
+        .mode(0o600)
+        .open(path)
+        .map_err(|e| format!("{}: {}", path, e)));
+    try!(fs::set_permissions(path, fs::Permissions::from_mode(0o600))
+        .map_err(|e| format!("{}: {}", path, e)));
+    file.write_all(contents).map_err(|e| format!("{}: {}", path, e))
+}
+
 pub fn get_public_ip() -> Result<String, String> {
     let output = Command::new("curl")
         .arg("ipecho.net/plain")
@@ -186,19 +981,520 @@ pub fn get_public_ip() -> Result<String, String> {
 
 #[cfg(test)]
 mod tests {
+    use std::rc::Rc;
+    use std::cell::RefCell;
     use utils::*;
 
+    #[test]
+    fn check_privileges_test() {
+        let full = "Name:\tkytan\nCapEff:\t000001ffffffffff\n";
+        let no_net_admin = "Name:\tkytan\nCapEff:\t00000000a80425fb\n";
+        assert!(check_privileges_with(true, Some(full)).is_ok());
+        assert!(check_privileges_with(true, None).is_ok());
+        assert!(check_privileges_with(false, None).unwrap_err().contains("Not running as root"));
+        // CAP_NET_ADMIN alone is enough without root, once inheritable.
+        let net_admin_only = "Name:\tkytan\nCapInh:\t0000000000001000\n\
+                              CapEff:\t0000000000001000\n";
+        assert!(check_privileges_with(false, Some(net_admin_only)).is_ok());
+        let not_inheritable = "Name:\tkytan\nCapInh:\t0000000000000000\n\
+                               CapEff:\t0000000000001000\n";
+        assert!(check_privileges_with(false, Some(not_inheritable))
+            .unwrap_err()
+            .contains("cap_net_admin+eip"));
+        assert!(check_privileges_with(true, Some(not_inheritable)).is_ok());
+        assert!(check_privileges_with(false, Some(no_net_admin))
+            .unwrap_err()
+            .contains("Not running as root"));
+        assert!(check_privileges_with(true, Some(no_net_admin))
+            .unwrap_err()
+            .contains("CAP_NET_ADMIN"));
+        assert!(check_privileges_with(true, Some("Name:\tkytan\n")).is_err());
+    }
+
+    fn router(address: &str) -> Option<Gateway> {
+        Some(Gateway::via(address.parse().unwrap()))
+    }
+
+    struct FakeRouting {
+        gateway: Option<Gateway>,
+        log: Rc<RefCell<Vec<String>>>,
+    }
+
+    // Has a default route of one family only.
+    impl Routing for FakeRouting {
+        fn get_default_gateway(&self, family: Family) -> Result<Gateway, String> {
+            self.gateway
+                .clone()
+                .and_then(|g| if g.family == family { Some(g) } else { None })
+                .ok_or(String::from("No default gateway found."))
+        }
+
+        fn list_routes(&self) -> Result<Vec<Route>, String> {
+            Ok(Vec::new())
+        }
+
+        fn add_route(&self,
+                     route_type: RouteType,
+                     route: &str,
+                     gateway: &Gateway)
+                     -> Result<(), String> {
+            self.log.borrow_mut().push(format!("add {:?} {} {}", route_type, route, gateway));
+            Ok(())
+        }
+
+        fn delete_route(&self, route_type: RouteType, route: &str) -> Result<(), String> {
+            self.log.borrow_mut().push(format!("del {:?} {}", route_type, route));
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn default_gateway_test() {
+        let log = Rc::new(RefCell::new(Vec::new()));
+        let routing = FakeRouting {
+            gateway: router("192.168.1.1"),
+            log: log.clone(),
+        };
+        {
+            let _gw = DefaultGateway::create(Box::new(routing), "10.10.10.1", "1.2.3.4").unwrap();
+            assert_eq!(*log.borrow(),
+                       vec!["add Host 1.2.3.4 192.168.1.1",
+                            "del Net default",
+                            "add Net default 10.10.10.1"]);
+        }
+        assert_eq!(log.borrow()[3..].to_vec(),
+                   vec!["del Net default", "add Net default 192.168.1.1", "del Host 1.2.3.4"]);
+    }
+
+    #[test]
+    fn reapply_test() {
+        let log = Rc::new(RefCell::new(Vec::new()));
+        let routing = FakeRouting {
+            gateway: router("192.168.1.1"),
+            log: log.clone(),
+        };
+        let gw = DefaultGateway::create(Box::new(routing), "10.10.10.1", "1.2.3.4").unwrap();
+        gw.reapply().unwrap();
+        assert_eq!(log.borrow()[3..].to_vec(), vec!["add Net default 10.10.10.1"]);
+    }
+
+    #[test]
+    fn nat64_default_gateway_test() {
+        // IPv6-only, with the server reached through a synthesized address.
+        let log = Rc::new(RefCell::new(Vec::new()));
+        let routing = FakeRouting {
+            gateway: Some(Gateway {
+                family: Family::Inet6,
+                address: Some("fe80::1".parse().unwrap()),
+                interface: Some(String::from("wlan0")),
+            }),
+            log: log.clone(),
+        };
+        let remote = "64:ff9b::c000:221";
+        {
+            let _gw = DefaultGateway::create(Box::new(routing), "10.10.10.1", remote).unwrap();
+            assert_eq!(*log.borrow(),
+                       vec!["add Host 64:ff9b::c000:221 fe80::1 dev wlan0",
+                            "add Net default 10.10.10.1"]);
+        }
+        assert_eq!(log.borrow()[2..].to_vec(),
+                   vec!["del Net default", "del Host 64:ff9b::c000:221"]);
+        // Pinned as a /128 through the link-local router.
+        assert_eq!(route_args(true,
+                              RouteType::Host,
+                              remote,
+                              Some(&Gateway {
+                                  family: Family::Inet6,
+                                  address: Some("fe80::1".parse().unwrap()),
+                                  interface: Some(String::from("wlan0")),
+                              }))
+                       .join(" "),
+                   "-n -A inet6 add 64:ff9b::c000:221/128 gw fe80::1 dev wlan0");
+
+        // A server reached over IPv4 cannot be pinned without an IPv4 route.
+        let routing = FakeRouting {
+            gateway: router("fe80::1"),
+            log: log.clone(),
+        };
+        assert!(DefaultGateway::create(Box::new(routing), "10.10.10.1", "192.0.2.33").is_err());
+    }
+
+    #[test]
+    fn set_remote_test() {
+        let log = Rc::new(RefCell::new(Vec::new()));
+        let routing = FakeRouting {
+            gateway: router("192.168.1.1"),
+            log: log.clone(),
+        };
+        {
+            let mut gw = DefaultGateway::create(Box::new(routing), "10.10.10.1", "1.2.3.4")
+                .unwrap();
+            gw.set_remote("5.6.7.8").unwrap();
+            assert_eq!(log.borrow()[3..].to_vec(),
+                       vec!["add Host 5.6.7.8 192.168.1.1", "del Host 1.2.3.4"]);
+        }
+        assert_eq!(log.borrow()[5..].to_vec(),
+                   vec!["del Net default", "add Net default 192.168.1.1", "del Host 5.6.7.8"]);
+    }
+
+    // Default routes that change as the host moves between networks.
+    struct MovingRouting {
+        gateways: Rc<RefCell<Vec<Gateway>>>,
+        log: Rc<RefCell<Vec<String>>>,
+    }
+
+    impl Routing for MovingRouting {
+        fn get_default_gateway(&self, _: Family) -> Result<Gateway, String> {
+            self.gateways.borrow().first().cloned().ok_or(String::from("No default gateway found."))
+        }
+
+        fn get_default_gateways(&self, _: Family) -> Result<Vec<Gateway>, String> {
+            Ok(self.gateways.borrow().clone())
+        }
+
+        fn list_routes(&self) -> Result<Vec<Route>, String> {
+            Ok(Vec::new())
+        }
+
+        fn add_route(&self,
+                     route_type: RouteType,
+                     route: &str,
+                     gateway: &Gateway)
+                     -> Result<(), String> {
+            self.log.borrow_mut().push(format!("add {:?} {} {}", route_type, route, gateway));
+            Ok(())
+        }
+
+        fn delete_route(&self, route_type: RouteType, route: &str) -> Result<(), String> {
+            self.log.borrow_mut().push(format!("del {:?} {}", route_type, route));
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn repin_test() {
+        let log = Rc::new(RefCell::new(Vec::new()));
+        let gateways = Rc::new(RefCell::new(vec![router("192.168.1.1").unwrap()]));
+        let routing = MovingRouting {
+            gateways: gateways.clone(),
+            log: log.clone(),
+        };
+        let mut gw = DefaultGateway::create(Box::new(routing), "10.10.10.1", "1.2.3.4").unwrap();
+        // Ours, and the one of the network we moved to.
+        *gateways.borrow_mut() = vec![router("10.10.10.1").unwrap(), router("172.20.0.1").unwrap()];
+        assert_eq!(gw.repin(), Ok(router("172.20.0.1")));
+        assert_eq!(log.borrow()[3..].to_vec(),
+                   vec!["del Host 1.2.3.4", "add Host 1.2.3.4 172.20.0.1"]);
+        assert_eq!(gw.repin(), Ok(None));
+        assert_eq!(log.borrow().len(), 5);
+        // Nowhere to go but the tunnel.
+        *gateways.borrow_mut() = vec![router("10.10.10.1").unwrap()];
+        assert!(gw.repin().is_err());
+        assert_eq!(log.borrow().len(), 5);
+    }
+
+    #[test]
+    fn parse_all_default_routes_test() {
+        let output = "default via 10.10.10.1 dev tun0\n\
+                      default via 192.168.1.1 dev eth0 proto dhcp metric 100\n";
+        let gateways = Gateway::parse_all(Family::Inet, output);
+        assert_eq!(gateways.len(), 2);
+        assert_eq!(gateways[1].address, Some("192.168.1.1".parse().unwrap()));
+        assert!(Gateway::parse_all(Family::Inet, "").is_empty());
+    }
+
+    #[test]
+    fn interrupted_default_gateway_test() {
+        use std::cell::Cell;
+        // Undo log expected after being interrupted before each route change.
+        let rollbacks: [&[&str]; 3] = [&[],
+                                       &["del Host 1.2.3.4"],
+                                       &["add Net default 192.168.1.1", "del Host 1.2.3.4"]];
+        for (step, rollback) in rollbacks.iter().enumerate() {
+            let log = Rc::new(RefCell::new(Vec::new()));
+            let routing = FakeRouting {
+                gateway: router("192.168.1.1"),
+                log: log.clone(),
+            };
+            let checks = Cell::new(0);
+            let result = DefaultGateway::create_interruptible(Box::new(routing),
+                                                              "10.10.10.1",
+                                                              "1.2.3.4",
+                                                              || {
+                                                                  checks.set(checks.get() + 1);
+                                                                  checks.get() > step
+                                                              });
+            assert!(result.is_err());
+            assert_eq!(log.borrow()[step..].to_vec(), rollback.to_vec());
+        }
+    }
+
+    #[test]
+    fn no_default_gateway_test() {
+        let log = Rc::new(RefCell::new(Vec::new()));
+        let routing = FakeRouting {
+            gateway: None,
+            log: log.clone(),
+        };
+        assert!(DefaultGateway::create(Box::new(routing), "10.10.10.1", "1.2.3.4").is_err());
+        assert!(log.borrow().is_empty());
+    }
+
+    #[test]
+    fn interface_gateway_test() {
+        let log = Rc::new(RefCell::new(Vec::new()));
+        let routing = FakeRouting {
+            gateway: parse_ip_route(Family::Inet, "default dev ppp0 scope link\n"),
+            log: log.clone(),
+        };
+        {
+            let _gw = DefaultGateway::create(Box::new(routing), "10.10.10.1", "1.2.3.4").unwrap();
+        }
+        // Restored out of the interface, as there is no router address.
+        assert_eq!(log.borrow()[0], "add Host 1.2.3.4 dev ppp0");
+        assert_eq!(log.borrow()[4], "add Net default dev ppp0");
+    }
+
+    // A host on 10.10.0.0/16, say an office LAN.
+    struct LanRouting;
+
+    impl Routing for LanRouting {
+        fn get_default_gateway(&self, _: Family) -> Result<Gateway, String> {
+            Ok(router("10.10.0.1").unwrap())
+        }
+
+        fn list_routes(&self) -> Result<Vec<Route>, String> {
+            Ok(parse_ip_routes("default via 10.10.0.1 dev eth0 proto dhcp metric 100\n\
+                                10.10.0.0/16 dev eth0 proto kernel scope link src 10.10.3.7\n\
+                                172.17.0.0/16 dev docker0 proto kernel scope link linkdown\n"))
+        }
+
+        fn add_route(&self, _: RouteType, _: &str, _: &Gateway) -> Result<(), String> {
+            Ok(())
+        }
+
+        fn delete_route(&self, _: RouteType, _: &str) -> Result<(), String> {
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn route_conflict_test() {
+        let inner = "10.10.10.2".parse().unwrap();
+        assert_eq!(check_route_conflict(&LanRouting, inner, 24, false),
+                   Err(String::from("The tunnel address 10.10.10.2/24 overlaps the local route \
+                                     10.10.0.0/16 dev eth0. Move the local network, or set \
+                                     allow_route_conflicts to connect anyway.")));
+        assert!(check_route_conflict(&LanRouting, inner, 24, true).is_ok());
+        // The default route overlaps everything, and is no conflict.
+        assert!(check_route_conflict(&LanRouting, "10.20.0.2".parse().unwrap(), 24, false)
+            .is_ok());
+        assert!(check_route_conflict(&LanRouting, "172.17.255.2".parse().unwrap(), 31, false)
+            .is_err());
+    }
+
+    #[test]
+    fn parse_routes_test() {
+        let route = |network: &str, prefix_len, interface: &str| {
+            Route {
+                network: network.parse().unwrap(),
+                prefix_len: prefix_len,
+                interface: Some(String::from(interface)),
+            }
+        };
+        assert_eq!(parse_ip_routes("default via 192.168.1.1 dev eth0\n\
+                                    192.168.1.0/24 dev eth0 proto kernel scope link\n\
+                                    203.0.113.5 via 192.168.1.1 dev eth0\n\
+                                    unreachable 10.0.0.0/8\n"),
+                   vec![route("192.168.1.0", 24, "eth0"),
+                        route("203.0.113.5", 32, "eth0"),
+                        Route {
+                            network: "10.0.0.0".parse().unwrap(),
+                            prefix_len: 8,
+                            interface: None,
+                        }]);
+        let netstat = "Routing tables\n\nInternet:\nDestination        Gateway            \
+                       Flags        Netif Expire\ndefault            192.168.1.1        UGScg  \
+                       en0\n127                127.0.0.1          UCS            lo0\n\
+                       192.168.1          link#4             UCS            en0      !\n\
+                       192.168.1.1/32     link#4             UCS            en0      !\n";
+        assert_eq!(parse_netstat(netstat),
+                   vec![route("127.0.0.0", 8, "lo0"),
+                        route("192.168.1.0", 24, "en0"),
+                        route("192.168.1.1", 32, "en0")]);
+        assert!(route("10.10.10.0", 24, "en0").overlaps("10.10.10.5".parse().unwrap(), 31));
+        assert!(!route("10.10.10.4", 31, "en0").overlaps("10.10.10.6".parse().unwrap(), 31));
+    }
+
+    #[test]
+    fn parse_gateway_test() {
+        let v4 = Gateway {
+            family: Family::Inet,
+            address: Some("192.168.1.1".parse().unwrap()),
+            interface: Some(String::from("eth0")),
+        };
+        assert_eq!(parse_ip_route(Family::Inet,
+                                  "default via 192.168.1.1 dev eth0 proto dhcp metric 100\n"),
+                   Some(v4));
+        assert_eq!(parse_ip_route(Family::Inet, "default dev wg0 scope link\n"),
+                   Some(Gateway {
+                       family: Family::Inet,
+                       address: None,
+                       interface: Some(String::from("wg0")),
+                   }));
+        let v6 = Gateway {
+            family: Family::Inet6,
+            address: Some("fe80::1".parse().unwrap()),
+            interface: Some(String::from("wlan0")),
+        };
+        assert_eq!(parse_ip_route(Family::Inet6,
+                                  "default via fe80::1 dev wlan0 proto ra metric 600 pref medium"),
+                   Some(v6.clone()));
+        assert_eq!(parse_ip_route(Family::Inet, ""), None);
+
+        let route_get = "   route to: default\ndestination: default\n    gateway: fe80::1%wlan0\n  \
+                         interface: wlan0\n      flags: <UP,GATEWAY,DONE,STATIC>\n";
+        assert_eq!(parse_route_get(Family::Inet6, route_get), Some(v6));
+        assert_eq!(parse_route_get(Family::Inet, "interface: utun3\n").unwrap().interface,
+                   Some(String::from("utun3")));
+        assert_eq!(parse_route_get(Family::Inet, "route: not in table\n"), None);
+    }
+
+    #[test]
+    fn port_routing_steps_test() {
+        let steps: Vec<String> = port_routing_steps(&[443, 22], "tun0", "203.0.113.5")
+            .iter()
+            .map(|s| s.join(" "))
+            .collect();
+        let marks: Vec<&String> = steps.iter().filter(|s| s.contains("--set-mark")).collect();
+        assert_eq!(marks,
+                   vec!["iptables -w -t mangle -A kytan-ports -p tcp --dport 443 -j MARK \
+                         --set-mark 0x6b74",
+                        "iptables -w -t mangle -A kytan-ports -p udp --dport 443 -j MARK \
+                         --set-mark 0x6b74",
+                        "iptables -w -t mangle -A kytan-ports -p tcp --dport 22 -j MARK \
+                         --set-mark 0x6b74",
+                        "iptables -w -t mangle -A kytan-ports -p udp --dport 22 -j MARK \
+                         --set-mark 0x6b74"]);
+        // Only marked packets take the tunnel, and the chain marks nothing else.
+        let chain: Vec<&String> = steps.iter()
+            .filter(|s| s.contains("-A kytan-ports") && !s.contains("--set-mark"))
+            .collect();
+        assert_eq!(chain,
+                   vec!["iptables -w -t mangle -A kytan-ports -d 203.0.113.5 -j RETURN"]);
+        assert!(steps.contains(&String::from("ip rule add fwmark 0x6b74 table 27508")));
+        assert!(steps.contains(&String::from("ip route add default dev tun0 table 27508")));
+        assert!(steps.iter().all(|s| !s.contains("default via")));
+
+        let undone: Vec<String> = port_routing_steps(&[443], "tun0", "203.0.113.5")
+            .iter()
+            .rev()
+            .map(|s| undo_step(s).join(" "))
+            .collect();
+        assert_eq!(undone[0], "ip route del default dev tun0 table 27508");
+        assert_eq!(undone[undone.len() - 1], "iptables -w -t mangle -X kytan-ports");
+        assert!(undone.iter().all(|s| !s.contains(" -A ") && !s.contains(" add ")));
+    }
+
+    #[test]
+    fn route_args_test() {
+        let args = |linux, route_type, route, gateway: Option<Gateway>| {
+            route_args(linux, route_type, route, gateway.as_ref()).join(" ")
+        };
+        let scoped_v6 = parse_ip_route(Family::Inet6, "default via fe80::1 dev wlan0");
+        let ppp = parse_ip_route(Family::Inet, "default dev ppp0");
+        let scoped_v4 = parse_ip_route(Family::Inet, "default via 192.168.1.1 dev eth0");
+
+        assert_eq!(args(true, RouteType::Host, "1.2.3.4", router("192.168.1.1")),
+                   "-n add -host 1.2.3.4 gw 192.168.1.1");
+        assert_eq!(args(true, RouteType::Net, "default", ppp.clone()),
+                   "-n add -net default dev ppp0");
+        assert_eq!(args(true, RouteType::Net, "default", scoped_v6.clone()),
+                   "-n -A inet6 add default gw fe80::1 dev wlan0");
+        assert_eq!(args(true, RouteType::Host, "2001:db8::1", scoped_v6.clone()),
+                   "-n -A inet6 add 2001:db8::1/128 gw fe80::1 dev wlan0");
+        assert_eq!(args(true, RouteType::Host, "2001:db8::1", None),
+                   "-n -A inet6 del 2001:db8::1/128");
+        assert_eq!(args(true, RouteType::Net, "default", None), "-n del -net default");
+
+        assert_eq!(args(false, RouteType::Host, "1.2.3.4", router("192.168.1.1")),
+                   "-n add -host 1.2.3.4 192.168.1.1");
+        assert_eq!(args(false, RouteType::Net, "default", scoped_v4),
+                   "-n add -net default 192.168.1.1 -ifscope eth0");
+        assert_eq!(args(false, RouteType::Net, "default", ppp),
+                   "-n add -net default -interface ppp0");
+        assert_eq!(args(false, RouteType::Net, "default", scoped_v6),
+                   "-n add -inet6 -net default fe80::1%wlan0");
+        assert_eq!(args(false, RouteType::Host, "2001:db8::1", None),
+                   "-n delete -inet6 -host 2001:db8::1");
+    }
+
     #[test]
     fn get_default_gateway_test() {
-        get_default_gateway().unwrap();
+        get_default_gateway(Family::Inet, &RetryPolicy::default()).unwrap();
     }
 
     #[test]
     fn route_test() {
         assert!(is_root());
 
-        let gw = get_default_gateway().unwrap();
-        add_route(RouteType::Host, "1.1.1.1", &gw).unwrap();
-        delete_route(RouteType::Host, "1.1.1.1").unwrap();
+        let policy = RetryPolicy::default();
+        let gw = get_default_gateway(Family::Inet, &policy).unwrap();
+
+        add_route(RouteType::Host, "1.1.1.1", &gw, &policy).unwrap();
+        delete_route(RouteType::Host, "1.1.1.1", &policy).unwrap();
+    }
+
+    fn quick_policy(attempts: u32) -> RetryPolicy {
+        RetryPolicy {
+            attempts: attempts,
+            backoff: Duration::from_millis(1),
+            timeout: Duration::from_millis(200),
+        }
+    }
+
+    #[test]
+    fn retry_flaky_test() {
+        let mut calls = 0;
+        let result = quick_policy(3).run("flaky", |_| {
+            calls += 1;
+            if calls < 2 {
+                Err(String::from("File exists"))
+            } else {
+                Ok(calls)
+            }
+        });
+        assert_eq!(result, Ok(2));
+    }
+
+    #[test]
+    fn retry_exhausted_test() {
+        let mut calls = 0;
+        let result: Result<(), String> = quick_policy(3).run("broken", |_| {
+            calls += 1;
+            Err(String::from("Device busy"))
+        });
+        assert_eq!(calls, 3);
+        let e = result.unwrap_err();
+        assert!(e.contains("3 attempt(s)"));
+        assert!(e.contains("Device busy"));
+    }
+
+    #[test]
+    fn private_file_test() {
+        let path = format!("{}/kytan-private-file-test", ::std::env::temp_dir().display());
+        write_private_file(&path, b"secret").unwrap();
+        assert_eq!(read_file(&path).unwrap(), b"secret");
+        assert_eq!(fs::metadata(&path).unwrap().permissions().mode() & 0o777, 0o600);
+        fs::remove_file(&path).unwrap();
+        assert!(read_file(&path).is_err());
+    }
+
+    #[test]
+    fn command_timeout_test() {
+        let start = Instant::now();
+        assert!(run_command(Command::new("sleep").arg("5"), Duration::from_millis(100)).is_err());
+        assert!(start.elapsed() < Duration::from_secs(5));
+        assert!(run_command(&mut Command::new("true"), Duration::from_secs(5)).unwrap().status.success());
     }
 }